@@ -0,0 +1,132 @@
+package apt
+
+// This file implements architecture specifications and Multi-Arch.
+// https://www.debian.org/doc/debian-policy/ch-customized-programs.html#architecture-specification-strings
+// https://wiki.ubuntu.com/MultiarchSpec
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// archCPUs maps Debian architecture names to CPU names of dpkg
+// where they differ.
+var archCPUs = map[string]string{
+	"armel": "arm",
+	"armhf": "arm",
+	"x32":   "amd64",
+}
+
+// archTuple splits a Debian architecture name such as "amd64" or
+// "kfreebsd-amd64" into its OS and CPU parts.
+func archTuple(arch string) (os, cpu string) {
+	os, cpu = "linux", arch
+	if i := strings.LastIndexByte(arch, '-'); i >= 0 {
+		os, cpu = arch[:i], arch[i+1:]
+	}
+	if c, ok := archCPUs[cpu]; ok {
+		cpu = c
+	}
+	return os, cpu
+}
+
+// MatchArch returns true if the architecture arch matches spec.
+//
+// spec may be an architecture name, "any", "all", or a wildcard
+// such as "linux-any" or "any-amd64".  "any" and wildcards never
+// match "all".
+func MatchArch(arch, spec string) bool {
+	switch {
+	case arch == spec:
+		return true
+	case arch == "all" || spec == "all":
+		return false
+	case spec == "any":
+		return true
+	}
+
+	i := strings.LastIndexByte(spec, '-')
+	if i < 0 {
+		return false
+	}
+	sos, scpu := spec[:i], spec[i+1:]
+	if sos != "any" && scpu != "any" {
+		// not a wildcard
+		return false
+	}
+	os, cpu := archTuple(arch)
+	if scpu != "any" {
+		if c, ok := archCPUs[scpu]; ok {
+			scpu = c
+		}
+		if scpu != cpu {
+			return false
+		}
+	}
+	return sos == "any" || sos == os || strings.HasSuffix(os, "-"+sos)
+}
+
+// MatchArchList returns true if arch matches an architecture
+// restriction list such as ["amd64", "i386"] or ["!hurd-any"].
+// A list of negated specifications matches if none of them match.
+// An empty list matches any architecture.
+func MatchArchList(arch string, specs []string) bool {
+	if len(specs) == 0 {
+		return true
+	}
+	negated := strings.HasPrefix(specs[0], "!")
+	for _, s := range specs {
+		if MatchArch(arch, strings.TrimPrefix(s, "!")) {
+			return !negated
+		}
+	}
+	return negated
+}
+
+// MatchArch returns true if the architecture restriction of d
+// includes arch.  Dependencies without restriction match any arch.
+func (d Dependency) MatchArch(arch string) bool {
+	return MatchArchList(arch, d.Architectures)
+}
+
+// MultiArch is the value of Multi-Arch field.
+type MultiArch string
+
+// Multi-Arch values.
+const (
+	MultiArchNo      = MultiArch("no")
+	MultiArchSame    = MultiArch("same")
+	MultiArchForeign = MultiArch("foreign")
+	MultiArchAllowed = MultiArch("allowed")
+)
+
+// ParseMultiArch parses the value of Multi-Arch field.
+// An empty string means "no".
+func ParseMultiArch(s string) (MultiArch, error) {
+	switch m := MultiArch(strings.TrimSpace(s)); m {
+	case "":
+		return MultiArchNo, nil
+	case MultiArchNo, MultiArchSame, MultiArchForeign, MultiArchAllowed:
+		return m, nil
+	}
+	return "", errors.New("invalid Multi-Arch: " + s)
+}
+
+// AcceptsArch returns true if p can satisfy d from a package of
+// architecture arch, considering the architecture qualifier of d and
+// Multi-Arch of p.  arch is also taken as the native architecture.
+//
+// The name and the version of p are not checked.
+func (d Dependency) AcceptsArch(arch string, p *Package) bool {
+	same := p.Architecture == arch || p.Architecture == "all"
+	switch d.ArchQualifier {
+	case "":
+		return same || p.MultiArch == MultiArchForeign
+	case "any":
+		return p.MultiArch == MultiArchAllowed
+	case "native":
+		return same
+	}
+	return p.Architecture == d.ArchQualifier
+}
@@ -0,0 +1,132 @@
+package apt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchArch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		arch, spec string
+		expected   bool
+	}{
+		{"amd64", "amd64", true},
+		{"amd64", "i386", false},
+		{"amd64", "any", true},
+		{"all", "any", false},
+		{"all", "all", true},
+		{"amd64", "all", false},
+		{"amd64", "linux-any", true},
+		{"armhf", "linux-any", true},
+		{"kfreebsd-amd64", "linux-any", false},
+		{"kfreebsd-amd64", "kfreebsd-any", true},
+		{"kfreebsd-amd64", "any-amd64", true},
+		{"amd64", "any-amd64", true},
+		{"i386", "any-amd64", false},
+		{"armhf", "any-arm", true},
+		{"armel", "any-armhf", true},
+		{"arm64", "any-arm", false},
+		{"x32", "any-amd64", true},
+		{"musl-linux-amd64", "linux-any", true},
+		{"hurd-i386", "hurd-i386", true},
+		{"hurd-i386", "linux-i386", false},
+		{"amd64", "linux-amd64", false},
+		{"all", "linux-any", false},
+	}
+	for _, c := range cases {
+		if MatchArch(c.arch, c.spec) != c.expected {
+			t.Errorf("MatchArch(%q, %q) != %v", c.arch, c.spec, c.expected)
+		}
+	}
+
+	if !MatchArchList("amd64", nil) {
+		t.Error(`empty list must match`)
+	}
+	if !MatchArchList("amd64", []string{"i386", "amd64"}) || MatchArchList("arm64", []string{"i386", "amd64"}) {
+		t.Error(`unexpected match for positive list`)
+	}
+	if MatchArchList("hurd-i386", []string{"!hurd-any", "!kfreebsd-any"}) || !MatchArchList("amd64", []string{"!hurd-any"}) {
+		t.Error(`unexpected match for negated list`)
+	}
+
+	rels, err := ParseRelations("a [amd64 i386], b [!linux-any]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rels[0][0].MatchArch("amd64") || rels[0][0].MatchArch("arm64") {
+		t.Error(`unexpected Dependency.MatchArch`)
+	}
+	if rels[1][0].MatchArch("amd64") || !rels[1][0].MatchArch("kfreebsd-amd64") {
+		t.Error(`unexpected Dependency.MatchArch for negated list`)
+	}
+}
+
+func TestMultiArch(t *testing.T) {
+	t.Parallel()
+
+	for s, expected := range map[string]MultiArch{
+		"":        MultiArchNo,
+		"no":      MultiArchNo,
+		"same":    MultiArchSame,
+		"foreign": MultiArchForeign,
+		"allowed": MultiArchAllowed,
+	} {
+		m, err := ParseMultiArch(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != expected {
+			t.Errorf("ParseMultiArch(%q) = %q", s, m)
+		}
+	}
+	if _, err := ParseMultiArch("maybe"); err == nil {
+		t.Error(`invalid Multi-Arch must be an error`)
+	}
+
+	pkgs, err := ReadPackages(strings.NewReader("Package: a\nVersion: 1\nFilename: a.deb\nSize: 1\nMulti-Arch: foreign\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs[0].MultiArch != MultiArchForeign {
+		t.Error(`unexpected MultiArch`, pkgs[0].MultiArch)
+	}
+	if _, err := ReadPackages(strings.NewReader("Package: a\nVersion: 1\nFilename: a.deb\nSize: 1\nMulti-Arch: x\n")); err == nil {
+		t.Error(`invalid Multi-Arch must be an error`)
+	}
+}
+
+func TestAcceptsArch(t *testing.T) {
+	t.Parallel()
+
+	amd64 := &Package{Architecture: "amd64", MultiArch: MultiArchNo}
+	i386 := &Package{Architecture: "i386", MultiArch: MultiArchNo}
+	all := &Package{Architecture: "all", MultiArch: MultiArchNo}
+	foreign := &Package{Architecture: "i386", MultiArch: MultiArchForeign}
+	allowed := &Package{Architecture: "i386", MultiArch: MultiArchAllowed}
+
+	cases := []struct {
+		qualifier string
+		p         *Package
+		expected  bool
+	}{
+		{"", amd64, true},
+		{"", i386, false},
+		{"", all, true},
+		{"", foreign, true},
+		{"", allowed, false},
+		{"any", amd64, false},
+		{"any", allowed, true},
+		{"native", amd64, true},
+		{"native", foreign, false},
+		{"i386", i386, true},
+		{"i386", amd64, false},
+	}
+	for _, c := range cases {
+		d := Dependency{Name: "a", ArchQualifier: c.qualifier}
+		if d.AcceptsArch("amd64", c.p) != c.expected {
+			t.Errorf("AcceptsArch for %q with %s %s != %v", c.qualifier, c.p.Architecture, c.p.MultiArch, c.expected)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package apt
+
+// This file provides utilities for compressed indices.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// compressionExts is the list of extensions for compressed indices.
+// https://wiki.debian.org/RepositoryFormat#Compression_of_indices
+var compressionExts = []string{".gz", ".bz2", ".xz", ".zst", ".lzma", ".lz4", ".lz"}
+
+// CompressionExt returns the compression extension of p such as ".gz".
+// If p is not a compressed file, an empty string is returned.
+func CompressionExt(p string) string {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(p, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// TrimCompressionExt returns p without the compression extension.
+func TrimCompressionExt(p string) string {
+	return p[0 : len(p)-len(CompressionExt(p))]
+}
+
+// compressionMagics maps magic bytes at the beginning of compressed
+// data to their extensions.  lzma has no magic bytes, so it is
+// determined by extensions.
+var compressionMagics = []struct {
+	magic []byte
+	ext   string
+}{
+	{[]byte{0x1f, 0x8b}, ".gz"},
+	{[]byte("BZh"), ".bz2"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, ".xz"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, ".zst"},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, ".lz4"},
+	{[]byte("LZIP"), ".lz"},
+}
+
+// maxMagicLen is the length of the longest magic bytes.
+const maxMagicLen = 6
+
+// DetectCompression returns the compression extension such as ".gz"
+// determined by the magic bytes at the beginning of data.
+// If no magic bytes match, an empty string is returned.
+func DetectCompression(data []byte) string {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(data, m.magic) {
+			return m.ext
+		}
+	}
+	return ""
+}
+
+// Decompress returns an io.ReadCloser that reads decompressed data
+// from r.  The compression algorithm is determined by the magic bytes
+// at the beginning of r, or by the extension of p if they are not
+// recognized.  This allows by-hash paths and files with wrong names.
+//
+// If r is not compressed and p has no compression extension,
+// r is returned as is.  The caller is responsible to close the
+// returned io.ReadCloser, which does not close r.
+func Decompress(p string, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// errors from Peek are returned again by subsequent reads.
+	head, _ := br.Peek(maxMagicLen)
+	ext := DetectCompression(head)
+	if ext == "" {
+		ext = CompressionExt(path.Base(p))
+	}
+
+	switch ext {
+	case "":
+		return ioutil.NopCloser(br), nil
+	case ".gz":
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case ".bz2":
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case ".xz":
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzr), nil
+	case ".zst":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case ".lzma":
+		lr, err := lzma.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(lr), nil
+	case ".lz4":
+		return ioutil.NopCloser(newLZ4Reader(br)), nil
+	case ".lz":
+		return ioutil.NopCloser(newLZIPReader(br)), nil
+	}
+	return nil, errors.New("unsupported file extension: " + ext)
+}
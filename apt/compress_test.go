@@ -0,0 +1,277 @@
+package apt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func TestCompressionExt(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"Packages":          "",
+		"Packages.gz":       ".gz",
+		"a/b/Sources.bz2":   ".bz2",
+		"Packages.xz":       ".xz",
+		"Packages.zst":      ".zst",
+		"Packages.lzma":     ".lzma",
+		"Packages.lz":       ".lz",
+		"Packages.lz4":      ".lz4",
+		"Release.gpg":       "",
+		"hoge_1.0_all.deb":  "",
+		"Translation-en.gz": ".gz",
+	}
+	for p, ext := range cases {
+		if CompressionExt(p) != ext {
+			t.Errorf("CompressionExt(%q) != %q", p, ext)
+		}
+		if TrimCompressionExt(p)+ext != p {
+			t.Errorf("TrimCompressionExt(%q) is wrong", p)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+
+	r, err := Decompress("a/Packages.gz", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error(`string(data) != "hello"`)
+	}
+
+	r, err = Decompress("a/Packages", bytes.NewReader([]byte("raw")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(r)
+	if string(data) != "raw" {
+		t.Error(`string(data) != "raw"`)
+	}
+
+	zbuf := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(zbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte("hello zstd"))
+	zw.Close()
+
+	r, err = Decompress("a/Packages.zst", zbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello zstd" {
+		t.Error(`string(data) != "hello zstd"`)
+	}
+
+	lbuf := new(bytes.Buffer)
+	lw, err := lzma.NewWriter(lbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw.Write([]byte("hello lzma"))
+	lw.Close()
+
+	r, err = Decompress("a/Packages.lzma", lbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello lzma" {
+		t.Error(`string(data) != "hello lzma"`)
+	}
+}
+
+func TestDecompressLZ(t *testing.T) {
+	t.Parallel()
+
+	plain, err := ioutil.ReadFile("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{".lz", ".lz4"} {
+		if !IsSupported("a/Packages" + ext) {
+			t.Error(`IsSupported must be true for`, ext)
+		}
+
+		data, err := ioutil.ReadFile("testdata/af/Packages" + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if DetectCompression(data) != ext {
+			t.Error(`DetectCompression(data) != ext`, ext)
+		}
+
+		cases := []struct {
+			p        string
+			data     []byte
+			expected []byte
+		}{
+			{"a/Packages" + ext, data, plain},
+			{"a/by-hash/SHA256/0123456789abcdef", data, plain},
+			// concatenated members or frames
+			{"a/Packages" + ext, append(append([]byte{}, data...), data...), append(append([]byte{}, plain...), plain...)},
+		}
+		for _, c := range cases {
+			r, err := Decompress(c.p, bytes.NewReader(c.data))
+			if err != nil {
+				t.Fatal(c.p, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(c.p, err)
+			}
+			if !bytes.Equal(out, c.expected) {
+				t.Error(`unexpected data for`, c.p)
+			}
+		}
+
+		// checksums in trailers must be verified.
+		corrupt := append([]byte{}, data...)
+		corrupt[len(corrupt)-lzipTrailerLen+1] ^= 0xff
+		if ext == ".lz4" {
+			corrupt[len(corrupt)-1] ^= 0xff
+		}
+		for _, bad := range [][]byte{corrupt, data[:len(data)/2]} {
+			r, err := Decompress("a/Packages"+ext, bytes.NewReader(bad))
+			if err != nil {
+				continue
+			}
+			_, err = ioutil.ReadAll(r)
+			r.Close()
+			if err == nil {
+				t.Error(`broken data must be an error`, ext)
+			}
+		}
+	}
+
+	// skippable frames are ignored.
+	lz4data, err := ioutil.ReadFile("testdata/af/Packages.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skippable := []byte{0x5a, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'x', 'y', 'z'}
+	r, err := Decompress("a/Packages.lz4", bytes.NewReader(append(skippable, lz4data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Error(`skippable frames must be ignored`)
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	t.Parallel()
+
+	xzdata, err := ioutil.ReadFile("testdata/af/Packages.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdata, err := ioutil.ReadFile("testdata/af/Packages.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		data []byte
+		ext  string
+	}{
+		{[]byte{0x1f, 0x8b, 0x08}, ".gz"},
+		{[]byte("BZh91AY&SY"), ".bz2"},
+		{xzdata, ".xz"},
+		{zstdata, ".zst"},
+		{[]byte{0x04, 0x22, 0x4d, 0x18, 0x64}, ".lz4"},
+		{[]byte("LZIP\x01\x0c"), ".lz"},
+		{[]byte("Package: a\n"), ""},
+		{[]byte{0x1f}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		if ext := DetectCompression(c.data); ext != c.ext {
+			t.Errorf("DetectCompression(%q) = %q, expected %q", c.data, ext, c.ext)
+		}
+	}
+}
+
+func TestDecompressMismatch(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+	gzdata := buf.Bytes()
+
+	xzdata, err := ioutil.ReadFile("testdata/af/Packages.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadFile("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		p        string
+		data     []byte
+		expected []byte
+	}{
+		{"a/Packages.xz", gzdata, []byte("hello")},
+		{"a/by-hash/SHA256/0123456789abcdef", gzdata, []byte("hello")},
+		{"a/Packages", xzdata, plain},
+		{"a/Packages.bz2", xzdata, plain},
+		{"a/Packages", []byte("raw"), []byte("raw")},
+	}
+	for _, c := range cases {
+		r, err := Decompress(c.p, bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(c.p, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(c.p, err)
+		}
+		if !bytes.Equal(data, c.expected) {
+			t.Errorf("unexpected data for %s: %q", c.p, data)
+		}
+	}
+
+	// without magic bytes, the extension decides.
+	if _, err := Decompress("a/Packages.gz", bytes.NewReader([]byte("raw data"))); err == nil {
+		t.Error(`uncompressed data named .gz must be an error`)
+	}
+}
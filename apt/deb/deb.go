@@ -0,0 +1,196 @@
+// Package deb reads binary package files (.deb) to inspect their
+// control fields.
+//
+// A .deb file is an ar archive of debian-binary, control.tar, and
+// data.tar.  Tar archives may be compressed.
+// https://manpages.debian.org/deb.5
+package deb
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/pkg/errors"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+
+	// maxDebianBinarySize limits the size of debian-binary member.
+	maxDebianBinarySize = 64
+
+	// maxControlSize limits the size of the control file.
+	maxControlSize = 16 * 1024 * 1024
+)
+
+// Info is information read from a .deb file.
+type Info struct {
+	// Format is the contents of debian-binary such as "2.0".
+	Format string
+
+	// Control is the paragraph of the control file.
+	Control apt.Paragraph
+
+	// ControlFiles is the list of files in control.tar such as
+	// "control", "md5sums", or "postinst".
+	ControlFiles []string
+}
+
+// Package returns the Package field.
+func (i *Info) Package() string {
+	return strings.Join(i.Control["Package"], "")
+}
+
+// Version returns the Version field.
+func (i *Info) Version() string {
+	return strings.Join(i.Control["Version"], "")
+}
+
+// Architecture returns the Architecture field.
+func (i *Info) Architecture() string {
+	return strings.Join(i.Control["Architecture"], "")
+}
+
+// Check returns an error if the package name, version, or architecture
+// of i differ from p, i.e. the file is not the package p claims.
+func (i *Info) Check(p *apt.Package) error {
+	if i.Package() != p.Package {
+		return errors.Errorf("package mismatch: %s != %s", i.Package(), p.Package)
+	}
+	if i.Version() != p.Version {
+		return errors.Errorf("version mismatch for %s: %s != %s", p.Package, i.Version(), p.Version)
+	}
+	if p.Architecture != "" && i.Architecture() != p.Architecture {
+		return errors.Errorf("architecture mismatch for %s: %s != %s", p.Package, i.Architecture(), p.Architecture)
+	}
+	return nil
+}
+
+type arHeader struct {
+	name string
+	size int64
+}
+
+// readARHeader reads the header of the next member of an ar archive.
+// io.EOF is returned at the end of the archive.
+func readARHeader(r io.Reader) (*arHeader, error) {
+	var b [arHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated ar header")
+		}
+		return nil, err
+	}
+	if b[58] != '`' || b[59] != '\n' {
+		return nil, errors.New("invalid ar header")
+	}
+	name := strings.TrimRight(string(b[0:16]), " ")
+	name = strings.TrimSuffix(name, "/")
+	size, err := strconv.ParseInt(strings.TrimRight(string(b[48:58]), " "), 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.New("invalid size in ar header: " + name)
+	}
+	return &arHeader{name: name, size: size}, nil
+}
+
+// Inspect reads a .deb file from r and returns its information.
+// Reading stops after control.tar, so data.tar is not read.
+func Inspect(r io.Reader) (*Info, error) {
+	var magic [len(arMagic)]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || string(magic[:]) != arMagic {
+		return nil, errors.New("not an ar archive")
+	}
+
+	info := new(Info)
+	for n := 0; ; n++ {
+		h, err := readARHeader(r)
+		if err == io.EOF {
+			return nil, errors.New("no control.tar")
+		}
+		if err != nil {
+			return nil, err
+		}
+		mr := io.LimitReader(r, h.size)
+
+		switch {
+		case n == 0:
+			if h.name != "debian-binary" {
+				return nil, errors.New("the first member is not debian-binary: " + h.name)
+			}
+			if h.size > maxDebianBinarySize {
+				return nil, errors.New("too large debian-binary")
+			}
+			data, err := ioutil.ReadAll(mr)
+			if err != nil {
+				return nil, err
+			}
+			info.Format = strings.TrimSpace(string(data))
+			if !strings.HasPrefix(info.Format, "2.") {
+				return nil, errors.New("unsupported format: " + info.Format)
+			}
+		case h.name == "control.tar" || strings.HasPrefix(h.name, "control.tar."):
+			if err := readControlTar(info, h.name, mr); err != nil {
+				return nil, errors.Wrap(err, h.name)
+			}
+			return info, nil
+		case strings.HasPrefix(h.name, "data.tar"):
+			return nil, errors.New("data.tar before control.tar")
+		}
+
+		// skip the rest of the member and padding.
+		skip := h.size % 2
+		if _, err := io.Copy(ioutil.Discard, mr); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+			return nil, errors.New("truncated ar archive")
+		}
+	}
+}
+
+// readControlTar reads control.tar of name from r into info.
+func readControlTar(info *Info, name string, r io.Reader) error {
+	dr, err := apt.Decompress(name, r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		fname := path.Clean(h.Name)
+		info.ControlFiles = append(info.ControlFiles, fname)
+		if fname != "control" {
+			continue
+		}
+
+		if h.Size > maxControlSize {
+			return errors.New("too large control file")
+		}
+		d, err := apt.NewParser(tr).Read()
+		if err != nil {
+			return errors.Wrap(err, "control")
+		}
+		info.Control = d
+	}
+	if info.Control == nil {
+		return errors.New("no control file")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package deb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+type testMember struct {
+	name string
+	data []byte
+}
+
+func makeAR(members ...testMember) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(arMagic)
+	for _, m := range members {
+		fmt.Fprintf(buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, 0, 0, 0, "100644", len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		h := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+const testControl = `Package: hello
+Version: 1.0-1
+Architecture: amd64
+Depends: libc6 (>= 2.17)
+Description: hello
+ a test package.
+`
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+
+	control := makeTarGz(t, map[string]string{"./control": testControl, "./md5sums": ""})
+	deb := makeAR(
+		testMember{"debian-binary", []byte("2.0\n")},
+		testMember{"control.tar.gz", control},
+		testMember{"data.tar.xz", []byte("not read")},
+	)
+
+	info, err := Inspect(bytes.NewReader(deb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != "2.0" {
+		t.Error(`info.Format != "2.0"`, info.Format)
+	}
+	if info.Package() != "hello" || info.Version() != "1.0-1" || info.Architecture() != "amd64" {
+		t.Error(`unexpected control`, info.Control)
+	}
+	if len(info.ControlFiles) != 2 {
+		t.Error(`unexpected control files`, info.ControlFiles)
+	}
+
+	p := &apt.Package{Package: "hello", Version: "1.0-1", Architecture: "amd64"}
+	if err := info.Check(p); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []*apt.Package{
+		{Package: "other", Version: "1.0-1", Architecture: "amd64"},
+		{Package: "hello", Version: "1.0-2", Architecture: "amd64"},
+		{Package: "hello", Version: "1.0-1", Architecture: "i386"},
+	} {
+		if err := info.Check(p); err == nil {
+			t.Error(`mismatch must be an error`, p)
+		}
+	}
+}
+
+func TestInspectInvalid(t *testing.T) {
+	t.Parallel()
+
+	control := makeTarGz(t, map[string]string{"./control": testControl})
+	cases := map[string][]byte{
+		"not ar": []byte("hello"),
+		"no debian-binary": makeAR(
+			testMember{"control.tar.gz", control},
+		),
+		"unsupported format": makeAR(
+			testMember{"debian-binary", []byte("3.0\n")},
+			testMember{"control.tar.gz", control},
+		),
+		"no control.tar": makeAR(
+			testMember{"debian-binary", []byte("2.0\n")},
+		),
+		"data before control": makeAR(
+			testMember{"debian-binary", []byte("2.0\n")},
+			testMember{"data.tar.gz", []byte("data")},
+			testMember{"control.tar.gz", control},
+		),
+		"no control file": makeAR(
+			testMember{"debian-binary", []byte("2.0\n")},
+			testMember{"control.tar.gz", makeTarGz(t, map[string]string{"./md5sums": ""})},
+		),
+		"broken control.tar": makeAR(
+			testMember{"debian-binary", []byte("2.0\n")},
+			testMember{"control.tar.gz", []byte("broken")},
+		),
+		"truncated": makeAR(
+			testMember{"debian-binary", []byte("2.0\n")},
+			testMember{"control.tar.gz", control},
+		)[:80],
+	}
+	for name, data := range cases {
+		if _, err := Inspect(bytes.NewReader(data)); err == nil {
+			t.Error(`invalid .deb must be an error:`, name)
+		}
+	}
+}
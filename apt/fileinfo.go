@@ -5,8 +5,10 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
+	"hash"
 	"io"
 	"path"
 
@@ -20,6 +22,7 @@ type FileInfo struct {
 	md5sum    []byte // nil means no MD5 checksum to be checked.
 	sha1sum   []byte // nil means no SHA1 ...
 	sha256sum []byte // nil means no SHA256 ...
+	sha512sum []byte // nil means no SHA512 ...
 }
 
 // Same returns true if t has the same checksum values.
@@ -42,6 +45,11 @@ func (fi *FileInfo) Same(t *FileInfo) bool {
 	if fi.sha256sum != nil && bytes.Compare(fi.sha256sum, t.sha256sum) != 0 {
 		return false
 	}
+	// SHA512 is compared only if both have it because FileInfo
+	// recorded by older versions lacks it.
+	if fi.sha512sum != nil && t.sha512sum != nil && bytes.Compare(fi.sha512sum, t.sha512sum) != 0 {
+		return false
+	}
 	return true
 }
 
@@ -57,7 +65,25 @@ func (fi *FileInfo) Size() uint64 {
 
 // HasChecksum returns true if fi has checksums.
 func (fi *FileInfo) HasChecksum() bool {
-	return fi.md5sum != nil
+	return fi.HashMask() != 0
+}
+
+// HashMask returns the set of checksums fi has.
+func (fi *FileInfo) HashMask() HashMask {
+	var m HashMask
+	if fi.md5sum != nil {
+		m |= HashMD5
+	}
+	if fi.sha1sum != nil {
+		m |= HashSHA1
+	}
+	if fi.sha256sum != nil {
+		m |= HashSHA256
+	}
+	if fi.sha512sum != nil {
+		m |= HashSHA512
+	}
+	return m
 }
 
 // CalcChecksums calculates checksums and stores them in fi.
@@ -65,10 +91,12 @@ func (fi *FileInfo) CalcChecksums(data []byte) {
 	md5sum := md5.Sum(data)
 	sha1sum := sha1.Sum(data)
 	sha256sum := sha256.Sum256(data)
+	sha512sum := sha512.Sum512(data)
 	fi.size = uint64(len(data))
 	fi.md5sum = md5sum[:]
 	fi.sha1sum = sha1sum[:]
 	fi.sha256sum = sha256sum[:]
+	fi.sha512sum = sha512sum[:]
 }
 
 // AddPrefix creates a new FileInfo by prepending prefix to the path.
@@ -114,12 +142,25 @@ func (fi *FileInfo) SHA256Path() string {
 		hex.EncodeToString(fi.sha256sum))
 }
 
+// SHA512Path returns the filepath for "by-hash" with sha512 checksum.
+// If fi has no checksum, an empty string will be returned.
+func (fi *FileInfo) SHA512Path() string {
+	if fi.sha512sum == nil {
+		return ""
+	}
+	return path.Join(path.Dir(fi.path),
+		"by-hash",
+		"SHA512",
+		hex.EncodeToString(fi.sha512sum))
+}
+
 type fileInfoJSON struct {
 	Path      string
 	Size      int64
 	MD5Sum    string
 	SHA1Sum   string
 	SHA256Sum string
+	SHA512Sum string `json:",omitempty"`
 }
 
 // MarshalJSON implements json.Marshaler
@@ -136,6 +177,9 @@ func (fi *FileInfo) MarshalJSON() ([]byte, error) {
 	if fi.sha256sum != nil {
 		fij.SHA256Sum = hex.EncodeToString(fi.sha256sum)
 	}
+	if fi.sha512sum != nil {
+		fij.SHA512Sum = hex.EncodeToString(fi.sha512sum)
+	}
 	return json.Marshal(&fij)
 }
 
@@ -159,32 +203,97 @@ func (fi *FileInfo) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return errors.Wrap(err, "UnmarshalJSON for "+fij.Path)
 	}
-	fi.md5sum = md5sum
-	fi.sha1sum = sha1sum
-	fi.sha256sum = sha256sum
+	sha512sum, err := hex.DecodeString(fij.SHA512Sum)
+	if err != nil {
+		return errors.Wrap(err, "UnmarshalJSON for "+fij.Path)
+	}
+	// keep missing checksums nil so that Same ignores them.
+	fi.md5sum, fi.sha1sum, fi.sha256sum, fi.sha512sum = nil, nil, nil, nil
+	if len(md5sum) > 0 {
+		fi.md5sum = md5sum
+	}
+	if len(sha1sum) > 0 {
+		fi.sha1sum = sha1sum
+	}
+	if len(sha256sum) > 0 {
+		fi.sha256sum = sha256sum
+	}
+	if len(sha512sum) > 0 {
+		fi.sha512sum = sha512sum
+	}
 	return nil
 }
 
+// HashMask is a set of checksum algorithms.
+type HashMask uint
+
+// Checksum algorithms for HashMask.
+const (
+	HashMD5 HashMask = 1 << iota
+	HashSHA1
+	HashSHA256
+	HashSHA512
+
+	HashAll = HashMD5 | HashSHA1 | HashSHA256 | HashSHA512
+)
+
 // CopyWithFileInfo copies from src to dst until either EOF is reached
 // on src or an error occurs, and returns FileInfo calculated while copying.
 func CopyWithFileInfo(dst io.Writer, src io.Reader, p string) (*FileInfo, error) {
-	md5hash := md5.New()
-	sha1hash := sha1.New()
-	sha256hash := sha256.New()
+	return CopyWithFileInfoMask(dst, src, p, HashAll)
+}
 
-	w := io.MultiWriter(md5hash, sha1hash, sha256hash, dst)
+// CopyWithFileInfoMask is the same as CopyWithFileInfo except that
+// only checksums in mask are calculated.  Others are left empty.
+//
+// To verify the copied data against an expected FileInfo fi,
+// pass fi.HashMask() to calculate just the checksums fi has.
+func CopyWithFileInfoMask(dst io.Writer, src io.Reader, p string, mask HashMask) (*FileInfo, error) {
+	var md5hash, sha1hash, sha256hash, sha512hash hash.Hash
+	var ws []io.Writer
+	if mask&HashMD5 != 0 {
+		md5hash = md5.New()
+		ws = append(ws, md5hash)
+	}
+	if mask&HashSHA1 != 0 {
+		sha1hash = sha1.New()
+		ws = append(ws, sha1hash)
+	}
+	if mask&HashSHA256 != 0 {
+		sha256hash = sha256.New()
+		ws = append(ws, sha256hash)
+	}
+	if mask&HashSHA512 != 0 {
+		sha512hash = sha512.New()
+		ws = append(ws, sha512hash)
+	}
+
+	w := dst
+	if len(ws) > 0 {
+		w = io.MultiWriter(append(ws, dst)...)
+	}
 	n, err := io.Copy(w, src)
 	if err != nil {
 		return nil, err
 	}
 
-	return &FileInfo{
-		path:      p,
-		size:      uint64(n),
-		md5sum:    md5hash.Sum(nil),
-		sha1sum:   sha1hash.Sum(nil),
-		sha256sum: sha256hash.Sum(nil),
-	}, nil
+	fi := &FileInfo{
+		path: p,
+		size: uint64(n),
+	}
+	if md5hash != nil {
+		fi.md5sum = md5hash.Sum(nil)
+	}
+	if sha1hash != nil {
+		fi.sha1sum = sha1hash.Sum(nil)
+	}
+	if sha256hash != nil {
+		fi.sha256sum = sha256hash.Sum(nil)
+	}
+	if sha512hash != nil {
+		fi.sha512sum = sha512hash.Sum(nil)
+	}
+	return fi, nil
 }
 
 // MakeFileInfoNoChecksum constructs a FileInfo without calculating checksums.
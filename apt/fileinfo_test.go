@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -69,6 +70,25 @@ func testFileInfoSame(t *testing.T) {
 		t.Error(`md5mismatch.Same(fi)`)
 	}
 
+	sha512sum := sha512.Sum512(data)
+	sha512sum2 := sha512.Sum512(data2)
+	with512 := &FileInfo{
+		path:      "/data",
+		size:      uint64(len(data)),
+		sha512sum: sha512sum[:],
+	}
+	if !with512.Same(fi) {
+		t.Error(`SHA512 must be ignored if fi lacks it`)
+	}
+	sha512mismatch := &FileInfo{
+		path:      "/data",
+		size:      uint64(len(data)),
+		sha512sum: sha512sum2[:],
+	}
+	if sha512mismatch.Same(with512) {
+		t.Error(`sha512mismatch.Same(with512)`)
+	}
+
 	md5match := &FileInfo{
 		path:   "/data",
 		size:   uint64(len(data)),
@@ -146,6 +166,19 @@ func testFileInfoJSON(t *testing.T) {
 		t.Error(`!fi.Same(fi2)`)
 		t.Log(fmt.Sprintf("%#v", fi2))
 	}
+	if !bytes.Equal(fi.sha512sum, fi2.sha512sum) {
+		t.Error(`SHA512 is not preserved`)
+	}
+
+	// FileInfo marshaled by older versions has no SHA512.
+	fi3 := new(FileInfo)
+	err = json.Unmarshal([]byte(`{"Path":"/abc/def","Size":11,"MD5Sum":"","SHA1Sum":"","SHA256Sum":""}`), fi3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi3.sha512sum != nil {
+		t.Error(`fi3.sha512sum != nil`)
+	}
 }
 
 func testFileInfoAddPrefix(t *testing.T) {
@@ -180,9 +213,11 @@ func testFileInfoChecksum(t *testing.T) {
 	md5sum := md5.Sum([]byte(text))
 	sha1sum := sha1.Sum([]byte(text))
 	sha256sum := sha256.Sum256([]byte(text))
+	sha512sum := sha512.Sum512([]byte(text))
 	m5 := hex.EncodeToString(md5sum[:])
 	s1 := hex.EncodeToString(sha1sum[:])
 	s256 := hex.EncodeToString(sha256sum[:])
+	s512 := hex.EncodeToString(sha512sum[:])
 
 	fi, err := CopyWithFileInfo(w, r, p)
 	if err != nil {
@@ -198,6 +233,12 @@ func testFileInfoChecksum(t *testing.T) {
 	if fi.SHA256Path() != "/abc/by-hash/SHA256/"+s256 {
 		t.Error(`fi.SHA256Path() != "/abc/by-hash/SHA256/" + s256`)
 	}
+	if fi.SHA512Path() != "/abc/by-hash/SHA512/"+s512 {
+		t.Error(`fi.SHA512Path() != "/abc/by-hash/SHA512/" + s512`)
+	}
+	if MakeFileInfoNoChecksum(p, 1).SHA512Path() != "" {
+		t.Error(`SHA512Path() must be empty without checksum`)
+	}
 }
 
 func testFileInfoCopy(t *testing.T) {
@@ -235,10 +276,61 @@ func testFileInfoCopy(t *testing.T) {
 	}
 }
 
+func testFileInfoCopyMask(t *testing.T) {
+	t.Parallel()
+
+	text := "hello world"
+	p := "/abc/def"
+	sha256sum := sha256.Sum256([]byte(text))
+	expected := &FileInfo{
+		path:      p,
+		size:      uint64(len(text)),
+		sha256sum: sha256sum[:],
+	}
+	if expected.HashMask() != HashSHA256 || !expected.HasChecksum() {
+		t.Error(`unexpected HashMask`, expected.HashMask())
+	}
+
+	w := new(bytes.Buffer)
+	fi, err := CopyWithFileInfoMask(w, strings.NewReader(text), p, expected.HashMask())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != text {
+		t.Error(`Copy did not work properly`, w.String())
+	}
+	if fi.md5sum != nil || fi.sha1sum != nil || fi.sha512sum != nil {
+		t.Error(`checksums not in mask must not be calculated`)
+	}
+	if !expected.Same(fi) {
+		t.Error("Generated FileInfo is invalid")
+	}
+
+	fi, err = CopyWithFileInfoMask(w, strings.NewReader(text), p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.HasChecksum() || fi.Size() != uint64(len(text)) {
+		t.Error(`empty mask must calculate only the size`)
+	}
+
+	fi, err = CopyWithFileInfoMask(w, strings.NewReader(text), p, HashMD5|HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.HashMask() != HashMD5|HashSHA512 {
+		t.Error(`unexpected HashMask`, fi.HashMask())
+	}
+	if MakeFileInfoNoChecksum(p, 1).HashMask() != 0 {
+		t.Error(`FileInfo without checksums must have no HashMask`)
+	}
+}
+
 func TestFileInfo(t *testing.T) {
 	t.Run("Same", testFileInfoSame)
 	t.Run("JSON", testFileInfoJSON)
 	t.Run("AddPrefix", testFileInfoAddPrefix)
 	t.Run("Checksum", testFileInfoChecksum)
 	t.Run("Copy", testFileInfoCopy)
+	t.Run("CopyMask", testFileInfoCopyMask)
 }
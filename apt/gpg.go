@@ -0,0 +1,99 @@
+package apt
+
+// This file implements verification of Release and InRelease files
+// by OpenPGP signatures.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/pkg/errors"
+)
+
+// armorHeader begins ASCII-armored OpenPGP data.
+const armorHeader = "-----BEGIN PGP "
+
+// ReadKeyring reads an ASCII-armored or binary OpenPGP keyring.
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var kr openpgp.EntityList
+	if bytes.Contains(data, []byte(armorHeader)) {
+		kr, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		kr, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(kr) == 0 {
+		return nil, errors.New("no keys in keyring")
+	}
+	return kr, nil
+}
+
+// LoadKeyring reads a keyring file by ReadKeyring.
+func LoadKeyring(filename string) (openpgp.EntityList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kr, err := ReadKeyring(f)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return kr, nil
+}
+
+// VerifyInRelease verifies the clear-signed InRelease read from r
+// and returns a reader of the signed payload, i.e. Release contents.
+//
+// Data outside of the signed message is rejected because parsers
+// might read it as if it were signed.
+func VerifyInRelease(r io.Reader, keyring openpgp.KeyRing) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	block, rest := clearsign.Decode(data)
+	if block == nil {
+		return nil, errors.New("not clear-signed")
+	}
+	i := bytes.Index(data, []byte("-----BEGIN PGP SIGNED MESSAGE-----"))
+	if i < 0 || len(bytes.TrimSpace(data[:i])) > 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("data outside of the signed message")
+	}
+
+	_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(block.Plaintext), nil
+}
+
+// VerifyRelease verifies Release read from r by the detached signature
+// in Release.gpg, which may be ASCII-armored.  It returns a reader of
+// the verified Release contents.
+func VerifyRelease(r io.Reader, sig []byte, keyring openpgp.KeyRing) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(armorHeader)) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
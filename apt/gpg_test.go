@@ -0,0 +1,133 @@
+package apt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	s := repotest.NewSigner("signer")
+	e := s.Entity
+
+	binary := new(bytes.Buffer)
+	if err := e.Serialize(binary); err != nil {
+		t.Fatal(err)
+	}
+	armored := s.PublicKey()
+
+	for _, data := range [][]byte{binary.Bytes(), armored} {
+		kr, err := ReadKeyring(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kr) != 1 || kr[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+			t.Error(`unexpected keyring`, kr)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keyring.asc")
+	if err := s.WriteKeyring(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyring(filename); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadKeyring(filepath.Join(dir, "none")); err == nil {
+		t.Error(`missing keyring must be an error`)
+	}
+	if _, err := ReadKeyring(bytes.NewReader(nil)); err == nil {
+		t.Error(`empty keyring must be an error`)
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+	other := repotest.NewSigner("other")
+	kr := signer.Keyring()
+	release, err := ioutil.ReadFile("testdata/af/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := signer.DetachSign(release)
+	r, err := VerifyRelease(bytes.NewReader(release), sig, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(data, release) {
+		t.Error(`unexpected payload`)
+	}
+
+	binsig := new(bytes.Buffer)
+	if err := openpgp.DetachSign(binsig, signer.Entity, bytes.NewReader(release), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyRelease(bytes.NewReader(release), binsig.Bytes(), kr); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := VerifyRelease(bytes.NewReader(release), sig, other.Keyring()); err == nil {
+		t.Error(`signature by unknown key must be an error`)
+	}
+	tampered := append([]byte("Origin: evil\n"), release...)
+	if _, err := VerifyRelease(bytes.NewReader(tampered), sig, kr); err == nil {
+		t.Error(`tampered Release must be an error`)
+	}
+}
+
+func TestVerifyInRelease(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+	other := repotest.NewSigner("other")
+	kr := signer.Keyring()
+	release, err := ioutil.ReadFile("testdata/af/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inRelease := signer.ClearSign(release)
+	r, err := VerifyInRelease(bytes.NewReader(inRelease), kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(bytes.TrimRight(data, "\n"), bytes.TrimRight(release, "\n")) {
+		t.Errorf("unexpected payload: %q", data)
+	}
+
+	if _, err := VerifyInRelease(bytes.NewReader(inRelease), other.Keyring()); err == nil {
+		t.Error(`signature by unknown key must be an error`)
+	}
+	if _, err := VerifyInRelease(bytes.NewReader(release), kr); err == nil {
+		t.Error(`unsigned Release must be an error`)
+	}
+	tampered := bytes.Replace(inRelease, []byte("Suite: testing"), []byte("Suite: evil"), 1)
+	if _, err := VerifyInRelease(bytes.NewReader(tampered), kr); err == nil {
+		t.Error(`tampered InRelease must be an error`)
+	}
+	prepended := append([]byte("Origin: evil\n\n"), inRelease...)
+	if _, err := VerifyInRelease(bytes.NewReader(prepended), kr); err == nil {
+		t.Error(`data before the signed message must be an error`)
+	}
+	appended := append(append([]byte(nil), inRelease...), "\nOrigin: evil\n"...)
+	if _, err := VerifyInRelease(bytes.NewReader(appended), kr); err == nil {
+		t.Error(`data after the signed message must be an error`)
+	}
+}
@@ -0,0 +1,81 @@
+package apt
+
+// This file implements a reader of concatenated LZ4 frames.
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	lz4SkippableMagic = 0x184D2A50
+	lz4SkippableMask  = 0xFFFFFFF0
+)
+
+// lz4Reader decompresses concatenated LZ4 frames and skips skippable
+// frames as the lz4 command does.  Each frame is decoded by
+// github.com/pierrec/lz4/v4, which verifies checksums in frames.
+type lz4Reader struct {
+	r      *bufio.Reader
+	zr     *lz4.Reader
+	frames int
+}
+
+func newLZ4Reader(r *bufio.Reader) *lz4Reader {
+	return &lz4Reader{r: r}
+}
+
+func (r *lz4Reader) Read(p []byte) (int, error) {
+	for {
+		if r.zr == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.zr.Read(p)
+		if err == io.EOF {
+			r.zr = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// next skips skippable frames and starts the next frame.  io.EOF is
+// returned at the end of the input following one or more frames.
+func (r *lz4Reader) next() error {
+	for {
+		head, err := r.r.Peek(8)
+		if len(head) == 0 && err == io.EOF {
+			if r.frames > 0 {
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+		if len(head) < 4 || binary.LittleEndian.Uint32(head)&lz4SkippableMask != lz4SkippableMagic {
+			break
+		}
+		if len(head) < 8 {
+			return io.ErrUnexpectedEOF
+		}
+		size := binary.LittleEndian.Uint32(head[4:])
+		if _, err := r.r.Discard(8 + int(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	r.zr = lz4.NewReader(r.r)
+	r.frames++
+	return nil
+}
@@ -0,0 +1,160 @@
+package apt
+
+// This file implements a decoder of the lzip format.
+// https://www.nongnu.org/lzip/manual/lzip_manual.html#File-format
+//
+// An lzip member is an LZMA stream with fixed properties and an
+// end marker, preceded by a header and followed by a trailer.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	lzipHeaderLen  = 6
+	lzipTrailerLen = 20
+
+	// lzipProperties is the LZMA properties byte of lzip members,
+	// i.e. lc=3, lp=0, and pb=2.
+	lzipProperties = 0x5d
+)
+
+var lzipMagic = []byte("LZIP")
+
+// lzipReader decompresses concatenated lzip members.
+type lzipReader struct {
+	r    *bufio.Reader
+	lr   *lzma.Reader
+	crc  hash.Hash32
+	size uint64
+
+	// members is the number of members read so far.
+	members int
+	err     error
+}
+
+func newLZIPReader(r *bufio.Reader) *lzipReader {
+	return &lzipReader{r: r, crc: crc32.NewIEEE()}
+}
+
+func (r *lzipReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.lr == nil {
+			r.err = r.readHeader()
+			continue
+		}
+
+		n, err := r.lr.Read(p)
+		r.crc.Write(p[:n])
+		r.size += uint64(n)
+		if err == io.EOF {
+			r.err = r.readTrailer()
+			err = nil
+		}
+		if err != nil {
+			r.err = errors.Wrap(err, "lzip")
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, r.err
+}
+
+// readHeader starts the next member.  io.EOF is returned at the end
+// of the input following one or more members.
+func (r *lzipReader) readHeader() error {
+	header := make([]byte, lzipHeaderLen)
+	_, err := io.ReadFull(r.r, header)
+	switch {
+	case err == io.EOF && r.members > 0:
+		return io.EOF
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return io.ErrUnexpectedEOF
+	case err != nil:
+		return err
+	case !bytes.Equal(header[:4], lzipMagic):
+		return errors.New("lzip: invalid magic number")
+	case header[4] != 1:
+		return errors.Errorf("lzip: unsupported version %d", header[4])
+	}
+
+	// the dictionary size is a power of 2 minus 0 to 7 sixteenths of it.
+	base := uint32(1) << (header[5] & 0x1f)
+	dictSize := base - (base/16)*uint32(header[5]>>5)
+	if dictSize < lzma.MinDictCap || dictSize > 1<<29 {
+		return errors.New("lzip: invalid dictionary size")
+	}
+
+	// make the header of the classic LZMA format for the stream
+	// without the uncompressed size.
+	lh := make([]byte, lzma.HeaderLen)
+	lh[0] = lzipProperties
+	binary.LittleEndian.PutUint32(lh[1:], dictSize)
+	for i := 5; i < lzma.HeaderLen; i++ {
+		lh[i] = 0xff
+	}
+	lr, err := lzma.NewReader(&prefixReader{lh, r.r})
+	if err != nil {
+		return errors.Wrap(err, "lzip")
+	}
+
+	r.lr = lr
+	r.crc.Reset()
+	r.size = 0
+	r.members++
+	return nil
+}
+
+// readTrailer finishes the current member by checking its trailer.
+func (r *lzipReader) readTrailer() error {
+	trailer := make([]byte, lzipTrailerLen)
+	_, err := io.ReadFull(r.r, trailer)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(trailer) != r.crc.Sum32() {
+		return errors.New("lzip: CRC mismatch")
+	}
+	if binary.LittleEndian.Uint64(trailer[4:]) != r.size {
+		return errors.New("lzip: data size mismatch")
+	}
+	r.lr = nil
+	return nil
+}
+
+// prefixReader reads prefix followed by r.  It implements
+// io.ByteReader so that the LZMA decoder reads r byte by byte.
+type prefixReader struct {
+	prefix []byte
+	r      *bufio.Reader
+}
+
+func (pr *prefixReader) Read(p []byte) (int, error) {
+	if len(pr.prefix) > 0 {
+		n := copy(p, pr.prefix)
+		pr.prefix = pr.prefix[n:]
+		return n, nil
+	}
+	return pr.r.Read(p)
+}
+
+func (pr *prefixReader) ReadByte() (byte, error) {
+	if len(pr.prefix) > 0 {
+		b := pr.prefix[0]
+		pr.prefix = pr.prefix[1:]
+		return b, nil
+	}
+	return pr.r.ReadByte()
+}
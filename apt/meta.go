@@ -3,8 +3,10 @@ package apt
 // This file provides utilities for debian repository indices.
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"io"
 	"path"
@@ -12,27 +14,12 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
-	"github.com/ulikunitz/xz"
 )
 
 // IsMeta returns true if p points a debian repository index file
 // containing checksums for other files.
 func IsMeta(p string) bool {
-	base := path.Base(p)
-
-	// https://wiki.debian.org/RepositoryFormat#Compression_of_indices
-	switch {
-	case strings.HasSuffix(base, ".gz"):
-		base = base[0 : len(base)-3]
-	case strings.HasSuffix(base, ".bz2"):
-		base = base[0 : len(base)-4]
-	case strings.HasSuffix(base, ".xz"):
-		base = base[0 : len(base)-3]
-	case strings.HasSuffix(base, ".lzma"):
-		base = base[0 : len(base)-5]
-	case strings.HasSuffix(base, ".lz"):
-		base = base[0 : len(base)-3]
-	}
+	base := TrimCompressionExt(path.Base(p))
 
 	switch base {
 	case "Release", "Release.gpg", "InRelease":
@@ -44,11 +31,30 @@ func IsMeta(p string) bool {
 	return false
 }
 
+// TranslationLanguage returns the language code such as "en" or
+// "pt_BR" if p points a translation index "Translation-<lang>",
+// optionally compressed.  Otherwise an empty string is returned.
+func TranslationLanguage(p string) string {
+	base := TrimCompressionExt(path.Base(p))
+	if !strings.HasPrefix(base, "Translation-") {
+		return ""
+	}
+	return strings.TrimPrefix(base, "Translation-")
+}
+
+// IsTranslation returns true if p points a translation index such as
+// "i18n/Translation-en.bz2".  Translation indices are listed in
+// Release and i18n/Index, but contain no checksums for other files,
+// so they are not meta data files.
+func IsTranslation(p string) bool {
+	return TranslationLanguage(p) != ""
+}
+
 // IsSupported returns true if the meta data is compressed that can be
 // decompressed by ExtractFileInfo.
 func IsSupported(p string) bool {
 	switch path.Ext(p) {
-	case "", ".gz", ".bz2", ".gpg", ".xz":
+	case "", ".gz", ".bz2", ".gpg", ".xz", ".zst", ".lzma", ".lz4", ".lz":
 		return true
 	}
 	return false
@@ -65,6 +71,52 @@ func SupportByHash(d Paragraph) bool {
 	return p[0] == "yes"
 }
 
+// IsByHash returns true if p is a path to acquire an index by its
+// hash value, i.e. "<dir>/by-hash/<algorithm>/<hex>".
+func IsByHash(p string) bool {
+	t := strings.Split(p, "/")
+	if len(t) < 3 || t[len(t)-3] != "by-hash" {
+		return false
+	}
+
+	var size int
+	switch t[len(t)-2] {
+	case "MD5Sum":
+		size = md5.Size
+	case "SHA1":
+		size = sha1.Size
+	case "SHA256":
+		size = sha256.Size
+	case "SHA512":
+		size = sha512.Size
+	default:
+		return false
+	}
+	sum, err := hex.DecodeString(t[len(t)-1])
+	return err == nil && len(sum) == size
+}
+
+// checkPath validates a relative path p given in an index.
+//
+// Paths in indices are joined into local file paths, so a malicious
+// or broken index must not be able to point outside the repository.
+func checkPath(p string) error {
+	switch {
+	case len(p) == 0:
+		return errors.New("empty path")
+	case strings.HasPrefix(p, "/"):
+		return errors.New("absolute path: " + p)
+	case strings.ContainsRune(p, 0):
+		return errors.New("NUL in path: " + p)
+	}
+	for _, s := range strings.Split(p, "/") {
+		if s == ".." {
+			return errors.New("parent directory in path: " + p)
+		}
+	}
+	return nil
+}
+
 func parseChecksum(l string) (p string, size uint64, csum []byte, err error) {
 	flds := strings.Fields(l)
 	if len(flds) != 3 {
@@ -82,25 +134,27 @@ func parseChecksum(l string) (p string, size uint64, csum []byte, err error) {
 	}
 
 	p = flds[2]
+	err = checkPath(p)
 	return
 }
 
 // getFilesFromRelease parses Release or InRelease file and
-// returns a list of *FileInfo pointed in the file.
-func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
+// calls fn for each *FileInfo pointed in the file.
+func getFilesFromRelease(p string, r io.Reader, fn func(*FileInfo) error) (Paragraph, error) {
 	dir := path.Dir(p)
 
 	d, err := NewParser(r).Read()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "NewParser(r).Read()")
+		return nil, errors.Wrap(err, "NewParser(r).Read()")
 	}
 
 	md5sums := d["MD5Sum"]
 	sha1sums := d["SHA1"]
 	sha256sums := d["SHA256"]
+	sha512sums := d["SHA512"]
 
-	if len(md5sums) == 0 && len(sha1sums) == 0 && len(sha256sums) == 0 {
-		return nil, d, nil
+	if len(md5sums) == 0 && len(sha1sums) == 0 && len(sha256sums) == 0 && len(sha512sums) == 0 {
+		return d, nil
 	}
 
 	m := make(map[string]*FileInfo)
@@ -109,7 +163,7 @@ func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		p, size, csum, err := parseChecksum(l)
 		p = path.Join(dir, path.Clean(p))
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "parseChecksum for md5sums")
+			return nil, errors.Wrap(err, "parseChecksum for md5sums")
 		}
 
 		fi := &FileInfo{
@@ -124,7 +178,7 @@ func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		p, size, csum, err := parseChecksum(l)
 		p = path.Join(dir, path.Clean(p))
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "parseChecksum for sha1sums")
+			return nil, errors.Wrap(err, "parseChecksum for sha1sums")
 		}
 
 		fi, ok := m[p]
@@ -144,7 +198,7 @@ func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		p, size, csum, err := parseChecksum(l)
 		p = path.Join(dir, path.Clean(p))
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "parseChecksum for sha256sums")
+			return nil, errors.Wrap(err, "parseChecksum for sha256sums")
 		}
 
 		fi, ok := m[p]
@@ -160,23 +214,43 @@ func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		}
 	}
 
+	for _, l := range sha512sums {
+		p, size, csum, err := parseChecksum(l)
+		p = path.Join(dir, path.Clean(p))
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for sha512sums")
+		}
+
+		fi, ok := m[p]
+		if ok {
+			fi.sha512sum = csum
+		} else {
+			fi := &FileInfo{
+				path:      p,
+				size:      size,
+				sha512sum: csum,
+			}
+			m[p] = fi
+		}
+	}
+
 	// WORKAROUND: some (e.g. dell) repositories have invalid Release
 	// that contains wrong checksum for Release itself.  Ignore them.
 	delete(m, path.Join(dir, "Release"))
 	delete(m, path.Join(dir, "Release.gpg"))
 	delete(m, path.Join(dir, "InRelease"))
 
-	l := make([]*FileInfo, 0, len(m))
 	for _, fi := range m {
-		l = append(l, fi)
+		if err := fn(fi); err != nil {
+			return nil, err
+		}
 	}
-	return l, d, nil
+	return d, nil
 }
 
-// getFilesFromPackages parses Packages file and returns
-// a list of *FileInfo pointed in the file.
-func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
-	var l []*FileInfo
+// getFilesFromPackages parses Packages file and calls fn
+// for each *FileInfo pointed in the file.
+func getFilesFromPackages(p string, r io.Reader, fn func(*FileInfo) error) (Paragraph, error) {
 	parser := NewParser(r)
 
 	for {
@@ -185,22 +259,25 @@ func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 			break
 		}
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "parser.Read")
+			return nil, errors.Wrap(err, "parser.Read")
 		}
 
 		filename, ok := d["Filename"]
 		if !ok {
-			return nil, nil, errors.New("no Filename in " + p)
+			return nil, errors.New("no Filename in " + p)
+		}
+		if err := checkPath(filename[0]); err != nil {
+			return nil, errors.Wrap(err, p)
 		}
 		fpath := path.Clean(filename[0])
 
 		strsize, ok := d["Size"]
 		if !ok {
-			return nil, nil, errors.New("no Size in " + p)
+			return nil, errors.New("no Size in " + p)
 		}
 		size, err := strconv.ParseUint(strsize[0], 10, 64)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
 		fi := &FileInfo{
@@ -210,34 +287,42 @@ func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		if csum, ok := d["MD5sum"]; ok {
 			b, err := hex.DecodeString(csum[0])
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
 			fi.md5sum = b
 		}
 		if csum, ok := d["SHA1"]; ok {
 			b, err := hex.DecodeString(csum[0])
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
 			fi.sha1sum = b
 		}
 		if csum, ok := d["SHA256"]; ok {
 			b, err := hex.DecodeString(csum[0])
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
 			fi.sha256sum = b
 		}
-		l = append(l, fi)
+		if csum, ok := d["SHA512"]; ok {
+			b, err := hex.DecodeString(csum[0])
+			if err != nil {
+				return nil, err
+			}
+			fi.sha512sum = b
+		}
+		if err := fn(fi); err != nil {
+			return nil, err
+		}
 	}
 
-	return l, nil, nil
+	return nil, nil
 }
 
-// getFilesFromSources parses Sources file and returns
-// a list of *FileInfo pointed in the file.
-func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
-	var l []*FileInfo
+// getFilesFromSources parses Sources file and calls fn
+// for each *FileInfo pointed in the file.
+func getFilesFromSources(p string, r io.Reader, fn func(*FileInfo) error) (Paragraph, error) {
 	parser := NewParser(r)
 
 	for {
@@ -246,12 +331,15 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 			break
 		}
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "parser.Read")
+			return nil, errors.Wrap(err, "parser.Read")
 		}
 
 		dir, ok := d["Directory"]
 		if !ok {
-			return nil, nil, errors.New("no Directory in " + p)
+			return nil, errors.New("no Directory in " + p)
+		}
+		if err := checkPath(dir[0]); err != nil {
+			return nil, errors.Wrap(err, p)
 		}
 
 		m := make(map[string]*FileInfo)
@@ -259,7 +347,7 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		for _, l := range d["Files"] {
 			fname, size, csum, err := parseChecksum(l)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Files")
+				return nil, errors.Wrap(err, "parseChecksum for Files")
 			}
 
 			fpath := path.Clean(path.Join(dir[0], fname))
@@ -273,7 +361,7 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		for _, l := range d["Checksums-Sha1"] {
 			fname, size, csum, err := parseChecksum(l)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
+				return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
 			}
 
 			fpath := path.Clean(path.Join(dir[0], fname))
@@ -291,7 +379,7 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 		for _, l := range d["Checksums-Sha256"] {
 			fname, size, csum, err := parseChecksum(l)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
+				return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
 			}
 
 			fpath := path.Clean(path.Join(dir[0], fname))
@@ -306,21 +394,41 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 			}
 		}
 
+		for _, l := range d["Checksums-Sha512"] {
+			fname, size, csum, err := parseChecksum(l)
+			if err != nil {
+				return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha512")
+			}
+
+			fpath := path.Clean(path.Join(dir[0], fname))
+			if _, ok := m[fpath]; ok {
+				m[fpath].sha512sum = csum
+			} else {
+				m[fpath] = &FileInfo{
+					path:      fpath,
+					size:      size,
+					sha512sum: csum,
+				}
+			}
+		}
+
 		for _, fi := range m {
-			if len(fi.md5sum) == 0 && len(fi.sha1sum) == 0 && len(fi.sha256sum) == 0 {
-				return nil, nil, errors.New("no checksum in " + fi.path)
+			if len(fi.md5sum) == 0 && len(fi.sha1sum) == 0 && len(fi.sha256sum) == 0 && len(fi.sha512sum) == 0 {
+				return nil, errors.New("no checksum in " + fi.path)
+			}
+			if err := fn(fi); err != nil {
+				return nil, err
 			}
-			l = append(l, fi)
 		}
 	}
 
-	return l, nil, nil
+	return nil, nil
 }
 
-// getFilesFromIndex parses i18n/Index file and returns
-// a list of *FileInfo pointed in the file.
-func getFilesFromIndex(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
-	return getFilesFromRelease(p, r)
+// getFilesFromIndex parses i18n/Index file and calls fn
+// for each *FileInfo pointed in the file.
+func getFilesFromIndex(p string, r io.Reader, fn func(*FileInfo) error) (Paragraph, error) {
+	return getFilesFromRelease(p, r, fn)
 }
 
 // ExtractFileInfo parses debian repository index files such as
@@ -332,46 +440,49 @@ func getFilesFromIndex(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
 //
 // p is the relative path of the file.
 func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
+	var l []*FileInfo
+	d, err := ExtractFileInfoFunc(p, r, func(fi *FileInfo) error {
+		l = append(l, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, d, nil
+}
+
+// ExtractFileInfoFunc is the same as ExtractFileInfo except that
+// it calls fn for each *FileInfo as soon as it is parsed instead of
+// returning a list.  Packages and Sources are processed with
+// constant memory.
+//
+// If fn returns an error, parsing stops and the error is returned.
+//
+// Translation indices are accepted but list no files.
+func ExtractFileInfoFunc(p string, r io.Reader, fn func(*FileInfo) error) (Paragraph, error) {
+	if IsTranslation(p) {
+		return nil, nil
+	}
 	if !IsMeta(p) {
-		return nil, nil, errors.New("not a meta data file: " + p)
+		return nil, errors.New("not a meta data file: " + p)
 	}
 
-	base := path.Base(p)
-	ext := path.Ext(base)
-	switch ext {
-	case "", ".gpg":
-		// do nothing
-	case ".gz":
-		gz, err := gzip.NewReader(r)
-		if err != nil {
-			return nil, nil, err
-		}
-		defer gz.Close()
-		r = gz
-		base = base[:len(base)-3]
-	case ".bz2":
-		r = bzip2.NewReader(r)
-		base = base[:len(base)-4]
-	case ".xz":
-		xzr, err := xz.NewReader(r)
-		if err != nil {
-			return nil, nil, err
-		}
-		r = xzr
-		base = base[:len(base)-3]
-	default:
-		return nil, nil, errors.New("unsupported file extension: " + ext)
+	dr, err := Decompress(p, r)
+	if err != nil {
+		return nil, err
 	}
+	defer dr.Close()
+	r = dr
 
-	switch base {
+	switch TrimCompressionExt(path.Base(p)) {
 	case "Release", "InRelease":
-		return getFilesFromRelease(p, r)
+		return getFilesFromRelease(p, r, fn)
 	case "Packages":
-		return getFilesFromPackages(p, r)
+		return getFilesFromPackages(p, r, fn)
 	case "Sources":
-		return getFilesFromSources(p, r)
+		return getFilesFromSources(p, r, fn)
 	case "Index":
-		return getFilesFromIndex(p, r)
+		return getFilesFromIndex(p, r, fn)
 	}
-	return nil, nil, nil
+	return nil, nil
 }
@@ -2,10 +2,44 @@ package apt
 
 import (
 	"encoding/hex"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 )
 
+func TestIsTranslation(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"ubuntu/dists/trusty/main/i18n/Translation-en.bz2": "en",
+		"i18n/Translation-pt_BR":                           "pt_BR",
+		"Translation-de.xz":                                "de",
+		"Translation-":                                     "",
+		"i18n/Index":                                       "",
+		"Packages.gz":                                      "",
+	}
+	for p, lang := range cases {
+		if TranslationLanguage(p) != lang {
+			t.Errorf("TranslationLanguage(%q) != %q", p, lang)
+		}
+		if IsTranslation(p) != (lang != "") {
+			t.Errorf("IsTranslation(%q) != %v", p, lang != "")
+		}
+		if IsTranslation(p) && IsMeta(p) {
+			t.Errorf("translation %q must not be meta data", p)
+		}
+	}
+
+	fil, d, err := ExtractFileInfo("ubuntu/dists/trusty/main/i18n/Translation-en", strings.NewReader("Package: a\nDescription-md5: x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fil != nil || d != nil {
+		t.Error(`translations must list no files`, fil, d)
+	}
+}
+
 func TestIsMeta(t *testing.T) {
 	if IsMeta("hoge.deb") {
 		t.Error(`IsMeta("hoge.deb")`)
@@ -34,6 +68,9 @@ func TestIsMeta(t *testing.T) {
 	if !IsMeta("Packages.xz") {
 		t.Error(`!IsMeta("Packages.xz")`)
 	}
+	if !IsMeta("Packages.zst") {
+		t.Error(`!IsMeta("Packages.zst")`)
+	}
 	if IsMeta("Packages.gz.xz") {
 		t.Error(`IsMeta("Packages.gz.xz")`)
 	}
@@ -45,6 +82,28 @@ func TestIsMeta(t *testing.T) {
 	}
 }
 
+func TestIsByHash(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]bool{
+		"dists/trusty/main/binary-amd64/by-hash/SHA256/" + strings.Repeat("ab", 32): true,
+		"by-hash/SHA1/" + strings.Repeat("ab", 20):                                  true,
+		"dists/trusty/by-hash/MD5Sum/" + strings.Repeat("ab", 16):                   true,
+		"dists/trusty/by-hash/SHA256/" + strings.Repeat("ab", 16):                   false,
+		"dists/trusty/by-hash/SHA512/" + strings.Repeat("ab", 64):                   true,
+		"dists/trusty/by-hash/SHA512/" + strings.Repeat("ab", 32):                   false,
+		"dists/trusty/by-hash/SHA384/" + strings.Repeat("ab", 48):                   false,
+		"dists/trusty/by-hash/SHA256/" + strings.Repeat("zz", 32):                   false,
+		"dists/trusty/main/binary-amd64/Packages":                                   false,
+		"SHA256/" + strings.Repeat("ab", 32):                                        false,
+	}
+	for p, expected := range cases {
+		if IsByHash(p) != expected {
+			t.Error(`unexpected IsByHash`, p, !expected)
+		}
+	}
+}
+
 func containsFileInfo(fi *FileInfo, l []*FileInfo) bool {
 	for _, fi2 := range l {
 		if fi.Same(fi2) {
@@ -164,6 +223,63 @@ func TestGetFilesFromPackages(t *testing.T) {
 	}
 }
 
+func TestCheckPath(t *testing.T) {
+	t.Parallel()
+
+	valid := []string{
+		"pool/main/a/apt/apt_1.0_amd64.deb",
+		"./hoge.deb",
+		"main/binary-amd64/Packages.gz",
+		"foo..bar/baz",
+	}
+	for _, p := range valid {
+		if err := checkPath(p); err != nil {
+			t.Errorf("checkPath(%q): %v", p, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/etc/passwd",
+		"../../etc/passwd",
+		"pool/../../x.deb",
+		"pool/main/..",
+		"pool/a\x00b",
+	}
+	for _, p := range invalid {
+		if err := checkPath(p); err == nil {
+			t.Errorf("checkPath(%q) should fail", p)
+		}
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"ubuntu/dists/testing/Release": `Suite: testing
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 0 ../../../../etc/cron.d/evil
+`,
+		"ubuntu/dists/testing/main/binary-amd64/Packages": `Package: evil
+Filename: /etc/cron.d/evil
+Size: 0
+SHA256: e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+`,
+		"ubuntu/dists/testing/main/source/Sources": `Package: evil
+Directory: pool/../../../etc
+Files:
+ d41d8cd98f00b204e9800998ecf8427e 0 evil.dsc
+`,
+	}
+	for p, data := range cases {
+		_, _, err := ExtractFileInfo(p, strings.NewReader(data))
+		if err == nil {
+			t.Errorf("ExtractFileInfo(%q) should fail", p)
+		}
+	}
+}
+
 func TestGetFilesFromSources(t *testing.T) {
 	t.Parallel()
 
@@ -318,3 +434,130 @@ func TestExtractFileInfoWithXZ(t *testing.T) {
 		t.Error("pool/c/cybozu-abc_0.2.2-1_amd64.deb")
 	}
 }
+
+func TestExtractFileInfoWithZstd(t *testing.T) {
+	t.Parallel()
+
+	if !IsSupported("ubuntu/dists/testing/main/binary-amd64/Packages.zst") {
+		t.Error(`Packages.zst must be supported`)
+	}
+
+	f, err := os.Open("testdata/af/Packages.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fil, _, err := ExtractFileInfo("ubuntu/dists/testing/Packages.zst", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha1sum, _ := hex.DecodeString("903b3305c86e872db25985f2b686ef8d1c3760cf")
+	fi := &FileInfo{
+		path:    "pool/c/cybozu-abc_0.2.2-1_amd64.deb",
+		size:    102369852,
+		sha1sum: sha1sum,
+	}
+	if !containsFileInfo(fi, fil) {
+		t.Error("pool/c/cybozu-abc_0.2.2-1_amd64.deb")
+	}
+}
+
+func TestGetFilesWithSHA512(t *testing.T) {
+	t.Parallel()
+
+	sum := strings.Repeat("ab", 64)
+	sum2 := strings.Repeat("cd", 64)
+	release := "Origin: test\n" +
+		"SHA256:\n" +
+		" " + strings.Repeat("ef", 32) + " 10 main/binary-amd64/Packages\n" +
+		"SHA512:\n" +
+		" " + sum + " 10 main/binary-amd64/Packages\n" +
+		" " + sum2 + " 20 main/binary-amd64/Packages.gz\n"
+	fil, _, err := ExtractFileInfo("dists/stable/Release", strings.NewReader(release))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]string)
+	for _, fi := range fil {
+		paths[fi.Path()] = fi.SHA512Path()
+	}
+	if paths["dists/stable/main/binary-amd64/Packages"] != "dists/stable/main/binary-amd64/by-hash/SHA512/"+sum {
+		t.Error(`unexpected SHA512 of Packages`, paths)
+	}
+	if paths["dists/stable/main/binary-amd64/Packages.gz"] != "dists/stable/main/binary-amd64/by-hash/SHA512/"+sum2 {
+		t.Error(`unexpected SHA512 of Packages.gz`, paths)
+	}
+
+	packages := "Package: a\nFilename: pool/a.deb\nSize: 3\nSHA512: " + sum + "\n"
+	fil, _, err = ExtractFileInfo("dists/stable/main/binary-amd64/Packages", strings.NewReader(packages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fil) != 1 || fil[0].SHA512Path() != "pool/by-hash/SHA512/"+sum {
+		t.Error(`unexpected SHA512 in Packages`, fil)
+	}
+
+	sources := "Package: a\nDirectory: pool/a\nChecksums-Sha512:\n " + sum + " 3 a.dsc\n"
+	fil, _, err = ExtractFileInfo("dists/stable/main/source/Sources", strings.NewReader(sources))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fil) != 1 || fil[0].SHA512Path() != "pool/a/by-hash/SHA512/"+sum {
+		t.Error(`unexpected SHA512 in Sources`, fil)
+	}
+}
+
+func TestExtractFileInfoFunc(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var paths []string
+	_, err = ExtractFileInfoFunc("ubuntu/dists/testing/main/binary-amd64/Packages", f, func(fi *FileInfo) error {
+		paths = append(paths, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 || paths[0] != "pool/c/cybozu-abc_0.2.2-1_amd64.deb" {
+		t.Error(`unexpected paths`, paths)
+	}
+
+	// errors from the callback stop parsing.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	stop := errors.New("stop")
+	count := 0
+	_, err = ExtractFileInfoFunc("ubuntu/dists/testing/main/binary-amd64/Packages", f, func(fi *FileInfo) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Error(`callback error must stop parsing`, err, count)
+	}
+
+	f2, err := os.Open("testdata/af/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	count = 0
+	d, err := ExtractFileInfoFunc("ubuntu/dists/testing/Release", f2, func(fi *FileInfo) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || count == 0 {
+		t.Error(`Release must return its paragraph and files`, count)
+	}
+}
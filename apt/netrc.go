@@ -0,0 +1,155 @@
+package apt
+
+// This file provides a reader for netrc and apt auth.conf files.
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Credentials is a set of login credentials for repositories.
+//
+// The file format is that of ~/.netrc and apt_auth.conf(5).
+// In addition to host names, machine entries may be given with
+// a scheme, a port, and a path prefix as in apt auth.conf:
+//
+//	machine https://example.org:8443/debian login user password secret
+type Credentials struct {
+	entries []credEntry
+	deflt   *credEntry
+}
+
+type credEntry struct {
+	scheme   string
+	host     string
+	path     string
+	login    string
+	password string
+}
+
+// ReadCredentials reads credentials from r.
+func ReadCredentials(r io.Reader) (*Credentials, error) {
+	var tokens []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(l)...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	c := new(Credentials)
+	var cur *credEntry
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch t {
+		case "default":
+			cur = new(credEntry)
+			c.deflt = cur
+			continue
+		case "macdef":
+			// macro definitions are not supported; skip the name.
+			i++
+			cur = nil
+			continue
+		}
+
+		if i+1 >= len(tokens) {
+			return nil, errors.New("missing value for " + t)
+		}
+		v := tokens[i+1]
+		i++
+
+		switch t {
+		case "machine":
+			c.entries = append(c.entries, parseMachine(v))
+			cur = &c.entries[len(c.entries)-1]
+		case "login":
+			if cur == nil {
+				return nil, errors.New("login without machine")
+			}
+			cur.login = v
+		case "password":
+			if cur == nil {
+				return nil, errors.New("password without machine")
+			}
+			cur.password = v
+		case "account":
+		default:
+			return nil, errors.New("unknown token: " + t)
+		}
+	}
+	return c, nil
+}
+
+// LoadCredentials reads credentials from a file.
+func LoadCredentials(filename string) (*Credentials, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := ReadCredentials(f)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return c, nil
+}
+
+func parseMachine(m string) credEntry {
+	var e credEntry
+	if i := strings.Index(m, "://"); i >= 0 {
+		e.scheme = m[:i]
+		m = m[i+3:]
+	}
+	if i := strings.Index(m, "/"); i >= 0 {
+		e.path = strings.TrimSuffix(m[i:], "/")
+		m = m[:i]
+	}
+	e.host = m
+	return e
+}
+
+func (e *credEntry) match(u *url.URL) bool {
+	if len(e.scheme) > 0 && e.scheme != u.Scheme {
+		return false
+	}
+	if strings.Contains(e.host, ":") {
+		if e.host != u.Host {
+			return false
+		}
+	} else if e.host != u.Hostname() {
+		return false
+	}
+	if len(e.path) == 0 {
+		return true
+	}
+	return u.Path == e.path || strings.HasPrefix(u.Path, e.path+"/")
+}
+
+// Lookup returns the login and password for u.
+//
+// The first matching machine entry is used.  If no entry matches,
+// the default entry, if any, is used.
+func (c *Credentials) Lookup(u *url.URL) (login, password string, ok bool) {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.match(u) {
+			return e.login, e.password, true
+		}
+	}
+	if c.deflt != nil {
+		return c.deflt.login, c.deflt.password, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,71 @@
+package apt
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	t.Parallel()
+
+	const data = `
+# private repositories
+machine example.org/debian login user1 password pass1
+machine https://example.org:8443 login user2 password pass2
+machine
+  example.com
+  login user3
+  password pass3
+default login anonymous password guest
+`
+	c, err := ReadCredentials(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url      string
+		login    string
+		password string
+	}{
+		{"http://example.org/debian/dists/stable/Release", "user1", "pass1"},
+		{"https://example.org/debian", "user1", "pass1"},
+		{"http://example.org/debian-security/", "anonymous", "guest"},
+		{"https://example.org:8443/ubuntu/", "user2", "pass2"},
+		{"http://example.org:8443/ubuntu/", "anonymous", "guest"},
+		{"http://example.com/", "user3", "pass3"},
+	}
+	for _, tc := range cases {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		login, password, ok := c.Lookup(u)
+		if !ok {
+			t.Error(`!ok for ` + tc.url)
+			continue
+		}
+		if login != tc.login || password != tc.password {
+			t.Errorf("wrong credentials for %s: %s %s", tc.url, login, password)
+		}
+	}
+
+	c, err = ReadCredentials(strings.NewReader("machine example.org login a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://example.net/")
+	if _, _, ok := c.Lookup(u); ok {
+		t.Error(`ok for example.net`)
+	}
+
+	_, err = ReadCredentials(strings.NewReader("machine example.org login"))
+	if err == nil {
+		t.Error(`err == nil for missing value`)
+	}
+	_, err = ReadCredentials(strings.NewReader("login a"))
+	if err == nil {
+		t.Error(`err == nil for login without machine`)
+	}
+}
@@ -0,0 +1,311 @@
+package apt
+
+// This file implements typed records of binary packages in Packages.
+// https://www.debian.org/doc/debian-policy/ch-relationships.html
+
+import (
+	"encoding/hex"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dependency is a package in a relationship field such as
+// "libc6:any (>= 2.17) [amd64] <!nocheck>".
+type Dependency struct {
+	Name string
+
+	// ArchQualifier is the qualifier after the name such as "any".
+	ArchQualifier string
+
+	// Op is one of "<<", "<=", "=", ">=", ">>", or an empty string
+	// if the version is not restricted.  Obsolete "<" and ">" are
+	// read as "<=" and ">=".
+	Op      string
+	Version string
+
+	// Architectures is the architecture restriction list such as
+	// ["amd64", "!i386"].
+	Architectures []string
+
+	// Profiles is the list of restriction formulas such as
+	// ["!nocheck", "stage1 cross"].
+	Profiles []string
+}
+
+// String returns d in the syntax of relationship fields.
+func (d Dependency) String() string {
+	s := d.Name
+	if d.ArchQualifier != "" {
+		s += ":" + d.ArchQualifier
+	}
+	if d.Op != "" {
+		s += " (" + d.Op + " " + d.Version + ")"
+	}
+	if len(d.Architectures) > 0 {
+		s += " [" + strings.Join(d.Architectures, " ") + "]"
+	}
+	for _, p := range d.Profiles {
+		s += " <" + p + ">"
+	}
+	return s
+}
+
+// Relation is a list of alternative dependencies separated by "|".
+type Relation []Dependency
+
+// String returns r in the syntax of relationship fields.
+func (r Relation) String() string {
+	l := make([]string, len(r))
+	for i, d := range r {
+		l[i] = d.String()
+	}
+	return strings.Join(l, " | ")
+}
+
+// Package is a binary package record in Packages.
+type Package struct {
+	Package      string
+	Version      string
+	Architecture string
+	Source       string
+	Filename     string
+	Size         uint64
+	MultiArch    MultiArch
+
+	PreDepends []Relation
+	Depends    []Relation
+	Recommends []Relation
+	Suggests   []Relation
+	Breaks     []Relation
+	Conflicts  []Relation
+	Provides   []Relation
+	Replaces   []Relation
+
+	// Paragraph is the record as parsed by Parser.
+	Paragraph Paragraph
+
+	fi *FileInfo
+}
+
+// FileInfo returns the FileInfo of the package file with checksums
+// given in the record.
+func (p *Package) FileInfo() *FileInfo {
+	return p.fi
+}
+
+// field returns a single line value of name in d.  Multiline values
+// are joined with spaces.
+func field(d Paragraph, name string) string {
+	return strings.TrimSpace(strings.Join(d[name], " "))
+}
+
+// ParseRelations parses a relationship field such as Depends.
+// An empty string results in an empty list.
+func ParseRelations(s string) ([]Relation, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var rels []Relation
+	for _, rs := range strings.Split(s, ",") {
+		var rel Relation
+		for _, ds := range strings.Split(rs, "|") {
+			d, err := parseDependency(ds)
+			if err != nil {
+				return nil, err
+			}
+			rel = append(rel, d)
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
+
+// parseDependency parses a dependency in a relationship field.
+func parseDependency(s string) (Dependency, error) {
+	var d Dependency
+	s = strings.TrimSpace(s)
+
+	i := strings.IndexAny(s, " \t([<")
+	if i < 0 {
+		i = len(s)
+	}
+	d.Name = s[:i]
+	if j := strings.IndexByte(d.Name, ':'); j >= 0 {
+		d.Name, d.ArchQualifier = d.Name[:j], d.Name[j+1:]
+		if d.ArchQualifier == "" {
+			return d, errors.New("empty architecture qualifier: " + s)
+		}
+	}
+	if d.Name == "" {
+		return d, errors.New("no package name: " + s)
+	}
+
+	rest := strings.TrimSpace(s[i:])
+	for len(rest) > 0 {
+		var closing byte
+		switch rest[0] {
+		case '(':
+			closing = ')'
+		case '[':
+			closing = ']'
+		case '<':
+			closing = '>'
+		default:
+			return d, errors.New("invalid dependency: " + s)
+		}
+		j := strings.IndexByte(rest, closing)
+		if j < 0 {
+			return d, errors.New("unterminated " + string(rest[0]) + ": " + s)
+		}
+		inner := strings.TrimSpace(rest[1:j])
+		rest = strings.TrimSpace(rest[j+1:])
+
+		switch closing {
+		case ')':
+			if d.Op != "" {
+				return d, errors.New("multiple version restrictions: " + s)
+			}
+			k := strings.IndexFunc(inner, func(r rune) bool {
+				return r != '<' && r != '>' && r != '='
+			})
+			if k <= 0 {
+				return d, errors.New("invalid version restriction: " + s)
+			}
+			d.Version = strings.TrimSpace(inner[k:])
+			switch op := inner[:k]; op {
+			case "<<", "<=", "=", ">=", ">>":
+				d.Op = op
+			case "<":
+				d.Op = "<="
+			case ">":
+				d.Op = ">="
+			default:
+				return d, errors.New("invalid version relation: " + s)
+			}
+			if d.Version == "" || strings.ContainsAny(d.Version, " \t") {
+				return d, errors.New("invalid version: " + s)
+			}
+		case ']':
+			if d.Architectures != nil {
+				return d, errors.New("multiple architecture restrictions: " + s)
+			}
+			d.Architectures = strings.Fields(inner)
+			if len(d.Architectures) == 0 {
+				return d, errors.New("empty architecture restriction: " + s)
+			}
+		case '>':
+			if inner == "" {
+				return d, errors.New("empty restriction formula: " + s)
+			}
+			d.Profiles = append(d.Profiles, strings.Join(strings.Fields(inner), " "))
+		}
+	}
+	return d, nil
+}
+
+// ParsePackage parses a paragraph of Packages.
+//
+// Package, Version, Filename, and Size fields are required.
+func ParsePackage(d Paragraph) (*Package, error) {
+	p := &Package{
+		Package:      field(d, "Package"),
+		Version:      field(d, "Version"),
+		Architecture: field(d, "Architecture"),
+		Source:       field(d, "Source"),
+		Filename:     field(d, "Filename"),
+		Paragraph:    d,
+	}
+	if p.Package == "" {
+		return nil, errors.New("no Package")
+	}
+	if p.Version == "" {
+		return nil, errors.New("no Version in " + p.Package)
+	}
+	if p.Filename == "" {
+		return nil, errors.New("no Filename in " + p.Package)
+	}
+	if err := checkPath(p.Filename); err != nil {
+		return nil, errors.Wrap(err, p.Package)
+	}
+	size, err := strconv.ParseUint(field(d, "Size"), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "Size of "+p.Package)
+	}
+	p.Size = size
+	p.MultiArch, err = ParseMultiArch(field(d, "Multi-Arch"))
+	if err != nil {
+		return nil, errors.Wrap(err, p.Package)
+	}
+
+	for _, f := range []struct {
+		name string
+		rels *[]Relation
+	}{
+		{"Pre-Depends", &p.PreDepends},
+		{"Depends", &p.Depends},
+		{"Recommends", &p.Recommends},
+		{"Suggests", &p.Suggests},
+		{"Breaks", &p.Breaks},
+		{"Conflicts", &p.Conflicts},
+		{"Provides", &p.Provides},
+		{"Replaces", &p.Replaces},
+	} {
+		rels, err := ParseRelations(field(d, f.name))
+		if err != nil {
+			return nil, errors.Wrap(err, f.name+" of "+p.Package)
+		}
+		*f.rels = rels
+	}
+
+	fi := &FileInfo{
+		path: path.Clean(p.Filename),
+		size: size,
+	}
+	for _, c := range []struct {
+		name string
+		sum  *[]byte
+	}{
+		{"MD5sum", &fi.md5sum},
+		{"SHA1", &fi.sha1sum},
+		{"SHA256", &fi.sha256sum},
+		{"SHA512", &fi.sha512sum},
+	} {
+		v := field(d, c.name)
+		if v == "" {
+			continue
+		}
+		b, err := hex.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrap(err, c.name+" of "+p.Package)
+		}
+		*c.sum = b
+	}
+	p.fi = fi
+	return p, nil
+}
+
+// ReadPackages reads all records in Packages from r.
+// r must be decompressed beforehand.
+func ReadPackages(r io.Reader) ([]*Package, error) {
+	var l []*Package
+	parser := NewParser(r)
+	for {
+		d, err := parser.Read()
+		if err == io.EOF {
+			return l, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parser.Read")
+		}
+		p, err := ParsePackage(d)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, p)
+	}
+}
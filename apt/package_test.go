@@ -0,0 +1,139 @@
+package apt
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRelations(t *testing.T) {
+	t.Parallel()
+
+	rels, err := ParseRelations("libc6 (>= 2.17), python3:any, foo (<< 1:2.0~rc1) | bar [amd64 !i386] <!nocheck> <stage1 cross>, baz (> 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Relation{
+		{{Name: "libc6", Op: ">=", Version: "2.17"}},
+		{{Name: "python3", ArchQualifier: "any"}},
+		{
+			{Name: "foo", Op: "<<", Version: "1:2.0~rc1"},
+			{Name: "bar", Architectures: []string{"amd64", "!i386"}, Profiles: []string{"!nocheck", "stage1 cross"}},
+		},
+		{{Name: "baz", Op: ">=", Version: "1"}},
+	}
+	if !reflect.DeepEqual(rels, expected) {
+		t.Errorf("unexpected relations: %#v", rels)
+	}
+	if s := rels[2].String(); s != "foo (<< 1:2.0~rc1) | bar [amd64 !i386] <!nocheck> <stage1 cross>" {
+		t.Error(`unexpected String()`, s)
+	}
+
+	rels, err = ParseRelations("  ")
+	if err != nil || rels != nil {
+		t.Error(`empty field must result in nil`, rels, err)
+	}
+
+	for _, s := range []string{
+		"a, , b",
+		"a |",
+		"a (>= )",
+		"a (~ 1)",
+		"a (>= 1",
+		"a [amd64",
+		"a []",
+		"a:",
+		"(>= 1)",
+		"a (>= 1) (<< 2)",
+		"a b",
+	} {
+		if _, err := ParseRelations(s); err == nil {
+			t.Error(`invalid relations must be an error`, s)
+		}
+	}
+}
+
+func TestParsePackage(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var pkgs []*Package
+	parser := NewParser(f)
+	for i := 0; i < 2; i++ {
+		d, err := parser.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ParsePackage(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, p)
+	}
+
+	p := pkgs[0]
+	if p.Package != "cybozu-abc" || p.Version != "0.2.2-1" || p.Architecture != "amd64" {
+		t.Error(`unexpected package`, p.Package, p.Version, p.Architecture)
+	}
+	if p.Size != 102369852 || p.Filename != "pool/c/cybozu-abc_0.2.2-1_amd64.deb" {
+		t.Error(`unexpected file`, p.Filename, p.Size)
+	}
+	if !reflect.DeepEqual(p.PreDepends, []Relation{{{Name: "adduser"}}}) {
+		t.Error(`unexpected Pre-Depends`, p.PreDepends)
+	}
+	if p.FileInfo().SHA256Path() != "pool/c/by-hash/SHA256/cebb641f03510c2c350ea2e94406c4c09708364fa296730e64ecdb1107b380b7" {
+		t.Error(`unexpected FileInfo`, p.FileInfo().SHA256Path())
+	}
+
+	p = pkgs[1]
+	if len(p.Depends) != 10 {
+		t.Error(`len(p.Depends) != 10`, len(p.Depends))
+	}
+	if d := p.Depends[1][0]; d.Name != "python-support" || d.Op != ">=" || d.Version != "0.90" {
+		t.Error(`unexpected dependency`, d)
+	}
+
+	// the third record misspells Package.
+	d, err := parser.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePackage(d); err == nil {
+		t.Error(`record without Package must be an error`)
+	}
+}
+
+func TestReadPackages(t *testing.T) {
+	t.Parallel()
+
+	pkgs, err := ReadPackages(strings.NewReader("Package: a\nVersion: 1\nFilename: a.deb\nSize: 1\n\nPackage: b\nVersion: 2\nFilename: b.deb\nSize: 2\nDepends: a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 2 || pkgs[1].Package != "b" || pkgs[1].Depends[0][0].Name != "a" {
+		t.Error(`unexpected packages`, pkgs)
+	}
+
+	_, err = ReadPackages(strings.NewReader("Package: a\nVersion: 1\nFilename: a.deb\nSize: 1\nDepends: b (>=\n"))
+	if err == nil {
+		t.Error(`invalid Depends must be an error`)
+	}
+	for _, s := range []string{
+		"Version: 1\nFilename: a.deb\nSize: 1\n",
+		"Package: a\nFilename: a.deb\nSize: 1\n",
+		"Package: a\nVersion: 1\nSize: 1\n",
+		"Package: a\nVersion: 1\nFilename: /a.deb\nSize: 1\n",
+		"Package: a\nVersion: 1\nFilename: a.deb\nSize: x\n",
+		"Package: a\nVersion: 1\nFilename: a.deb\nSize: 1\nSHA256: xyz\n",
+	} {
+		if _, err := ReadPackages(strings.NewReader(s)); err == nil {
+			t.Error(`invalid record must be an error`, s)
+		}
+	}
+}
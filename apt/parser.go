@@ -12,16 +12,26 @@ package apt
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 )
 
 const (
-	maxScanTokenSize = 1 * 1024 * 1024 // 1 MiB
-	startBufSize     = 4096            // Default buffer allocation size in bufio
+	startBufSize = 4096 // Default buffer allocation size in bufio
 )
 
+// MaxLineSize is the maximum length of a line that parsers created by
+// NewParser can read.  Some indices have enormous fields such as
+// Provides or Package-List.  Buffers grow only as needed, so a large
+// limit costs nothing for ordinary lines.
+//
+// This is used by ExtractFileInfo and others in this package.
+// Change it only before parsing starts.
+var MaxLineSize = 16 * 1024 * 1024 // 16 MiB
+
 // Paragraph is a mapping between field names and values.
 //
 // Values are a list of strings.  For simple fields, the list has only
@@ -29,86 +39,245 @@ const (
 // Folded fields are treated just the same as multiline fields.
 type Paragraph map[string][]string
 
+// Field is a field in RawParagraph.
+type Field struct {
+	// Name is the field name.  Empty for comment lines.
+	Name string
+
+	// Values are the same as values of Paragraph.  nil if the field
+	// has no value.
+	Values []string
+
+	// Raw is the exact bytes of the field including continuation
+	// lines and newlines.
+	Raw []byte
+}
+
+// RawParagraph is a paragraph that keeps the order of fields and
+// their exact bytes.  Concatenating Bytes of paragraphs returned by
+// Parser.ReadRaw reproduces the input except for PGP armor.
+type RawParagraph struct {
+	// Fields are fields and comment lines in order.
+	Fields []*Field
+
+	// Separator is the empty line that terminated the paragraph.
+	// Empty at the end of input.
+	Separator []byte
+}
+
+// Get returns values of the first field of name, or nil.
+func (rp *RawParagraph) Get(name string) []string {
+	for _, f := range rp.Fields {
+		if f.Name == name {
+			return f.Values
+		}
+	}
+	return nil
+}
+
+// Set replaces values of the first field of name, or appends a new
+// field.  The raw bytes of the field are formatted as Writer does.
+func (rp *RawParagraph) Set(name string, values []string) error {
+	if !validFieldName(name) {
+		return errors.New("invalid field name: " + name)
+	}
+	var buf bytes.Buffer
+	if err := writeField(&buf, name, values); err != nil {
+		return err
+	}
+	nf := &Field{Name: name, Values: values, Raw: buf.Bytes()}
+	for i, f := range rp.Fields {
+		if f.Name == name {
+			rp.Fields[i] = nf
+			return nil
+		}
+	}
+	rp.Fields = append(rp.Fields, nf)
+	return nil
+}
+
+// Paragraph returns rp as Paragraph.
+func (rp *RawParagraph) Paragraph() Paragraph {
+	d := make(Paragraph)
+	for _, f := range rp.Fields {
+		if f.Name == "" || f.Values == nil {
+			continue
+		}
+		d[f.Name] = append(d[f.Name], f.Values...)
+	}
+	return d
+}
+
+// Bytes returns the exact bytes of rp including the separator.
+func (rp *RawParagraph) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range rp.Fields {
+		buf.Write(f.Raw)
+	}
+	buf.Write(rp.Separator)
+	return buf.Bytes()
+}
+
 // Parser reads debian control file and return Paragraph one by one.
 //
 // PGP preambles and signatures are ignored if any.
 type Parser struct {
-	s         *bufio.Scanner
-	lastField string
-	err       error
-	isPGP     bool
+	r     *bufio.Reader
+	line  []byte
+	err   error
+	isPGP bool
+
+	maxLineSize int
 }
 
 // NewParser creates a parser from a io.Reader.
+// Lines longer than MaxLineSize result in an error.
 func NewParser(r io.Reader) *Parser {
-	p := &Parser{
-		s:     bufio.NewScanner(r),
-		isPGP: false,
+	return NewParserSize(r, MaxLineSize)
+}
+
+// NewParserSize creates a parser that can read lines up to
+// maxLineSize bytes.
+func NewParserSize(r io.Reader, maxLineSize int) *Parser {
+	return &Parser{
+		r:           bufio.NewReaderSize(r, startBufSize),
+		isPGP:       false,
+		maxLineSize: maxLineSize,
 	}
-	b := make([]byte, startBufSize)
-	p.s.Buffer(b, maxScanTokenSize)
-	return p
+}
+
+// readLine reads a line including the newline.  The returned slice
+// is valid until the next call.  io.EOF is returned only if no data
+// is left.
+func (p *Parser) readLine() ([]byte, error) {
+	p.line = p.line[:0]
+	for {
+		b, err := p.r.ReadSlice('\n')
+		p.line = append(p.line, b...)
+		if len(p.line) > p.maxLineSize+1 {
+			return nil, fmt.Errorf("line too long: exceeds %d bytes", p.maxLineSize)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(p.line) > 0:
+			return p.line, nil
+		}
+		return p.line, err
+	}
+}
+
+// text returns line without the trailing newline.
+func text(line []byte) string {
+	l := strings.TrimSuffix(string(line), "\n")
+	return strings.TrimSuffix(l, "\r")
 }
 
 // Read reads a paragraph.
 //
 // It returns io.EOF if no more paragraph can be read.
 func (p *Parser) Read() (Paragraph, error) {
+	rp, err := p.read(false)
+	if err != nil {
+		return nil, err
+	}
+	return rp.Paragraph(), nil
+}
+
+// ReadRaw reads a paragraph keeping the order and bytes of fields.
+//
+// It returns io.EOF if no more paragraph can be read.
+func (p *Parser) ReadRaw() (*RawParagraph, error) {
+	return p.read(true)
+}
+
+func (p *Parser) read(raw bool) (*RawParagraph, error) {
 	if p.err != nil {
 		return nil, p.err
 	}
 
-	ret := make(Paragraph)
+	rp := new(RawParagraph)
+	var last *Field
+	appendRaw := func(f *Field, line []byte) {
+		if raw {
+			f.Raw = append(f.Raw, line...)
+		}
+	}
+
 L:
-	for p.s.Scan() {
-		switch l := p.s.Text(); {
+	for {
+		line, err := p.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.err = err
+			return nil, err
+		}
+
+		switch l := text(line); {
 		case len(l) == 0:
+			if raw {
+				rp.Separator = append([]byte(nil), line...)
+			}
 			break L
 		case l[0] == '#':
+			if raw {
+				rp.Fields = append(rp.Fields, &Field{Raw: append([]byte(nil), line...)})
+			}
 			continue
 		case l == "-----BEGIN PGP SIGNED MESSAGE-----":
 			p.isPGP = true
-			for p.s.Scan() {
-				if l2 := p.s.Text(); len(l2) == 0 {
+			for {
+				line, err := p.readLine()
+				if err != nil || len(text(line)) == 0 {
 					break
 				}
 			}
 			continue
 		case p.isPGP && l == "-----BEGIN PGP SIGNATURE-----":
 			// skip to EOF
-			for p.s.Scan() {
+			for {
+				if _, err := p.readLine(); err != nil {
+					break
+				}
 			}
 			break L
 		case l[0] == ' ' || l[0] == '\t':
 			// multiline
-			if p.lastField == "" {
+			if last == nil {
 				p.err = errors.New("invalid line: " + l)
 				return nil, p.err
 			}
-			ret[p.lastField] = append(ret[p.lastField], strings.Trim(l, " \t"))
+			last.Values = append(last.Values, strings.Trim(l, " \t"))
+			appendRaw(last, line)
 		case strings.ContainsRune(l, ':'):
 			t := strings.SplitN(l, ":", 2)
-			k := t[0]
+			f := &Field{Name: t[0]}
 			v := strings.Trim(t[1], " \t")
-			p.lastField = k
-			if len(v) == 0 {
+			if len(v) > 0 {
 				// ignore empty value field
-				continue
+				f.Values = []string{v}
 			}
-			ret[k] = append(ret[k], v)
+			appendRaw(f, line)
+			rp.Fields = append(rp.Fields, f)
+			last = f
 		default:
 			p.err = errors.New("invalid line: " + l)
 			return nil, p.err
 		}
 	}
-	p.lastField = ""
-	if err := p.s.Err(); err != nil {
-		p.err = err
-	} else if len(ret) == 0 {
-		p.err = io.EOF
+
+	empty := true
+	for _, f := range rp.Fields {
+		if f.Name != "" && f.Values != nil {
+			empty = false
+			break
+		}
 	}
-	if p.err != nil {
+	if empty {
+		p.err = io.EOF
 		return nil, p.err
 	}
-	return ret, nil
+	return rp, nil
 }
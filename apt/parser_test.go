@@ -1,8 +1,12 @@
 package apt
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -178,3 +182,101 @@ func TestParserPackages(t *testing.T) {
 		t.Error(`err != io.EOF`)
 	}
 }
+
+func TestParserLongLine(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("a, ", 1024*1024)
+	data := "Package: a\nProvides: " + long + "\n"
+
+	d, err := NewParser(strings.NewReader(data)).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d["Provides"][0]) != len(strings.TrimSpace(long)) {
+		t.Error(`unexpected Provides length`, len(d["Provides"][0]))
+	}
+
+	_, err = NewParserSize(strings.NewReader(data), 1024).Read()
+	if err == nil {
+		t.Fatal(`too long line must be an error`)
+	}
+	if !strings.Contains(err.Error(), "line too long") {
+		t.Error(`unclear error`, err)
+	}
+}
+
+func TestParserReadRaw(t *testing.T) {
+	t.Parallel()
+
+	for _, fname := range []string{"testdata/af/Release", "testdata/af/Packages"} {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		p := NewParser(bytes.NewReader(data))
+		for {
+			rp, err := p.ReadRaw()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.Write(rp.Bytes())
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Error(`ReadRaw must reproduce the input`, fname)
+		}
+	}
+
+	data := "Package: a\r\n# comment\r\nDescription:  short\r\n long\r\nEmpty:\r\nVersion: 1\r\n\r\nPackage: b\n"
+	p := NewParser(strings.NewReader(data))
+	rp, err := p.ReadRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range rp.Fields {
+		names = append(names, f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Package", "", "Description", "Empty", "Version"}) {
+		t.Error(`unexpected field order`, names)
+	}
+	if string(rp.Fields[2].Raw) != "Description:  short\r\n long\r\n" {
+		t.Errorf("unexpected raw bytes: %q", rp.Fields[2].Raw)
+	}
+	if !reflect.DeepEqual(rp.Get("Description"), []string{"short", "long"}) || rp.Get("Empty") != nil {
+		t.Error(`unexpected values`, rp.Get("Description"), rp.Get("Empty"))
+	}
+	d := rp.Paragraph()
+	if _, ok := d["Empty"]; ok || len(d) != 3 {
+		t.Error(`unexpected paragraph`, d)
+	}
+
+	if err := rp.Set("Version", []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Set("Architecture", []string{"all"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Set("Bad Name", []string{"x"}); err == nil {
+		t.Error(`invalid field name must be an error`)
+	}
+	expected := "Package: a\r\n# comment\r\nDescription:  short\r\n long\r\nEmpty:\r\nVersion: 2\nArchitecture: all\n\r\n"
+	if string(rp.Bytes()) != expected {
+		t.Errorf("unexpected bytes after Set: %q", rp.Bytes())
+	}
+
+	rp, err = p.ReadRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rp.Bytes()) != "Package: b\n" || rp.Separator != nil {
+		t.Errorf("unexpected last paragraph: %q", rp.Bytes())
+	}
+	if _, err := p.ReadRaw(); err != io.EOF {
+		t.Error(`err != io.EOF`, err)
+	}
+}
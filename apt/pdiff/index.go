@@ -0,0 +1,186 @@
+package pdiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/pkg/errors"
+)
+
+// ErrNoPatch is returned by Index.Update when the index to be updated
+// is not found in the history.
+var ErrNoPatch = errors.New("no patch for the index")
+
+// Entry is a line of SHA256 fields in Index.
+type Entry struct {
+	SHA256 []byte
+	Size   uint64
+
+	// Name is the name of the patch.  Empty for SHA256-Current.
+	Name string
+}
+
+// Index represents Packages.diff/Index.
+type Index struct {
+	// Current is the checksum of the latest index.
+	Current Entry
+
+	// History is the list of checksums of old indices.
+	// Patch Name is to be applied to the index of the entry.
+	History []Entry
+
+	// Patches is the list of checksums of uncompressed patches.
+	Patches []Entry
+
+	// Download is the list of checksums of compressed patches
+	// whose names have compression extensions such as ".gz".
+	Download []Entry
+
+	// Merged is true if X-Patch-Precedence is "merged".  Merged
+	// patches update old indices directly to the latest one.
+	Merged bool
+}
+
+func parseEntry(l string, named bool) (Entry, error) {
+	var e Entry
+	t := strings.Fields(l)
+	if (named && len(t) != 3) || (!named && len(t) != 2) {
+		return e, errors.New("invalid line: " + l)
+	}
+	sum, err := hex.DecodeString(t[0])
+	if err != nil || len(sum) != sha256.Size {
+		return e, errors.New("invalid checksum: " + l)
+	}
+	size, err := strconv.ParseUint(t[1], 10, 64)
+	if err != nil {
+		return e, errors.New("invalid size: " + l)
+	}
+	e.SHA256 = sum
+	e.Size = size
+	if named {
+		e.Name = t[2]
+		if strings.ContainsRune(e.Name, '/') {
+			return e, errors.New("invalid patch name: " + l)
+		}
+	}
+	return e, nil
+}
+
+// ParseIndex parses Packages.diff/Index and the like.
+func ParseIndex(r io.Reader) (*Index, error) {
+	d, err := apt.NewParser(r).Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "parser.Read")
+	}
+
+	idx := &Index{
+		Merged: strings.Join(d["X-Patch-Precedence"], "") == "merged",
+	}
+	cur := d["SHA256-Current"]
+	if len(cur) != 1 {
+		return nil, errors.New("no SHA256-Current")
+	}
+	idx.Current, err = parseEntry(cur[0], false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []struct {
+		name    string
+		entries *[]Entry
+	}{
+		{"SHA256-History", &idx.History},
+		{"SHA256-Patches", &idx.Patches},
+		{"SHA256-Download", &idx.Download},
+	} {
+		for _, l := range d[f.name] {
+			e, err := parseEntry(l, true)
+			if err != nil {
+				return nil, errors.Wrap(err, f.name)
+			}
+			*f.entries = append(*f.entries, e)
+		}
+	}
+	return idx, nil
+}
+
+// verify checks data against the checksum and size of e.
+func verify(data []byte, e Entry) bool {
+	sum := sha256.Sum256(data)
+	return uint64(len(data)) == e.Size && bytes.Equal(sum[:], e.SHA256)
+}
+
+func find(entries []Entry, name string) (Entry, bool) {
+	for _, e := range entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Update updates the decompressed index data to the latest one.
+//
+// fetch should return the uncompressed contents of the named patch.
+// Patches and intermediate results are verified by their SHA256
+// checksums.  If data is already the latest, it is returned as is.
+// ErrNoPatch is returned if data is not found in the history.
+func (idx *Index) Update(data []byte, fetch func(name string) (io.ReadCloser, error)) ([]byte, error) {
+	if verify(data, idx.Current) {
+		return data, nil
+	}
+
+	start := -1
+	for i, e := range idx.History {
+		if verify(data, e) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, ErrNoPatch
+	}
+
+	chain := idx.History[start:]
+	if idx.Merged {
+		chain = chain[:1]
+	}
+	for i, h := range chain {
+		pe, ok := find(idx.Patches, h.Name)
+		if !ok {
+			return nil, errors.New("no checksum for patch " + h.Name)
+		}
+		rc, err := fetch(h.Name)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetch "+h.Name)
+		}
+		patch, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "fetch "+h.Name)
+		}
+		if !verify(patch, pe) {
+			return nil, errors.New("checksum mismatch for patch " + h.Name)
+		}
+
+		data, err = Apply(data, bytes.NewReader(patch))
+		if err != nil {
+			return nil, errors.Wrap(err, h.Name)
+		}
+
+		target := idx.Current
+		if i+1 < len(chain) {
+			target = chain[i+1]
+		}
+		if !verify(data, target) {
+			return nil, errors.New("checksum mismatch after applying " + h.Name)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,142 @@
+package pdiff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func testLine(data, name string) string {
+	sum := sha256.Sum256([]byte(data))
+	return strings.TrimSpace(fmt.Sprintf("%s %d %s", hex.EncodeToString(sum[:]), len(data), name))
+}
+
+const (
+	testV1 = "a\nb\nc\n"
+	testV2 = "a\nB\nc\n"
+	testV3 = "a\nB\nc\nd\n"
+
+	testPatch1 = "2c\nB\n.\n"
+	testPatch2 = "3a\nd\n.\n"
+	testMerged = "3a\nd\n.\n2c\nB\n.\n"
+)
+
+func testIndex(merged bool) string {
+	s := "SHA256-Current: " + testLine(testV3, "") + "\n"
+	if merged {
+		s += "X-Patch-Precedence: merged\n"
+		s += "SHA256-History:\n " + testLine(testV1, "T-1") + "\n " + testLine(testV2, "T-2") + "\n"
+		s += "SHA256-Patches:\n " + testLine(testMerged, "T-1") + "\n " + testLine(testPatch2, "T-2") + "\n"
+		return s
+	}
+	s += "SHA256-History:\n " + testLine(testV1, "T-1") + "\n " + testLine(testV2, "T-2") + "\n"
+	s += "SHA256-Patches:\n " + testLine(testPatch1, "T-1") + "\n " + testLine(testPatch2, "T-2") + "\n"
+	s += "SHA256-Download:\n " + testLine("x", "T-1.gz") + "\n " + testLine("y", "T-2.gz") + "\n"
+	return s
+}
+
+func testFetch(patches map[string]string) func(string) (io.ReadCloser, error) {
+	return func(name string) (io.ReadCloser, error) {
+		p, ok := patches[name]
+		if !ok {
+			return nil, errors.New("not found: " + name)
+		}
+		return ioutil.NopCloser(strings.NewReader(p)), nil
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	t.Parallel()
+
+	idx, err := ParseIndex(strings.NewReader(testIndex(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Merged {
+		t.Error(`idx.Merged`)
+	}
+	if idx.Current.Size != uint64(len(testV3)) || idx.Current.Name != "" {
+		t.Error(`unexpected Current`, idx.Current)
+	}
+	if len(idx.History) != 2 || idx.History[1].Name != "T-2" || idx.History[1].Size != uint64(len(testV2)) {
+		t.Error(`unexpected History`, idx.History)
+	}
+	if len(idx.Patches) != 2 || len(idx.Download) != 2 || idx.Download[0].Name != "T-1.gz" {
+		t.Error(`unexpected Patches or Download`, idx.Patches, idx.Download)
+	}
+
+	idx, err = ParseIndex(strings.NewReader(testIndex(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Merged {
+		t.Error(`!idx.Merged`)
+	}
+
+	for _, s := range []string{
+		"SHA256-History:\n " + testLine(testV1, "T-1") + "\n",
+		"SHA256-Current: xyz 1\n",
+		"SHA256-Current: " + testLine(testV1, "T-1") + "\n",
+		"SHA256-Current: " + testLine(testV1, "") + "\nSHA256-Patches:\n " + testLine(testV1, "") + "\n",
+		"SHA256-Current: " + testLine(testV1, "") + "\nSHA256-Patches:\n " + testLine(testV1, "../T-1") + "\n",
+	} {
+		if _, err := ParseIndex(strings.NewReader(s)); err == nil {
+			t.Errorf("invalid index must be an error: %q", s)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	idx, err := ParseIndex(strings.NewReader(testIndex(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := testFetch(map[string]string{"T-1": testPatch1, "T-2": testPatch2})
+
+	for _, v := range []string{testV1, testV2, testV3} {
+		data, err := idx.Update([]byte(v), fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != testV3 {
+			t.Errorf("unexpected result: %q", data)
+		}
+	}
+
+	_, err = idx.Update([]byte("x\n"), fetch)
+	if err != ErrNoPatch {
+		t.Error(`err != ErrNoPatch`, err)
+	}
+
+	// a patch not matching its checksum
+	_, err = idx.Update([]byte(testV1), testFetch(map[string]string{"T-1": testPatch2, "T-2": testPatch2}))
+	if err == nil {
+		t.Error(`corrupt patch must be an error`)
+	}
+
+	// an intermediate result not matching History
+	idx.History[1].SHA256 = idx.Current.SHA256
+	_, err = idx.Update([]byte(testV1), fetch)
+	if err == nil {
+		t.Error(`intermediate checksum mismatch must be an error`)
+	}
+
+	idx, err = ParseIndex(strings.NewReader(testIndex(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := idx.Update([]byte(testV1), testFetch(map[string]string{"T-1": testMerged}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testV3 {
+		t.Errorf("unexpected result: %q", data)
+	}
+}
@@ -0,0 +1,188 @@
+// Package pdiff implements APT pdiff, incremental updates of indices
+// with ed-style patches listed in Packages.diff/Index.
+//
+// https://wiki.debian.org/DebianRepository/Format#Diffs
+package pdiff
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/pkg/errors"
+)
+
+const (
+	startBufSize  = 4096
+	maxPatchLines = 1 << 24
+)
+
+// hunk is a command in a patch.  Lines from start to end, inclusive,
+// are replaced with lines.  For appends, end is start-1 and lines are
+// inserted after line end.
+type hunk struct {
+	start, end int
+	lines      [][]byte
+}
+
+// parseAddress parses "N" or "N,M".
+func parseAddress(s string) (int, int, error) {
+	t := strings.SplitN(s, ",", 2)
+	start, err := strconv.Atoi(t[0])
+	if err != nil || start < 0 {
+		return 0, 0, errors.New("invalid address: " + s)
+	}
+	end := start
+	if len(t) == 2 {
+		end, err = strconv.Atoi(t[1])
+		if err != nil || end < start {
+			return 0, 0, errors.New("invalid address: " + s)
+		}
+	}
+	return start, end, nil
+}
+
+// parsePatch parses an ed-style patch produced by "diff --ed".
+//
+// Supported commands are "Na", "N[,M]c", "N[,M]d", and "s/.//".
+// "s/.//" replaces the last inserted line ".." with ".", and a
+// following "a" without address continues the previous insertion.
+// This is how diff --ed writes a line consisting of a single dot.
+func parsePatch(r io.Reader) ([]*hunk, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, startBufSize), apt.MaxLineSize)
+
+	var hunks []*hunk
+	var last *hunk
+	nlines := 0
+	readLines := func(h *hunk) error {
+		for s.Scan() {
+			l := s.Bytes()
+			if len(l) == 1 && l[0] == '.' {
+				return nil
+			}
+			nlines++
+			if nlines > maxPatchLines {
+				return errors.New("too many lines in patch")
+			}
+			h.lines = append(h.lines, append([]byte(nil), l...))
+		}
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return errors.New("unterminated text in patch")
+	}
+
+	for s.Scan() {
+		l := s.Text()
+		if l == "" {
+			return nil, errors.New("empty command in patch")
+		}
+
+		switch {
+		case l == "s/.//":
+			if last == nil || len(last.lines) == 0 || !bytes.Equal(last.lines[len(last.lines)-1], []byte("..")) {
+				return nil, errors.New("s/.// without preceding ..")
+			}
+			last.lines[len(last.lines)-1] = []byte(".")
+			continue
+		case l == "a":
+			if last == nil {
+				return nil, errors.New("a without address")
+			}
+			if err := readLines(last); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		cmd := l[len(l)-1]
+		start, end, err := parseAddress(l[:len(l)-1])
+		if err != nil {
+			return nil, err
+		}
+		h := &hunk{start: start, end: end}
+		switch cmd {
+		case 'a':
+			if start != end {
+				return nil, errors.New("invalid command: " + l)
+			}
+			h.start = start + 1
+			if err := readLines(h); err != nil {
+				return nil, err
+			}
+		case 'c':
+			if start == 0 {
+				return nil, errors.New("invalid command: " + l)
+			}
+			if err := readLines(h); err != nil {
+				return nil, err
+			}
+		case 'd':
+			if start == 0 {
+				return nil, errors.New("invalid command: " + l)
+			}
+		default:
+			return nil, errors.New("unsupported command: " + l)
+		}
+		hunks = append(hunks, h)
+		last = h
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return hunks, nil
+}
+
+// splitLines splits data into lines including newlines.
+// The last line may lack a newline.
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, data)
+			break
+		}
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// Apply applies an ed-style patch to src and returns the result.
+//
+// Commands are applied in order as ed does.  Patches in pdiff
+// modify lines from the end to the beginning.
+func Apply(src []byte, patch io.Reader) ([]byte, error) {
+	hunks, err := parsePatch(patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsePatch")
+	}
+
+	lines := splitLines(src)
+	if n := len(lines); n > 0 && !bytes.HasSuffix(lines[n-1], []byte("\n")) {
+		return nil, errors.New("no newline at end of file")
+	}
+	for _, h := range hunks {
+		if h.end > len(lines) {
+			return nil, errors.Errorf("line %d is out of range", h.end)
+		}
+		ins := make([][]byte, len(h.lines))
+		for i, l := range h.lines {
+			ins[i] = append(l, '\n')
+		}
+		// lines[h.start-1:h.end] are replaced with ins.
+		tail := append(ins, lines[h.end:]...)
+		lines = append(lines[:h.start-1], tail...)
+	}
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.Write(l)
+	}
+	return buf.Bytes(), nil
+}
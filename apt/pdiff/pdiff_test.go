@@ -0,0 +1,59 @@
+package pdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+
+	// generated by diff --ed.
+	patch := "5a\nf\n.\n4d\n2c\nX\n..\n.\ns/.//\na\nY\n.\n"
+	data, err := Apply([]byte("a\nb\nc\nd\ne\n"), strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a\nX\n.\nY\nc\ne\nf\n" {
+		t.Errorf("unexpected result: %q", data)
+	}
+
+	data, err = Apply([]byte("a\nb\n"), strings.NewReader("0a\nz\n.\n1,2d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "b\n" {
+		t.Errorf("unexpected result: %q", data)
+	}
+
+	data, err = Apply(nil, strings.NewReader("0a\nz\n.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "z\n" {
+		t.Errorf("unexpected result: %q", data)
+	}
+
+	for _, p := range []string{
+		"3d\n",
+		"2,3c\nx\n.\n",
+		"0d\n",
+		"0c\nx\n.\n",
+		"1,2a\nx\n.\n",
+		"2,1d\n",
+		"1c\nx\n",
+		"1x\n",
+		"\n",
+		"a\nx\n.\n",
+		"s/.//\n",
+		"1c\nx\n.\ns/.//\n",
+	} {
+		if _, err := Apply([]byte("a\nb\n"), strings.NewReader(p)); err == nil {
+			t.Errorf("invalid patch must be an error: %q", p)
+		}
+	}
+
+	if _, err := Apply([]byte("a\nb"), strings.NewReader("1d\n")); err == nil {
+		t.Error(`data without the last newline must be an error`)
+	}
+}
@@ -0,0 +1,88 @@
+package apt
+
+// This file implements parsing of time fields in Release.
+// https://wiki.debian.org/DebianRepository/Format#Date.2C_Valid-Until
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// releaseTimeLayouts are layouts of Date and Valid-Until.  The first
+// is the standard one.  Others are found in the wild.
+var releaseTimeLayouts = []string{
+	"Mon, 02 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 02 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"02 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 MST",
+	"02 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"Monday, 02-Jan-06 15:04:05 MST",
+	"Mon Jan 2 15:04:05 2006",
+}
+
+// ParseReleaseTime parses the value of Date or Valid-Until field in
+// Release such as "Sat, 01 Jan 2022 00:00:00 UTC".
+//
+// Numeric time zones, single-digit days, missing weekdays, and
+// RFC 850 or asctime formats are also accepted.  Time zone names
+// other than UTC and GMT are rejected because they are ambiguous.
+// The result is in UTC.
+func ParseReleaseTime(s string) (time.Time, error) {
+	// asctime pads single-digit days with a space.
+	s = strings.Join(strings.Fields(s), " ")
+	err := errors.New("invalid time: " + s)
+	for _, layout := range releaseTimeLayouts {
+		t, perr := time.Parse(layout, s)
+		if perr != nil {
+			continue
+		}
+		if strings.HasSuffix(layout, "MST") {
+			// names are parsed as zones with unknown offsets.
+			if zone, _ := t.Zone(); zone != "UTC" && zone != "GMT" {
+				err = errors.New("ambiguous time zone: " + s)
+				continue
+			}
+		}
+		return t.UTC(), nil
+	}
+	return time.Time{}, err
+}
+
+// ReleaseDate returns the time of Date field in Release paragraph d.
+func ReleaseDate(d Paragraph) (time.Time, error) {
+	v := field(d, "Date")
+	if v == "" {
+		return time.Time{}, errors.New("no Date")
+	}
+	return ParseReleaseTime(v)
+}
+
+// ReleaseValidUntil returns the time of Valid-Until field in Release
+// paragraph d.  The second return value is false if the field is
+// absent, which means Release never expires.
+func ReleaseValidUntil(d Paragraph) (time.Time, bool, error) {
+	v := field(d, "Valid-Until")
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := ParseReleaseTime(v)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// ReleaseExpired returns true if Valid-Until of Release paragraph d
+// is before now.  An invalid Valid-Until is treated as expired.
+func ReleaseExpired(d Paragraph, now time.Time) bool {
+	t, ok, err := ReleaseValidUntil(d)
+	if err != nil {
+		return true
+	}
+	return ok && t.Before(now)
+}
@@ -0,0 +1,93 @@
+package apt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReleaseTime(t *testing.T) {
+	t.Parallel()
+
+	expected := time.Date(2022, 1, 1, 12, 34, 56, 0, time.UTC)
+	for _, s := range []string{
+		"Sat, 01 Jan 2022 12:34:56 UTC",
+		"Sat, 1 Jan 2022 12:34:56 UTC",
+		"Sat, 01 Jan 2022 12:34:56 GMT",
+		"Sat, 01 Jan 2022 12:34:56 +0000",
+		"Sat, 01 Jan 2022 21:34:56 +0900",
+		"Sat,  01 Jan 2022 12:34:56 UTC",
+		"01 Jan 2022 12:34:56 UTC",
+		"1 Jan 2022 13:34:56 +0100",
+		"Saturday, 01-Jan-22 12:34:56 GMT",
+		"Sat Jan  1 12:34:56 2022",
+	} {
+		tm, err := ParseReleaseTime(s)
+		if err != nil {
+			t.Errorf("ParseReleaseTime(%q) failed: %v", s, err)
+			continue
+		}
+		if !tm.Equal(expected) || tm.Location() != time.UTC {
+			t.Errorf("ParseReleaseTime(%q) = %v", s, tm)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"2022-01-01T12:34:56Z",
+		"Sat, 01 Jan 2022 12:34:56 JST",
+		"Sat, 32 Jan 2022 12:34:56 UTC",
+		"Sat, 01 Jan 2022",
+	} {
+		if _, err := ParseReleaseTime(s); err == nil {
+			t.Errorf("ParseReleaseTime(%q) must fail", s)
+		}
+	}
+}
+
+func TestReleaseDate(t *testing.T) {
+	t.Parallel()
+
+	d := Paragraph{
+		"Date":        {"Sat, 01 Jan 2022 00:00:00 UTC"},
+		"Valid-Until": {"Sat, 08 Jan 2022 00:00:00 UTC"},
+	}
+	date, err := ReleaseDate(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error(`unexpected Date`, date)
+	}
+	until, ok, err := ReleaseValidUntil(d)
+	if err != nil || !ok {
+		t.Fatal(`ReleaseValidUntil failed`, ok, err)
+	}
+	if !until.Equal(time.Date(2022, 1, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Error(`unexpected Valid-Until`, until)
+	}
+	if ReleaseExpired(d, time.Date(2022, 1, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Error(`Release must not be expired before Valid-Until`)
+	}
+	if !ReleaseExpired(d, time.Date(2022, 1, 9, 0, 0, 0, 0, time.UTC)) {
+		t.Error(`Release must be expired after Valid-Until`)
+	}
+
+	d = Paragraph{}
+	if _, err := ReleaseDate(d); err == nil {
+		t.Error(`missing Date must be an error`)
+	}
+	if _, ok, err := ReleaseValidUntil(d); ok || err != nil {
+		t.Error(`missing Valid-Until must not be an error`, ok, err)
+	}
+	if ReleaseExpired(d, time.Now()) {
+		t.Error(`Release without Valid-Until never expires`)
+	}
+	if !ReleaseExpired(Paragraph{"Valid-Until": {"soon"}}, time.Now()) {
+		t.Error(`invalid Valid-Until must be treated as expired`)
+	}
+
+	f, err := ParseReleaseTime("Fri, 03 Jun 2016 00:38:19 UTC")
+	if err != nil || f.Year() != 2016 {
+		t.Error(`testdata Date must be parsed`, f, err)
+	}
+}
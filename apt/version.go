@@ -0,0 +1,179 @@
+package apt
+
+// This file implements Debian package versions compatible with dpkg.
+// https://www.debian.org/doc/debian-policy/ch-controlfields.html#version
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is a Debian package version "[epoch:]upstream[-revision]".
+type Version struct {
+	Epoch    uint64
+	Upstream string
+	Revision string
+}
+
+// ParseVersion parses a version string.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	orig := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return v, errors.New("empty version")
+	}
+
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		epoch, err := strconv.ParseUint(s[:i], 10, 32)
+		if err != nil {
+			return v, errors.New("invalid epoch: " + orig)
+		}
+		v.Epoch = epoch
+		s = s[i+1:]
+	}
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		v.Revision = s[i+1:]
+		s = s[:i]
+		if v.Revision == "" {
+			return v, errors.New("empty revision: " + orig)
+		}
+	}
+	v.Upstream = s
+	if v.Upstream == "" {
+		return v, errors.New("empty upstream version: " + orig)
+	}
+
+	for _, c := range []byte(v.Upstream) {
+		if !isAlnum(c) && !strings.ContainsRune(".+~-:", rune(c)) {
+			return v, errors.New("invalid character in upstream version: " + orig)
+		}
+	}
+	for _, c := range []byte(v.Revision) {
+		if !isAlnum(c) && !strings.ContainsRune(".+~", rune(c)) {
+			return v, errors.New("invalid character in revision: " + orig)
+		}
+	}
+	return v, nil
+}
+
+// String returns the version string.  The epoch is omitted if zero.
+func (v Version) String() string {
+	s := v.Upstream
+	if v.Epoch > 0 || strings.IndexByte(s, ':') >= 0 {
+		s = strconv.FormatUint(v.Epoch, 10) + ":" + s
+	}
+	if v.Revision != "" {
+		s += "-" + v.Revision
+	}
+	return s
+}
+
+// Compare returns -1, 0, or 1 if v is older than, equal to, or newer
+// than w, respectively, in the same way as dpkg.
+func (v Version) Compare(w Version) int {
+	switch {
+	case v.Epoch < w.Epoch:
+		return -1
+	case v.Epoch > w.Epoch:
+		return 1
+	}
+	if c := verrevcmp(v.Upstream, w.Upstream); c != 0 {
+		return c
+	}
+	return verrevcmp(v.Revision, w.Revision)
+}
+
+// CompareVersions parses and compares version strings a and b.
+// See Version.Compare.
+func CompareVersions(a, b string) (int, error) {
+	va, err := ParseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := ParseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// versionOrder returns the weight of c in non-digit parts of versions.
+// '~' sorts before anything, even the end of a part.  0 is for the end.
+func versionOrder(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case isAlnum(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// verrevcmp compares upstream versions or revisions as dpkg does.
+func verrevcmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = versionOrder(a[i])
+			}
+			if j < len(b) {
+				bc = versionOrder(b[j])
+			}
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
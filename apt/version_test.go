@@ -0,0 +1,98 @@
+package apt
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	t.Parallel()
+
+	v, err := ParseVersion("2:1.0-rc1-3ubuntu1~18.04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Epoch != 2 || v.Upstream != "1.0-rc1" || v.Revision != "3ubuntu1~18.04" {
+		t.Errorf("unexpected version: %#v", v)
+	}
+	if v.String() != "2:1.0-rc1-3ubuntu1~18.04" {
+		t.Error(`unexpected String()`, v.String())
+	}
+
+	v, err = ParseVersion("1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Epoch != 0 || v.Upstream != "1.2.3" || v.Revision != "" {
+		t.Errorf("unexpected version: %#v", v)
+	}
+	if v.String() != "1.2.3" {
+		t.Error(`unexpected String()`, v.String())
+	}
+
+	for _, s := range []string{
+		"",
+		":1.0",
+		"a:1.0",
+		"-1:1.0",
+		"1:",
+		"-1",
+		"1.0-",
+		"1.0 1",
+		"1.0_1",
+		"1.0-1:2",
+	} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Error(`invalid version must be an error`, s)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.010", "1.10", 0},
+		{"1:0.1", "2.0", 1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0+", "1.0.", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"1.0-1~bpo1", "1.0-1", -1},
+		{"2.30-0ubuntu2", "2.30-0ubuntu10", -1},
+		{"7.6p2-4", "7.6-0", 1},
+		{"1.0.0", "1.0", 1},
+		{"a", "b", -1},
+	}
+	for _, c := range cases {
+		n, err := CompareVersions(c.a, c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != c.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", c.a, c.b, n, c.expected)
+		}
+		n, err = CompareVersions(c.b, c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != -c.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", c.b, c.a, n, -c.expected)
+		}
+	}
+
+	if _, err := CompareVersions("1.0", "1:"); err == nil {
+		t.Error(`invalid version must be an error`)
+	}
+}
@@ -0,0 +1,185 @@
+package apt
+
+// This file implements a debian control file writer.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Field orders for Writer.  These follow apt-ftparchive and dpkg.
+var (
+	ReleaseFieldOrder = []string{
+		"Origin", "Label", "Suite", "Version", "Codename", "Changelogs",
+		"Date", "Valid-Until", "NotAutomatic", "ButAutomaticUpgrades",
+		"Acquire-By-Hash", "Architectures", "Components", "Description",
+		"MD5Sum", "SHA1", "SHA256", "SHA512",
+	}
+
+	PackagesFieldOrder = []string{
+		"Package", "Package-Type", "Architecture", "Version", "Multi-Arch",
+		"Priority", "Essential", "Section", "Origin", "Installed-Size",
+		"Maintainer", "Original-Maintainer", "Bugs", "Source",
+		"Replaces", "Provides", "Depends", "Pre-Depends", "Recommends",
+		"Suggests", "Breaks", "Conflicts", "Enhances", "Built-Using",
+		"Filename", "Size", "MD5sum", "SHA1", "SHA256", "SHA512",
+		"Description", "Description-md5", "Homepage", "Tag", "Task",
+	}
+
+	SourcesFieldOrder = []string{
+		"Package", "Format", "Binary", "Architecture", "Version",
+		"Priority", "Section", "Maintainer", "Uploaders", "Homepage",
+		"Standards-Version", "Build-Depends", "Build-Depends-Indep",
+		"Build-Depends-Arch", "Build-Conflicts", "Build-Conflicts-Indep",
+		"Build-Conflicts-Arch", "Testsuite", "Vcs-Browser", "Vcs-Git",
+		"Directory", "Package-List", "Files", "Checksums-Sha1",
+		"Checksums-Sha256", "Checksums-Sha512",
+	}
+
+	SourcesListFieldOrder = []string{
+		"Types", "URIs", "Suites", "Components", "Architectures",
+		"Languages", "Targets", "Trusted", "Signed-By", "Enabled",
+	}
+)
+
+// listFields are multiline fields whose first line is empty.
+// Parser does not keep empty first lines, so Writer needs to know them.
+// Some of them are simple fields in other files, e.g. SHA256 in
+// Packages, so a single value without spaces is written in one line.
+var listFields = map[string]bool{
+	"MD5Sum":           true,
+	"SHA1":             true,
+	"SHA256":           true,
+	"SHA512":           true,
+	"Files":            true,
+	"Checksums-Sha1":   true,
+	"Checksums-Sha256": true,
+	"Checksums-Sha512": true,
+	"Package-List":     true,
+	"Conffiles":        true,
+	"SHA1-History":     true,
+	"SHA1-Patches":     true,
+	"SHA1-Download":    true,
+	"SHA256-History":   true,
+	"SHA256-Patches":   true,
+	"SHA256-Download":  true,
+}
+
+// Writer writes Paragraph as debian control file stanzas.
+//
+// Fields listed in the order given to NewWriter come first in that
+// order.  Other fields follow in lexical order.  Multiline values are
+// folded with a leading space, and empty lines are written as " .".
+type Writer struct {
+	w     io.Writer
+	order map[string]int
+	n     int
+}
+
+// NewWriter creates a writer.  order may be nil.
+func NewWriter(w io.Writer, order []string) *Writer {
+	m := make(map[string]int, len(order))
+	for i, f := range order {
+		m[f] = i
+	}
+	return &Writer{w: w, order: m}
+}
+
+func validFieldName(name string) bool {
+	if name == "" || name[0] == '#' || name[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c >= 0x7f || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes a paragraph.  Paragraphs are separated by an empty line.
+// Fields without values are omitted.
+func (w *Writer) Write(d Paragraph) error {
+	keys := make([]string, 0, len(d))
+	for k, v := range d {
+		if !validFieldName(k) {
+			return errors.New("invalid field name: " + k)
+		}
+		if len(v) == 0 {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return errors.New("empty paragraph")
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		oi, iok := w.order[keys[i]]
+		oj, jok := w.order[keys[j]]
+		switch {
+		case iok && jok:
+			return oi < oj
+		case iok != jok:
+			return iok
+		}
+		return keys[i] < keys[j]
+	})
+
+	var buf bytes.Buffer
+	if w.n > 0 {
+		buf.WriteByte('\n')
+	}
+	for _, k := range keys {
+		if err := writeField(&buf, k, d[k]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.n++
+	return nil
+}
+
+// writeField writes a field of name k with values v to buf.
+func writeField(buf *bytes.Buffer, k string, v []string) error {
+	if len(v) == 0 {
+		return errors.New("no value in " + k)
+	}
+	buf.WriteString(k)
+	buf.WriteByte(':')
+	if listFields[k] && (len(v) > 1 || strings.ContainsAny(v[0], " \t")) {
+		buf.WriteByte('\n')
+	} else {
+		if strings.ContainsAny(v[0], "\r\n") {
+			return errors.New("newline in " + k)
+		}
+		first := strings.TrimSpace(v[0])
+		if first == "" && len(v) == 1 {
+			return errors.New("empty value in " + k)
+		}
+		if first != "" {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(first)
+		buf.WriteByte('\n')
+		v = v[1:]
+	}
+	for _, l := range v {
+		if strings.ContainsAny(l, "\r\n") {
+			return errors.New("newline in " + k)
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			l = "."
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+	return nil
+}
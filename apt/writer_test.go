@@ -0,0 +1,113 @@
+package apt
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, PackagesFieldOrder)
+	err := w.Write(Paragraph{
+		"Zzz":         {"last"},
+		"Description": {"short", "long line", "", "after an empty line"},
+		"Version":     {"1.0"},
+		"Package":     {"a"},
+		"Aaa":         {"unknown"},
+		"Empty":       nil,
+		"SHA256":      {"abc"},
+		"Files":       {"abc 1 a.dsc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(Paragraph{"Package": {"b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `Package: a
+Version: 1.0
+SHA256: abc
+Description: short
+ long line
+ .
+ after an empty line
+Aaa: unknown
+Files:
+ abc 1 a.dsc
+Zzz: last
+
+Package: b
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	for _, d := range []Paragraph{
+		{},
+		{"Empty": nil},
+		{"Bad:Name": {"a"}},
+		{"Bad Name": {"a"}},
+		{"#Comment": {"a"}},
+		{"Package": {"a\nb"}},
+		{"Description": {"a", "b\n"}},
+		{"Package": {" "}},
+	} {
+		if err := NewWriter(&buf, nil).Write(d); err == nil {
+			t.Error(`invalid paragraph must be an error`, d)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, fname := range []string{"testdata/af/Release", "testdata/af/Packages"} {
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var orig []Paragraph
+		parser := NewParser(f)
+		for {
+			d, err := parser.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			orig = append(orig, d)
+		}
+		f.Close()
+
+		var buf bytes.Buffer
+		w := NewWriter(&buf, nil)
+		for _, d := range orig {
+			if err := w.Write(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var written []Paragraph
+		parser = NewParser(&buf)
+		for {
+			d, err := parser.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, d)
+		}
+		if !reflect.DeepEqual(orig, written) {
+			t.Error(`round trip changed paragraphs`, fname)
+		}
+	}
+}
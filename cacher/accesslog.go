@@ -0,0 +1,179 @@
+package cacher
+
+// This file implements access logs of the HTTP server.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// Formats of access logs for Config.AccessLogFormat.
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// How items are served.
+const (
+	cacheHit      = "HIT"
+	cacheMiss     = "MISS"
+	cacheUpstream = "UPSTREAM"
+	cacheStale    = "STALE"
+	cacheRemote   = "REMOTE"
+	cacheRedirect = "REDIRECT"
+	cacheBlocked  = "BLOCKED"
+)
+
+const (
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+type accessEntryKey struct{}
+
+// accessEntry is a record of an access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+	Cache     string    `json:"cache"`
+	Latency   float64   `json:"latency"` // seconds
+}
+
+// setCacheStatus records how the item for r is served.
+func setCacheStatus(r *http.Request, cache string) {
+	if e, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		e.Cache = cache
+	}
+}
+
+// accessRecorder records the status and the size of a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	e *accessEntry
+}
+
+func (ar accessRecorder) WriteHeader(status int) {
+	if ar.e.Status == 0 {
+		ar.e.Status = status
+	}
+	ar.ResponseWriter.WriteHeader(status)
+}
+
+func (ar accessRecorder) Write(p []byte) (int, error) {
+	if ar.e.Status == 0 {
+		ar.e.Status = http.StatusOK
+	}
+	n, err := ar.ResponseWriter.Write(p)
+	ar.e.Bytes += int64(n)
+	return n, err
+}
+
+func (ar accessRecorder) Flush() {
+	if fl, ok := ar.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func orHyphen(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatCombined formats e in Apache combined log format followed by
+// the cache status and the latency in microseconds.
+func formatCombined(e *accessEntry) []byte {
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	return []byte(fmt.Sprintf("%s - - [%s] %q %d %s %q %q %s %d\n",
+		e.Remote, e.Time.Format(combinedTimeFormat),
+		e.Method+" "+e.URI+" "+e.Protocol, e.Status, size,
+		orHyphen(e.Referer), orHyphen(e.UserAgent),
+		orHyphen(e.Cache), int64(e.Latency*1e6)))
+}
+
+// accessLog returns a Middleware that writes access logs to w.
+func accessLog(w io.Writer, format string) Middleware {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			e := &accessEntry{
+				Time:      time.Now(),
+				Remote:    r.RemoteAddr,
+				Method:    r.Method,
+				URI:       r.RequestURI,
+				Protocol:  r.Proto,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+			}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				e.Remote = host
+			}
+			defer func() {
+				if e.Status == 0 {
+					e.Status = http.StatusOK
+				}
+				e.Latency = time.Since(e.Time).Seconds()
+
+				var data []byte
+				if format == AccessLogJSON {
+					data, _ = json.Marshal(e)
+					data = append(data, '\n')
+				} else {
+					data = formatCombined(e)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if _, err := w.Write(data); err != nil {
+					log.Error("failed to write an access log", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+			}()
+
+			ctx := context.WithValue(r.Context(), accessEntryKey{}, e)
+			next.ServeHTTP(accessRecorder{rw, e}, r.WithContext(ctx))
+		})
+	}
+}
+
+// openAccessLog opens the sink of access logs.
+//
+// "-" is the standard output.  Files are reopened by SIGUSR1 as
+// the log file of go-apt-cacher.
+func openAccessLog(filename, format string) (io.Writer, error) {
+	switch format {
+	case "", AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, errors.New("unknown access log format: " + format)
+	}
+	if filename == "-" {
+		return os.Stdout, nil
+	}
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return log.NewFileReopener(abspath, syscall.SIGUSR1)
+}
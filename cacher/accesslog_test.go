@@ -0,0 +1,86 @@
+package cacher
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormatCombined(t *testing.T) {
+	t.Parallel()
+
+	e := &accessEntry{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Remote:    "10.0.0.1",
+		Method:    "GET",
+		URI:       "/ubuntu/pool/a.deb",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		Bytes:     123,
+		UserAgent: "Debian APT-HTTP/1.3",
+		Cache:     cacheHit,
+		Latency:   0.0015,
+	}
+	expected := `10.0.0.1 - - [02/Jan/2020:03:04:05 +0000] "GET /ubuntu/pool/a.deb HTTP/1.1" 200 123 "-" "Debian APT-HTTP/1.3" HIT 1500` + "\n"
+	if got := string(formatCombined(e)); got != expected {
+		t.Error(`unexpected log`, got)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+
+	buf := new(bytes.Buffer)
+	handler := Chain(cacheHandler{c}, accessLog(buf, AccessLogJSON))
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/ubuntu/dists/stable/Release", nil)
+		r.Header.Set("User-Agent", "apt")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("GET", "/unknown/a.deb", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	dec := json.NewDecoder(buf)
+	// the first request is streamed unless the download finishes
+	// before streaming starts.
+	expected := []struct {
+		status int
+		cache  []string
+	}{
+		{http.StatusOK, []string{cacheUpstream, cacheMiss}},
+		{http.StatusOK, []string{cacheHit}},
+		{http.StatusNotFound, []string{cacheMiss}},
+	}
+	for _, ex := range expected {
+		var e accessEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		ok := false
+		for _, cache := range ex.cache {
+			ok = ok || e.Cache == cache
+		}
+		if e.Status != ex.status || !ok {
+			t.Error(`unexpected entry`, e)
+		}
+		if e.Remote != "192.0.2.1" || e.Method != "GET" {
+			t.Error(`unexpected entry`, e)
+		}
+	}
+	if dec.More() {
+		t.Error(`too many entries`)
+	}
+}
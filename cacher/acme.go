@@ -0,0 +1,61 @@
+package cacher
+
+// This file implements automatic certificate management by ACME.
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/cybozu-go/well"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates autocert.Manager from config.
+// If ACME is not configured, nil is returned.
+func newACMEManager(config *Config) (*autocert.Manager, error) {
+	if len(config.ACMEHosts) == 0 {
+		return nil, nil
+	}
+
+	cacheDir := filepath.Clean(config.ACMECacheDir)
+	if !filepath.IsAbs(cacheDir) {
+		return nil, errors.New("acme_cache_dir must be an absolute path")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(config.ACMEHosts...),
+		Email:      config.ACMEEmail,
+	}
+	if len(config.ACMEDirectoryURL) > 0 {
+		m.Client = &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+	}
+	return m, nil
+}
+
+// NewChallengeServer returns HTTPServer to answer ACME HTTP-01
+// challenges at config.ACMEHTTPAddress.  Other requests are passed
+// to h so that clients can keep using plain HTTP, unless client
+// certificates are required by config.ClientCAFile.  In that case,
+// they are redirected to HTTPS.
+//
+// If ACME or ACMEHTTPAddress is not configured, nil is returned.
+func NewChallengeServer(c *Cacher, config *Config, h http.Handler) *well.HTTPServer {
+	if c.acme == nil || len(config.ACMEHTTPAddress) == 0 {
+		return nil
+	}
+
+	if len(config.ClientCAFile) > 0 {
+		h = nil
+	}
+
+	return &well.HTTPServer{
+		Server: &http.Server{
+			Addr:    config.ACMEHTTPAddress,
+			Handler: c.acme.HTTPHandler(h),
+		},
+	}
+}
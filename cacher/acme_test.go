@@ -0,0 +1,53 @@
+package cacher
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestACME(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig()
+	m, err := newACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != nil {
+		t.Error(`ACME must be disabled by default`)
+	}
+
+	config.ACMEHosts = []string{"apt.example.com"}
+	_, err = newACMEManager(config)
+	if err == nil {
+		t.Error(`acme_cache_dir must be required`)
+	}
+
+	config.ACMECacheDir = "acme"
+	_, err = newACMEManager(config)
+	if err == nil {
+		t.Error(`relative acme_cache_dir must be rejected`)
+	}
+
+	config.ACMECacheDir = "/var/lib/go-apt-cacher/acme"
+	m, err = newACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.HostPolicy(context.Background(), "apt.example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := m.HostPolicy(context.Background(), "evil.example.com"); err == nil {
+		t.Error(`evil.example.com must be rejected`)
+	}
+
+	c := &Cacher{acme: m}
+	if NewChallengeServer(c, config, http.NotFoundHandler()) != nil {
+		t.Error(`challenge server must be disabled without acme_http_address`)
+	}
+	config.ACMEHTTPAddress = ":80"
+	if NewChallengeServer(c, config, http.NotFoundHandler()) == nil {
+		t.Error(`challenge server must be enabled`)
+	}
+}
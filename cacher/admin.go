@@ -0,0 +1,307 @@
+package cacher
+
+// This file implements the admin API.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/well"
+	"github.com/pkg/errors"
+)
+
+// StorageUsage is the usage of a storage.
+type StorageUsage struct {
+	Items    int    `json:"items"`
+	Used     uint64 `json:"used_bytes"`
+	Capacity uint64 `json:"capacity_bytes"`
+
+	// Evictions and EvictedBytes are the number and the total size
+	// of items removed to free up capacity.
+	Evictions    uint64 `json:"evictions"`
+	EvictedBytes uint64 `json:"evicted_bytes"`
+
+	// Prefixes is the usage of each prefix.
+	Prefixes map[string]PrefixUsage `json:"prefixes"`
+}
+
+// AdminStats is the statistics returned by the admin API.
+type AdminStats struct {
+	Meta     StorageUsage `json:"meta"`
+	Cache    StorageUsage `json:"cache"`
+	Requests Stats        `json:"requests"`
+}
+
+// CachedItem is an item listed by the admin API.
+type CachedItem struct {
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+}
+
+func usageOf(s *Storage) StorageUsage {
+	items, used, capacity := s.Usage()
+	evictions, evicted := s.Evictions()
+	return StorageUsage{
+		Items:        items,
+		Used:         used,
+		Capacity:     capacity,
+		Evictions:    evictions,
+		EvictedBytes: evicted,
+		Prefixes:     s.PrefixUsage(),
+	}
+}
+
+// hasPathPrefix returns true if p is prefix or under the directory prefix.
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if len(prefix) == 0 {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// List returns cached items under prefix sorted by path.
+// If prefix is empty, all items are returned.
+func (c *Cacher) List(prefix string) []CachedItem {
+	var l []CachedItem
+	for _, s := range []*Storage{c.meta, c.items} {
+		for _, fi := range s.ListAll() {
+			if hasPathPrefix(fi.Path(), prefix) {
+				l = append(l, CachedItem{fi.Path(), fi.Size()})
+			}
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Path < l[j].Path })
+	return l
+}
+
+// Delete removes a cached item.  It returns ErrNotFound if p is not
+// cached.  The item will be downloaded again when requested.
+func (c *Cacher) Delete(p string) error {
+	storage := c.items
+	if apt.IsMeta(p) {
+		storage = c.meta
+	}
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+
+	if !storage.Contains(p) {
+		return ErrNotFound
+	}
+	return storage.Delete(p)
+}
+
+// Purge removes all cached items under prefix.
+// It returns the number of removed items.
+func (c *Cacher) Purge(prefix string) (int, error) {
+	if len(strings.Trim(prefix, "/")) == 0 {
+		return 0, errors.New("empty prefix")
+	}
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+
+	n := 0
+	for _, s := range []*Storage{c.meta, c.items} {
+		for _, fi := range s.ListAll() {
+			if !hasPathPrefix(fi.Path(), prefix) {
+				continue
+			}
+			if err := s.Delete(fi.Path()); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// adminHandler serves the admin API.
+type adminHandler struct {
+	*Cacher
+	token string
+
+	// allowed restricts clients if not empty.
+	allowed trustedNets
+
+	// debug enables endpoints under /debug/.
+	debug bool
+}
+
+func (h adminHandler) authorized(r *http.Request) bool {
+	if len(h.allowed) > 0 && !h.allowed.contains(hostIP(r.RemoteAddr)) {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.debug && strings.HasPrefix(r.URL.Path, "/debug/") {
+		h.serveDebug(w, r)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/stats" && r.Method == "GET":
+		writeJSON(w, AdminStats{
+			Meta:     usageOf(h.meta),
+			Cache:    usageOf(h.items),
+			Requests: h.Stats(),
+		})
+	case r.URL.Path == "/downloads" && r.Method == "GET":
+		writeJSON(w, h.Downloads())
+	case r.URL.Path == "/items" && r.Method == "GET":
+		writeJSON(w, h.List(r.URL.Query().Get("prefix")))
+	case strings.HasPrefix(r.URL.Path, "/items/") && r.Method == "DELETE":
+		p := path.Clean(strings.TrimPrefix(r.URL.Path, "/items/"))
+		err := h.Delete(p)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrNotFound:
+			http.NotFound(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case r.URL.Path == "/purge" && r.Method == "POST":
+		prefix := r.URL.Query().Get("prefix")
+		n, err := h.Purge(prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("purged", map[string]interface{}{
+			"prefix":  prefix,
+			"deleted": n,
+		})
+		writeJSON(w, map[string]int{"deleted": n})
+	case r.URL.Path == "/prefetch" && r.Method == "POST":
+		h.servePrefetch(w, r)
+	case r.URL.Path == "/import" && r.Method == "POST":
+		dir := r.URL.Query().Get("dir")
+		if !filepath.IsAbs(dir) {
+			http.Error(w, "dir must be an absolute path", http.StatusBadRequest)
+			return
+		}
+		res, err := h.Import(dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, res)
+	case r.URL.Path == "/warm" && r.Method == "POST":
+		q := r.URL.Query()
+		dir := q.Get("dir")
+		if !filepath.IsAbs(dir) {
+			http.Error(w, "dir must be an absolute path", http.StatusBadRequest)
+			return
+		}
+		res, err := h.WarmFromMirror(dir, q.Get("prefix"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, res)
+	case strings.HasPrefix(r.URL.Path, notifyPath):
+		h.serveNotify(w, r)
+	case r.URL.Path == "/compact" && r.Method == "POST":
+		res, err := h.Compact(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, res)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePrefetch starts prefetching in background.
+func (h adminHandler) servePrefetch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	patterns := q["pattern"]
+	if !h.mapped(prefix) || strings.Contains(prefix, "/") {
+		http.Error(w, "unknown prefix", http.StatusBadRequest)
+		return
+	}
+	if err := checkPatterns(patterns); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.prefetchLock.Lock()
+	running := h.prefetching[prefix]
+	h.prefetchLock.Unlock()
+	if running {
+		http.Error(w, ErrPrefetchRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	well.Go(func(ctx context.Context) error {
+		_, err := h.Prefetch(ctx, prefix, patterns)
+		if err != nil && ctx.Err() == nil {
+			log.Error("prefetch failed", map[string]interface{}{
+				"prefix": prefix,
+				"error":  err.Error(),
+			})
+		}
+		return nil
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// NewAdminServer returns HTTPServer for the admin API listening on
+// config.AdminAddress.  If AdminAddress is empty, nil is returned.
+func NewAdminServer(c *Cacher, config *Config) (*well.HTTPServer, error) {
+	if len(config.AdminAddress) == 0 {
+		return nil, nil
+	}
+	if len(config.AdminToken) == 0 {
+		return nil, errors.New("admin_token is required for admin_address")
+	}
+	allowed, err := parseTrustedNets(config.AdminAllow)
+	if err != nil {
+		return nil, errors.Wrap(err, "admin_allow")
+	}
+
+	return &well.HTTPServer{
+		Server: &http.Server{
+			Addr: config.AdminAddress,
+			Handler: adminHandler{
+				Cacher:  c,
+				token:   config.AdminToken,
+				allowed: allowed,
+				debug:   config.AdminDebug,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,120 @@
+package cacher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {upstream.URL},
+			"debian": {upstream.URL},
+		}
+	})
+	defer cleanup()
+	for _, p := range []string{
+		"ubuntu/dists/stable/Release",
+		"ubuntu/pool/a/a_1.0_amd64.deb",
+		"ubuntu/pool/b/b_1.0_amd64.deb",
+		"debian/pool/a/a_1.0_amd64.deb",
+	} {
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(p, status)
+		}
+		f.Close()
+	}
+
+	_, err := NewAdminServer(c, &Config{AdminAddress: ":3143"})
+	if err == nil {
+		t.Error(`admin_token must be required`)
+	}
+
+	h := adminHandler{Cacher: c, token: "secret"}
+	do := func(method, target string, v interface{}) int {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if v != nil && w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Error(`w.Code != http.StatusUnauthorized`, w.Code)
+	}
+
+	var stats AdminStats
+	if code := do("GET", "/stats", &stats); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if stats.Meta.Items != 1 {
+		t.Error(`stats.Meta.Items != 1`, stats.Meta.Items)
+	}
+	if stats.Cache.Items != 3 {
+		t.Error(`stats.Cache.Items != 3`, stats.Cache.Items)
+	}
+	if stats.Cache.Used != 12 {
+		t.Error(`stats.Cache.Used != 12`, stats.Cache.Used)
+	}
+
+	var items []CachedItem
+	if code := do("GET", "/items?prefix=ubuntu", &items); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if len(items) != 3 || items[0].Path != "ubuntu/dists/stable/Release" {
+		t.Error(`unexpected items`, items)
+	}
+
+	if code := do("DELETE", "/items/ubuntu/pool/a/a_1.0_amd64.deb", nil); code != http.StatusNoContent {
+		t.Error(`code != http.StatusNoContent`, code)
+	}
+	if code := do("DELETE", "/items/ubuntu/pool/a/a_1.0_amd64.deb", nil); code != http.StatusNotFound {
+		t.Error(`code != http.StatusNotFound`, code)
+	}
+
+	if code := do("POST", "/purge", nil); code != http.StatusBadRequest {
+		t.Error(`purge without prefix must be rejected`, code)
+	}
+	var purged map[string]int
+	if code := do("POST", "/purge?prefix=ubuntu/", &purged); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if purged["deleted"] != 2 {
+		t.Error(`purged["deleted"] != 2`, purged)
+	}
+
+	items = c.List("")
+	if len(items) != 1 || items[0].Path != "debian/pool/a/a_1.0_amd64.deb" {
+		t.Error(`unexpected items`, items)
+	}
+
+	// deleted items are downloaded again.
+	status, f, err := c.Get("ubuntu/pool/b/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Error(`status != http.StatusOK`, status)
+	}
+	f.Close()
+}
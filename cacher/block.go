@@ -0,0 +1,23 @@
+package cacher
+
+// This file implements blocklists of packages.
+
+import (
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+// blocked returns true if p is an item blocked by blocked_packages of
+// its prefix.  Blocked items are never served nor cached.
+func (c *Cacher) blocked(p string) bool {
+	t := strings.SplitN(p, "/", 2)
+	if len(t) != 2 || apt.IsMeta(p) {
+		return false
+	}
+	uc, ok := c.upstreams[t[0]]
+	if !ok || len(uc.BlockedPackages) == 0 {
+		return false
+	}
+	return matchPatterns(uc.BlockedPackages, t[1])
+}
@@ -0,0 +1,65 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlockedPackages(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("deb"))
+	}))
+	defer upstream.Close()
+
+	if err := (&UpstreamConfig{BlockedPackages: []string{"["}}).check(); err == nil {
+		t.Error(`bad patterns must be rejected`)
+	}
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {upstream.URL},
+			"debian": {upstream.URL},
+		}
+		config.Upstreams = map[string]*UpstreamConfig{
+			"ubuntu": {BlockedPackages: []string{"openssl_1.0_*.deb"}},
+		}
+	})
+	defer cleanup()
+	s := httptest.NewServer(cacheHandler{c})
+	defer s.Close()
+
+	testCases := []struct {
+		p      string
+		status int
+	}{
+		{"ubuntu/pool/main/o/openssl/openssl_1.0_amd64.deb", http.StatusForbidden},
+		{"ubuntu/pool/main/o/openssl/openssl_1.1_amd64.deb", http.StatusOK},
+		{"debian/pool/main/o/openssl/openssl_1.0_amd64.deb", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		for _, method := range []string{"GET", "HEAD"} {
+			req, err := http.NewRequest(method, s.URL+"/"+tc.p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Error(`unexpected status`, method, tc.p, resp.StatusCode)
+			}
+		}
+	}
+
+	if c.items.Contains(testCases[0].p) {
+		t.Error(`blocked packages must not be cached`)
+	}
+	if c.Download(testCases[0].p, nil) != nil {
+		t.Error(`blocked packages must not be downloaded`)
+	}
+}
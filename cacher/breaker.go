@@ -0,0 +1,177 @@
+package cacher
+
+// This file implements circuit breakers of upstream hosts.  After
+// repeated failures, no new requests are sent to the host for a
+// cool-down period so that a dead upstream does not tie up connection
+// slots and clients until requests time out.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBreakerCoolDown = 30
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen is returned when requests to an upstream are refused
+// by its circuit breaker.
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// BreakerStats is statistics of the circuit breaker of an upstream host.
+type BreakerStats struct {
+	// State is "closed", "open", or "half-open".
+	State string `json:"state"`
+
+	// Failures is the number of consecutive failures.
+	Failures int `json:"failures"`
+
+	// Trips is the number of times the breaker has opened.
+	Trips uint64 `json:"trips"`
+
+	// Rejected is the number of requests refused while open.
+	Rejected uint64 `json:"rejected"`
+}
+
+type hostBreaker struct {
+	failures  int
+	openUntil time.Time
+	trial     bool
+	trips     uint64
+	rejected  uint64
+}
+
+func (hb *hostBreaker) state(now time.Time) string {
+	switch {
+	case hb.openUntil.IsZero():
+		return breakerClosed
+	case now.Before(hb.openUntil):
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// breaker is a set of circuit breakers keyed by upstream hosts.
+//
+// A breaker opens after threshold consecutive failures and refuses
+// requests for coolDown.  Then a trial request is allowed; its success
+// closes the breaker and its failure opens it again.
+type breaker struct {
+	threshold int
+	coolDown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+// newBreaker returns a breaker, or nil if threshold is zero.
+func newBreaker(threshold int, coolDown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+		hosts:     make(map[string]*hostBreaker),
+	}
+}
+
+// allow returns true if a request to host may be sent.
+func (b *breaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		return true
+	}
+	switch hb.state(time.Now()) {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if !hb.trial {
+			hb.trial = true
+			return true
+		}
+	}
+	hb.rejected++
+	return false
+}
+
+// success records a successful request to host.
+func (b *breaker) success(host string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		return
+	}
+	if !hb.openUntil.IsZero() {
+		log.Info("circuit breaker closed", map[string]interface{}{
+			"host": host,
+		})
+	}
+	hb.failures = 0
+	hb.openUntil = time.Time{}
+	hb.trial = false
+}
+
+// failure records a failed request to host.
+func (b *breaker) failure(host string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		hb = new(hostBreaker)
+		b.hosts[host] = hb
+	}
+	hb.failures++
+	if !hb.trial && hb.failures < b.threshold {
+		return
+	}
+	hb.openUntil = time.Now().Add(b.coolDown)
+	hb.trial = false
+	hb.trips++
+	log.Warn("circuit breaker opened", map[string]interface{}{
+		"host":     host,
+		"failures": hb.failures,
+	})
+}
+
+func (b *breaker) stats() map[string]BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	m := make(map[string]BreakerStats, len(b.hosts))
+	for host, hb := range b.hosts {
+		m[host] = BreakerStats{
+			State:    hb.state(now),
+			Failures: hb.failures,
+			Trips:    hb.trips,
+			Rejected: hb.rejected,
+		}
+	}
+	return m
+}
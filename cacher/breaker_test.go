@@ -0,0 +1,104 @@
+package cacher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	if newBreaker(0, time.Second).allow("a") != true {
+		t.Error(`disabled breakers must allow requests`)
+	}
+
+	b := newBreaker(2, 100*time.Millisecond)
+	b.failure("a")
+	if !b.allow("a") {
+		t.Error(`breaker must be closed below the threshold`)
+	}
+	b.failure("a")
+	if b.allow("a") {
+		t.Error(`breaker must be open`)
+	}
+	if !b.allow("b") {
+		t.Error(`breakers must be per host`)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.allow("a") {
+		t.Error(`a trial request must be allowed`)
+	}
+	if b.allow("a") {
+		t.Error(`only one trial request must be allowed`)
+	}
+	b.failure("a")
+	if b.allow("a") {
+		t.Error(`failed trial must open the breaker again`)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.allow("a") {
+		t.Error(`a trial request must be allowed`)
+	}
+	b.success("a")
+	if !b.allow("a") || !b.allow("a") {
+		t.Error(`successful trial must close the breaker`)
+	}
+
+	st := b.stats()["a"]
+	if st.State != breakerClosed || st.Trips != 2 || st.Rejected != 3 {
+		t.Error(`unexpected stats`, st)
+	}
+}
+
+func TestBreakerUpstream(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.Retries = 0
+		config.BreakerThreshold = 2
+		config.BreakerCoolDown = 60
+	})
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		p := fmt.Sprintf("ubuntu/pool/main/a/a%d.deb", i)
+		status, _, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := http.StatusInternalServerError
+		if i >= 2 {
+			expected = http.StatusServiceUnavailable
+		}
+		if status != expected {
+			t.Error(`unexpected status`, p, status)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Error(`requests must not be sent while the breaker is open`, requests)
+	}
+	u := c.Stats().Breakers[upstream.Listener.Addr().String()]
+	if u.State != breakerOpen || u.Rejected != 2 {
+		t.Error(`unexpected stats`, u)
+	}
+}
@@ -0,0 +1,126 @@
+package cacher
+
+// This file implements acquisition of indices by their hash values.
+// https://wiki.debian.org/DebianRepository/Format#indices_acquisition_via_hashsums_.28by-hash.29
+
+import (
+	"path"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+type byHashEntry struct {
+	fi      *apt.FileInfo
+	release string
+}
+
+// byHashIndex maps by-hash paths of files listed in Release files
+// that declare "Acquire-By-Hash: yes" to their FileInfo.
+//
+// Only files listed in the current Release files are mapped so that
+// outdated contents never replace current ones.
+// byHashIndex is guarded by Cacher.fiLock.
+type byHashIndex struct {
+	items    map[string]byHashEntry
+	releases map[string][]string
+}
+
+func newByHashIndex() *byHashIndex {
+	return &byHashIndex{
+		items:    make(map[string]byHashEntry),
+		releases: make(map[string][]string),
+	}
+}
+
+// update replaces by-hash paths of files listed in release.
+// fil and d are the result of apt.ExtractFileInfo for release.
+func (bi *byHashIndex) update(release string, fil []*apt.FileInfo, d apt.Paragraph) {
+	for _, p := range bi.releases[release] {
+		if bi.items[p].release == release {
+			delete(bi.items, p)
+		}
+	}
+	delete(bi.releases, release)
+
+	if d == nil || !apt.SupportByHash(d) {
+		return
+	}
+	var paths []string
+	for _, fi := range fil {
+		for _, p := range []string{fi.SHA256Path(), fi.SHA512Path(), fi.SHA1Path(), fi.MD5SumPath()} {
+			if p == "" {
+				continue
+			}
+			bi.items[p] = byHashEntry{fi, release}
+			paths = append(paths, p)
+		}
+	}
+	bi.releases[release] = paths
+}
+
+// get returns FileInfo of the file for a by-hash path p, or nil.
+func (bi *byHashIndex) get(p string) *apt.FileInfo {
+	if !apt.IsByHash(p) {
+		return nil
+	}
+	return bi.items[p].fi
+}
+
+// source returns the by-hash path to download fi, or an empty string
+// if the upstream does not provide fi by its hash value.
+func (bi *byHashIndex) source(fi *apt.FileInfo) string {
+	for _, p := range []string{fi.SHA256Path(), fi.SHA512Path(), fi.SHA1Path(), fi.MD5SumPath()} {
+		if e, ok := bi.items[p]; ok && e.fi.Path() == fi.Path() && e.fi.Same(fi) {
+			return p
+		}
+	}
+	return ""
+}
+
+// isRelease returns true if p is a Release or InRelease file.
+func isRelease(p string) bool {
+	switch path.Base(p) {
+	case "Release", "InRelease":
+		return true
+	}
+	return false
+}
+
+// byHashTarget returns the path of the file for a by-hash path p.
+// If p is not a known by-hash path, p is returned as is.
+func (c *Cacher) byHashTarget(p string) string {
+	c.fiLock.RLock()
+	defer c.fiLock.RUnlock()
+
+	if fi := c.byHash.get(p); fi != nil {
+		return fi.Path()
+	}
+	return p
+}
+
+// loadByHash maps by-hash paths of files listed in cached Release files.
+func (c *Cacher) loadByHash() error {
+	for _, fi := range c.meta.ListAll() {
+		p := fi.Path()
+		if !isRelease(p) {
+			continue
+		}
+		t := strings.SplitN(p, "/", 2)
+		if len(t) != 2 {
+			continue
+		}
+		f, err := c.meta.Lookup(fi)
+		if err != nil {
+			return err
+		}
+		fil, d, err := apt.ExtractFileInfo(t[1], f)
+		f.Close()
+		if err != nil {
+			// broken Release files are accepted as is.
+			continue
+		}
+		c.byHash.update(p, addPrefix(t[0], fil), d)
+	}
+	return nil
+}
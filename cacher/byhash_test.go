@@ -0,0 +1,76 @@
+package cacher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestByHash(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", true, pkg)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config = cfg
+	})
+	defer cleanup()
+	testGetData(t, c, "ubuntu/dists/stable/Release", repo.Get("dists/stable/Release"))
+
+	packages := "dists/stable/main/binary-amd64/Packages.gz"
+	data := repo.Get(packages)
+	sum := sha256.Sum256(data)
+	byHash := "dists/stable/main/binary-amd64/by-hash/SHA256/" + hex.EncodeToString(sum[:])
+
+	// the upstream is being updated; Packages.gz is not yet available.
+	repo.Put(packages, nil)
+
+	testGetData(t, c, "ubuntu/"+byHash, data)
+	if !c.meta.Contains("ubuntu/" + packages) {
+		t.Error(`Packages.gz must be cached`)
+	}
+	c.fiLock.RLock()
+	_, ok := c.info.Get("ubuntu/" + repotest.PoolPath(pkg))
+	c.fiLock.RUnlock()
+	if !ok {
+		t.Error(`Packages.gz must be indexed`)
+	}
+
+	// the file is downloaded by its hash value.
+	testGetData(t, c, "ubuntu/"+packages, data)
+
+	// unknown by-hash paths are not mapped.
+	unknown := "dists/stable/main/binary-amd64/by-hash/SHA256/" + hex.EncodeToString(make([]byte, sha256.Size))
+	if p := c.byHashTarget("ubuntu/" + unknown); p != "ubuntu/"+unknown {
+		t.Error(`unknown by-hash path must not be mapped`, p)
+	}
+	status, f, err := c.Get("ubuntu/" + unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		f.Close()
+	}
+	if status != http.StatusNotFound {
+		t.Error(`status != http.StatusNotFound`, status)
+	}
+
+	// by-hash paths are mapped after restart.
+	c, err = NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := c.byHashTarget("ubuntu/" + byHash); p != "ubuntu/"+packages {
+		t.Error(`by-hash path must be mapped after restart`, p)
+	}
+}
@@ -0,0 +1,55 @@
+package cacher
+
+// This file implements caching headers of responses to clients.
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/pkg/errors"
+)
+
+// clientCacheControl is Cache-Control headers given to clients.
+type clientCacheControl struct {
+	index string
+	pool  string
+}
+
+func newClientCacheControl(index, pool string) (*clientCacheControl, error) {
+	for _, cc := range []string{index, pool} {
+		if strings.ContainsAny(cc, "\r\n") {
+			return nil, errors.New("bad Cache-Control: " + cc)
+		}
+	}
+	return &clientCacheControl{
+		index: strings.TrimSpace(index),
+		pool:  strings.TrimSpace(pool),
+	}, nil
+}
+
+// isIndex returns true if p is an index that may be updated.
+// Files fetched by hash never change, so they are not indices.
+func isIndex(p string) bool {
+	if strings.Contains(p, "/by-hash/") {
+		return false
+	}
+	return apt.IsMeta(p) || apt.IsTranslation(p) || strings.Contains(p, "/dists/")
+}
+
+// set sets Cache-Control for p in h.  Expires is also set for HTTP/1.0
+// caches if the lifetime is given.
+func (cc *clientCacheControl) set(h http.Header, p string, now time.Time) {
+	v := cc.pool
+	if isIndex(p) {
+		v = cc.index
+	}
+	if v == "" {
+		return
+	}
+	h.Set("Cache-Control", v)
+	if lifetime, ok := freshnessLifetime(http.Header{"Cache-Control": {v}}, now); ok {
+		h.Set("Expires", now.Add(lifetime).UTC().Format(http.TimeFormat))
+	}
+}
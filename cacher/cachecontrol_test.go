@@ -0,0 +1,99 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientCacheControl(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newClientCacheControl("max-age=60\r\nX-Bad: 1", ""); err == nil {
+		t.Error(`headers must not be injected`)
+	}
+	cc, err := newClientCacheControl("max-age=60", "public, max-age=86400")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		p       string
+		cc      string
+		expires time.Duration
+	}{
+		{"ubuntu/dists/stable/InRelease", "max-age=60", time.Minute},
+		{"ubuntu/dists/stable/main/i18n/Translation-en.bz2", "max-age=60", time.Minute},
+		{"flat/stable/Translation-en.bz2", "max-age=60", time.Minute},
+		{"ubuntu/dists/stable/main/binary-amd64/by-hash/SHA256/abcd", "public, max-age=86400", 24 * time.Hour},
+		{"ubuntu/pool/main/a/apt/apt_1.0_amd64.deb", "public, max-age=86400", 24 * time.Hour},
+	}
+	for _, tc := range testCases {
+		h := make(http.Header)
+		cc.set(h, tc.p, now)
+		if h.Get("Cache-Control") != tc.cc {
+			t.Error(`unexpected Cache-Control`, tc.p, h.Get("Cache-Control"))
+		}
+		if h.Get("Expires") != now.Add(tc.expires).Format(http.TimeFormat) {
+			t.Error(`unexpected Expires`, tc.p, h.Get("Expires"))
+		}
+	}
+
+	cc, err = newClientCacheControl("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := make(http.Header)
+	cc.set(h, "ubuntu/dists/stable/InRelease", now)
+	if len(h) != 0 {
+		t.Error(`no headers must be added by default`, h)
+	}
+}
+
+func TestServeCacheControl(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.IndexCacheControl = "no-cache"
+		config.PoolCacheControl = "max-age=3600"
+	})
+	defer cleanup()
+	s := httptest.NewServer(cacheHandler{c})
+	defer s.Close()
+
+	testCases := []struct {
+		p  string
+		cc string
+	}{
+		{"ubuntu/dists/stable/InRelease", "no-cache"},
+		{"ubuntu/pool/main/a/apt/apt_1.0_amd64.deb", "max-age=3600"},
+	}
+	for _, tc := range testCases {
+		// the first request is streamed, and the others are cached.
+		for _, method := range []string{"GET", "GET", "HEAD"} {
+			req, err := http.NewRequest(method, s.URL+"/"+tc.p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Header.Get("Cache-Control") != tc.cc {
+				t.Error(`unexpected Cache-Control`, method, tc.p, resp.Header.Get("Cache-Control"))
+			}
+			if resp.Header.Get("Expires") == "" {
+				t.Error(`Expires must be set`, method, tc.p)
+			}
+		}
+	}
+}
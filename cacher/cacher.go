@@ -5,6 +5,7 @@ package cacher
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -16,17 +17,27 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/aptutil/internal/backoff"
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/well"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
+	kib            = 1 << 10
+	mib            = 1 << 20
 	gib            = 1 << 30
 	requestTimeout = 30 * time.Minute
+
+	// buffer size of upstream connections in low memory mode.
+	lowMemoryBufferSize = 1024
 )
 
+var errShuttingDown = errors.New("shutting down")
+
 // addPrefix add prefix for each *FileInfo in fil.
 func addPrefix(prefix string, fil []*apt.FileInfo) []*apt.FileInfo {
 	ret := make([]*apt.FileInfo, 0, len(fil))
@@ -38,23 +49,88 @@ func addPrefix(prefix string, fil []*apt.FileInfo) []*apt.FileInfo {
 
 // Cacher downloads and caches APT indices and deb files.
 type Cacher struct {
-	meta          *Storage
-	items         *Storage
-	um            URLMap
-	checkInterval time.Duration
-	cachePeriod   time.Duration
-	client        *http.Client
-	maxConns      int
+	meta           *Storage
+	items          *Storage
+	um             URLMap
+	upstreamURLs   map[string][]*url.URL
+	srv            map[string]*srvUpstream
+	sources        *sourcesList
+	keyrings       map[string]openpgp.EntityList
+	upstreamHealth *upstreamHealth
+	breaker        *breaker
+	upstreams      map[string]*UpstreamConfig
+	checkInterval  time.Duration
+	onDemand       bool // refresh Release files on demand
+	refreshIndices []string
+	cachePeriods   cachePeriods
+	serveStale     time.Duration
+	offline        bool
+	proxy          bool
+	proxyHosts     []string
+	selfNames      map[string]bool // names of this server for proxy
+	selfPort       string
+	client         *http.Client
+	clients        map[string]*http.Client
+	creds          *apt.Credentials
+	maxConns       int
+	maxRedirects   int
+	retries        uint
+	backoff        backoff.Backoff
+
+	prefetchConcurrency int
+	prefetchLock        sync.Mutex
+	prefetching         map[string]bool
+
+	// refsCh is non-nil if protect_referenced is true.
+	refsCh chan struct{}
+
+	scrubRate float64 // bytes per second
 
 	fiLock sync.RWMutex
-	info   map[string]*apt.FileInfo
+	info   fileIndex
+
+	// guarded by fiLock.
+	maintained    map[string]bool
+	snapshotSaved bool
+	byHash        *byHashIndex
 
 	dlLock     sync.RWMutex
-	dlChannels map[string]chan struct{}
-	results    map[string]int
+	downloads  map[string][]*dlFuture
+	results    map[string]result
+	uncached   map[string]uncachedItem
+	staleSince map[string]time.Time
+	refreshed  map[string]time.Time
+
+	resultsPath  string
+	resultsDirty bool
 
 	hostLock sync.Mutex
 	hostSem  map[string]chan struct{}
+
+	stats   *requestStats
+	trusted trustedNets
+
+	peers      []*url.URL
+	peerClient *http.Client
+	peerHealth *upstreamHealth
+	cluster    *cluster
+
+	accessLog       io.Writer
+	accessLogFormat string
+
+	limiter     *clientLimiter
+	hot         *hotCache
+	clientCache *clientCacheControl
+
+	health         health
+	onStorageError string
+
+	// wrapTempFile, if not nil, wraps temporary files in the storage
+	// to inject write errors in tests.
+	wrapTempFile func(*os.File) io.Writer
+
+	acme *autocert.Manager
+	tls  *tls.Config
 }
 
 // NewCacher constructs Cacher.
@@ -63,7 +139,21 @@ func NewCacher(config *Config) (*Cacher, error) {
 		return nil, errors.New("invaild check_interval")
 	}
 	checkInterval := time.Duration(config.CheckInterval) * time.Second
-	cachePeriod := time.Duration(config.CachePeriod) * time.Second
+	if err := checkPatterns(config.RefreshIndices); err != nil {
+		return nil, errors.Wrap(err, "refresh_indices")
+	}
+	clientCache, err := newClientCacheControl(config.IndexCacheControl, config.PoolCacheControl)
+	if err != nil {
+		return nil, err
+	}
+	cachePeriods, err := newCachePeriods(config.CachePeriod, config.CachePeriods)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServeStale < 0 {
+		return nil, errors.New("serve_stale must be >= 0")
+	}
+	serveStale := time.Duration(config.ServeStale) * time.Second
 
 	metaDir := filepath.Clean(config.MetaDirectory)
 	if !filepath.IsAbs(metaDir) {
@@ -84,8 +174,55 @@ func NewCacher(config *Config) (*Cacher, error) {
 	}
 	capacity := uint64(config.CacheCapacity) * gib
 
+	if err := checkUpstreams(config); err != nil {
+		return nil, err
+	}
+
+	policy, err := EvictionPolicyByName(config.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.CacheTTL < 0 {
+		return nil, errors.New("cache_ttl must be >= 0")
+	}
+	if config.MetaTTL < 0 {
+		return nil, errors.New("meta_ttl must be >= 0")
+	}
+	if err := checkLayout(config.CacheLayout); err != nil {
+		return nil, errors.Wrap(err, "cache_layout")
+	}
+	if config.ScrubInterval < 0 {
+		return nil, errors.New("scrub_interval must be >= 0")
+	}
+	if config.ScrubRate <= 0 {
+		return nil, errors.New("scrub_rate must be > 0")
+	}
+	if config.CompactInterval < 0 {
+		return nil, errors.New("compact_interval must be >= 0")
+	}
+	if config.SharedDirectories && config.LowMemory {
+		return nil, errors.New("shared_directories cannot be used with low_memory")
+	}
+
 	meta := NewStorage(metaDir, 0)
+	meta.SetCompression(config.CompressMeta)
 	cache := NewStorage(cacheDir, capacity)
+	cache.SetEvictionPolicy(policy)
+	cache.SetLayout(config.CacheLayout)
+	for prefix, uc := range config.Upstreams {
+		if uc.CacheCapacity > 0 {
+			cache.SetPrefixCapacity(prefix, uint64(uc.CacheCapacity)*gib)
+		}
+	}
+
+	if config.SharedDirectories {
+		if err := meta.SetShared(); err != nil {
+			return nil, errors.Wrap(err, "meta_dir")
+		}
+		if err := cache.SetShared(); err != nil {
+			return nil, errors.Wrap(err, "cache_dir")
+		}
+	}
 
 	if err := meta.Load(); err != nil {
 		return nil, errors.Wrap(err, "meta.Load")
@@ -93,37 +230,353 @@ func NewCacher(config *Config) (*Cacher, error) {
 	if err := cache.Load(); err != nil {
 		return nil, errors.Wrap(err, "cache.Load")
 	}
+	var snap *infoSnapshotData
+	if !config.SharedDirectories {
+		snap = loadInfoSnapshot(metaDir)
+	}
+	if snap != nil && (snap.Disk != config.LowMemory || snap.Metas != len(meta.ListAll())) {
+		log.Warn("ignored an inconsistent snapshot", nil)
+		snap = nil
+	}
 
-	um := make(URLMap)
-	for prefix, urlString := range config.Mapping {
-		u, err := url.Parse(urlString)
+	var creds *apt.Credentials
+	if len(config.AuthFile) > 0 {
+		cr, err := apt.LoadCredentials(config.AuthFile)
 		if err != nil {
-			return nil, errors.Wrap(err, prefix)
+			return nil, errors.Wrap(err, "auth_file")
+		}
+		creds = cr
+	}
+
+	if config.MaxRedirects < 0 {
+		return nil, errors.New("max_redirects must be >= 0")
+	}
+	if config.Retries < 0 {
+		return nil, errors.New("retries must be >= 0")
+	}
+	bo, err := backoff.New(config.RetryBaseDelay, config.RetryMaxDelay, config.RetryJitter)
+	if err != nil {
+		return nil, err
+	}
+
+	onStorageError := config.OnStorageError
+	switch onStorageError {
+	case "":
+		onStorageError = StorageErrorPassThrough
+	case StorageErrorPassThrough, StorageErrorUnavailable:
+	default:
+		return nil, errors.New("invalid on_storage_error: " + onStorageError)
+	}
+
+	trusted, err := parseTrustedNets(config.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "trusted_proxies")
+	}
+
+	if config.MaxConnections < 0 {
+		return nil, errors.New("max_connections must be >= 0")
+	}
+	if config.MaxRequests < 0 {
+		return nil, errors.New("max_requests must be >= 0")
+	}
+	if config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.IdleTimeout < 0 {
+		return nil, errors.New("timeouts must be >= 0")
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, errors.New("shutdown_timeout must be >= 0")
+	}
+	if config.ClientRateLimit < 0 {
+		return nil, errors.New("client_rate_limit must be >= 0")
+	}
+	if config.ClientRateBurst < 0 {
+		return nil, errors.New("client_rate_burst must be >= 0")
+	}
+	if config.ClientBandwidth < 0 {
+		return nil, errors.New("client_bandwidth must be >= 0")
+	}
+	exempt, err := parseTrustedNets(config.RateLimitExempt)
+	if err != nil {
+		return nil, errors.Wrap(err, "rate_limit_exempt")
+	}
+	limiter := newClientLimiter(config.ClientRateLimit, config.ClientRateBurst,
+		float64(config.ClientBandwidth)*kib, exempt)
+
+	var accessLog io.Writer
+	if len(config.AccessLog) > 0 {
+		accessLog, err = openAccessLog(config.AccessLog, config.AccessLogFormat)
+		if err != nil {
+			return nil, errors.Wrap(err, "access_log")
 		}
-		if u.Scheme != "http" && u.Scheme != "https" {
-			return nil, errors.New("unsupported scheme: " + u.Scheme)
+	}
+
+	acme, err := newACMEManager(config)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := newTLSConfig(config, acme)
+	if err != nil {
+		return nil, err
+	}
+
+	var info fileIndex = make(mapIndex)
+	client := &http.Client{CheckRedirect: noRedirect}
+	base := http.DefaultTransport.(*http.Transport)
+	if config.LowMemory {
+		di, err := newDiskIndex(filepath.Join(metaDir, indexDB), snap != nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "newDiskIndex")
 		}
-		err = um.Register(prefix, u)
+		info = di
+
+		transport := &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     90 * time.Second,
+			WriteBufferSize:     lowMemoryBufferSize,
+			ReadBufferSize:      lowMemoryBufferSize,
+		}
+		client.Transport = transport
+		base = transport
+	}
+
+	clients, err := newUpstreamClients(config.Upstreams, base)
+	if err != nil {
+		return nil, err
+	}
+	keyrings, err := loadKeyrings(config.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	um := make(URLMap)
+	upstreamURLs := make(map[string][]*url.URL)
+	srv := make(map[string]*srvUpstream)
+	for prefix, urlStrings := range config.Mapping {
+		if len(urlStrings) == 0 {
+			return nil, errors.New("no URL for " + prefix)
+		}
+		urls := make([]*url.URL, 0, len(urlStrings))
+		for _, urlString := range urlStrings {
+			u, err := url.Parse(urlString)
+			if err != nil {
+				return nil, errors.Wrap(err, prefix)
+			}
+			if u.Scheme == srvScheme {
+				if len(urlStrings) > 1 {
+					return nil, errors.New(prefix + ": " + srvScheme + " URL must be the only URL")
+				}
+				s, err := parseSRVUpstream(u)
+				if err != nil {
+					return nil, errors.Wrap(err, prefix)
+				}
+				if err := s.refresh(context.Background()); err != nil {
+					// refreshSRV will resolve them later.
+					log.Error("failed to resolve SRV records", map[string]interface{}{
+						"prefix": prefix,
+						"name":   s.name,
+						"error":  err.Error(),
+					})
+				}
+				srv[prefix] = s
+				urls = append(urls, u)
+				continue
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, errors.New("unsupported scheme: " + u.Scheme)
+			}
+			addSlash(u)
+			urls = append(urls, u)
+		}
+		err = um.Register(prefix, urls[0])
 		if err != nil {
 			return nil, errors.Wrap(err, prefix)
 		}
+		upstreamURLs[prefix] = urls
+	}
+	var sources *sourcesList
+	if len(config.SourcesList) > 0 {
+		sources, err = newSourcesList(config.SourcesList, config.Mapping)
+		if err != nil {
+			return nil, errors.Wrap(err, "sources_list")
+		}
+	}
+	if config.SourcesListInterval < 0 {
+		return nil, errors.New("sources_list_interval must be >= 0")
+	}
+	if err := checkProxyHosts(config.ProxyHosts); err != nil {
+		return nil, errors.Wrap(err, "proxy_hosts")
+	}
+	if config.PrefetchConcurrency <= 0 {
+		return nil, errors.New("prefetch_concurrency must be > 0")
+	}
+	for prefix, pc := range config.Prefetch {
+		if _, ok := config.Mapping[prefix]; !ok {
+			return nil, errors.New("prefetch for unknown prefix: " + prefix)
+		}
+		if err := pc.check(); err != nil {
+			return nil, errors.Wrap(err, "prefetch."+prefix)
+		}
+	}
+	if len(srv) > 0 && config.SRVRefreshInterval <= 0 {
+		return nil, errors.New("srv_refresh_interval must be > 0")
+	}
+	if config.HotCacheSize < 0 || config.HotCacheMaxItem <= 0 {
+		return nil, errors.New("hot_cache_size must be >= 0 and hot_cache_max_item must be > 0")
+	}
+	if config.UpstreamCoolDown < 0 {
+		return nil, errors.New("upstream_cool_down must be >= 0")
+	}
+	if config.BreakerThreshold < 0 {
+		return nil, errors.New("breaker_threshold must be >= 0")
+	}
+	if config.BreakerThreshold > 0 && config.BreakerCoolDown <= 0 {
+		return nil, errors.New("breaker_cool_down must be > 0")
+	}
+	peers, err := parsePeers(config.Peers)
+	if err != nil {
+		return nil, errors.Wrap(err, "peers")
+	}
+	peerHealth := newUpstreamHealth(
+		time.Duration(config.UpstreamCoolDown) * time.Second)
+	cl, err := newCluster(config.ClusterNodes, config.ClusterSelf, peerHealth)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster_nodes")
 	}
 
 	c := &Cacher{
-		meta:          meta,
-		items:         cache,
-		um:            um,
-		checkInterval: checkInterval,
-		cachePeriod:   cachePeriod,
-		client:        &http.Client{},
-		maxConns:      config.MaxConns,
-		info:          make(map[string]*apt.FileInfo),
-		dlChannels:    make(map[string]chan struct{}),
-		results:       make(map[string]int),
-		hostSem:       make(map[string]chan struct{}),
+		meta:         meta,
+		items:        cache,
+		um:           um,
+		upstreamURLs: upstreamURLs,
+		srv:          srv,
+		sources:      sources,
+		keyrings:     keyrings,
+		upstreamHealth: newUpstreamHealth(
+			time.Duration(config.UpstreamCoolDown) * time.Second),
+		breaker: newBreaker(config.BreakerThreshold,
+			time.Duration(config.BreakerCoolDown)*time.Second),
+		upstreams:      config.Upstreams,
+		checkInterval:  checkInterval,
+		onDemand:       config.RefreshOnDemand,
+		refreshIndices: config.RefreshIndices,
+		cachePeriods:   cachePeriods,
+		serveStale:     serveStale,
+		offline:        config.Offline,
+		proxy:          config.Proxy,
+		proxyHosts:     config.ProxyHosts,
+		client:         client,
+		clients:        clients,
+		creds:          creds,
+		maxConns:       config.MaxConns,
+		maxRedirects:   config.MaxRedirects,
+		retries:        uint(config.Retries),
+		backoff:        bo,
+		info:           info,
+		maintained:     make(map[string]bool),
+		byHash:         newByHashIndex(),
+		downloads:      make(map[string][]*dlFuture),
+		results:        make(map[string]result),
+		uncached:       make(map[string]uncachedItem),
+		staleSince:     make(map[string]time.Time),
+		refreshed:      make(map[string]time.Time),
+		resultsPath:    filepath.Join(metaDir, resultsFile),
+		hostSem:        make(map[string]chan struct{}),
+		stats:          newRequestStats(),
+		trusted:        trusted,
+
+		peers:      peers,
+		peerClient: newPeerClient(peerTimeout),
+		peerHealth: peerHealth,
+		cluster:    cl,
+
+		onStorageError: onStorageError,
+
+		accessLog:       accessLog,
+		accessLogFormat: config.AccessLogFormat,
+
+		limiter: limiter,
+		hot: newHotCache(int64(config.HotCacheSize)*mib,
+			int64(config.HotCacheMaxItem)*kib),
+		clientCache: clientCache,
+
+		prefetchConcurrency: config.PrefetchConcurrency,
+		prefetching:         make(map[string]bool),
+		scrubRate:           float64(config.ScrubRate) * mib,
+
+		acme: acme,
+		tls:  tc,
+	}
+	if c.proxy {
+		c.selfNames, c.selfPort = selfNames(config.Addr)
+	}
+
+	if err := c.loadResults(); err != nil {
+		log.Warn("failed to load cached statuses", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	well.Go(c.persistResults)
+	if len(srv) > 0 {
+		interval := time.Duration(config.SRVRefreshInterval) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.refreshSRV(ctx, interval)
+		})
+	}
+	if sources != nil && config.SourcesListInterval > 0 {
+		interval := time.Duration(config.SourcesListInterval) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.watchSources(ctx, interval)
+		})
+	}
+	if config.ScrubInterval > 0 {
+		interval := time.Duration(config.ScrubInterval) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.scrubItems(ctx, interval)
+		})
+	}
+	if config.CompactInterval > 0 {
+		interval := time.Duration(config.CompactInterval) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.compactStorage(ctx, interval)
+		})
+	}
+	if config.CacheTTL > 0 {
+		ttl := time.Duration(config.CacheTTL) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.expire(ctx, ttl, "expired items", c.items.Expire)
+		})
+	}
+	if config.MetaTTL > 0 {
+		ttl := time.Duration(config.MetaTTL) * time.Second
+		well.Go(func(ctx context.Context) error {
+			return c.expire(ctx, ttl, "expired meta data files", c.expireMeta)
+		})
+	}
+
+	if !c.offline {
+		for prefix, pc := range config.Prefetch {
+			if len(pc.At) > 0 {
+				c.schedulePrefetch(prefix, pc)
+			}
+		}
+	}
+
+	if !config.SharedDirectories {
+		well.Go(c.persistSnapshots)
 	}
 
 	metas := meta.ListAll()
+	if snap != nil {
+		if err := c.info.Put(snap.items...); err != nil {
+			return nil, errors.Wrap(err, "info.Put")
+		}
+		for _, p := range snap.Maintained {
+			if meta.Contains(p) || cache.Contains(p) {
+				c.maintMeta(p)
+			}
+		}
+		metas = nil
+	}
 	for _, fi := range metas {
 		f, err := meta.Lookup(fi)
 		if err != nil {
@@ -139,70 +592,117 @@ func NewCacher(config *Config) (*Cacher, error) {
 			return nil, errors.Wrap(err, "ExtractFileInfo("+fi.Path()+")")
 		}
 		fil = addPrefix(t[0], fil)
-		for _, fi2 := range fil {
-			c.info[fi2.Path()] = fi2
+		if err := c.info.Put(fil...); err != nil {
+			return nil, errors.Wrap(err, "info.Put")
 		}
 	}
 
 	// add meta files w/o checksums (Release, Release.gpg, and InRelease).
 	for _, fi := range metas {
 		p := fi.Path()
-		if _, ok := c.info[p]; !ok {
-			c.info[p] = fi
+		if _, ok := c.info.Get(p); !ok {
+			if err := c.info.Put(fi); err != nil {
+				return nil, errors.Wrap(err, "info.Put")
+			}
 			c.maintMeta(p)
 		}
 	}
 
+	// indices cached before restarts.
+	if len(c.refreshIndices) > 0 {
+		for _, fi := range append(meta.ListAll(), cache.ListAll()...) {
+			if p := fi.Path(); !c.maintained[p] && c.refreshes(p) {
+				c.maintMeta(p)
+			}
+		}
+	}
+
+	if err := c.loadByHash(); err != nil {
+		return nil, errors.Wrap(err, "loadByHash")
+	}
+
+	if config.ProtectReferenced {
+		if err := c.updateReferences(); err != nil {
+			return nil, errors.Wrap(err, "updateReferences")
+		}
+		c.refsCh = make(chan struct{}, 1)
+		well.Go(c.maintReferences)
+	}
+
 	return c, nil
 }
 
-func (c *Cacher) acquireSemaphore(host string) {
-	if c.maxConns == 0 {
-		return
+// acquireSemaphore acquires the semaphore to limit connections to host
+// for p, and returns its key to release it.
+//
+// Prefixes with their own max_conns have dedicated semaphores.
+// An empty key is returned if connections are not limited.
+func (c *Cacher) acquireSemaphore(p, host string) string {
+	key, n := host, c.maxConns
+	prefix := strings.SplitN(p, "/", 2)[0]
+	if uc, ok := c.upstreams[prefix]; ok && uc.MaxConns > 0 {
+		key, n = prefix+"@"+host, uc.MaxConns
+	}
+	if n == 0 {
+		return ""
 	}
 
 	c.hostLock.Lock()
-	sem, ok := c.hostSem[host]
+	sem, ok := c.hostSem[key]
 	if !ok {
-		sem = make(chan struct{}, c.maxConns)
-		for i := 0; i < c.maxConns; i++ {
+		sem = make(chan struct{}, n)
+		for i := 0; i < n; i++ {
 			sem <- struct{}{}
 		}
-		c.hostSem[host] = sem
+		c.hostSem[key] = sem
 	}
 	c.hostLock.Unlock()
 
 	<-sem
+	return key
 }
 
-func (c *Cacher) releaseSemaphore(host string) {
-	if c.maxConns == 0 {
+func (c *Cacher) releaseSemaphore(key string) {
+	if key == "" {
 		return
 	}
 
 	c.hostLock.Lock()
-	c.hostSem[host] <- struct{}{}
+	c.hostSem[key] <- struct{}{}
 	c.hostLock.Unlock()
 }
 
 func (c *Cacher) maintMeta(p string) {
-	switch path.Base(p) {
-	case "Release":
-		well.Go(func(ctx context.Context) error {
-			c.maintRelease(ctx, p, true)
-			return nil
-		})
-	case "InRelease":
+	c.maintained[p] = true
+	if c.offline {
+		return
+	}
+
+	switch base := path.Base(p); base {
+	case "Release", "InRelease":
+		if c.onDemand {
+			// checked when requested.
+			return
+		}
 		well.Go(func(ctx context.Context) error {
-			c.maintRelease(ctx, p, false)
+			c.maintRelease(ctx, p, base == "Release")
 			return nil
 		})
+	default:
+		if c.refreshes(p) {
+			well.Go(func(ctx context.Context) error {
+				c.maintIndex(ctx, p)
+				return nil
+			})
+		}
 	}
 }
 
 func (c *Cacher) maintRelease(ctx context.Context, p string, withGPG bool) {
-	ticker := time.NewTicker(c.checkInterval)
-	defer ticker.Stop()
+	// the first check is staggered so that Release files of many
+	// mappings are not checked at once.
+	timer := time.NewTimer(stagger(c.checkInterval))
+	defer timer.Stop()
 
 	if log.Enabled(log.LvDebug) {
 		log.Debug("maintRelease", map[string]interface{}{
@@ -214,14 +714,20 @@ func (c *Cacher) maintRelease(ctx context.Context, p string, withGPG bool) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			ch1 := c.Download(p, nil)
-			if withGPG {
-				ch2 := c.Download(p+".gpg", nil)
-				<-ch2
-			}
-			<-ch1
+		case <-timer.C:
 		}
+		timer.Reset(jitter(c.checkInterval))
+
+		if !c.meta.Contains(p) {
+			// expired until requested again.
+			continue
+		}
+		ch1 := c.Download(p, nil)
+		if withGPG {
+			ch2 := c.Download(p+".gpg", nil)
+			<-ch2
+		}
+		<-ch1
 	}
 }
 
@@ -233,62 +739,92 @@ func closeRespBody(r *http.Response) {
 // Download downloads an item and caches it.
 //
 // If valid is not nil, the downloaded data is validated against it.
+// A download in progress is shared if it is validated against the
+// same checksum, or valid is nil.
 //
 // The caller receives a channel that will be closed when the item
 // is downloaded and cached.  If prefix of p is not registered
-// in URLMap, nil is returned.
+// in URLMap or p is blocked, nil is returned.
 //
 // Note that download may fail, or just invalidated soon.
 // Users of this method should retry if the item is not cached
 // or invalidated.
 func (c *Cacher) Download(p string, valid *apt.FileInfo) <-chan struct{} {
-	u := c.um.URL(p)
-	if u == nil {
+	f := c.future(p, valid)
+	if f == nil {
 		return nil
 	}
+	return f.done
+}
 
-	c.dlLock.Lock()
-	defer c.dlLock.Unlock()
-
-	ch, ok := c.dlChannels[p]
-	if ok {
-		return ch
+// setAuth sets credentials for the upstream of p to req.
+//
+// Credentials configured for the mapping prefix take precedence over
+// those in auth_file.
+func (c *Cacher) setAuth(req *http.Request, p string) {
+	prefix := strings.SplitN(p, "/", 2)[0]
+	if uc, ok := c.upstreams[prefix]; ok && uc.setAuth(req) {
+		return
+	}
+	if c.creds != nil {
+		if login, password, ok := c.creds.Lookup(req.URL); ok {
+			req.SetBasicAuth(login, password)
+		}
 	}
-
-	ch = make(chan struct{})
-	c.dlChannels[p] = ch
-	well.Go(func(ctx context.Context) error {
-		c.download(ctx, p, u, valid)
-		return nil
-	})
-	return ch
 }
 
-// download is a goroutine to download an item.
-func (c *Cacher) download(ctx context.Context, p string, u *url.URL, valid *apt.FileInfo) {
-	c.acquireSemaphore(u.Host)
+// clientFor returns the HTTP client for the upstream of p.
+func (c *Cacher) clientFor(p string) *http.Client {
+	prefix := strings.SplitN(p, "/", 2)[0]
+	if client, ok := c.clients[prefix]; ok {
+		return client
+	}
+	return c.client
+}
 
+// download is a goroutine to download an item for future f.
+func (c *Cacher) download(ctx context.Context, f *dlFuture, u *url.URL) {
+	p, valid, st := f.path, f.valid, f.stream
 	statusCode := http.StatusInternalServerError
 
+	// cached is the contents cached by this download, if known.
+	var cached *apt.FileInfo
+
+	// uncached is the file to serve the item without caching, if any.
+	var uncached string
+
 	defer func() {
-		c.releaseSemaphore(u.Host)
 		c.dlLock.Lock()
-		ch := c.dlChannels[p]
-		delete(c.dlChannels, p)
-		c.results[p] = statusCode
+		c.removeFuture(f)
+		// streaming clients receive the end of the item only after
+		// it is validated and cached.
+		if statusCode == http.StatusOK {
+			st.finish(nil)
+		} else {
+			st.finish(errStreamAborted)
+		}
+		period := c.setResult(p, statusCode)
+		if statusCode == http.StatusOK {
+			delete(c.staleSince, p)
+			if c.onDemand && refreshedOnDemand(p) {
+				c.refreshed[p] = time.Now()
+			}
+		}
 		c.dlLock.Unlock()
-		close(ch)
+		f.resolve(statusCode, cached)
 
-		// invalidate result cache after some interval
+		// remove uncached item after some interval.
+		// expired statuses are removed by persistResults.
+		if uncached == "" {
+			return
+		}
 		well.Go(func(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return nil
-			case <-time.After(c.cachePeriod):
+			case <-time.After(period):
 			}
-			c.dlLock.Lock()
-			delete(c.results, p)
-			c.dlLock.Unlock()
+			c.removeUncached(p, uncached)
 			return nil
 		})
 	}()
@@ -296,89 +832,233 @@ func (c *Cacher) download(ctx context.Context, p string, u *url.URL, valid *apt.
 	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
 	defer cancel()
 
-	// imitation apt-get command
-	// NOTE: apt-get sets If-Modified-Since and makes a request to the server,
-	// but the current aptutil cannot handle this because it cold-starts every time.
-	header := http.Header{}
-	header.Add("Cache-Control", "max-age=0")
-	header.Add("User-Agent", "Debian APT-HTTP/1.3 (aptutil)")
-
-	req := &http.Request{
-		Method:     "GET",
-		URL:        u,
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     header,
-	}
-	resp, err := c.client.Do(req.WithContext(ctx))
+	storage := c.items
+	if apt.IsMeta(p) {
+		storage = c.meta
+	}
+
+	// the same contents may have been cached for another path.
+	if valid != nil && storage == c.items {
+		c.fiLock.Lock()
+		reused := !c.snapshotSaved && storage.Reuse(valid)
+		c.fiLock.Unlock()
+		if reused {
+			statusCode = http.StatusOK
+			cached = valid
+			log.Debug("reused cached contents", map[string]interface{}{
+				"path": p,
+			})
+			return
+		}
+	}
+
+	// peers may have cached the item.
+	if storage == c.items && c.fetchFromPeers(ctx, p, valid) {
+		statusCode = http.StatusOK
+		cached = valid
+		return
+	}
+
+	// download files listed in Release by their hash values if
+	// possible, as the upstream may be updating them.
+	src := p
+	if valid != nil {
+		c.fiLock.RLock()
+		if bp := c.byHash.source(valid); bp != "" {
+			src = bp
+		}
+		c.fiLock.RUnlock()
+	}
+
+	var cond *Validators
+	if (storage == c.meta || c.cacheControl(p) != nil) && src == p {
+		cond = c.revalidatable(p, storage)
+	}
+	ur, resp, err := c.openUpstream(ctx, src, cond)
+	if ur != nil {
+		defer ur.Close()
+		u = ur.u
+	}
 	if err != nil {
 		log.Warn("GET failed", map[string]interface{}{
 			"url":   u.String(),
 			"error": err.Error(),
 		})
+		if _, ok := err.(*redirectError); ok {
+			statusCode = http.StatusBadGateway
+		} else if err == errBreakerOpen {
+			statusCode = http.StatusServiceUnavailable
+		}
 		return
 	}
 
-	defer closeRespBody(resp)
 	statusCode = resp.StatusCode
-	if statusCode != 200 {
+	if statusCode == http.StatusNotModified && ur.cond != nil {
+		// the cached item is still fresh.
+		statusCode = http.StatusOK
+		if storage == c.items && c.cacheControl(p) != nil {
+			v := c.setFreshness(p, ur.cond, resp.Header)
+			if err := storage.SetValidators(p, v); err != nil {
+				log.Warn("could not save validators", map[string]interface{}{
+					"path":  p,
+					"error": err.Error(),
+				})
+			}
+		}
+		log.Debug("not modified", map[string]interface{}{
+			"path": p,
+		})
 		return
 	}
-
-	storage := c.items
-	if apt.IsMeta(p) {
-		storage = c.meta
+	if statusCode != 200 {
+		return
 	}
 
+	// passThrough is true if the item is not to be cached due to
+	// storage failures.
+	passThrough := false
 	tempfile, err := storage.TempFile()
+	if err != nil {
+		c.health.fail(err)
+		if c.onStorageError == StorageErrorPassThrough {
+			tempfile, err = passThroughTempFile()
+			passThrough = true
+		}
+	}
 	if err != nil {
 		log.Warn("GET failed", map[string]interface{}{
 			"url":   u.String(),
 			"error": err.Error(),
 		})
+		statusCode = http.StatusServiceUnavailable
 		return
 	}
+	cw := newCacheWriter(tempfile, st, passThrough,
+		c.onStorageError == StorageErrorPassThrough, c.wrapTempFile)
+	keep := false
 	defer func() {
-		tempfile.Close()
-		os.Remove(tempfile.Name())
+		cw.f.Close()
+		if !keep {
+			os.Remove(cw.f.Name())
+		}
 	}()
 
-	fi, err := apt.CopyWithFileInfo(tempfile, resp.Body, p)
-	if err != nil {
-		log.Warn("GET failed", map[string]interface{}{
-			"url":   u.String(),
+	// zero if Last-Modified is missing or invalid.
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	if err := st.start(tempfile.Name(), resp.ContentLength, lastModified); err != nil {
+		log.Warn("failed to start streaming", map[string]interface{}{
+			"path":  p,
 			"error": err.Error(),
 		})
-		return
 	}
-	err = tempfile.Sync()
+
+	fi, err := apt.CopyWithFileInfo(streamWriter{cw, st}, ur, p)
+
+	// release the connection now as verifyRelease downloads
+	// Release.gpg from the same host.
+	ur.Close()
+
+	if err == nil {
+		err = cw.Sync()
+	}
+	if cw.err != nil {
+		c.health.fail(cw.err)
+	}
 	if err != nil {
-		log.Warn("tempfile.Sync failed", map[string]interface{}{
+		log.Warn("GET failed", map[string]interface{}{
 			"url":   u.String(),
 			"error": err.Error(),
 		})
+		statusCode = http.StatusBadGateway
+		if cw.failed {
+			statusCode = http.StatusServiceUnavailable
+		}
 		return
 	}
+	tempfile, passThrough = cw.f, cw.passThrough
 	if valid != nil && !valid.Same(fi) {
 		log.Warn("downloaded data is not valid", map[string]interface{}{
 			"url": u.String(),
 		})
+		statusCode = http.StatusBadGateway
+		return
+	}
+	if isRelease(p) {
+		if err := c.verifyRelease(ctx, p, tempfile); err != nil {
+			log.Error("failed to verify signature", map[string]interface{}{
+				"url":   u.String(),
+				"error": err.Error(),
+			})
+			statusCode = http.StatusBadGateway
+			return
+		}
+	}
+
+	if !lastModified.IsZero() {
+		err = os.Chtimes(tempfile.Name(), lastModified, lastModified)
+		if err != nil {
+			log.Warn("failed to set Last-Modified", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+		}
+	}
+
+	if passThrough {
+		uncached = tempfile.Name()
+		c.addUncached(p, uncached, fi)
+		keep = true
 		return
 	}
 
+	err = c.cache(p, storage, tempfile, fi, resp.Header)
+	switch {
+	case err == errShuttingDown:
+		statusCode = http.StatusServiceUnavailable
+		return
+	case err != nil:
+		log.Error("could not save an item", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+		if c.onStorageError == StorageErrorPassThrough {
+			uncached = tempfile.Name()
+			c.addUncached(p, uncached, fi)
+			keep = true
+		} else {
+			statusCode = http.StatusServiceUnavailable
+		}
+		return
+	}
+	cached = fi
+	if c.health.recover() {
+		well.Go(func(ctx context.Context) error {
+			c.retryUncached()
+			return nil
+		})
+	}
+	log.Info("downloaded and cached", map[string]interface{}{
+		"path": p,
+	})
+}
+
+// cache inserts the downloaded file f for p into storage and indexes it.
+// h is the header of the upstream response, or nil if unknown.
+//
+// errShuttingDown is returned if the indices have been saved.
+// Other errors are storage failures.
+func (c *Cacher) cache(p string, storage *Storage, f *os.File, fi *apt.FileInfo, h http.Header) error {
 	var fil []*apt.FileInfo
+	var d apt.Paragraph
 
 	if t := strings.SplitN(path.Clean(p), "/", 2); len(t) == 2 && apt.IsMeta(t[1]) {
-		_, err = tempfile.Seek(0, io.SeekStart)
+		_, err := f.Seek(0, io.SeekStart)
 		if err != nil {
-			log.Error("failed to reset tempfile offset", map[string]interface{}{
-				"error": err.Error(),
-			})
-			return
+			return errors.Wrap(err, "failed to reset tempfile offset")
 		}
 
-		fil, _, err = apt.ExtractFileInfo(t[1], tempfile)
+		fil, d, err = apt.ExtractFileInfo(t[1], f)
 		if err != nil {
 			log.Error("invalid meta data", map[string]interface{}{
 				"path":  p,
@@ -392,87 +1072,318 @@ func (c *Cacher) download(ctx context.Context, p string, u *url.URL, valid *apt.
 	c.fiLock.Lock()
 	defer c.fiLock.Unlock()
 
+	if c.snapshotSaved {
+		return errShuttingDown
+	}
+
 	// To keep consistency between Cacher and Storage so that
 	// both have the same set of FileInfo, storage.Insert need to be
 	// guarded by c.fiLock.
-	if err := storage.Insert(tempfile.Name(), fi); err != nil {
-		log.Error("could not save an item", map[string]interface{}{
-			"path":  p,
-			"error": err.Error(),
-		})
-		// panic because go-apt-cacher cannot continue working
-		panic(err)
+	if err := storage.Insert(f.Name(), fi); err != nil {
+		c.health.fail(err)
+		return err
 	}
 
-	for _, fi2 := range fil {
-		c.info[fi2.Path()] = fi2
+	if h != nil {
+		v := validatorsFromHeader(h)
+		if storage == c.items {
+			v = c.setFreshness(p, v, h)
+		}
+		if v != nil {
+			if err := storage.SetValidators(p, v); err != nil {
+				log.Warn("could not save validators", map[string]interface{}{
+					"path":  p,
+					"error": err.Error(),
+				})
+			}
+		}
 	}
+
 	if apt.IsMeta(p) {
-		_, ok := c.info[p]
+		_, ok := c.info.Get(p)
 		if !ok {
 			// As this is the first time that downloaded meta file p,
 			c.maintMeta(p)
 		}
 	}
-	c.info[p] = fi
-	log.Info("downloaded and cached", map[string]interface{}{
-		"path": p,
-	})
+	if !c.maintained[p] && c.refreshes(p) {
+		// indices listed in Release files are maintained when
+		// requested first.
+		c.maintMeta(p)
+	}
+	if err := c.info.Put(append(fil, fi)...); err != nil {
+		log.Error("could not index items", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+	}
+	if isRelease(p) {
+		c.byHash.update(p, fil, d)
+	}
+	if len(fil) > 0 {
+		c.notifyReferences()
+	}
+	return nil
 }
 
 // Get looks up a cached item, and if not found, downloads it
-// from the upstream server.
+// from the upstream server.  p may be a by-hash path of a file
+// listed in Release.
 //
 // The return values are cached HTTP status code of the response from
 // an upstream server, a pointer to os.File for the cache file,
 // and error.
 func (c *Cacher) Get(p string) (statusCode int, f *os.File, err error) {
-	u := c.um.URL(p)
-	if u == nil {
-		return http.StatusNotFound, nil, nil
+	statusCode, f, _, _, err = c.get(p, false)
+	return
+}
+
+// get implements Get.  If stream is true and p is being downloaded,
+// a reader of the item being downloaded is returned instead of
+// waiting for the download.
+//
+// cache is one of cacheHit, cacheMiss, cacheUpstream, and cacheStale
+// to tell how the item is served.
+func (c *Cacher) get(p string, stream bool) (statusCode int, f *os.File, r *streamReader, cache string, err error) {
+	// by-hash paths of indices are served as their files.
+	p = c.byHashTarget(p)
+
+	// cached items of unresolved SRV upstreams are served.
+	unresolved := c.unresolved(p)
+	if c.upstreamURL(p) == nil && !unresolved {
+		return http.StatusNotFound, nil, nil, cacheMiss, nil
+	}
+	if c.blocked(p) {
+		return http.StatusForbidden, nil, nil, cacheBlocked, nil
 	}
 
 	storage := c.items
 	if apt.IsMeta(p) {
 		if !apt.IsSupported(p) {
 			// return 404 for unsupported compression algorithms
-			return http.StatusNotFound, nil, nil
+			return http.StatusNotFound, nil, nil, cacheMiss, nil
 		}
 		storage = c.meta
 	}
 
+	cache = cacheHit
+	defer func() {
+		c.stats.record(p, cache == cacheHit && statusCode == http.StatusOK)
+	}()
+
+	waited := false
+
 RETRY:
 	c.fiLock.RLock()
-	fi, ok := c.info[p]
+	fi, ok := c.info.Get(p)
 	c.fiLock.RUnlock()
 
+	valid := fi
 	if ok {
 		f, err := storage.Lookup(fi)
-		switch err {
-		case nil:
-			return http.StatusOK, f, nil
-		case ErrNotFound:
+		switch {
+		case err == nil && storage == c.items && !c.offline && storage.Stale(p, time.Now()):
+			if waited {
+				// the item is stale as soon as revalidated, or
+				// failed to be refreshed.
+				c.dlLock.RLock()
+				result, _ := c.getResult(p, true)
+				c.dlLock.RUnlock()
+				if result != http.StatusOK {
+					cache = cacheStale
+				}
+				return http.StatusOK, f, nil, cache, nil
+			}
+			// the contents may have been changed.
+			f.Close()
+			valid = nil
+		case err == nil && !waited && c.refreshDue(p, true):
+			// check updates of Release files on demand.  The cached
+			// file is served if the check fails.
+			f.Close()
+			if ch := c.Download(p, nil); ch != nil {
+				<-ch
+			}
+			waited = true
+			goto RETRY
+		case err == nil:
+			return http.StatusOK, f, nil, cache, nil
+		case err == ErrNotFound:
 		default:
 			log.Error("lookup failure", map[string]interface{}{
 				"error": err.Error(),
 			})
-			return http.StatusInternalServerError, nil, err
+			return http.StatusInternalServerError, nil, nil, cacheMiss, err
 		}
 	}
 
 	// not found in storage.
+	if ok && valid != nil {
+		if f := c.convertIndex(storage, fi); f != nil {
+			return http.StatusOK, f, nil, cache, nil
+		}
+	}
+	if c.offline {
+		statusCode, f, err = c.getOffline(p, storage, ok)
+		return statusCode, f, nil, cacheMiss, err
+	}
+
 	c.dlLock.RLock()
-	ch, chOk := c.dlChannels[p]
-	result, resultOk := c.results[p]
+	result, resultOk := c.getResult(p, waited)
 	c.dlLock.RUnlock()
 
 	if resultOk && result != http.StatusOK {
-		return result, nil, nil
+		if storage == c.meta && result >= 500 {
+			if f := c.openStale(p); f != nil {
+				return http.StatusOK, f, nil, cacheStale, nil
+			}
+		}
+		return result, nil, nil, cacheMiss, nil
 	}
-	if chOk {
-		<-ch
-	} else {
-		<-c.Download(p, fi)
+	if f := c.openUncached(p); f != nil {
+		return http.StatusOK, f, nil, cacheUpstream, nil
 	}
+	cache = cacheMiss
+	fut := c.future(p, valid)
+	if fut == nil && unresolved {
+		return http.StatusServiceUnavailable, nil, nil, cache, nil
+	}
+	if fut == nil {
+		return http.StatusNotFound, nil, nil, cache, nil
+	}
+	if stream {
+		if r := fut.openStream(); r != nil {
+			return http.StatusOK, nil, r, cacheUpstream, nil
+		}
+	}
+	<-fut.done
+
+	// serve what the download cached without looking up the index
+	// again, as it may have been updated for other contents.
+	if fut.status == http.StatusOK && fut.fi != nil {
+		if f, err := storage.Lookup(fut.fi); err == nil {
+			return http.StatusOK, f, nil, cache, nil
+		}
+	}
+	waited = true
 	goto RETRY
 }
+
+// statCached returns FileInfo and os.FileInfo of a cached item p
+// listed in indices, or nils if not found.
+func (c *Cacher) statCached(p string) (*apt.FileInfo, os.FileInfo) {
+	storage := c.items
+	if apt.IsMeta(p) {
+		storage = c.meta
+	}
+
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	cached, stat, err := storage.Stat(fi)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Warn("stat failure", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+		}
+		return nil, nil
+	}
+	return cached, stat
+}
+
+// stat is a variant of get for HEAD requests.  Cached items are
+// looked up without opening them.  Items not cached are retrieved
+// as get does.
+//
+// fi is nil if checksums of the item are unknown, e.g. the item
+// is not listed in indices.
+func (c *Cacher) stat(p string) (statusCode int, fi *apt.FileInfo, stat os.FileInfo, cache string, err error) {
+	p = c.byHashTarget(p)
+	if fi, stat := c.statCached(p); stat != nil {
+		c.stats.record(p, true)
+		return http.StatusOK, fi, stat, cacheHit, nil
+	}
+
+	statusCode, f, _, cache, err := c.get(p, false)
+	if err != nil || statusCode != http.StatusOK {
+		return statusCode, nil, nil, cache, err
+	}
+	defer f.Close()
+
+	if fi, stat := c.statCached(p); stat != nil {
+		return http.StatusOK, fi, stat, cache, nil
+	}
+	stat, err = f.Stat()
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, cache, err
+	}
+	return http.StatusOK, nil, stat, cache, nil
+}
+
+// getOffline returns an item not found by the file index in offline mode.
+//
+// Items not listed in indices, such as those imported from another
+// cache, are served as is.  Items that do not match the index are not.
+func (c *Cacher) getOffline(p string, storage *Storage, indexed bool) (int, *os.File, error) {
+	if indexed {
+		return http.StatusNotFound, nil, nil
+	}
+	f, err := storage.Open(p)
+	switch err {
+	case nil:
+		return http.StatusOK, f, nil
+	case ErrNotFound:
+		return http.StatusNotFound, nil, nil
+	}
+	return http.StatusInternalServerError, nil, err
+}
+
+// openStale opens the previously cached version of a meta data
+// file p if the grace period of serve_stale has not passed since
+// the upstream started failing.  Otherwise, nil is returned.
+func (c *Cacher) openStale(p string) *os.File {
+	if c.serveStale == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	c.dlLock.Lock()
+	since, ok := c.staleSince[p]
+	if !ok {
+		since = now
+		c.staleSince[p] = now
+	}
+	c.dlLock.Unlock()
+	if now.Sub(since) > c.serveStale {
+		return nil
+	}
+
+	f, err := c.meta.Open(p)
+	if err != nil {
+		return nil
+	}
+	log.Warn("serving stale item", map[string]interface{}{
+		"path":  p,
+		"since": since.Format(time.RFC3339),
+	})
+	return f
+}
+
+// Stats returns a snapshot of request statistics.
+func (c *Cacher) Stats() Stats {
+	st := c.stats.snapshot()
+	st.NegativeCache = c.negativeCounts()
+	if c.hot != nil {
+		st.HotCache = c.hot.stats()
+	}
+	if c.breaker != nil {
+		st.Breakers = c.breaker.stats()
+	}
+	return st
+}
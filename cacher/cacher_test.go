@@ -0,0 +1,36 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestCacher creates a Cacher whose directories are in a new
+// temporary directory.  If mutate is not nil, it is called to modify
+// the configuration before the Cacher is created.
+//
+// The returned function removes the temporary directory.
+func newTestCacher(t *testing.T, mutate func(config *Config)) (*Cacher, func()) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.MetaDirectory = filepath.Join(dir, "meta")
+	config.CacheDirectory = filepath.Join(dir, "cache")
+	if mutate != nil {
+		mutate(config)
+	}
+
+	c, err := NewCacher(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, func() {
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,189 @@
+package cacher
+
+// This file implements the cluster mode that partitions items among
+// go-apt-cacher instances by consistent hashing.
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// clusterHeader marks requests forwarded to the owner node.
+	clusterHeader = "X-Apt-Cacher-Cluster"
+
+	// clusterReplicas is the number of virtual nodes per node.
+	clusterReplicas = 128
+)
+
+var (
+	// headers of requests forwarded to owner nodes.
+	forwardedRequestHeaders = []string{
+		"Range", "If-Range", "If-Modified-Since", "If-Unmodified-Since",
+		"If-None-Match", "If-Match", "User-Agent",
+	}
+
+	// headers of responses copied from owner nodes.
+	forwardedResponseHeaders = []string{
+		"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges",
+		"Last-Modified", "ETag", checksumHeader,
+	}
+)
+
+func ringHash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// hashRing is a consistent hash ring of nodes.
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]*url.URL
+}
+
+func newHashRing(nodes []*url.URL) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]*url.URL)}
+	for _, n := range nodes {
+		for i := 0; i < clusterReplicas; i++ {
+			h := ringHash(n.String() + "#" + strconv.Itoa(i))
+			if _, ok := r.nodes[h]; ok {
+				continue
+			}
+			r.nodes[h] = n
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// owner returns the node that owns key.
+func (r *hashRing) owner(key string) *url.URL {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// cluster is a group of go-apt-cacher instances sharing items.
+type cluster struct {
+	self   *url.URL
+	ring   *hashRing
+	client *http.Client
+	health *upstreamHealth
+}
+
+// newCluster returns a cluster, or nil if nodes is empty.
+func newCluster(nodes []string, self string, health *upstreamHealth) (*cluster, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	urls, err := parsePeers(nodes)
+	if err != nil {
+		return nil, err
+	}
+	selfURLs, err := parsePeers([]string{self})
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster_self")
+	}
+	found := false
+	for _, u := range urls {
+		if u.String() == selfURLs[0].String() {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("cluster_self must be in cluster_nodes")
+	}
+
+	return &cluster{
+		self:   selfURLs[0],
+		ring:   newHashRing(urls),
+		client: newPeerClient(0),
+		health: health,
+	}, nil
+}
+
+// ownerOf returns the node owning p, or nil if p is to be served
+// by this node.  Meta data files are served by every node as they
+// are needed to verify items.
+func (cl *cluster) ownerOf(p string) *url.URL {
+	if apt.IsMeta(p) {
+		return nil
+	}
+	owner := cl.ring.owner(p)
+	if owner == nil || owner.String() == cl.self.String() {
+		return nil
+	}
+	if !cl.health.healthy(owner) {
+		return nil
+	}
+	return owner
+}
+
+// forward serves p by the owner node.  It returns false if the owner
+// cannot be connected so that p can be served locally.
+func (cl *cluster) forward(w http.ResponseWriter, r *http.Request, owner *url.URL, p string) bool {
+	u := owner.ResolveReference(&url.URL{Path: p})
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	for _, k := range forwardedRequestHeaders {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set(clusterHeader, "1")
+
+	resp, err := cl.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Warn("failed to forward to owner", map[string]interface{}{
+				"owner": owner.String(),
+				"path":  p,
+				"error": err.Error(),
+			})
+			cl.health.fail(owner)
+		}
+		return false
+	}
+	defer resp.Body.Close()
+	cl.health.ok(owner)
+
+	setCacheStatus(r, cacheRemote)
+	for _, k := range forwardedResponseHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if fl, ok := w.(http.Flusher); ok {
+		dst = flushWriter{w, fl}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		log.Warn("forwarding aborted", map[string]interface{}{
+			"owner": owner.String(),
+			"path":  p,
+			"error": err.Error(),
+		})
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package cacher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestHashRing(t *testing.T) {
+	t.Parallel()
+
+	nodes, err := parsePeers([]string{
+		"http://cacher1:3142", "http://cacher2:3142", "http://cacher3:3142",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3 := newHashRing(nodes)
+	r2 := newHashRing(nodes[:2])
+
+	counts := make(map[string]int)
+	moved := 0
+	const n = 3000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("ubuntu/pool/main/p%d.deb", i)
+		o3 := r3.owner(key)
+		counts[o3.String()]++
+		if r3.owner(key) != o3 {
+			t.Fatal(`owner must be stable`, key)
+		}
+		o2 := r2.owner(key)
+		if o3 != nodes[2] && o2 != o3 {
+			moved++
+		}
+	}
+	for _, u := range nodes {
+		if c := counts[u.String()]; c < n/6 {
+			t.Error(`keys must be distributed evenly`, u, c)
+		}
+	}
+	if moved != 0 {
+		t.Error(`only keys of the removed node may move`, moved)
+	}
+
+	if newHashRing(nil).owner("a") != nil {
+		t.Error(`empty ring must not have owners`)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	t.Parallel()
+
+	// enough packages for both nodes to own some.
+	var pkgs []repotest.Package
+	for i := 0; i < 32; i++ {
+		pkgs = append(pkgs, repotest.Package{
+			Name: fmt.Sprintf("p%d", i), Version: "1.0", Arch: "amd64",
+			Data: []byte(fmt.Sprintf("package %d", i)),
+		})
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		repo.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	// start servers first to know their URLs.
+	var handlers [2]http.Handler
+	var servers [2]*httptest.Server
+	var nodes []string
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+		nodes = append(nodes, servers[i].URL)
+	}
+	var cachers [2]*Cacher
+	var config *Config
+	for i := range cachers {
+		c, cleanup := newTestCacher(t, func(cfg *Config) {
+			cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+			cfg.ClusterNodes = nodes
+			cfg.ClusterSelf = nodes[i]
+			config = cfg
+		})
+		defer cleanup()
+		cachers[i] = c
+		handlers[i] = cacheHandler{c}
+	}
+
+	// the second round is served from the cache of owners.
+	for round := 0; round < 2; round++ {
+		for _, pkg := range pkgs {
+			p := "ubuntu/" + repotest.PoolPath(pkg)
+			resp, err := http.Get(servers[0].URL + "/" + p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || string(data) != string(pkg.Data) {
+				t.Error(`unexpected response`, p, resp.StatusCode, string(data))
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	owned := 0
+	for _, pkg := range pkgs {
+		p := "ubuntu/" + repotest.PoolPath(pkg)
+		if n := requests["/"+repotest.PoolPath(pkg)]; n != 1 {
+			t.Error(`items must be downloaded once in a cluster`, p, n)
+		}
+		owner := cachers[0].cluster.ring.owner(p).String()
+		for i, c := range cachers {
+			if c.items.Contains(p) != (owner == nodes[i]+"/") {
+				t.Error(`items must be cached only by the owner`, p, i)
+			}
+		}
+		if owner == nodes[1]+"/" {
+			owned++
+		}
+	}
+	if owned == 0 {
+		t.Error(`no items are owned by the other node`)
+	}
+
+	config.ClusterSelf = "http://cacher3:3142"
+	if _, err := NewCacher(config); err == nil {
+		t.Error(`cluster_self must be in cluster_nodes`)
+	}
+}
@@ -0,0 +1,243 @@
+package cacher
+
+// This file implements compaction of cache directories.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+const (
+	// staleTempAge is the age of temporary files left by crashes.
+	// Downloads never take longer than requestTimeout.
+	staleTempAge = 2 * requestTimeout
+)
+
+// CompactResult is the result of compaction.
+type CompactResult struct {
+	// EmptyDirs is the number of removed empty directories.
+	EmptyDirs int `json:"empty_dirs"`
+
+	// TempFiles is the number of removed stale temporary files.
+	TempFiles int `json:"temp_files"`
+
+	// Missing is the number of items removed as their files are gone.
+	Missing int `json:"missing"`
+
+	// Adjusted is the total difference of the used bytes corrected.
+	Adjusted uint64 `json:"adjusted_bytes"`
+}
+
+func (r *CompactResult) add(o *CompactResult) {
+	r.EmptyDirs += o.EmptyDirs
+	r.TempFiles += o.TempFiles
+	r.Missing += o.Missing
+	r.Adjusted += o.Adjusted
+}
+
+// isTempFile returns true if name is a temporary file by TempFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, "_tmp")
+}
+
+// Compact removes empty directories and temporary files older than
+// tempAge, and reconciles items and their used bytes with files.
+//
+// Files are walked without the lock so that requests are not blocked.
+func (cm *Storage) Compact(ctx context.Context, tempAge time.Duration) (*CompactResult, error) {
+	res := new(CompactResult)
+	deadline := time.Now().Add(-tempAge)
+
+	var dirs []string
+	wf := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != cm.dir && path != filepath.Join(cm.dir, tempDir) {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isTempFile(info.Name()) || info.ModTime().After(deadline) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		res.TempFiles++
+		return nil
+	}
+	if err := filepath.Walk(cm.dir, wf); err != nil {
+		return res, err
+	}
+
+	// children come after their parents.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if cm.removeEmptyDir(dirs[i]) {
+			res.EmptyDirs++
+		}
+	}
+
+	missing, err := cm.missingEntries(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.Missing, res.Adjusted = cm.reconcile(missing)
+	return res, nil
+}
+
+// removeEmptyDir removes dir if it is empty.  The lock is held so that
+// Insert does not put files into dir being removed.
+func (cm *Storage) removeEmptyDir(dir string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.lockDir()()
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	names, _ := f.Readdirnames(1)
+	f.Close()
+	if len(names) > 0 {
+		return false
+	}
+	return os.Remove(dir) == nil
+}
+
+// missingEntries returns entries whose files do not exist.
+func (cm *Storage) missingEntries(ctx context.Context) ([]*entry, error) {
+	cm.mu.Lock()
+	entries := make([]*entry, 0, len(cm.cache))
+	for _, e := range cm.cache {
+		entries = append(entries, e)
+	}
+	cm.mu.Unlock()
+
+	var missing []*entry
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		_, err := os.Stat(filepath.Join(cm.dir, e.FilePath()))
+		if os.IsNotExist(err) {
+			missing = append(missing, e)
+		}
+	}
+	return missing, nil
+}
+
+// reconcile removes missing entries still cached and recalculates
+// used bytes of pools.  It returns the number of removed entries and
+// the total difference of used bytes.
+func (cm *Storage) reconcile(missing []*entry) (int, uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.lockDir()()
+
+	n := 0
+	for _, e := range missing {
+		if cm.cache[e.Path()] != e {
+			// replaced meanwhile.
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(cm.dir, e.FilePath())); !os.IsNotExist(err) {
+			continue
+		}
+		cm.invalidateSnapshot()
+		cm.remove(e)
+		delete(cm.cache, e.Path())
+		cm.releaseContent(e)
+		cm.removeSidecars(e)
+		log.Warn("removed an item whose file is missing", map[string]interface{}{
+			"path": e.Path(),
+		})
+		n++
+	}
+
+	used := make(map[*pool]uint64)
+	for _, e := range cm.cache {
+		used[e.pool] += e.Size()
+	}
+	var adjusted uint64
+	for _, pl := range append(cm.poolList(), &cm.shared) {
+		if u := used[pl]; u != pl.used {
+			if u > pl.used {
+				adjusted += u - pl.used
+			} else {
+				adjusted += pl.used - u
+			}
+			pl.used = u
+		}
+	}
+	cm.recount()
+	cm.maint()
+	return n, adjusted
+}
+
+// poolList returns pools with dedicated capacities.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) poolList() []*pool {
+	l := make([]*pool, 0, len(cm.pools))
+	for _, pl := range cm.pools {
+		l = append(l, pl)
+	}
+	return l
+}
+
+// Compact compacts the directories of meta data files and items.
+func (c *Cacher) Compact(ctx context.Context) (*CompactResult, error) {
+	res := new(CompactResult)
+	for _, s := range []*Storage{c.meta, c.items} {
+		r, err := s.Compact(ctx, staleTempAge)
+		if r != nil {
+			res.add(r)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// compactStorage runs Compact every interval.
+func (c *Cacher) compactStorage(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		res, err := c.Compact(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error("compaction failed", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+			continue
+		}
+		log.Info("compacted storage", map[string]interface{}{
+			"empty_dirs":     res.EmptyDirs,
+			"temp_files":     res.TempFiles,
+			"missing":        res.Missing,
+			"adjusted_bytes": res.Adjusted,
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package cacher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageCompact(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abc")
+	if _, err := insert(cm, data, "ubuntu/pool/a/a.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert(cm, []byte("defg"), "ubuntu/pool/b/b.deb"); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is removed by hand.
+	if err := os.Remove(filepath.Join(dir, cm.itemFile("ubuntu/pool/b/b.deb"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "x/y/z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(dir, "_tmp123")
+	recent := filepath.Join(dir, "_tmp456")
+	for _, name := range []string{old, recent} {
+		if err := ioutil.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	cm.mu.Lock()
+	cm.shared.used += 10
+	cm.mu.Unlock()
+
+	res, err := cm.Compact(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CompactResult{EmptyDirs: 4, TempFiles: 1, Missing: 1, Adjusted: 10}
+	if *res != expected {
+		t.Error(`unexpected result`, *res)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+		t.Error(`empty directories must be removed`)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error(`stale temporary files must be removed`)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error(`recent temporary files must be kept`, err)
+	}
+	if cm.Contains("ubuntu/pool/b/b.deb") {
+		t.Error(`missing items must be removed`)
+	}
+	if items, used, _ := cm.Usage(); items != 1 || used != uint64(len(data)) {
+		t.Error(`used bytes must be corrected`, items, used)
+	}
+}
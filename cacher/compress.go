@@ -0,0 +1,302 @@
+package cacher
+
+// This file implements compressed storage of uncompressed meta data
+// files such as Packages.  Such files are kept gzip-compressed on disk,
+// and decompressed into a temporary file shared by readers when opened.
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+const (
+	// compressThreshold is the minimum size of files to be compressed.
+	compressThreshold = 16 * kib
+)
+
+var gzipMagic = [2]byte{0x1f, 0x8b}
+
+// SetCompression enables compression of uncompressed files such as
+// Packages and Sources.  Release files are not compressed as they
+// are small and requested frequently.
+//
+// Compressed files are read regardless of this setting.
+// This must be called before Load.
+func (cm *Storage) SetCompression(enabled bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.compress = enabled
+}
+
+// mayBeCompressed returns true if the cache file of p may be stored
+// compressed.  Uncompressed meta data files never start with gzipMagic.
+func mayBeCompressed(p string) bool {
+	return apt.IsMeta(p) && apt.TrimCompressionExt(p) == p && path.Ext(p) != ".gpg"
+}
+
+// shouldCompress returns true if p of size should be compressed.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) shouldCompress(p string, size uint64) bool {
+	return cm.compress && mayBeCompressed(p) && !isRelease(p) && size >= compressThreshold
+}
+
+// isCompressed returns true if f, the cache file of p, is compressed.
+func isCompressed(f *os.File, p string) (bool, error) {
+	if !mayBeCompressed(p) {
+		return false, nil
+	}
+	var magic [2]byte
+	_, err := f.ReadAt(magic[:], 0)
+	switch err {
+	case nil:
+	case io.EOF:
+		return false, nil
+	default:
+		return false, err
+	}
+	return magic == gzipMagic, nil
+}
+
+// compressFile creates a compressed copy of filename in dir keeping
+// the modification time, and returns its name.
+func compressFile(dir, filename string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := ioutil.TempFile(dir, "_tmp")
+	if err != nil {
+		return "", err
+	}
+	name := dst.Name()
+	err = func() error {
+		defer dst.Close()
+		gw, err := gzip.NewWriterLevel(dst, gzip.BestSpeed)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gw, src); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		return dst.Sync()
+	}()
+	if err == nil {
+		err = os.Chtimes(name, st.ModTime(), st.ModTime())
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// gzipSize returns the uncompressed size recorded in the trailer of
+// a gzip file.  The size is modulo 2^32 as defined by RFC 1952.
+func gzipSize(filename string) (uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	var trailer [4]byte
+	if _, err := io.ReadFull(f, trailer[:]); err != nil {
+		return 0, err
+	}
+	return uint64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+// decompressFile decompresses f into a temporary file in dir and
+// returns its name.  The modification time st of f is kept for
+// Last-Modified.
+func decompressFile(dir string, f *os.File, st os.FileInfo) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gr.Close()
+
+	df, err := ioutil.TempFile(dir, "_tmp")
+	if err != nil {
+		return "", err
+	}
+	name := df.Name()
+	_, err = io.Copy(df, gr)
+	if err1 := df.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chtimes(name, time.Now(), st.ModTime())
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// readItem reads the contents of the cache file of p.
+func readItem(filename, p string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	compressed, err := isCompressed(f, p)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return ioutil.ReadAll(f)
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+// decompressedCopy is a decompressed copy of a compressed cache file.
+// A copy is shared by readers until the cache file is replaced so
+// that requests of popular indices do not decompress them each time.
+type decompressedCopy struct {
+	mu   sync.Mutex
+	src  os.FileInfo // of the compressed cache file
+	name string
+}
+
+// remove removes the copy.
+func (d *decompressedCopy) remove() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.name != "" {
+		os.Remove(d.name)
+		d.name = ""
+	}
+}
+
+// decompress returns f, the cache file of p, as is if it is not
+// compressed.  Otherwise, f is closed and the decompressed copy of p
+// is opened, decompressing f if the copy is missing or out of date.
+//
+// Files are opened before decompression with cm.mu lock held so that
+// they are not removed meanwhile.
+func (cm *Storage) decompress(f *os.File, p string) (*os.File, error) {
+	compressed, err := isCompressed(f, p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !compressed {
+		return f, nil
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cm.copyLock.Lock()
+	if cm.copies == nil {
+		cm.copies = make(map[string]*decompressedCopy)
+	}
+	d, ok := cm.copies[p]
+	if !ok {
+		d = new(decompressedCopy)
+		cm.copies[p] = d
+	}
+	cm.copyLock.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.name != "" && os.SameFile(d.src, st) && d.src.ModTime().Equal(st.ModTime()) {
+		df, err := os.Open(d.name)
+		if err == nil {
+			return df, nil
+		}
+		// removed by Compact.
+	}
+
+	dir, err := cm.tempDirectory()
+	if err != nil {
+		return nil, err
+	}
+	name, err := decompressFile(dir, f, st)
+	if err != nil {
+		return nil, err
+	}
+	if d.name != "" {
+		// readers of the old copy can continue to read it.
+		os.Remove(d.name)
+	}
+	d.src = st
+	d.name = name
+	return os.Open(name)
+}
+
+// dropCopy removes the decompressed copy of p, if any.
+// This does not wait for decompression in progress.
+func (cm *Storage) dropCopy(p string) {
+	cm.copyLock.Lock()
+	d, ok := cm.copies[p]
+	delete(cm.copies, p)
+	cm.copyLock.Unlock()
+
+	if ok {
+		go d.remove()
+	}
+}
+
+// loadedSize returns the uncompressed size of the cache file of p
+// found by Load.  size is the size of the file.
+func (cm *Storage) loadedSize(filename, p string, size uint64) (uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	compressed, err := isCompressed(f, p)
+	f.Close()
+	if err != nil || !compressed {
+		return size, err
+	}
+	return gzipSize(filename)
+}
+
+// sizedFileInfo overrides the size of compressed files.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 {
+	return fi.size
+}
@@ -0,0 +1,183 @@
+package cacher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageCompression(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packages := new(bytes.Buffer)
+	for i := 0; packages.Len() < 4*compressThreshold; i++ {
+		fmt.Fprintf(packages, "Package: p%d\nVersion: 1.0\n\n", i)
+	}
+	release := bytes.Repeat([]byte("Origin: Ubuntu\n"), 2*compressThreshold/15)
+
+	cm := NewStorage(dir, 0)
+	cm.SetCompression(true)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	pfi, err := insert(cm, packages.Bytes(), "ubuntu/dists/stable/main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfi, err := insert(cm, release, "ubuntu/dists/stable/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(filepath.Join(dir, cm.itemFile(pfi.Path())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() >= int64(packages.Len()) {
+		t.Error(`Packages must be stored compressed`, st.Size())
+	}
+	mtime := st.ModTime()
+	st, err = os.Stat(filepath.Join(dir, cm.itemFile(rfi.Path())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != int64(len(release)) {
+		t.Error(`Release must not be compressed`, st.Size())
+	}
+
+	check := func(cm *Storage) {
+		f, err := cm.Lookup(pfi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, packages.Bytes()) {
+			t.Error(`compressed item must be decompressed`)
+		}
+
+		_, st, err := cm.Stat(pfi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() != int64(packages.Len()) {
+			t.Error(`Stat must return the uncompressed size`, st.Size())
+		}
+
+		f, err = cm.Open(rfi.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, release) {
+			t.Error(`uncompressed item must be served as is`)
+		}
+	}
+	check(cm)
+
+	f, err := cm.Lookup(pfi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fst, err := f.Stat()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fst.ModTime().Equal(mtime) {
+		t.Error(`modification time must be kept`)
+	}
+
+	// compressed items are read after compression is disabled.
+	cm2 := NewStorage(dir, 0)
+	if err := cm2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := cm2.Usage(); used != uint64(packages.Len()+len(release)) {
+		t.Error(`Load must count uncompressed sizes`, used)
+	}
+	check(cm2)
+}
+
+func TestSharedDecompression(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packages := bytes.Repeat([]byte("Package: a\nVersion: 1.0\n\n"), compressThreshold)
+	p := "ubuntu/dists/stable/main/binary-amd64/Packages"
+
+	cm := NewStorage(dir, 0)
+	cm.SetCompression(true)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := insert(cm, packages, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() (*os.File, os.FileInfo) {
+		f, err := cm.Lookup(fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f, st
+	}
+	// keep files open so that their inode numbers are not reused.
+	f1, st1 := open()
+	defer f1.Close()
+	f2, st2 := open()
+	defer f2.Close()
+	if !os.SameFile(st1, st2) {
+		t.Error(`decompressed copy must be shared`)
+	}
+
+	// updates make a new copy.
+	fi, err = insert(cm, append(packages, "Package: b\n"...), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f3, st3 := open()
+	defer f3.Close()
+	if os.SameFile(st1, st3) {
+		t.Error(`decompressed copy must be made again after updates`)
+	}
+	if st3.Size() != int64(len(packages)+len("Package: b\n")) {
+		t.Error(`unexpected size`, st3.Size())
+	}
+
+	if err := cm.Delete(p); err != nil {
+		t.Fatal(err)
+	}
+	cm.copyLock.Lock()
+	n := len(cm.copies)
+	cm.copyLock.Unlock()
+	if n != 0 {
+		t.Error(`copies of deleted items must be removed`, n)
+	}
+}
@@ -1,6 +1,9 @@
 package cacher
 
-import "github.com/cybozu-go/well"
+import (
+	"github.com/cybozu-go/well"
+	"github.com/pkg/errors"
+)
 
 const (
 	defaultAddress       = ":3142"
@@ -8,6 +11,11 @@ const (
 	defaultCachePeriod   = 3
 	defaultCacheCapacity = 1
 	defaultMaxConns      = 10
+	defaultRetries       = 3
+	defaultMaxRedirects  = 10
+
+	// LowMemoryMaxConns is the default of MaxConns when LowMemory is true.
+	LowMemoryMaxConns = 2
 )
 
 // Config is a struct to read TOML configurations.
@@ -25,17 +33,77 @@ type Config struct {
 	// Default is ":3142".
 	Addr string `toml:"listen_address"`
 
+	// MaxConnections limits client connections at once.  New
+	// connections wait to be accepted while the limit is reached.
+	//
+	// Default is 0, i.e. unlimited.
+	MaxConnections int `toml:"max_connections"`
+
+	// MaxRequests limits requests served at once.  Excess requests
+	// are responded with 503 Service Unavailable.
+	//
+	// Default is 0, i.e. unlimited.
+	MaxRequests int `toml:"max_requests"`
+
+	// ReadTimeout, WriteTimeout, and IdleTimeout specify timeouts in
+	// seconds of the HTTP server to read requests, to write responses,
+	// and to wait for the next request on keep-alive connections.
+	//
+	// Default is 30, 0 (no timeout), and 0 (ReadTimeout) respectively.
+	ReadTimeout  int `toml:"read_timeout"`
+	WriteTimeout int `toml:"write_timeout"`
+	IdleTimeout  int `toml:"idle_timeout"`
+
+	// ShutdownTimeout specifies seconds to wait for requests in
+	// progress to finish at shutdown.
+	//
+	// Default is 0, i.e. wait until all requests finish.
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+
 	// CheckInterval specifies interval in seconds to check updates for
 	// Release/InRelease files.
 	//
 	// Default is 600 seconds.
 	CheckInterval int `toml:"check_interval"`
 
+	// RefreshOnDemand makes Release, Release.gpg, and InRelease files
+	// checked for updates only when requested, at most once every
+	// CheckInterval, instead of periodically in background.
+	//
+	// Default is false.
+	RefreshOnDemand bool `toml:"refresh_on_demand"`
+
+	// RefreshIndices specifies patterns of indices downloaded again
+	// every CheckInterval when updated Release files list different
+	// contents, such as "Translation-*" and "Contents-*".
+	// Patterns without "/" are matched with the base names by path.Match.
+	// Only indices once requested are refreshed.
+	//
+	// Default is empty, i.e. indices are downloaded when requested.
+	RefreshIndices []string `toml:"refresh_indices"`
+
+	// IndexCacheControl and PoolCacheControl specify Cache-Control
+	// headers of responses for indices under dists/ and for other
+	// items such as packages in pool/.  Indices fetched by hash are
+	// treated as the latter as they never change.  Expires headers
+	// are also added if max-age is given.
+	//
+	// Default is empty, i.e. no caching headers are added.
+	IndexCacheControl string `toml:"index_cache_control"`
+	PoolCacheControl  string `toml:"pool_cache_control"`
+
 	// CachePeriod specifies the period to cache bad HTTP response statuses.
 	//
 	// Default is 3 seconds.
 	CachePeriod int `toml:"cache_period"`
 
+	// CachePeriods specifies periods in seconds to cache bad HTTP
+	// response statuses for each status code such as "404", or status
+	// class such as "5xx".  CachePeriod is used for others.
+	//
+	// Cached statuses are saved in MetaDirectory to survive restarts.
+	CachePeriods map[string]int `toml:"cache_periods"`
+
 	// MetaDirectory specifies a directory to store APT meta data files.
 	//
 	// This must differ from CacheDirectory.
@@ -51,17 +119,365 @@ type Config struct {
 	// Unit is GiB.  Default is 1 GiB.
 	CacheCapacity int `toml:"cache_capacity"`
 
+	// ProtectReferenced makes items listed in cached indices evicted
+	// only after items no longer listed.
+	//
+	// Default is false.
+	ProtectReferenced bool `toml:"protect_referenced"`
+
+	// EvictionPolicy specifies the order to remove items when
+	// the total size exceeds CacheCapacity.
+	//
+	// "lru" removes the least recently used items first.
+	// "lfu" removes the least frequently used items first.
+	// "size" removes items with the least frequencies per byte first.
+	// Default is "lru".
+	EvictionPolicy string `toml:"eviction_policy"`
+
+	// CacheTTL removes items not accessed for the given seconds
+	// regardless of the capacity.
+	//
+	// Default is 0, i.e. items are removed only by the capacity.
+	CacheTTL int `toml:"cache_ttl"`
+
+	// MetaTTL removes meta data files not requested for the given
+	// seconds, and those of prefixes no longer in Mapping.
+	// Removed files are no longer refreshed.
+	//
+	// Default is 0, i.e. meta data files are kept forever.
+	MetaTTL int `toml:"meta_ttl"`
+
+	// CacheLayout specifies how cache files are placed in CacheDirectory.
+	//
+	// "tree" places them at the same paths as items.
+	// "sharded" places them at hashed paths such as _objects/ab/cd/<hash>
+	// so that no directory contains too many files.
+	// Files in either layout are loaded regardless of this.
+	// Default is "tree".
+	CacheLayout string `toml:"cache_layout"`
+
+	// ScrubInterval specifies seconds between scrubs, which verify
+	// checksums of cached items and remove corrupted ones.
+	//
+	// Default is 0, i.e. items are not scrubbed.
+	ScrubInterval int `toml:"scrub_interval"`
+
+	// ScrubRate limits the speed to read cached items for scrubs.
+	//
+	// Unit is MiB/s.  Default is 10.
+	ScrubRate int `toml:"scrub_rate"`
+
+	// CompactInterval specifies seconds between compactions, which
+	// remove empty directories and temporary files left by crashes,
+	// and correct the used bytes of caches.
+	//
+	// Default is 0, i.e. directories are not compacted periodically.
+	CompactInterval int `toml:"compact_interval"`
+
+	// SharedDirectories allows other processes, such as the other
+	// half of a blue/green deployment, to share MetaDirectory and
+	// CacheDirectory.  Modifications of files are serialized by
+	// lock files, and snapshots are not used.
+	//
+	// This cannot be used with LowMemory.
+	SharedDirectories bool `toml:"shared_directories"`
+
 	// MaxConns specifies the maximum concurrent connections to an
 	// upstream host.
 	//
 	// Zero disables limit on the number of connections.
 	MaxConns int `toml:"max_conns"`
 
+	// Offline makes go-apt-cacher serve only cached items.
+	// Upstream servers are never contacted, and requests for items
+	// not in the cache result in 404 Not Found.
+	//
+	// Default is false.
+	Offline bool `toml:"offline"`
+
+	// Proxy enables the transparent proxy mode.  Clients can use
+	// go-apt-cacher as an HTTP proxy by Acquire::http::Proxy of apt
+	// without rewriting sources.list.
+	//
+	// Requests for upstream servers in Mapping are cached under their
+	// prefixes.  Requests for other hosts are served only if the host
+	// matches one of ProxyHosts.
+	//
+	// Default is false.
+	Proxy bool `toml:"proxy"`
+
+	// ProxyHosts is a list of host name patterns that can be proxied
+	// without mappings.  Items are cached under the host names.
+	// Patterns are matched by path.Match such as "*.ubuntu.com".
+	ProxyHosts []string `toml:"proxy_hosts"`
+
+	// ServeStale specifies a grace period in seconds to serve the
+	// previously cached version of a meta data file when the upstream
+	// fails to provide the current one.  The period starts at the
+	// first failure.
+	//
+	// Zero disables serving stale files.  Default is 0.
+	ServeStale int `toml:"serve_stale"`
+
+	// MaxRedirects specifies the maximum number of redirects to follow
+	// for a request to an upstream server.  The limit on MaxConns is
+	// applied to the host that finally serves the item, and the item
+	// is cached at the path of the original request.
+	//
+	// Zero disables redirects.  Default is 10.
+	MaxRedirects int `toml:"max_redirects"`
+
+	// Retries specifies how many times a failed download is retried.
+	// Network errors and 5xx responses are retried, and downloads
+	// dropped in the middle are resumed by Range requests.
+	//
+	// Zero disables retries.  Default is 3.
+	Retries int `toml:"retries"`
+
+	// RetryBaseDelay, RetryMaxDelay, and RetryJitter configure
+	// exponential backoff between retries in the same way as
+	// go-apt-mirror.
+	//
+	// Default is 1.0, 16.0, and 0.0 respectively.
+	RetryBaseDelay float64 `toml:"retry_base_delay"`
+	RetryMaxDelay  float64 `toml:"retry_max_delay"`
+	RetryJitter    float64 `toml:"retry_jitter"`
+
+	// Peers is a list of base URLs of other go-apt-cacher instances
+	// such as "http://cacher2.example.com:3142".
+	//
+	// Items not cached locally are requested to peers before the
+	// upstreams.  Peers serve only items they have cached, and
+	// items from peers are verified by checksums in indices.
+	// Peers must have the same mapping prefixes.
+	Peers []string `toml:"peers"`
+
+	// ClusterNodes is a list of base URLs of go-apt-cacher instances
+	// in a cluster including this instance.  ClusterSelf is the URL
+	// of this instance in ClusterNodes.
+	//
+	// Items are partitioned among nodes by consistent hashing of
+	// their paths, and requests for items owned by other nodes are
+	// proxied to the owners.  Meta data files are served by every
+	// node.  Nodes must have the same configuration of ClusterNodes
+	// and mapping prefixes.
+	ClusterNodes []string `toml:"cluster_nodes"`
+	ClusterSelf  string   `toml:"cluster_self"`
+
+	// TrustedProxies is a list of IP addresses or CIDR networks of
+	// reverse proxies in front of go-apt-cacher.
+	//
+	// Client addresses are taken from X-Forwarded-For header of
+	// requests from these proxies.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// ProxyProtocol enables PROXY protocol on the listener.
+	//
+	// If TrustedProxies is not empty, PROXY protocol headers are
+	// accepted only from them.
+	ProxyProtocol bool `toml:"proxy_protocol"`
+
+	// OnStorageError specifies how to respond when the cache storage
+	// fails, e.g. the disk is full or read-only.
+	//
+	// "pass_through" serves downloaded items without caching them.
+	// "error" returns 503 Service Unavailable.
+	// Default is "pass_through".
+	OnStorageError string `toml:"on_storage_error"`
+
+	// AccessLog specifies the file to write access logs.
+	// "-" is the standard output.  The file is reopened by SIGUSR1.
+	//
+	// Default is empty, i.e. access logs are not written.
+	AccessLog string `toml:"access_log"`
+
+	// AccessLogFormat is the format of access logs.
+	//
+	// "combined" is Apache combined log format followed by the cache
+	// status and the latency in microseconds.
+	// "json" writes a JSON object per line.
+	// Default is "combined".
+	AccessLogFormat string `toml:"access_log_format"`
+
+	// ClientRateLimit limits requests per second from each client IP
+	// address.  Requests exceeding the limit are responded with
+	// 429 Too Many Requests.
+	//
+	// Default is 0, i.e. unlimited.
+	ClientRateLimit float64 `toml:"client_rate_limit"`
+
+	// ClientRateBurst is the number of requests allowed at once
+	// beyond ClientRateLimit.
+	//
+	// Default is ClientRateLimit rounded up.
+	ClientRateBurst int `toml:"client_rate_burst"`
+
+	// ClientBandwidth limits the bandwidth in KiB/s of responses to
+	// each client IP address.  Concurrent responses to the same client
+	// share the bandwidth.
+	//
+	// Default is 0, i.e. unlimited.
+	ClientBandwidth int `toml:"client_bandwidth"`
+
+	// RateLimitExempt is a list of IP addresses or CIDR networks of
+	// clients not limited by ClientRateLimit and ClientBandwidth.
+	RateLimitExempt []string `toml:"rate_limit_exempt"`
+
+	// LowMemory enables a profile for hosts with little memory.
+	//
+	// FileInfo listed in indices are kept on disk instead of memory,
+	// and buffers for upstream connections are shrunk.
+	LowMemory bool `toml:"low_memory"`
+
+	// CompressMeta keeps uncompressed meta data files such as Packages
+	// gzip-compressed in MetaDirectory to save disk space.  They are
+	// decompressed into a temporary file shared by requests when first
+	// served after they are updated.
+	//
+	// Files compressed once are read even after this is disabled.
+	CompressMeta bool `toml:"compress_meta"`
+
+	// HotCacheSize specifies the capacity in MiB of the in-memory hot
+	// tier of meta data files.  Files up to HotCacheMaxItem KiB are
+	// served from memory once they are requested.
+	//
+	// Default is 0 (disabled) and 1024 respectively.
+	HotCacheSize    int `toml:"hot_cache_size"`
+	HotCacheMaxItem int `toml:"hot_cache_max_item"`
+
+	// AuthFile specifies a netrc or apt auth.conf style file
+	// containing credentials for upstream repositories.
+	//
+	// Default is empty, i.e. no credentials are sent.
+	AuthFile string `toml:"auth_file"`
+
+	// TLSCertFile and TLSKeyFile specify PEM files of the certificate
+	// and the private key.  If given, go-apt-cacher serves HTTPS at Addr.
+	//
+	// These cannot be used together with ACMEHosts.
+	TLSCertFile string `toml:"tls_cert_file"`
+	TLSKeyFile  string `toml:"tls_key_file"`
+
+	// ClientCAFile specifies a PEM file of CA certificates to verify
+	// client certificates.  If given, clients must present certificates
+	// signed by one of them.
+	//
+	// This requires TLS by TLSCertFile or ACMEHosts.
+	ClientCAFile string `toml:"client_ca_file"`
+
+	// ACMEHosts is a list of host names to obtain certificates for
+	// by ACME such as Let's Encrypt.
+	//
+	// If not empty, go-apt-cacher serves HTTPS at Addr.
+	ACMEHosts []string `toml:"acme_hosts"`
+
+	// ACMECacheDir specifies a directory to store certificates and
+	// the account key obtained by ACME.
+	//
+	// This is required if ACMEHosts is not empty.
+	ACMECacheDir string `toml:"acme_cache_dir"`
+
+	// ACMEEmail is the contact address of the ACME account.
+	//
+	// Default is empty.
+	ACMEEmail string `toml:"acme_email"`
+
+	// ACMEDirectoryURL is the directory URL of the ACME server.
+	//
+	// Default is Let's Encrypt production.
+	ACMEDirectoryURL string `toml:"acme_directory_url"`
+
+	// ACMEHTTPAddress is the listening address to answer HTTP-01
+	// challenges.  Other requests to this address are served as usual.
+	//
+	// Default is empty, i.e. only TLS-ALPN-01 challenges are answered.
+	ACMEHTTPAddress string `toml:"acme_http_address"`
+
+	// AdminAddress is the listening address of the admin API.
+	//
+	// Default is empty, i.e. the admin API is disabled.
+	AdminAddress string `toml:"admin_address"`
+
+	// AdminToken is the token required in "Authorization: Bearer"
+	// header of admin API requests.
+	//
+	// This is required if AdminAddress is not empty.
+	AdminToken string `toml:"admin_token"`
+
+	// AdminAllow is a list of IP addresses or CIDR networks allowed
+	// to access the admin API in addition to AdminToken.
+	//
+	// Default is empty, i.e. any address is allowed.
+	AdminAllow []string `toml:"admin_allow"`
+
+	// AdminDebug enables net/http/pprof and runtime statistics
+	// under /debug/ of the admin API.
+	//
+	// Default is false.
+	AdminDebug bool `toml:"admin_debug"`
+
+	// UpstreamCoolDown specifies the period in seconds to avoid an
+	// upstream after it fails when other upstreams are available.
+	//
+	// Default is 60 seconds.
+	UpstreamCoolDown int `toml:"upstream_cool_down"`
+
+	// BreakerThreshold specifies the number of consecutive failures of
+	// an upstream host to stop sending requests to it for
+	// BreakerCoolDown seconds.  Meanwhile, requests for items not cached
+	// fail with 503, and stale meta data files are served if any.
+	//
+	// Default is 0, i.e. circuit breakers are disabled.
+	BreakerThreshold int `toml:"breaker_threshold"`
+
+	// BreakerCoolDown specifies the period in seconds for which
+	// circuit breakers stay open.
+	//
+	// Default is 30 seconds.
+	BreakerCoolDown int `toml:"breaker_cool_down"`
+
+	// SRVRefreshInterval specifies the interval in seconds to resolve
+	// SRV records of "dns+srv://" mappings again.
+	//
+	// Default is 300 seconds.
+	SRVRefreshInterval int `toml:"srv_refresh_interval"`
+
+	// SourcesList is the path of a sources.list file of APT, or a
+	// directory such as /etc/apt/sources.list.d.  HTTP and HTTPS
+	// repositories in it are mapped to prefixes derived from their
+	// URLs, in addition to Mapping.  Both the one-line style and the
+	// deb822 style (*.sources) are supported.
+	//
+	// Default is "", i.e. no mappings are learned.
+	SourcesList string `toml:"sources_list"`
+
+	// SourcesListInterval specifies the interval in seconds to read
+	// SourcesList again to follow changes.
+	//
+	// Default is 0, i.e. SourcesList is read only at startup.
+	SourcesListInterval int `toml:"sources_list_interval"`
+
 	// Log is well.LogConfig
 	Log well.LogConfig `toml:"log"`
 
 	// Mapping specifies mapping between prefixes and APT URLs.
-	Mapping map[string]string `toml:"mapping"`
+	//
+	// If multiple URLs are given for a prefix, they are tried in order
+	// and failed ones are avoided for UpstreamCoolDown seconds.
+	Mapping map[string]UpstreamURLs `toml:"mapping"`
+
+	// PrefetchConcurrency specifies how many items are downloaded at
+	// once by prefetching.
+	//
+	// Default is 4.
+	PrefetchConcurrency int `toml:"prefetch_concurrency"`
+
+	// Prefetch specifies per-prefix configurations to prefetch items.
+	Prefetch map[string]*PrefetchConfig `toml:"prefetch"`
+
+	// Upstreams specifies per-prefix configurations of upstream
+	// repositories such as credentials.
+	Upstreams map[string]*UpstreamConfig `toml:"upstream"`
 }
 
 // NewConfig creates Config with default values.
@@ -72,5 +488,40 @@ func NewConfig() *Config {
 		CachePeriod:   defaultCachePeriod,
 		CacheCapacity: defaultCacheCapacity,
 		MaxConns:      defaultMaxConns,
+		Retries:       defaultRetries,
+		MaxRedirects:  defaultMaxRedirects,
+
+		UpstreamCoolDown:    defaultUpstreamCoolDown,
+		BreakerCoolDown:     defaultBreakerCoolDown,
+		SRVRefreshInterval:  defaultSRVRefreshInterval,
+		HotCacheMaxItem:     defaultHotCacheMaxItem,
+		PrefetchConcurrency: defaultPrefetchConcurrency,
+		ScrubRate:           defaultScrubRate,
+	}
+}
+
+// UpstreamURLs is a list of URLs of mirrors of an APT repository.
+//
+// In TOML, this can be a string or an array of strings.
+type UpstreamURLs []string
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (u *UpstreamURLs) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*u = UpstreamURLs{v}
+		return nil
+	case []interface{}:
+		urls := make(UpstreamURLs, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return errors.New("mapping must be a string or an array of strings")
+			}
+			urls = append(urls, s)
+		}
+		*u = urls
+		return nil
 	}
+	return errors.New("mapping must be a string or an array of strings")
 }
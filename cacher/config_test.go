@@ -42,13 +42,20 @@ func TestConfig(t *testing.T) {
 		t.Error(`config.Log.Level != "error"`)
 	}
 
-	if config.Mapping["ubuntu"] != "http://archive.ubuntu.com/ubuntu" {
+	if m := config.Mapping["ubuntu"]; len(m) != 1 || m[0] != "http://archive.ubuntu.com/ubuntu" {
 		t.Error(`config.Mapping["ubuntu"]`)
 	}
-	if config.Mapping["security"] != "http://security.ubuntu.com/ubuntu" {
+	if m := config.Mapping["security"]; len(m) != 1 || m[0] != "http://security.ubuntu.com/ubuntu" {
 		t.Error(`config.Mapping["security"]`)
 	}
-	if config.Mapping["dell"] != "http://linux.dell.com/repo/community/ubuntu" {
+	if m := config.Mapping["dell"]; len(m) != 1 || m[0] != "http://linux.dell.com/repo/community/ubuntu" {
 		t.Error(`config.Mapping["dell"]`)
 	}
+	if m := config.Mapping["debian"]; len(m) != 2 || m[1] != "http://ftp.jp.debian.org/debian" {
+		t.Error(`config.Mapping["debian"]`, m)
+	}
+
+	if uc := config.Upstreams["private"]; uc == nil || uc.Token != "secret" {
+		t.Error(`config.Upstreams["private"]`)
+	}
 }
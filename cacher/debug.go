@@ -0,0 +1,106 @@
+package cacher
+
+// This file implements debug endpoints of the admin API.
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// MemoryStats is a summary of runtime.MemStats.
+type MemoryStats struct {
+	Alloc        uint64 `json:"alloc_bytes"`
+	Sys          uint64 `json:"sys_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	HeapIdle     uint64 `json:"heap_idle_bytes"`
+	HeapReleased uint64 `json:"heap_released_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	StackInuse   uint64 `json:"stack_inuse_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+// CacherStats is the number of entries held in memory by Cacher.
+type CacherStats struct {
+	MetaItems   int `json:"meta_items"`
+	CacheItems  int `json:"cache_items"`
+	Indexed     int `json:"indexed"`
+	Downloading int `json:"downloading"`
+	Streams     int `json:"streams"`
+	Results     int `json:"results"`
+	Uncached    int `json:"uncached"`
+}
+
+// DebugInfo is a snapshot of the runtime returned by the admin API.
+type DebugInfo struct {
+	Goroutines int         `json:"goroutines"`
+	Memory     MemoryStats `json:"memory"`
+	Cacher     CacherStats `json:"cacher"`
+}
+
+// debugInfo takes a snapshot of the runtime.
+// If gc is true, garbage collection runs beforehand.
+func (c *Cacher) debugInfo(gc bool) DebugInfo {
+	if gc {
+		runtime.GC()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	info := DebugInfo{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			Alloc:        ms.Alloc,
+			Sys:          ms.Sys,
+			HeapInuse:    ms.HeapInuse,
+			HeapIdle:     ms.HeapIdle,
+			HeapReleased: ms.HeapReleased,
+			HeapObjects:  ms.HeapObjects,
+			StackInuse:   ms.StackInuse,
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+		},
+	}
+	info.Cacher.MetaItems, _, _ = c.meta.Usage()
+	info.Cacher.CacheItems, _, _ = c.items.Usage()
+
+	c.fiLock.RLock()
+	if m, ok := c.info.(mapIndex); ok {
+		info.Cacher.Indexed = len(m)
+	} else {
+		info.Cacher.Indexed = -1
+	}
+	c.fiLock.RUnlock()
+
+	c.dlLock.RLock()
+	for _, l := range c.downloads {
+		info.Cacher.Downloading += len(l)
+	}
+	info.Cacher.Streams = info.Cacher.Downloading
+	info.Cacher.Results = len(c.results)
+	info.Cacher.Uncached = len(c.uncached)
+	c.dlLock.RUnlock()
+	return info
+}
+
+// serveDebug serves runtime information and net/http/pprof under /debug/.
+func (h adminHandler) serveDebug(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/debug/runtime" && r.Method == "GET":
+		writeJSON(w, h.debugInfo(r.URL.Query().Get("gc") == "1"))
+	case r.URL.Path == "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case r.URL.Path == "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case r.URL.Path == "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case r.URL.Path == "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	case strings.HasPrefix(r.URL.Path, "/debug/pprof/"):
+		pprof.Index(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,66 @@
+package cacher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminDebug(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {"http://localhost:1"}}
+	})
+	defer cleanup()
+	allowed, err := parseTrustedNets([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(h adminHandler, target, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = remote
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	h := adminHandler{Cacher: c, token: "secret", allowed: allowed}
+	if w := serve(h, "/debug/runtime", "192.0.2.1:1234"); w.Code != http.StatusNotFound {
+		t.Error(`debug endpoints must be disabled by default`, w.Code)
+	}
+
+	h.debug = true
+	if w := serve(h, "/debug/runtime", "198.51.100.1:1234"); w.Code != http.StatusUnauthorized {
+		t.Error(`w.Code != http.StatusUnauthorized`, w.Code)
+	}
+
+	w := serve(h, "/debug/runtime?gc=1", "192.0.2.1:1234")
+	if w.Code != http.StatusOK {
+		t.Fatal(`w.Code != http.StatusOK`, w.Code)
+	}
+	var info DebugInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Goroutines == 0 || info.Memory.NumGC == 0 {
+		t.Error(`unexpected debug info`, info)
+	}
+
+	w = serve(h, "/debug/pprof/", "192.0.2.1:1234")
+	if w.Code != http.StatusOK {
+		t.Error(`w.Code != http.StatusOK`, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "goroutine") {
+		t.Error(`pprof index must list profiles`)
+	}
+
+	w = serve(h, "/debug/pprof/heap?debug=1", "192.0.2.1:1234")
+	if w.Code != http.StatusOK {
+		t.Error(`w.Code != http.StatusOK`, w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package cacher
+
+// This file implements content-addressed deduplication of cache items.
+//
+// Contents of items are kept in dedupDir named by their SHA256
+// checksums, and items are hard links to them.  Items with the same
+// contents under different prefixes therefore share disk space.
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+)
+
+// contentPath returns the filename of the contents of fi,
+// or an empty string if fi has no SHA256 checksum.
+func (cm *Storage) contentPath(fi *apt.FileInfo) string {
+	p := fi.SHA256Path()
+	if p == "" {
+		return ""
+	}
+	sum := path.Base(p)
+	return filepath.Join(cm.dir, dedupDir, sum[:2], sum)
+}
+
+// isContentPath returns true if subpath is a file in dedupDir.
+func isContentPath(subpath string) bool {
+	return strings.HasPrefix(subpath, dedupDir+string(filepath.Separator))
+}
+
+// linkCount returns the number of hard links to a file.
+func linkCount(info os.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Nlink)
+}
+
+// storeContent adds the contents of filename for fi to dedupDir,
+// and returns the filename there.  If the same contents exist
+// already, they are used instead.
+//
+// An empty string is returned if the contents cannot be stored.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) storeContent(filename string, fi *apt.FileInfo) string {
+	cp := cm.contentPath(fi)
+	if cp == "" {
+		return ""
+	}
+
+	st, err := os.Stat(cp)
+	if err == nil && uint64(st.Size()) == fi.Size() {
+		return cp
+	}
+
+	err = os.MkdirAll(filepath.Dir(cp), 0755)
+	if err == nil {
+		os.Remove(cp)
+		err = os.Link(filename, cp)
+	}
+	if err != nil {
+		log.Warn("failed to store contents", map[string]interface{}{
+			"path":  fi.Path(),
+			"error": err.Error(),
+		})
+		return ""
+	}
+	return cp
+}
+
+// releaseContent removes the contents of e from dedupDir if no other
+// item links to them.
+//
+// Contents of items whose checksums have not been calculated are
+// left, and removed by Load later.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) releaseContent(e *entry) {
+	cp := cm.contentPath(e.FileInfo)
+	if cp == "" {
+		return
+	}
+	st, err := os.Stat(cp)
+	if err != nil || linkCount(st) != 1 {
+		return
+	}
+	if err := os.Remove(cp); err != nil {
+		log.Warn("failed to remove contents", map[string]interface{}{
+			"path":  e.Path(),
+			"error": err.Error(),
+		})
+	}
+}
+
+// Reuse inserts an item for fi by linking the contents of another item
+// with the same SHA256 checksum.  It returns false if no such contents
+// are stored.
+func (cm *Storage) Reuse(fi *apt.FileInfo) bool {
+	cp := cm.contentPath(fi)
+	if cp == "" {
+		return false
+	}
+	st, err := os.Stat(cp)
+	if err != nil || uint64(st.Size()) != fi.Size() {
+		return false
+	}
+
+	if err := cm.Insert(cp, fi); err != nil {
+		log.Warn("failed to reuse contents", map[string]interface{}{
+			"path":  fi.Path(),
+			"error": err.Error(),
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestDedup(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 0)
+
+	fiA, err := insert(cm, []byte("data"), "ubuntu/a.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert(cm, []byte("data"), "ports/a.deb"); err != nil {
+		t.Fatal(err)
+	}
+
+	st1, err := os.Stat(filepath.Join(dir, "ubuntu/a.deb"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := os.Stat(filepath.Join(dir, "ports/a.deb"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(st1, st2) {
+		t.Error(`items with the same contents must share a file`)
+	}
+
+	// the contents can be reused for another path.
+	fiB, err := makeFileInfo("debian/b.deb", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Reuse(fiB) {
+		t.Fatal(`contents must be reused`)
+	}
+	f, err := cm.Lookup(fiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fiC, err := makeFileInfo("debian/c.deb", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Reuse(fiC) {
+		t.Error(`unknown contents must not be reused`)
+	}
+
+	cp := cm.contentPath(fiA)
+	for _, p := range []string{"ubuntu/a.deb", "ports/a.deb"} {
+		if err := cm.Delete(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(cp); err != nil {
+			t.Error(`contents must be kept while linked`, err)
+		}
+	}
+	if err := cm.Delete("debian/b.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cp); !os.IsNotExist(err) {
+		t.Error(`contents must be removed`, err)
+	}
+
+	// Load removes contents no longer linked.
+	if _, err := insert(cm, []byte("data"), "ubuntu/a.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "ubuntu/a.deb"+fileSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cp); !os.IsNotExist(err) {
+		t.Error(`contents must be removed by Load`, err)
+	}
+	if items, _, _ := cm.Usage(); items != 0 {
+		t.Error(`items != 0`, items)
+	}
+}
+
+func TestDedupDownload(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		repo.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {upstream.URL},
+			"mirror": {upstream.URL},
+		}
+	})
+	defer cleanup()
+	for _, prefix := range []string{"ubuntu", "mirror"} {
+		for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+			testGetData(t, c, prefix+"/"+p, repo.Get(p))
+		}
+		testGetData(t, c, prefix+"/"+repotest.PoolPath(pkg), pkg.Data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/"+repotest.PoolPath(pkg)]; n != 1 {
+		t.Error(`the package must be downloaded once`, n)
+	}
+}
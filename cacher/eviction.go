@@ -0,0 +1,186 @@
+package cacher
+
+// This file implements eviction policies of Storage.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// Names of eviction policies for Config.EvictionPolicy.
+const (
+	EvictionLRU  = "lru"
+	EvictionLFU  = "lfu"
+	EvictionSize = "size"
+)
+
+// ItemStats is statistics of a cached item given to EvictionPolicy.
+type ItemStats struct {
+	// Size is the size of the item in bytes.
+	Size uint64
+
+	// Hits is the number of insertions and lookups of the item.
+	Hits uint64
+
+	// Clock is the logical time of the last access to the item.
+	// It increases by one for each access to the Storage.
+	Clock uint64
+
+	// Inflation is the priority of the item removed last from the
+	// same capacity.  Policies can add this to age out items that
+	// were popular once.
+	Inflation float64
+}
+
+// EvictionPolicy decides which items are removed first when
+// the total size of items exceeds the capacity of Storage.
+type EvictionPolicy interface {
+	// Priority returns the priority of an item.  Items with lower
+	// priorities are removed first.  It is called when an item is
+	// inserted or looked up.
+	Priority(s ItemStats) float64
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) Priority(s ItemStats) float64 {
+	return float64(s.Clock)
+}
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) Priority(s ItemStats) float64 {
+	return s.Inflation + float64(s.Hits)
+}
+
+type sizePolicy struct{}
+
+func (sizePolicy) Priority(s ItemStats) float64 {
+	size := s.Size
+	if size == 0 {
+		size = 1
+	}
+	return s.Inflation + float64(s.Hits)/float64(size)
+}
+
+var (
+	// LRU removes the least recently used items first.
+	LRU EvictionPolicy = lruPolicy{}
+
+	// LFU removes the least frequently used items first.
+	// Frequencies age out by dynamic aging (LFU-DA).
+	LFU EvictionPolicy = lfuPolicy{}
+
+	// SizeWeighted removes items with the least frequencies per byte
+	// first so that a few large items do not push out many small
+	// popular items.  Frequencies age out as LFU (GDSF).
+	SizeWeighted EvictionPolicy = sizePolicy{}
+)
+
+// EvictionPolicyByName returns EvictionPolicy for name.
+// An empty name is LRU.
+func EvictionPolicyByName(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", EvictionLRU:
+		return LRU, nil
+	case EvictionLFU:
+		return LFU, nil
+	case EvictionSize:
+		return SizeWeighted, nil
+	}
+	return nil, errors.New("unknown eviction policy: " + name)
+}
+
+// evictionHeap implements heap.Interface for entries.
+//
+// Unreferenced entries come first, then ones with lower priorities.
+// Ties are broken by the access time.
+type evictionHeap []*entry
+
+func (h evictionHeap) Len() int {
+	return len(h)
+}
+
+func (h evictionHeap) Less(i, j int) bool {
+	if h[i].referenced != h[j].referenced {
+		return !h[i].referenced
+	}
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].atime < h[j].atime
+}
+
+func (h evictionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *evictionHeap) Push(x interface{}) {
+	e, ok := x.(*entry)
+	if !ok {
+		panic("Storage.Push: wrong type")
+	}
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *evictionHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	e.index = -1 // for safety
+	*h = old[0 : n-1]
+	return e
+}
+
+// expire calls fn periodically to remove items not accessed for ttl.
+// fn returns the number of removed items, which is logged with msg.
+func (c *Cacher) expire(ctx context.Context, ttl time.Duration, msg string, fn func(time.Duration) int) error {
+	interval := c.checkInterval
+	if ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if n := fn(ttl); n > 0 {
+			log.Info(msg, map[string]interface{}{
+				"items": n,
+			})
+		}
+	}
+}
+
+// expireMeta removes meta data files not requested for ttl, and
+// those of prefixes no longer mapped.  It returns the number of
+// removed files.
+func (c *Cacher) expireMeta(ttl time.Duration) int {
+	n := 0
+	for _, fi := range c.meta.ListAll() {
+		p := fi.Path()
+		if c.upstreamURL(p) != nil || c.unresolved(p) {
+			continue
+		}
+		if err := c.meta.Delete(p); err != nil {
+			log.Warn("could not remove meta data file", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+			continue
+		}
+		n++
+	}
+	return n + c.meta.Expire(ttl)
+}
@@ -0,0 +1,34 @@
+package cacher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireMeta(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {"http://archive.ubuntu.com/ubuntu"}}
+	})
+	defer cleanup()
+
+	recent := "ubuntu/dists/stable/InRelease"
+	old := "ubuntu/dists/old/InRelease"
+	unmapped := "debian/dists/stable/InRelease"
+	for _, p := range []string{recent, old, unmapped} {
+		if _, err := insert(c.meta, []byte(p), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.meta.mu.Lock()
+	c.meta.cache[old].accessed = time.Now().Add(-2 * time.Hour)
+	c.meta.mu.Unlock()
+
+	if n := c.expireMeta(time.Hour); n != 2 {
+		t.Error(`old and unmapped meta data files must expire`, n)
+	}
+	if !c.meta.Contains(recent) || c.meta.Contains(old) || c.meta.Contains(unmapped) {
+		t.Error(`unexpected meta data files`, c.meta.ListAll())
+	}
+}
@@ -0,0 +1,189 @@
+package cacher
+
+// This file implements failover among multiple upstreams of a prefix.
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUpstreamCoolDown = 60
+)
+
+// upstreamHealth remembers unhealthy upstreams.
+//
+// An upstream is unhealthy for a cool-down period after it fails.
+// Unhealthy upstreams are tried after healthy ones.
+type upstreamHealth struct {
+	coolDown time.Duration
+
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+}
+
+func newUpstreamHealth(coolDown time.Duration) *upstreamHealth {
+	return &upstreamHealth{
+		coolDown:  coolDown,
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+// fail marks base unhealthy.
+func (h *upstreamHealth) fail(base *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := base.String()
+	if _, ok := h.downUntil[key]; !ok {
+		log.Warn("upstream is unhealthy", map[string]interface{}{
+			"upstream": key,
+		})
+	}
+	h.downUntil[key] = time.Now().Add(h.coolDown)
+}
+
+// ok marks base healthy.
+func (h *upstreamHealth) ok(base *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := base.String()
+	if _, ok := h.downUntil[key]; ok {
+		log.Info("upstream is healthy", map[string]interface{}{
+			"upstream": key,
+		})
+		delete(h.downUntil, key)
+	}
+}
+
+// healthy returns true if base is not in its cool-down period.
+func (h *upstreamHealth) healthy(base *url.URL) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.downUntil[base.String()]
+	return !ok || !time.Now().Before(t)
+}
+
+// order returns bases ordered by preference.
+//
+// Healthy upstreams come first in the configured order, followed by
+// unhealthy ones in the order of the end of their cool-down periods.
+func (h *upstreamHealth) order(bases []*url.URL) []*url.URL {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	until := make([]time.Time, len(bases))
+	for i, b := range bases {
+		if t, ok := h.downUntil[b.String()]; ok && now.Before(t) {
+			until[i] = t
+		}
+	}
+
+	idx := make([]int, len(bases))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return until[idx[i]].Before(until[idx[j]])
+	})
+
+	ret := make([]*url.URL, len(bases))
+	for i, k := range idx {
+		ret[i] = bases[k]
+	}
+	return ret
+}
+
+// candidates returns pairs of upstream base URLs and URLs for p
+// in the order to try.
+func (c *Cacher) candidates(p string) (bases, urls []*url.URL) {
+	t := strings.SplitN(strings.TrimLeft(p, "/"), "/", 2)
+	all := c.upstreamsOf(t[0])
+	if len(all) == 0 {
+		base := c.proxyBase(t[0])
+		if base == nil {
+			return nil, nil
+		}
+		all = []*url.URL{base}
+	}
+
+	bases = c.upstreamHealth.order(all)
+	urls = make([]*url.URL, len(bases))
+	for i, b := range bases {
+		if len(t) == 1 {
+			urls[i] = b
+			continue
+		}
+		urls[i] = b.ResolveReference(&url.URL{Path: t[1]})
+	}
+	return bases, urls
+}
+
+// openUpstream sends the initial request for p to the upstreams of
+// the prefix in the order of candidates.
+//
+// Network errors and 5xx responses of an upstream make it unhealthy,
+// and the next upstream is tried.  Only the last candidate is retried
+// with backoff.  Upstreams whose circuit breakers are open are skipped,
+// and errBreakerOpen is returned if all are skipped.  The returned
+// reader must be closed even if an error is returned.
+func (c *Cacher) openUpstream(ctx context.Context, p string, cond *Validators) (*upstreamReader, *http.Response, error) {
+	bases, urls := c.candidates(p)
+	for i, u := range urls {
+		last := i == len(urls)-1
+		if !c.breaker.allow(u.Host) {
+			if last {
+				return nil, nil, errBreakerOpen
+			}
+			continue
+		}
+		ur := newUpstreamReader(ctx, c, p, u)
+		ur.cond = cond
+		ur.failFast = !last
+
+		resp, err := ur.Open()
+		_, isRedirectErr := err.(*redirectError)
+		failed := (err != nil && !isRedirectErr) || (err == nil && resp.StatusCode >= 500)
+		if failed {
+			c.breaker.failure(u.Host)
+		} else {
+			c.breaker.success(u.Host)
+		}
+		if len(urls) > 1 {
+			if failed {
+				c.upstreamHealth.fail(bases[i])
+			} else {
+				c.upstreamHealth.ok(bases[i])
+			}
+		}
+		if !failed || last || ctx.Err() != nil {
+			return ur, resp, err
+		}
+
+		fields := map[string]interface{}{
+			"url":  u.String(),
+			"next": urls[i+1].String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else {
+			fields["status"] = resp.StatusCode
+		}
+		log.Warn("failing over to another upstream", fields)
+		ur.Close()
+	}
+
+	// not reached as the prefix of p is registered.
+	return nil, nil, errors.New("no upstream for " + p)
+}
@@ -0,0 +1,95 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	t.Parallel()
+
+	a := &url.URL{Scheme: "http", Host: "a", Path: "/"}
+	b := &url.URL{Scheme: "http", Host: "b", Path: "/"}
+	c := &url.URL{Scheme: "http", Host: "c", Path: "/"}
+
+	h := newUpstreamHealth(time.Hour)
+	h.fail(b)
+	h.fail(a)
+
+	order := h.order([]*url.URL{a, b, c})
+	if order[0] != c || order[1] != b || order[2] != a {
+		t.Error(`unexpected order`, order)
+	}
+
+	h.ok(a)
+	order = h.order([]*url.URL{a, b, c})
+	if order[0] != a || order[1] != c || order[2] != b {
+		t.Error(`unexpected order`, order)
+	}
+
+	// cool-down has passed.
+	h = newUpstreamHealth(0)
+	h.fail(a)
+	order = h.order([]*url.URL{a, b, c})
+	if order[0] != a {
+		t.Error(`order[0] != a`, order)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+
+	var mu sync.Mutex
+	var count int
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		if r.URL.Path != "/ubuntu/pool/a.deb" && r.URL.Path != "/ubuntu/pool/b.deb" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer good.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {dead.URL + "/ubuntu", good.URL + "/ubuntu"},
+		}
+	})
+	defer cleanup()
+
+	testGetData(t, c, "ubuntu/pool/a.deb", []byte("data"))
+
+	// the dead upstream is avoided during the cool-down.
+	bases, _ := c.candidates("ubuntu/pool/b.deb")
+	if bases[0].Host != good.Listener.Addr().String() {
+		t.Error(`the good upstream must be tried first`, bases)
+	}
+	testGetData(t, c, "ubuntu/pool/b.deb", []byte("data"))
+
+	// 404 is not a reason to fail over.
+	status, _, err := c.Get("ubuntu/pool/c.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNotFound {
+		t.Error(`status != http.StatusNotFound`, status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 3 {
+		t.Error(`count != 3`, count)
+	}
+}
@@ -0,0 +1,114 @@
+package cacher
+
+// This file implements freshness of cached items given by upstream
+// Cache-Control and Expires headers.  See RFC 7234.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshnessLifetime returns the freshness lifetime of a response with
+// header h.  ok is false if h does not specify the lifetime.
+//
+// Responses with "no-store" or "no-cache" have zero lifetime so that
+// they are revalidated on every request.
+func freshnessLifetime(h http.Header, now time.Time) (lifetime time.Duration, ok bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, cc := range h["Cache-Control"] {
+		for _, d := range strings.Split(cc, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			switch name {
+			case "no-store", "no-cache":
+				return 0, true
+			case "max-age":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					sMaxAge = n
+				}
+			}
+		}
+	}
+	switch {
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second, true
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		// invalid dates such as "0" represent a time in the past.
+		return 0, true
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	if t.Before(date) {
+		return 0, true
+	}
+	return t.Sub(date), true
+}
+
+// expires returns the time when an item downloaded with header h
+// at now becomes stale, or zero if it never does.
+func (uc *UpstreamConfig) expires(h http.Header, now time.Time) time.Time {
+	lifetime, ok := freshnessLifetime(h, now)
+	if !ok {
+		if uc.MaxFreshness == 0 {
+			return time.Time{}
+		}
+		lifetime = time.Duration(uc.MaxFreshness) * time.Second
+	}
+
+	min := time.Duration(uc.MinFreshness) * time.Second
+	max := time.Duration(uc.MaxFreshness) * time.Second
+	if lifetime < min {
+		lifetime = min
+	}
+	if max > 0 && lifetime > max {
+		lifetime = max
+	}
+	return now.Add(lifetime)
+}
+
+// cacheControl returns the configuration of the upstream of p if it
+// honors Cache-Control, or nil.
+func (c *Cacher) cacheControl(p string) *UpstreamConfig {
+	prefix := strings.SplitN(p, "/", 2)[0]
+	if uc, ok := c.upstreams[prefix]; ok && uc.HonorCacheControl {
+		return uc
+	}
+	return nil
+}
+
+// setFreshness records the time when a cached item p becomes stale
+// into v by the response header h.
+func (c *Cacher) setFreshness(p string, v *Validators, h http.Header) *Validators {
+	uc := c.cacheControl(p)
+	if uc == nil {
+		return v
+	}
+	if v == nil {
+		v = new(Validators)
+	}
+	v.Expires = 0
+	if t := uc.expires(h, time.Now()); !t.IsZero() {
+		v.Expires = t.Unix()
+	}
+	return v
+}
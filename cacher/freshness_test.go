@@ -0,0 +1,108 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	cases := []struct {
+		header   http.Header
+		lifetime time.Duration
+		ok       bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public, max-age=600"}}, 600 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}}, 60 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=600", "no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=x"}}, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"0"}}, 60 * time.Second, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0, true},
+	}
+	for _, tc := range cases {
+		lifetime, ok := freshnessLifetime(tc.header, now)
+		if lifetime != tc.lifetime || ok != tc.ok {
+			t.Error(`unexpected lifetime`, tc.header, lifetime, ok)
+		}
+	}
+
+	now = time.Now()
+	uc := &UpstreamConfig{MinFreshness: 60, MaxFreshness: 3600}
+	if exp := uc.expires(http.Header{"Cache-Control": {"no-cache"}}, now); !exp.Equal(now.Add(time.Minute)) {
+		t.Error(`lifetime must be clamped to min_freshness`, exp)
+	}
+	if exp := uc.expires(http.Header{"Cache-Control": {"max-age=86400"}}, now); !exp.Equal(now.Add(time.Hour)) {
+		t.Error(`lifetime must be clamped to max_freshness`, exp)
+	}
+	if exp := uc.expires(http.Header{}, now); !exp.Equal(now.Add(time.Hour)) {
+		t.Error(`max_freshness must be used without headers`, exp)
+	}
+	uc = &UpstreamConfig{}
+	if exp := uc.expires(http.Header{}, now); !exp.IsZero() {
+		t.Error(`items without headers must not expire`, exp)
+	}
+}
+
+func TestHonorCacheControl(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	data, etag := "v1", `"1"`
+	requests := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.URL.Path]++
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.CachePeriod = 0
+		config.Mapping = map[string]UpstreamURLs{
+			"nightly": {upstream.URL + "/nightly"},
+			"stable":  {upstream.URL + "/stable"},
+		}
+		config.Upstreams = map[string]*UpstreamConfig{
+			"nightly": {HonorCacheControl: true},
+		}
+	})
+	defer cleanup()
+
+	testGetData(t, c, "nightly/pool/a.deb", []byte("v1"))
+	testGetData(t, c, "stable/pool/a.deb", []byte("v1"))
+
+	// revalidated by a conditional request.
+	testGetData(t, c, "nightly/pool/a.deb", []byte("v1"))
+
+	mu.Lock()
+	data, etag = "v2", `"2"`
+	mu.Unlock()
+	testGetData(t, c, "nightly/pool/a.deb", []byte("v2"))
+	testGetData(t, c, "stable/pool/a.deb", []byte("v1"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/nightly/pool/a.deb"]; n != 3 {
+		t.Error(`stale items must be revalidated`, n)
+	}
+	if n := requests["/stable/pool/a.deb"]; n != 1 {
+		t.Error(`items must be cached forever by default`, n)
+	}
+}
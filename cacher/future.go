@@ -0,0 +1,169 @@
+package cacher
+
+// This file implements futures of downloads shared by requests.
+//
+// A future is identified by the path and the expected checksum of an
+// item.  Requests without the expected checksum join any download of
+// the path, while those with it join only downloads validated by the
+// same checksum.  Otherwise a new download is started so that a
+// request never waits for contents it cannot accept.
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/well"
+)
+
+// dlFuture is a download of an item in progress.
+type dlFuture struct {
+	path     string
+	valid    *apt.FileInfo
+	expected string
+	started  time.Time
+	stream   *stream
+	done     chan struct{}
+
+	// guarded by Cacher.dlLock.
+	requests int
+
+	// status and fi are set before done is closed.  fi is the
+	// contents of the cached item, or nil if unknown.
+	status int
+	fi     *apt.FileInfo
+}
+
+// DownloadState is the state of a download reported by the admin API.
+type DownloadState struct {
+	Path string `json:"path"`
+
+	// Expected is the checksum that the item is validated against,
+	// or an empty string if the item is not validated.
+	Expected string    `json:"expected,omitempty"`
+	Started  time.Time `json:"started"`
+
+	// Requests is the number of requests sharing the download.
+	Requests int `json:"requests"`
+
+	// Received is the number of bytes received from the upstream.
+	Received int64 `json:"received_bytes"`
+	Size     int64 `json:"size"`
+}
+
+// expectedKey returns the key to identify downloads validated by valid.
+func expectedKey(valid *apt.FileInfo) string {
+	if valid == nil {
+		return ""
+	}
+	for _, p := range []string{valid.SHA256Path(), valid.SHA512Path(), valid.SHA1Path(), valid.MD5SumPath()} {
+		if p != "" {
+			return path.Base(path.Dir(p)) + ":" + path.Base(p)
+		}
+	}
+	return "size:" + strconv.FormatUint(valid.Size(), 10)
+}
+
+// accepts returns true if the result of f can be used by a request
+// expecting valid.
+func (f *dlFuture) accepts(valid *apt.FileInfo) bool {
+	return valid == nil || f.expected == expectedKey(valid)
+}
+
+// resolve sets the result of f and wakes up requests waiting for it.
+func (f *dlFuture) resolve(status int, fi *apt.FileInfo) {
+	f.status = status
+	if status == http.StatusOK {
+		f.fi = fi
+	}
+	close(f.done)
+}
+
+// future returns the download of p that accepts valid, starting
+// a new one if none is in progress.  If prefix of p is not mapped
+// or p is blocked, nil is returned.
+func (c *Cacher) future(p string, valid *apt.FileInfo) *dlFuture {
+	u := c.upstreamURL(p)
+	if u == nil || c.blocked(p) {
+		return nil
+	}
+
+	c.dlLock.Lock()
+	defer c.dlLock.Unlock()
+
+	for _, f := range c.downloads[p] {
+		if f.accepts(valid) {
+			f.requests++
+			return f
+		}
+	}
+
+	f := &dlFuture{
+		path:     p,
+		valid:    valid,
+		expected: expectedKey(valid),
+		started:  time.Now(),
+		stream:   newStream(),
+		done:     make(chan struct{}),
+		requests: 1,
+	}
+	c.downloads[p] = append(c.downloads[p], f)
+	well.Go(func(ctx context.Context) error {
+		c.download(ctx, f, u)
+		return nil
+	})
+	return f
+}
+
+// removeFuture unregisters f.  c.dlLock must be locked.
+func (c *Cacher) removeFuture(f *dlFuture) {
+	l := c.downloads[f.path]
+	for i, e := range l {
+		if e == f {
+			l = append(l[:i], l[i+1:]...)
+			break
+		}
+	}
+	if len(l) == 0 {
+		delete(c.downloads, f.path)
+		return
+	}
+	c.downloads[f.path] = l
+}
+
+// Downloads returns the states of downloads in progress sorted by path.
+func (c *Cacher) Downloads() []DownloadState {
+	c.dlLock.RLock()
+	var l []DownloadState
+	var streams []*stream
+	for _, fl := range c.downloads {
+		for _, f := range fl {
+			l = append(l, DownloadState{
+				Path:     f.path,
+				Expected: f.expected,
+				Started:  f.started,
+				Requests: f.requests,
+			})
+			streams = append(streams, f.stream)
+		}
+	}
+	c.dlLock.RUnlock()
+
+	for i, s := range streams {
+		s.mu.Lock()
+		l[i].Received = s.written
+		l[i].Size = s.size
+		s.mu.Unlock()
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Path != l[j].Path {
+			return l[i].Path < l[j].Path
+		}
+		return l[i].Started.Before(l[j].Started)
+	})
+	return l
+}
@@ -0,0 +1,145 @@
+package cacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func testFileInfo(t *testing.T, p, data string) *apt.FileInfo {
+	fi, err := apt.CopyWithFileInfo(ioutil.Discard, bytes.NewReader([]byte(data)), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestExpectedKey(t *testing.T) {
+	t.Parallel()
+
+	p := "ubuntu/pool/a.deb"
+	if expectedKey(nil) != "" {
+		t.Error(`expectedKey(nil) != ""`)
+	}
+	key := expectedKey(testFileInfo(t, p, "data"))
+	if key != "SHA256:3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7" {
+		t.Error(`unexpected key`, key)
+	}
+	if expectedKey(apt.MakeFileInfoNoChecksum(p, 4)) != "size:4" {
+		t.Error(`unexpected key without checksums`)
+	}
+
+	f := &dlFuture{expected: key}
+	if !f.accepts(nil) || !f.accepts(testFileInfo(t, p, "data")) {
+		t.Error(`f must accept the same contents`)
+	}
+	if f.accepts(testFileInfo(t, p, "other")) {
+		t.Error(`f must not accept other contents`)
+	}
+}
+
+func TestFuture(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	count := 0
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		<-release
+		w.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+
+	p := "ubuntu/pool/a.deb"
+	good := testFileInfo(t, p, "data")
+	ch1 := c.Download(p, nil)
+	ch2 := c.Download(p, nil)
+	if ch1 == nil || ch1 != ch2 {
+		t.Error(`downloads without checksums must be shared`)
+	}
+	ch3 := c.Download(p, good)
+	if ch3 == ch1 {
+		t.Error(`unvalidated download must not be shared with validated requests`)
+	}
+	if ch4 := c.Download(p, testFileInfo(t, p, "data")); ch4 != ch3 {
+		t.Error(`downloads with the same checksum must be shared`)
+	}
+	if ch5 := c.Download(p, nil); ch5 != ch1 {
+		t.Error(`requests without checksums must join the first download`)
+	}
+
+	ds := c.Downloads()
+	if len(ds) != 2 {
+		t.Fatal(`len(ds) != 2`, ds)
+	}
+	for _, d := range ds {
+		if d.Path != p {
+			t.Error(`unexpected path`, d.Path)
+		}
+		switch d.Expected {
+		case "":
+			if d.Requests != 3 {
+				t.Error(`d.Requests != 3`, d.Requests)
+			}
+		case expectedKey(good):
+			if d.Requests != 2 {
+				t.Error(`d.Requests != 2`, d.Requests)
+			}
+		default:
+			t.Error(`unexpected expected checksum`, d.Expected)
+		}
+	}
+
+	// both downloads must reach the upstream before it responds.
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := count
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	<-ch1
+	<-ch3
+	if ds := c.Downloads(); len(ds) != 0 {
+		t.Error(`finished downloads must be removed`, ds)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, f, err := c.Get("ubuntu/pool/b.deb")
+			if err != nil || status != http.StatusOK {
+				t.Error(`c.Get failed`, status, err)
+				return
+			}
+			f.Close()
+		}()
+	}
+	wg.Wait()
+	testGetData(t, c, p, []byte("data"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 3 {
+		t.Error(`count != 3`, count)
+	}
+}
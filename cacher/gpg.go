@@ -0,0 +1,96 @@
+package cacher
+
+// This file implements verification of Release and InRelease files
+// by OpenPGP signatures before trusting checksums in them.
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/pkg/errors"
+)
+
+// loadKeyrings loads keyrings of upstreams.
+func loadKeyrings(upstreams map[string]*UpstreamConfig) (map[string]openpgp.EntityList, error) {
+	keyrings := make(map[string]openpgp.EntityList)
+	for prefix, uc := range upstreams {
+		if len(uc.Keyring) == 0 {
+			continue
+		}
+		kr, err := apt.LoadKeyring(uc.Keyring)
+		if err != nil {
+			return nil, errors.Wrap(err, "upstream."+prefix+".keyring")
+		}
+		keyrings[prefix] = kr
+	}
+	return keyrings, nil
+}
+
+// verifyRelease verifies a downloaded Release or InRelease file f at p
+// by the keyring of the prefix.  The signature of Release is taken
+// from Release.gpg, which is downloaded if necessary.
+//
+// Files of prefixes without keyrings and other files are not verified.
+func (c *Cacher) verifyRelease(ctx context.Context, p string, f *os.File) error {
+	t := strings.SplitN(p, "/", 2)
+	kr, ok := c.keyrings[t[0]]
+	if !ok {
+		return nil
+	}
+
+	var sig []byte
+	switch path.Base(p) {
+	case "InRelease":
+	case "Release":
+		var err error
+		sig, err = c.releaseSignature(ctx, p+".gpg")
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if sig != nil {
+		_, err = apt.VerifyRelease(f, sig, kr)
+	} else {
+		_, err = apt.VerifyInRelease(f, kr)
+	}
+	return err
+}
+
+// releaseSignature downloads Release.gpg at p and returns its contents.
+func (c *Cacher) releaseSignature(ctx context.Context, p string) ([]byte, error) {
+	ch := c.Download(p, nil)
+	if ch == nil {
+		return nil, errors.New("no upstream for " + p)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ch:
+	}
+
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok {
+		return nil, errors.New("failed to download " + p)
+	}
+	f, err := c.meta.Lookup(fi)
+	if err != nil {
+		return nil, errors.Wrap(err, p)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,123 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestVerifyRelease(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+	other := repotest.NewSigner("other")
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("package a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	repo.Sign("dists/stable", signer)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		dir := filepath.Dir(cfg.MetaDirectory)
+		signerKeyring := filepath.Join(dir, "signer.asc")
+		if err := signer.WriteKeyring(signerKeyring); err != nil {
+			t.Fatal(err)
+		}
+		otherKeyring := filepath.Join(dir, "other.asc")
+		if err := other.WriteKeyring(otherKeyring); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.Mapping = map[string]UpstreamURLs{
+			"trusted": {upstream.URL},
+			"forged":  {upstream.URL},
+		}
+		cfg.Upstreams = map[string]*UpstreamConfig{
+			"trusted": {Keyring: signerKeyring},
+			"forged":  {Keyring: otherKeyring},
+		}
+		config = cfg
+	})
+	defer cleanup()
+
+	for _, p := range []string{"dists/stable/InRelease", "dists/stable/Release"} {
+		testGetData(t, c, "trusted/"+p, repo.Get(p))
+
+		status, f, err := c.Get("forged/" + p)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusBadGateway {
+			t.Error(`files signed by unknown keys must not be served`, p, status)
+		}
+	}
+
+	packages := "dists/stable/main/binary-amd64/Packages"
+	c.fiLock.RLock()
+	_, trusted := c.info.Get("trusted/" + packages)
+	_, forged := c.info.Get("forged/" + packages)
+	c.fiLock.RUnlock()
+	if !trusted {
+		t.Error(`checksums in verified files must be trusted`)
+	}
+	if forged {
+		t.Error(`checksums in unverified files must not be trusted`)
+	}
+
+	config.Upstreams = map[string]*UpstreamConfig{
+		"trusted": {Keyring: filepath.Join(filepath.Dir(config.MetaDirectory), "none.asc")},
+	}
+	if _, err := NewCacher(config); err == nil {
+		t.Error(`missing keyring must be an error`)
+	}
+}
+
+func TestVerifyReleaseMaxConns(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("package a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	repo.Sign("dists/stable", signer)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		keyring := filepath.Join(filepath.Dir(cfg.MetaDirectory), "signer.asc")
+		if err := signer.WriteKeyring(keyring); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.MaxConns = 1
+		cfg.Mapping = map[string]UpstreamURLs{"trusted": {upstream.URL}}
+		cfg.Upstreams = map[string]*UpstreamConfig{
+			"trusted": {Keyring: keyring},
+		}
+	})
+	defer cleanup()
+
+	// Release.gpg is downloaded from the same host while Release is
+	// being verified.
+	done := make(chan struct{})
+	go func() {
+		testGetData(t, c, "trusted/dists/stable/Release", repo.Get("dists/stable/Release"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal(`verification of Release is blocked by max_conns`)
+	}
+}
@@ -2,6 +2,7 @@ package cacher
 
 import (
 	"fmt"
+	"io"
 	"mime"
 	"net/http"
 	"path"
@@ -11,11 +12,30 @@ import (
 	"github.com/cybozu-go/log"
 )
 
+const (
+	// healthPath is the URL path of the health check API.
+	healthPath = "/" + healthName
+
+	// checksumHeader is the header of SHA256 checksums of items
+	// in responses to HEAD requests.
+	checksumHeader = "X-Checksum-Sha256"
+)
+
 type cacheHandler struct {
 	*Cacher
 }
 
 func (c cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var p string
+	proxied := false
+	if c.proxy {
+		p, proxied = c.proxyPath(r)
+		if !proxied && r.URL.IsAbs() {
+			http.Error(w, "proxy to the host is not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
 	switch r.Method {
 	case "GET", "HEAD":
 		// later on
@@ -24,15 +44,61 @@ func (c cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p := path.Clean(r.URL.Path[1:])
+	if proxied {
+		c.serveItem(w, r, p)
+		return
+	}
 
+	switch r.URL.Path {
+	case healthPath:
+		if err := c.Health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+		return
+	}
+
+	c.serveItem(w, r, path.Clean(r.URL.Path[1:]))
+}
+
+// serveItem serves an item at p.
+func (c cacheHandler) serveItem(w http.ResponseWriter, r *http.Request, p string) {
 	if log.Enabled(log.LvDebug) {
 		log.Debug("request path", map[string]interface{}{
 			"path": p,
 		})
 	}
 
-	status, f, err := c.Get(p)
+	if c.blocked(p) {
+		setCacheStatus(r, cacheBlocked)
+		http.Error(w, "blocked", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get(peerHeader) != "" {
+		c.servePeer(w, r, p)
+		return
+	}
+	if c.serveRedirect(w, r, p) {
+		return
+	}
+	if c.cluster != nil && r.Header.Get(clusterHeader) == "" {
+		if owner := c.cluster.ownerOf(p); owner != nil && c.cluster.forward(w, r, owner, p) {
+			return
+		}
+	}
+	if r.Method == "HEAD" {
+		c.serveHead(w, r, p)
+		return
+	}
+	if c.serveHot(w, r, p) {
+		return
+	}
+
+	// Range requests are served from the cache file.
+	stream := r.Header.Get("Range") == ""
+	status, f, sr, cache, err := c.get(p, stream)
+	setCacheStatus(r, cache)
 
 	switch {
 	case err != nil:
@@ -41,26 +107,99 @@ func (c cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 	case status != http.StatusOK:
 		http.Error(w, fmt.Sprintf("status %d", status), status)
+	case sr != nil:
+		defer sr.Close()
+		c.serveStream(w, p, sr)
 	default:
 		// http.StatusOK
 		defer f.Close()
-		if r.Method == "GET" {
-			var zeroTime time.Time
-			http.ServeContent(w, r, path.Base(p), zeroTime, f)
-			return
-		}
 		stat, err := f.Stat()
 		if err != nil {
 			status = http.StatusInternalServerError
 			http.Error(w, err.Error(), status)
 			return
 		}
+		c.addHot(p, f, stat)
+		c.clientCache.set(w.Header(), p, time.Now())
+		// The modification time of the cache file is the Last-Modified
+		// of the upstream response, or the time when it was cached.
+		http.ServeContent(w, r, path.Base(p), stat.ModTime(), f)
+	}
+}
+
+// serveHead serves headers of an item at p without opening the cache
+// file if it is cached.  The SHA256 checksum of the item is given in
+// checksumHeader if known.
+func (c cacheHandler) serveHead(w http.ResponseWriter, r *http.Request, p string) {
+	status, fi, stat, cache, err := c.stat(p)
+	setCacheStatus(r, cache)
+
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), status)
+	case status == http.StatusNotFound:
+		http.NotFound(w, r)
+	case status != http.StatusOK:
+		http.Error(w, fmt.Sprintf("status %d", status), status)
+	default:
 		ct := mime.TypeByExtension(path.Ext(p))
 		if ct == "" {
 			ct = "application/octet-stream"
 		}
 		w.Header().Set("Content-Type", ct)
 		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+		w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+		c.clientCache.set(w.Header(), p, time.Now())
+		if fi != nil {
+			if sp := fi.SHA256Path(); sp != "" {
+				w.Header().Set(checksumHeader, path.Base(sp))
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// serveStream serves an item being downloaded.
+//
+// If the download fails, the response is aborted so that the client
+// can notice the failure.
+func (c cacheHandler) serveStream(w http.ResponseWriter, p string, sr *streamReader) {
+	ct := mime.TypeByExtension(path.Ext(p))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	if size := sr.Size(); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if mt := sr.ModTime(); !mt.IsZero() {
+		w.Header().Set("Last-Modified", mt.UTC().Format(http.TimeFormat))
+	}
+	c.clientCache.set(w.Header(), p, time.Now())
+	w.WriteHeader(http.StatusOK)
+
+	// flush each chunk so that clients receive data as it arrives.
+	var dst io.Writer = w
+	if fl, ok := w.(http.Flusher); ok {
+		dst = flushWriter{w, fl}
+	}
+	_, err := io.Copy(dst, sr)
+	if err != nil {
+		log.Warn("streaming aborted", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type flushWriter struct {
+	w  io.Writer
+	fl http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.fl.Flush()
+	return n, err
+}
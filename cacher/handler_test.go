@@ -0,0 +1,131 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestLastModified(t *testing.T) {
+	t.Parallel()
+
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pool/a.deb" {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		// items with the same contents share the modification time.
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	handler := cacheHandler{c}
+	serve := func(method, target, ims string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if ims != "" {
+			r.Header.Set("If-Modified-Since", ims)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := serve("GET", "/ubuntu/pool/a.deb", "")
+		if w.Code != http.StatusOK {
+			t.Fatal(`w.Code != http.StatusOK`, w.Code)
+		}
+		if lm := w.Header().Get("Last-Modified"); lm != lastModified {
+			t.Error(`unexpected Last-Modified`, i, lm)
+		}
+	}
+	if w := serve("HEAD", "/ubuntu/pool/a.deb", ""); w.Header().Get("Last-Modified") != lastModified {
+		t.Error(`unexpected Last-Modified for HEAD`, w.Header().Get("Last-Modified"))
+	}
+	if w := serve("GET", "/ubuntu/pool/a.deb", lastModified); w.Code != http.StatusNotModified {
+		t.Error(`w.Code != http.StatusNotModified`, w.Code)
+	}
+
+	// the time of caching is used without Last-Modified.
+	status, f, err := c.Get("ubuntu/pool/b.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	f.Close()
+
+	w := serve("GET", "/ubuntu/pool/b.deb", "")
+	lm, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(lm); d < 0 || d > time.Minute {
+		t.Error(`unexpected Last-Modified`, lm)
+	}
+}
+
+func TestHead(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("package a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+
+	handler := cacheHandler{c}
+	sum := sha256.Sum256(pkg.Data)
+	for i, expected := range []string{cacheMiss, cacheHit} {
+		r := httptest.NewRequest("HEAD", "/ubuntu/"+repotest.PoolPath(pkg), nil)
+		e := new(accessEntry)
+		r = r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, e))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal(`w.Code != http.StatusOK`, i, w.Code)
+		}
+		if e.Cache != expected {
+			t.Error(`unexpected cache status`, i, e.Cache)
+		}
+		if w.Body.Len() != 0 {
+			t.Error(`HEAD response must not have a body`)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(pkg.Data)) {
+			t.Error(`unexpected Content-Length`, i, cl)
+		}
+		if w.Header().Get("Last-Modified") == "" {
+			t.Error(`Last-Modified must be set`, i)
+		}
+		if cs := w.Header().Get(checksumHeader); cs != hex.EncodeToString(sum[:]) {
+			t.Error(`unexpected checksum`, i, cs)
+		}
+	}
+
+	r := httptest.NewRequest("HEAD", "/ubuntu/pool/main/n/none.deb", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error(`w.Code != http.StatusNotFound`, w.Code)
+	}
+}
@@ -0,0 +1,310 @@
+package cacher
+
+// This file implements degraded mode for storage failures.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StorageErrorPassThrough serves downloaded items without caching
+	// them when the storage fails.
+	StorageErrorPassThrough = "pass_through"
+
+	// StorageErrorUnavailable returns 503 Service Unavailable
+	// when the storage fails.
+	StorageErrorUnavailable = "error"
+)
+
+// health tracks failures of the cache storage.
+type health struct {
+	mu  sync.Mutex
+	err error
+}
+
+// fail records a storage failure.  The first failure is logged
+// as critical to alert operators.
+func (h *health) fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err == nil {
+		log.Critical("storage failure; go-apt-cacher is degraded", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	h.err = err
+}
+
+// recover clears the failure.  It returns true if the storage
+// has failed before.
+func (h *health) recover() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	failed := h.err != nil
+	if failed {
+		log.Info("storage recovered", nil)
+	}
+	h.err = nil
+	return failed
+}
+
+func (h *health) get() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Health returns non-nil error if go-apt-cacher is degraded by
+// storage failures.
+func (c *Cacher) Health() error {
+	return c.health.get()
+}
+
+// cacheWriter writes an item being downloaded to a temporary file.
+//
+// If writing to the file fails and fallback is true, the data written
+// so far is copied to a file created by passThroughTempFile, and the
+// rest is written to that file to serve the item without caching.
+type cacheWriter struct {
+	f        *os.File
+	w        io.Writer // writes to f
+	st       *stream
+	fallback bool
+	off      int64
+
+	// passThrough is true if f is outside of the storage.
+	passThrough bool
+
+	// err is the first storage failure, even if it was recovered
+	// by switching to a pass-through file.
+	err error
+
+	// failed is true if a storage failure was returned to the caller.
+	failed bool
+}
+
+func newCacheWriter(f *os.File, st *stream, passThrough, fallback bool, wrap func(*os.File) io.Writer) *cacheWriter {
+	cw := &cacheWriter{
+		f:           f,
+		w:           f,
+		st:          st,
+		fallback:    fallback && !passThrough,
+		passThrough: passThrough,
+	}
+	if wrap != nil && !passThrough {
+		cw.w = wrap(f)
+	}
+	return cw
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.off += int64(n)
+	if err != nil && cw.recover(err) {
+		// p[:n] has been written to the old file and copied.
+		var m int
+		m, err = cw.f.Write(p[n:])
+		cw.off += int64(m)
+		n += m
+	}
+	if err != nil {
+		cw.failed = true
+	}
+	return n, err
+}
+
+// Sync commits the contents of the file to the storage.
+// Pass-through files are not synced as they are temporary.
+func (cw *cacheWriter) Sync() error {
+	if cw.passThrough {
+		return nil
+	}
+	err := cw.f.Sync()
+	if err != nil && !cw.recover(err) {
+		cw.failed = true
+		return err
+	}
+	return nil
+}
+
+// recover records a storage failure err and switches to
+// a pass-through file if possible.
+func (cw *cacheWriter) recover(err error) bool {
+	if cw.err == nil {
+		cw.err = err
+	}
+	if !cw.fallback || cw.passThrough {
+		return false
+	}
+	if err := cw.switchFile(); err != nil {
+		log.Error("failed to pass through", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+func (cw *cacheWriter) switchFile() error {
+	f, err := passThroughTempFile()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(cw.f, 0, cw.off))
+	if err == nil {
+		err = cw.st.switchFile(f.Name())
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "switchFile")
+	}
+
+	cw.f.Close()
+	os.Remove(cw.f.Name())
+	cw.f = f
+	cw.w = f
+	cw.passThrough = true
+	return nil
+}
+
+// passThroughTempFile creates a temporary file outside of the cache
+// storage to serve an item without caching.
+func passThroughTempFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "go-apt-cacher-")
+	if err != nil {
+		return nil, errors.Wrap(err, "passThroughTempFile")
+	}
+	return f, nil
+}
+
+// uncachedItem is an item served without caching.
+type uncachedItem struct {
+	name string
+	fi   *apt.FileInfo
+}
+
+// addUncached registers a file to serve p without caching.
+// A file registered earlier for p is removed.  The file will be
+// removed by removeUncached.
+func (c *Cacher) addUncached(p, name string, fi *apt.FileInfo) {
+	c.dlLock.Lock()
+	old, ok := c.uncached[p]
+	c.uncached[p] = uncachedItem{name, fi}
+	c.dlLock.Unlock()
+
+	if ok && old.name != name {
+		os.Remove(old.name)
+	}
+}
+
+// removeUncached unregisters and removes the file name for p.
+// Nothing is done if another file has been registered for p.
+func (c *Cacher) removeUncached(p, name string) {
+	c.dlLock.Lock()
+	registered := c.uncached[p].name == name
+	if registered {
+		delete(c.uncached, p)
+	}
+	c.dlLock.Unlock()
+
+	if registered {
+		os.Remove(name)
+	}
+}
+
+// retryUncached caches items served without caching.
+// It is called when the storage has recovered.
+func (c *Cacher) retryUncached() {
+	c.dlLock.RLock()
+	items := make(map[string]uncachedItem, len(c.uncached))
+	for p, u := range c.uncached {
+		items[p] = u
+	}
+	c.dlLock.RUnlock()
+
+	for p, u := range items {
+		err := c.retryCache(p, u)
+		if err == errShuttingDown {
+			return
+		}
+		if err != nil {
+			log.Warn("failed to cache an uncached item", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+			if c.health.get() != nil {
+				// the storage has failed again.
+				return
+			}
+			continue
+		}
+		c.removeUncached(p, u.name)
+		log.Info("cached an uncached item", map[string]interface{}{
+			"path": p,
+		})
+	}
+}
+
+// retryCache copies the file of an uncached item u into the storage
+// and caches it as p.
+func (c *Cacher) retryCache(p string, u uncachedItem) error {
+	src, err := os.Open(u.name)
+	if err != nil {
+		// removed or replaced by another download.
+		return nil
+	}
+	defer src.Close()
+
+	storage := c.items
+	if apt.IsMeta(p) {
+		storage = c.meta
+	}
+	tempfile, err := storage.TempFile()
+	if err != nil {
+		c.health.fail(err)
+		return err
+	}
+	defer func() {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+	}()
+
+	_, err = io.Copy(tempfile, src)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	if err != nil {
+		c.health.fail(err)
+		return err
+	}
+	if st, err := src.Stat(); err == nil {
+		os.Chtimes(tempfile.Name(), st.ModTime(), st.ModTime())
+	}
+	return c.cache(p, storage, tempfile, u.fi, nil)
+}
+
+// openUncached opens the file registered for p.
+func (c *Cacher) openUncached(p string) *os.File {
+	c.dlLock.RLock()
+	u, ok := c.uncached[p]
+	c.dlLock.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(u.name)
+	if err != nil {
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,263 @@
+package cacher
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testStorageError(t *testing.T, mode string) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("deb data"))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.OnStorageError = mode
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+
+		// make Insert fail by placing a file where a directory is needed.
+		if err := os.MkdirAll(filepath.Join(config.CacheDirectory, "ubuntu"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(filepath.Join(config.CacheDirectory, "ubuntu", "pool"), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanup()
+
+	status, f, err := c.Get("ubuntu/pool/a_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Health() == nil {
+		t.Error(`c.Health() == nil`)
+	}
+
+	if mode == StorageErrorUnavailable {
+		if status != http.StatusServiceUnavailable {
+			t.Error(`status != http.StatusServiceUnavailable`, status)
+		}
+		return
+	}
+
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "deb data" {
+		t.Error(`string(data) != "deb data"`)
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	t.Run("PassThrough", func(t *testing.T) {
+		testStorageError(t, StorageErrorPassThrough)
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		testStorageError(t, StorageErrorUnavailable)
+	})
+}
+
+// fullWriter fails after writing limit bytes as if the disk is full.
+type fullWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (fw *fullWriter) Write(p []byte) (int, error) {
+	if len(p) <= fw.limit {
+		n, err := fw.w.Write(p)
+		fw.limit -= n
+		return n, err
+	}
+	n, _ := fw.w.Write(p[:fw.limit])
+	fw.limit -= n
+	return n, syscall.ENOSPC
+}
+
+func testWriteError(t *testing.T, mode string) {
+	t.Parallel()
+
+	body := strings.Repeat("deb data", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.OnStorageError = mode
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	c.wrapTempFile = func(f *os.File) io.Writer {
+		return &fullWriter{w: f, limit: 100}
+	}
+
+	status, f, err := c.Get("ubuntu/pool/a_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Health() == nil {
+		t.Error(`c.Health() == nil`)
+	}
+
+	if mode == StorageErrorUnavailable {
+		if status != http.StatusServiceUnavailable {
+			t.Error(`status != http.StatusServiceUnavailable`, status)
+		}
+		return
+	}
+
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Error(`string(data) != body`, len(data))
+	}
+	if c.items.Contains("ubuntu/pool/a_1.0_amd64.deb") {
+		t.Error(`the item must not be cached`)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Run("PassThrough", func(t *testing.T) {
+		testWriteError(t, StorageErrorPassThrough)
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		testWriteError(t, StorageErrorUnavailable)
+	})
+}
+
+func TestUncached(t *testing.T) {
+	t.Parallel()
+
+	c := &Cacher{uncached: make(map[string]uncachedItem)}
+	f1, err := passThroughTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1.Close()
+	defer os.Remove(f1.Name())
+	f2, err := passThroughTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2.Close()
+	defer os.Remove(f2.Name())
+
+	const p = "ubuntu/pool/a_1.0_amd64.deb"
+	c.addUncached(p, f1.Name(), nil)
+	c.addUncached(p, f2.Name(), nil)
+	if _, err := os.Stat(f1.Name()); !os.IsNotExist(err) {
+		t.Error(`replaced file must be removed`, err)
+	}
+
+	// the first download must not remove the second file.
+	c.removeUncached(p, f1.Name())
+	f := c.openUncached(p)
+	if f == nil {
+		t.Fatal(`c.openUncached(p) == nil`)
+	}
+	f.Close()
+
+	c.removeUncached(p, f2.Name())
+	if c.openUncached(p) != nil {
+		t.Error(`c.openUncached(p) != nil`)
+	}
+	if _, err := os.Stat(f2.Name()); !os.IsNotExist(err) {
+		t.Error(`removed file must be removed`, err)
+	}
+}
+
+func TestRetryUncached(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	var blocker string
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+
+		// make Insert fail by placing a file where a directory is needed.
+		if err := os.MkdirAll(filepath.Join(config.CacheDirectory, "ubuntu"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		blocker = filepath.Join(config.CacheDirectory, "ubuntu", "pool")
+		if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanup()
+
+	const p1 = "ubuntu/pool/a_1.0_amd64.deb"
+	status, f, err := c.Get(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	f.Close()
+	if c.Health() == nil {
+		t.Fatal(`c.Health() == nil`)
+	}
+
+	// the storage recovers.
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	status, f, err = c.Get("ubuntu/pool/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	f.Close()
+	if c.Health() != nil {
+		t.Error(`c.Health() != nil`)
+	}
+
+	var data []byte
+	for i := 0; i < 100; i++ {
+		f, err := c.items.Open(p1)
+		if err == nil {
+			data, err = ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(data) != "/pool/a_1.0_amd64.deb" {
+		t.Error(`uncached item was not cached`, string(data))
+	}
+	if c.openUncached(p1) != nil {
+		t.Error(`c.openUncached(p1) != nil`)
+	}
+}
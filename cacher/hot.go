@@ -0,0 +1,193 @@
+package cacher
+
+// This file implements the in-memory hot tier of small meta data files.
+// Files such as InRelease are requested by every client at once, so
+// they are served from memory without opening cache files.
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+const (
+	defaultHotCacheMaxItem = 1024 // KiB
+)
+
+// HotCacheStats is statistics of the hot tier.
+type HotCacheStats struct {
+	// Items is the number of items in memory.
+	Items int `json:"items"`
+
+	// Bytes is the total size of items in memory.
+	Bytes int64 `json:"bytes"`
+
+	// Hits is the number of requests served from memory.
+	Hits uint64 `json:"hits"`
+}
+
+type hotEntry struct {
+	p       string
+	fi      *apt.FileInfo
+	data    []byte
+	modTime time.Time
+}
+
+// hotCache is an LRU cache of small meta data files in memory.
+type hotCache struct {
+	capacity int64
+	maxItem  int64
+
+	mu    sync.Mutex
+	used  int64
+	hits  uint64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// newHotCache returns a hotCache, or nil if capacity is zero.
+func newHotCache(capacity, maxItem int64) *hotCache {
+	if capacity <= 0 {
+		return nil
+	}
+	if maxItem > capacity {
+		maxItem = capacity
+	}
+	return &hotCache{
+		capacity: capacity,
+		maxItem:  maxItem,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry of p if it has the same contents as fi.
+func (h *hotCache) get(p string, fi *apt.FileInfo) *hotEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	el, ok := h.items[p]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*hotEntry)
+	if !fi.Same(e.fi) {
+		// p has been updated.
+		h.removeElement(el)
+		return nil
+	}
+	h.ll.MoveToFront(el)
+	h.hits++
+	return e
+}
+
+// add adds an entry.  Entries larger than maxItem are ignored.
+func (h *hotCache) add(e *hotEntry) {
+	size := int64(len(e.data))
+	if size > h.maxItem {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if el, ok := h.items[e.p]; ok {
+		h.removeElement(el)
+	}
+	h.items[e.p] = h.ll.PushFront(e)
+	h.used += size
+	for h.used > h.capacity {
+		h.removeElement(h.ll.Back())
+	}
+}
+
+// removeElement removes el.
+// h.mu lock must be acquired beforehand.
+func (h *hotCache) removeElement(el *list.Element) {
+	e := h.ll.Remove(el).(*hotEntry)
+	delete(h.items, e.p)
+	h.used -= int64(len(e.data))
+}
+
+func (h *hotCache) stats() *HotCacheStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &HotCacheStats{
+		Items: h.ll.Len(),
+		Bytes: h.used,
+		Hits:  h.hits,
+	}
+}
+
+// hotFileInfo returns FileInfo of a meta data file p to be served
+// from the hot tier, or nil.
+func (c *Cacher) hotFileInfo(p string) (string, *apt.FileInfo) {
+	if c.hot == nil || !apt.IsMeta(p) {
+		return "", nil
+	}
+	p = c.byHashTarget(p)
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	return p, fi
+}
+
+// serveHot serves a meta data file p from memory if possible.
+// It returns false if p is not in memory.
+func (c cacheHandler) serveHot(w http.ResponseWriter, r *http.Request, p string) bool {
+	hp, fi := c.hotFileInfo(p)
+	if fi == nil || c.refreshDue(hp, false) {
+		return false
+	}
+	e := c.hot.get(hp, fi)
+	if e == nil {
+		return false
+	}
+	c.meta.Touch(hp)
+	c.stats.record(hp, true)
+	setCacheStatus(r, cacheHit)
+	c.clientCache.set(w.Header(), p, time.Now())
+	http.ServeContent(w, r, path.Base(p), e.modTime, bytes.NewReader(e.data))
+	return true
+}
+
+// addHot adds a meta data file p served from f to memory.
+// The offset of f is reset to the beginning.
+func (c *Cacher) addHot(p string, f *os.File, stat os.FileInfo) {
+	if c.hot == nil || !apt.IsMeta(p) || stat.Size() > c.hot.maxItem {
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	if _, serr := f.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		return
+	}
+
+	// FileInfo is calculated from data as the index may have been
+	// updated meanwhile.
+	p = c.byHashTarget(p)
+	fi, err := apt.CopyWithFileInfo(ioutil.Discard, bytes.NewReader(data), p)
+	if err != nil {
+		return
+	}
+	c.hot.add(&hotEntry{
+		p:       p,
+		fi:      fi,
+		data:    data,
+		modTime: stat.ModTime(),
+	})
+}
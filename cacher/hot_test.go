@@ -0,0 +1,106 @@
+package cacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func TestHotCache(t *testing.T) {
+	t.Parallel()
+
+	entry := func(p, data string) *hotEntry {
+		fi, err := apt.CopyWithFileInfo(ioutil.Discard, bytes.NewReader([]byte(data)), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &hotEntry{p: p, fi: fi, data: []byte(data)}
+	}
+
+	h := newHotCache(10, 4)
+	a, b, c := entry("a", "aaaa"), entry("b", "bbbb"), entry("c", "cccc")
+	h.add(a)
+	h.add(b)
+	if h.get("a", a.fi) == nil {
+		t.Error(`a must be cached`)
+	}
+	h.add(c)
+	if h.get("b", b.fi) != nil {
+		t.Error(`the least recently used entry must be removed`)
+	}
+	if h.get("a", a.fi) == nil || h.get("c", c.fi) == nil {
+		t.Error(`a and c must be cached`)
+	}
+	if h.get("a", entry("a", "new").fi) != nil {
+		t.Error(`updated entries must not be returned`)
+	}
+	h.add(entry("d", "ddddd"))
+	if st := h.stats(); st.Items != 1 || st.Bytes != 4 || st.Hits != 3 {
+		t.Error(`unexpected stats`, st)
+	}
+	if newHotCache(0, 4) != nil {
+		t.Error(`zero capacity must disable the hot tier`)
+	}
+}
+
+func TestServeHot(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	data := "Label: v1\n"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.HotCacheSize = 1
+	})
+	defer cleanup()
+	s := httptest.NewServer(cacheHandler{c})
+	defer s.Close()
+
+	p := "ubuntu/dists/stable/InRelease"
+	get := func(expected string) {
+		resp, err := http.Get(s.URL + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Error(`unexpected data`, string(body), expected)
+		}
+	}
+
+	get("Label: v1\n")
+	get("Label: v1\n")
+	get("Label: v1\n")
+	// the first request may be served while being downloaded.
+	st := c.Stats().HotCache
+	if st == nil || st.Items != 1 || st.Hits == 0 {
+		t.Fatal(`InRelease must be served from memory`, st)
+	}
+	hits := st.Hits
+
+	mu.Lock()
+	data = "Label: v2\n"
+	mu.Unlock()
+	<-c.Download(p, nil)
+	get("Label: v2\n")
+	get("Label: v2\n")
+	if st := c.Stats().HotCache; st.Hits != hits+1 {
+		t.Error(`updated files must be served from memory`, st)
+	}
+}
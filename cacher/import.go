@@ -0,0 +1,175 @@
+package cacher
+
+// This file implements importing existing cache files.
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// ImportResult is the result of Cacher.Import.
+type ImportResult struct {
+	// Imported is the number of files inserted into the cache.
+	Imported int `json:"imported"`
+
+	// Cached is the number of files already cached.
+	Cached int `json:"cached"`
+
+	// Unknown is the number of files not listed in cached indices
+	// or not matching their checksums.
+	Unknown int `json:"unknown"`
+}
+
+// importSources walks dir and returns files to be imported keyed by
+// their base names.  Cache files of go-apt-cacher are recognized by
+// fileSuffix, and their names in the sharded layout are read from
+// pathSuffix files.  Meta data files and dedupDir are ignored.
+func importSources(dir string) (map[string][]string, error) {
+	files := make(map[string][]string)
+	wf := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == dedupDir || info.Name() == tempDir) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name := strings.TrimSuffix(info.Name(), fileSuffix)
+		if strings.HasSuffix(name, pathSuffix) {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), fileSuffix) {
+			if data, err := readData(sidecar(p, pathSuffix)); err == nil {
+				name = path.Base(string(data))
+			}
+		}
+		switch {
+		case strings.HasPrefix(name, "_tmp"):
+			return nil
+		case strings.HasSuffix(name, validatorsSuffix):
+			return nil
+		case apt.IsMeta(name):
+			return nil
+		}
+		files[name] = append(files[name], p)
+		return nil
+	}
+	if err := filepath.Walk(dir, wf); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// importTargets returns items listed in cached indices whose base
+// names are in files.
+func (c *Cacher) importTargets(files map[string][]string) (map[string][]*apt.FileInfo, error) {
+	targets := make(map[string][]*apt.FileInfo)
+	err := c.walkIndexed("", func(fi *apt.FileInfo) {
+		name := path.Base(fi.Path())
+		if _, ok := files[name]; ok && !apt.IsMeta(fi.Path()) && !c.blocked(fi.Path()) {
+			targets[name] = append(targets[name], fi)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// importFile inserts the file at filename as fi if its checksums match.
+// It returns false if they do not match.
+func (c *Cacher) importFile(filename string, fi *apt.FileInfo) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	tempfile, err := c.items.TempFile()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+	}()
+
+	hashed, err := apt.CopyWithFileInfo(tempfile, f, fi.Path())
+	if err != nil {
+		return false, err
+	}
+	if !fi.Same(hashed) {
+		return false, nil
+	}
+	if err := tempfile.Sync(); err != nil {
+		return false, err
+	}
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+	if err := c.items.Insert(tempfile.Name(), hashed); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Import inserts files under dir into the cache so that a new
+// go-apt-cacher starts warm.
+//
+// dir can be an archive directory of apt such as /var/cache/apt/archives,
+// a tree of a mirror, or cache_dir of another go-apt-cacher.
+// Files are mapped to items listed in cached indices by their names,
+// and imported only if their checksums match.
+func (c *Cacher) Import(dir string) (*ImportResult, error) {
+	files, err := importSources(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "import")
+	}
+	targets, err := c.importTargets(files)
+	if err != nil {
+		return nil, errors.Wrap(err, "import")
+	}
+
+	res := new(ImportResult)
+	for name, filenames := range files {
+		for _, filename := range filenames {
+			imported, cached := false, false
+			for _, fi := range targets[name] {
+				if c.items.Contains(fi.Path()) {
+					cached = true
+					continue
+				}
+				ok, err := c.importFile(filename, fi)
+				if err != nil {
+					return res, errors.Wrap(err, "import "+filename)
+				}
+				imported = imported || ok
+			}
+
+			switch {
+			case imported:
+				res.Imported++
+			case cached:
+				res.Cached++
+			default:
+				res.Unknown++
+			}
+		}
+	}
+
+	log.Info("imported", map[string]interface{}{
+		"dir":      dir,
+		"imported": res.Imported,
+		"cached":   res.Cached,
+		"unknown":  res.Unknown,
+	})
+	return res, nil
+}
@@ -0,0 +1,77 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")},
+		{Name: "b", Version: "1.0", Arch: "amd64", Data: []byte("b")},
+		{Name: "c", Version: "1.0", Arch: "amd64", Data: []byte("c")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	testGetData(t, c, "ubuntu/"+repotest.PoolPath(pkgs[2]), pkgs[2].Data)
+
+	// an archive directory of apt.
+	archives, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archives)
+	files := map[string][]byte{
+		"a_1.0_amd64.deb":         []byte("a"),
+		"b_1.0_amd64.deb":         []byte("broken"),
+		"c_1.0_amd64.deb":         []byte("c"),
+		"d_1.0_amd64.deb":         []byte("d"),
+		"partial/a_1.0_amd64.deb": []byte("a"),
+		"lock":                    nil,
+	}
+	for name, data := range files {
+		p := filepath.Join(archives, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := c.Import(archives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// partial/a_1.0_amd64.deb is counted as cached as it is
+	// processed after a_1.0_amd64.deb.
+	expected := ImportResult{Imported: 1, Cached: 2, Unknown: 3}
+	if *res != expected {
+		t.Error(`unexpected result`, *res)
+	}
+
+	if !c.items.Contains("ubuntu/" + repotest.PoolPath(pkgs[0])) {
+		t.Error(`a must be imported`)
+	}
+	if c.items.Contains("ubuntu/" + repotest.PoolPath(pkgs[1])) {
+		t.Error(`broken b must not be imported`)
+	}
+	testGetData(t, c, "ubuntu/"+repotest.PoolPath(pkgs[0]), pkgs[0].Data)
+}
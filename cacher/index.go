@@ -0,0 +1,163 @@
+package cacher
+
+// This file implements indices of FileInfo listed in meta data files.
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	indexBucket = []byte("index")
+)
+
+// fileIndex maps paths to *apt.FileInfo.
+//
+// Callers must serialize Put calls with other method calls.
+type fileIndex interface {
+	// Get returns *apt.FileInfo for p.
+	Get(p string) (*apt.FileInfo, bool)
+
+	// Put adds or replaces fil.
+	Put(fil ...*apt.FileInfo) error
+
+	// Close releases resources.
+	Close() error
+}
+
+// mapIndex is a fileIndex kept in memory.
+type mapIndex map[string]*apt.FileInfo
+
+func (m mapIndex) Get(p string) (*apt.FileInfo, bool) {
+	fi, ok := m[p]
+	return fi, ok
+}
+
+func (m mapIndex) Put(fil ...*apt.FileInfo) error {
+	for _, fi := range fil {
+		m[fi.Path()] = fi
+	}
+	return nil
+}
+
+func (m mapIndex) Close() error {
+	return nil
+}
+
+// diskIndex is a fileIndex stored in a bbolt database.
+//
+// This trades lookup speed for memory footprint as indices of
+// large repositories may have hundreds of thousands of entries.
+type diskIndex struct {
+	db *bolt.DB
+}
+
+// newDiskIndex creates a diskIndex at filename.
+// Unless keep is true, existing contents are discarded because
+// the index is rebuilt from meta data files at startup.
+func newDiskIndex(filename string, keep bool) (*diskIndex, error) {
+	if !keep {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(filename, 0644, &bolt.Options{
+		Timeout: time.Second,
+		NoSync:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &diskIndex{db}, nil
+}
+
+func (d *diskIndex) Get(p string) (*apt.FileInfo, bool) {
+	var fi *apt.FileInfo
+	d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(indexBucket).Get([]byte(p))
+		if data == nil {
+			return nil
+		}
+		fi2 := new(apt.FileInfo)
+		if json.Unmarshal(data, fi2) == nil {
+			fi = fi2
+		}
+		return nil
+	})
+	return fi, fi != nil
+}
+
+func (d *diskIndex) Put(fil ...*apt.FileInfo) error {
+	if len(fil) == 0 {
+		return nil
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		for _, fi := range fil {
+			data, err := json.Marshal(fi)
+			if err != nil {
+				return errors.Wrap(err, fi.Path())
+			}
+			err = b.Put([]byte(fi.Path()), data)
+			if err != nil {
+				return errors.Wrap(err, fi.Path())
+			}
+		}
+		return nil
+	})
+}
+
+func (d *diskIndex) Close() error {
+	return d.db.Close()
+}
+
+// walkIndexed calls fn for each item listed in cached meta data files
+// under prefix.  If prefix is empty, all meta data files are read.
+// Meta data files listed in others are also passed to fn.
+//
+// As fileIndex cannot enumerate items, meta data files are parsed.
+func (c *Cacher) walkIndexed(prefix string, fn func(fi *apt.FileInfo)) error {
+	for _, mfi := range c.meta.ListAll() {
+		t := strings.SplitN(mfi.Path(), "/", 2)
+		if len(t) != 2 || (prefix != "" && t[0] != prefix) {
+			continue
+		}
+		f, err := c.meta.Open(mfi.Path())
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fil, _, err := apt.ExtractFileInfo(t[1], f)
+		f.Close()
+		if err != nil {
+			log.Warn("invalid meta data", map[string]interface{}{
+				"path":  mfi.Path(),
+				"error": err.Error(),
+			})
+			continue
+		}
+		for _, fi := range addPrefix(t[0], fil) {
+			fn(fi)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package cacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func testFileIndex(t *testing.T, idx fileIndex) {
+	fi, err := apt.CopyWithFileInfo(ioutil.Discard, bytes.NewReader([]byte("hello")), "ubuntu/pool/a.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := apt.MakeFileInfoNoChecksum("ubuntu/dists/trusty/Release", 100)
+
+	if _, ok := idx.Get(fi.Path()); ok {
+		t.Error(`idx.Get(fi.Path()) should fail`)
+	}
+
+	if err := idx.Put(fi, release); err != nil {
+		t.Fatal(err)
+	}
+
+	fi2, ok := idx.Get(fi.Path())
+	if !ok {
+		t.Fatal(`!ok`)
+	}
+	if !fi.Same(fi2) || !fi2.Same(fi) {
+		t.Error(`fi2 is not the same as fi`)
+	}
+
+	rel2, ok := idx.Get(release.Path())
+	if !ok {
+		t.Fatal(`!ok for release`)
+	}
+	// checksums missing in the index must be ignored.
+	downloaded, err := apt.CopyWithFileInfo(ioutil.Discard, bytes.NewReader(make([]byte, 100)), release.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rel2.Same(downloaded) {
+		t.Error(`!rel2.Same(downloaded)`)
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileIndex(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Map", func(t *testing.T) {
+		testFileIndex(t, make(mapIndex))
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "gotest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		idx, err := newDiskIndex(filepath.Join(dir, indexDB), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testFileIndex(t, idx)
+	})
+}
@@ -0,0 +1,75 @@
+//go:build integration
+// +build integration
+
+package cacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestIntegration(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "hoge", Version: "1.0", Arch: "amd64", Data: []byte("hoge deb")},
+		{Name: "fuga", Version: "2.0-1", Arch: "amd64", Data: []byte("fuga deb")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", true, pkgs...)
+	repo.Corrupt(repotest.PoolPath(pkgs[1]))
+	server := httptest.NewServer(repo)
+	defer server.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"test": {server.URL}}
+	})
+	defer cleanup()
+
+	get := func(p string, data []byte) {
+		t.Helper()
+
+		status, f, err := c.Get("test/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatalf(`%s: status != http.StatusOK: %d`, p, status)
+		}
+		defer f.Close()
+
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf(`%s: %q != %q`, p, got, data)
+		}
+	}
+
+	for _, p := range []string{
+		"dists/stable/Release",
+		"dists/stable/main/binary-amd64/Packages.gz",
+		"dists/stable/main/binary-amd64/Packages",
+	} {
+		get(p, repo.Get(p))
+	}
+	get(repotest.PoolPath(pkgs[0]), pkgs[0].Data)
+
+	// the corrupted package must not be served.
+	status, f, err := c.Get("test/" + repotest.PoolPath(pkgs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		f.Close()
+	}
+	if status == http.StatusOK {
+		t.Error(`corrupted package was served`)
+	}
+}
@@ -0,0 +1,108 @@
+package cacher
+
+// This file implements layouts of cache files in Storage.
+//
+// In the tree layout, the cache file of an item is placed at the same
+// path as the item with fileSuffix.  In the sharded layout, it is placed
+// at shardDir/ab/cd/<hash>, where <hash> is the SHA256 checksum of the
+// item path, so that no directory contains too many files.  The item
+// path is recorded next to the cache file with pathSuffix.
+//
+// Storage loads cache files of both layouts, and places new ones in
+// the configured layout.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// Layouts of cache files for Config.CacheLayout.
+const (
+	LayoutTree    = "tree"
+	LayoutSharded = "sharded"
+)
+
+const (
+	pathSuffix = ".path"
+)
+
+// checkLayout validates a layout name.  An empty name is LayoutTree.
+func checkLayout(layout string) error {
+	switch layout {
+	case "", LayoutTree, LayoutSharded:
+		return nil
+	}
+	return errors.New("unknown layout: " + layout)
+}
+
+// shardFile returns the filename of the cache file of p relative to
+// the Storage directory in the sharded layout.
+func shardFile(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(shardDir, h[:2], h[2:4], h+fileSuffix)
+}
+
+// isShardPath returns true if subpath is in shardDir.
+func isShardPath(subpath string) bool {
+	return strings.HasPrefix(subpath, shardDir+string(filepath.Separator))
+}
+
+// sidecar returns the filename of a file accompanying the cache file.
+func sidecar(file, suffix string) string {
+	return strings.TrimSuffix(file, fileSuffix) + suffix
+}
+
+// itemFile returns the filename of the cache file of p relative to
+// the Storage directory in the configured layout.
+func (cm *Storage) itemFile(p string) string {
+	if cm.layout == LayoutSharded {
+		return shardFile(p)
+	}
+	return p + fileSuffix
+}
+
+// writeShardPath records the item path p of a cache file in the
+// sharded layout.
+func (cm *Storage) writeShardPath(file, p string) error {
+	return ioutil.WriteFile(filepath.Join(cm.dir, sidecar(file, pathSuffix)), []byte(p), 0644)
+}
+
+// readShardPath returns the item path of a cache file in the sharded
+// layout.  An error is returned if the path is not recorded correctly.
+func (cm *Storage) readShardPath(file string) (string, error) {
+	data, err := readData(filepath.Join(cm.dir, sidecar(file, pathSuffix)))
+	if err != nil {
+		return "", err
+	}
+	p := string(data)
+	if shardFile(p) != file {
+		return "", errors.New("path mismatch: " + file)
+	}
+	return p, nil
+}
+
+// removeSidecars removes files accompanying the cache file of e.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) removeSidecars(e *entry) {
+	suffixes := []string{validatorsSuffix}
+	if isShardPath(e.file) {
+		suffixes = append(suffixes, pathSuffix)
+	}
+	for _, suffix := range suffixes {
+		err := os.Remove(filepath.Join(cm.dir, sidecar(e.file, suffix)))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn("failed to remove a file", map[string]interface{}{
+				"path":  e.Path(),
+				"error": err.Error(),
+			})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package cacher
+
+// This file implements server-side limits of connections and requests.
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// overloadRetryAfter is Retry-After in seconds for overloaded requests.
+	overloadRetryAfter = 1
+)
+
+// limitListener is a net.Listener that accepts at most max
+// connections at once.  Accept blocks until a connection is closed
+// so that file descriptors are not exhausted.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(ln net.Listener, max int) net.Listener {
+	return &limitListener{ln, make(chan struct{}, max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// maxRequests returns a Middleware that serves at most max requests
+// at once.  Excess requests are responded with 503 Service Unavailable.
+func maxRequests(max int) Middleware {
+	sem := make(chan struct{}, max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+			default:
+				w.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+				http.Error(w, "too many requests in progress", http.StatusServiceUnavailable)
+				return
+			}
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
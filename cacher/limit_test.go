@@ -0,0 +1,97 @@
+package cacher
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(l, 1)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	var first net.Conn
+	select {
+	case first = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal(`first connection must be accepted`)
+	}
+	select {
+	case <-accepted:
+		t.Fatal(`second connection must wait`)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal(`second connection must be accepted after close`)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	t.Parallel()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := maxRequests(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-entered
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error(`w.Code != http.StatusServiceUnavailable`, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error(`Retry-After must be set`)
+	}
+
+	close(release)
+	<-done
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusOK {
+		t.Error(`w.Code != http.StatusOK`, w.Code)
+	}
+}
@@ -0,0 +1,265 @@
+package cacher
+
+// This file implements migration of cache files between layouts.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// MigrateResult is the result of Migrate.
+type MigrateResult struct {
+	// Migrated is the number of files moved to the configured layout.
+	Migrated int `json:"migrated"`
+
+	// Unchanged is the number of files already in the layout.
+	Unchanged int `json:"unchanged"`
+
+	// Removed is the number of files removed because their checksums
+	// do not match or the same items exist in the layout.
+	Removed int `json:"removed"`
+
+	// Unverified is the number of files not listed in cached indices.
+	// They are migrated without verification.
+	Unverified int `json:"unverified"`
+}
+
+// isLegacyFile returns true if subpath may be a cache file without
+// fileSuffix, which was created by old versions of go-apt-cacher.
+func isLegacyFile(subpath string) bool {
+	switch {
+	case !strings.Contains(subpath, string(filepath.Separator)):
+		// items always have prefixes.
+		return false
+	case isReserved(strings.SplitN(subpath, string(filepath.Separator), 2)[0]):
+		return false
+	case filepath.Ext(subpath) == fileSuffix:
+		return false
+	case strings.HasSuffix(subpath, validatorsSuffix):
+		return false
+	}
+	return true
+}
+
+// migrateMeta renames legacy meta data files in dir to have fileSuffix.
+func migrateMeta(dir string, res *MigrateResult) error {
+	wf := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		subpath, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if !isLegacyFile(subpath) || !apt.IsMeta(subpath) {
+			return nil
+		}
+		target := p + fileSuffix
+		if _, err := os.Stat(target); err == nil {
+			res.Removed++
+			return os.Remove(p)
+		}
+		res.Migrated++
+		return os.Rename(p, target)
+	}
+	return filepath.Walk(dir, wf)
+}
+
+// metaFileInfo returns FileInfo listed in meta data files in dir.
+func metaFileInfo(dir string) (mapIndex, error) {
+	meta := NewStorage(dir, 0)
+	if err := meta.Load(); err != nil {
+		return nil, err
+	}
+	index := make(mapIndex)
+	for _, mfi := range meta.ListAll() {
+		t := strings.SplitN(mfi.Path(), "/", 2)
+		f, err := meta.Open(mfi.Path())
+		if err != nil {
+			return nil, err
+		}
+		fil, _, err := apt.ExtractFileInfo(t[1], f)
+		f.Close()
+		if err != nil {
+			log.Warn("invalid meta data", map[string]interface{}{
+				"path":  mfi.Path(),
+				"error": err.Error(),
+			})
+			continue
+		}
+		index.Put(addPrefix(t[0], fil)...)
+	}
+	return index, nil
+}
+
+// migrateItem moves the cache file of p at file to the layout of cm.
+func (cm *Storage) migrateItem(p, file string, index mapIndex, res *MigrateResult) error {
+	filename := filepath.Join(cm.dir, file)
+	removeAll := func() error {
+		res.Removed++
+		for _, suffix := range []string{validatorsSuffix, pathSuffix} {
+			os.Remove(filepath.Join(cm.dir, sidecar(file, suffix)))
+		}
+		return os.Remove(filename)
+	}
+
+	target := cm.itemFile(p)
+	if target != file {
+		if _, err := os.Stat(filepath.Join(cm.dir, target)); err == nil {
+			return removeAll()
+		}
+	}
+
+	if fi, ok := index.Get(p); ok {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		hashed, err := apt.CopyWithFileInfoMask(ioutil.Discard, f, p, fi.HashMask())
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if !fi.Same(hashed) {
+			log.Warn("removed a corrupted cache file", map[string]interface{}{
+				"path": p,
+			})
+			return removeAll()
+		}
+	} else {
+		res.Unverified++
+	}
+
+	if target == file {
+		res.Unchanged++
+		return nil
+	}
+
+	dest := filepath.Join(cm.dir, target)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if isShardPath(target) {
+		if err := cm.writeShardPath(target, p); err != nil {
+			return err
+		}
+	}
+	v := filepath.Join(cm.dir, sidecar(file, validatorsSuffix))
+	if _, err := os.Stat(v); err == nil {
+		err = os.Rename(v, filepath.Join(cm.dir, sidecar(target, validatorsSuffix)))
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(filename, dest); err != nil {
+		return err
+	}
+	if isShardPath(file) {
+		os.Remove(filepath.Join(cm.dir, sidecar(file, pathSuffix)))
+	}
+	res.Migrated++
+	return nil
+}
+
+// Migrate converts cache files of go-apt-cacher in place to the
+// layout specified by config.CacheLayout.
+//
+// Files created by old versions without fileSuffix are also converted.
+// Checksums of items listed in cached indices are verified, and
+// corrupted files are removed.  go-apt-cacher must not be running.
+func Migrate(config *Config) (*MigrateResult, error) {
+	if err := checkLayout(config.CacheLayout); err != nil {
+		return nil, errors.Wrap(err, "cache_layout")
+	}
+	metaDir := filepath.Clean(config.MetaDirectory)
+	cacheDir := filepath.Clean(config.CacheDirectory)
+	if !filepath.IsAbs(metaDir) || !filepath.IsAbs(cacheDir) {
+		return nil, errors.New("meta_dir and cache_dir must be absolute paths")
+	}
+
+	// snapshots no longer match files after migration.
+	for _, f := range []string{
+		filepath.Join(metaDir, storageSnapshot),
+		filepath.Join(metaDir, infoSnapshot),
+		filepath.Join(cacheDir, storageSnapshot),
+	} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	res := new(MigrateResult)
+	if err := migrateMeta(metaDir, res); err != nil {
+		return nil, errors.Wrap(err, "migrate meta_dir")
+	}
+	index, err := metaFileInfo(metaDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "load meta_dir")
+	}
+
+	cm := NewStorage(cacheDir, 0)
+	cm.SetLayout(config.CacheLayout)
+
+	// collect files first as migrateItem moves them during walk.
+	files := make(map[string]string)
+	wf := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		subpath, err := filepath.Rel(cacheDir, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (subpath == dedupDir || subpath == tempDir) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		switch {
+		case isShardPath(subpath) && filepath.Ext(subpath) == fileSuffix:
+			itemPath, err := cm.readShardPath(subpath)
+			if err != nil {
+				log.Warn("ignored a broken cache file", map[string]interface{}{
+					"path":  subpath,
+					"error": err.Error(),
+				})
+				return nil
+			}
+			files[subpath] = itemPath
+		case isShardPath(subpath):
+		case filepath.Ext(subpath) == fileSuffix:
+			files[subpath] = strings.TrimSuffix(subpath, fileSuffix)
+		case isLegacyFile(subpath):
+			files[subpath] = subpath
+		}
+		return nil
+	}
+	if err := filepath.Walk(cacheDir, wf); err != nil {
+		return nil, errors.Wrap(err, "walk cache_dir")
+	}
+
+	for file, p := range files {
+		if err := cm.migrateItem(p, file, index, res); err != nil {
+			return res, errors.Wrap(err, "migrate "+p)
+		}
+	}
+
+	log.Info("migrated", map[string]interface{}{
+		"layout":     cm.layout,
+		"migrated":   res.Migrated,
+		"unchanged":  res.Unchanged,
+		"removed":    res.Removed,
+		"unverified": res.Unverified,
+	})
+	return res, nil
+}
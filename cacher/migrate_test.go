@@ -0,0 +1,97 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")},
+		{Name: "b", Version: "1.0", Arch: "amd64", Data: []byte("b")},
+		{Name: "c", Version: "1.0", Arch: "amd64", Data: []byte("c")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config = cfg
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	paths := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		paths[i] = "ubuntu/" + repotest.PoolPath(pkg)
+		testGetData(t, c, paths[i], pkg.Data)
+	}
+
+	cacheFile := func(p string) string {
+		return filepath.Join(config.CacheDirectory, p)
+	}
+	// a is in the legacy layout.
+	if err := os.Rename(cacheFile(paths[0]+fileSuffix), cacheFile(paths[0])); err != nil {
+		t.Fatal(err)
+	}
+	// b is corrupted.
+	if err := os.Remove(cacheFile(paths[1] + fileSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cacheFile(paths[1]+fileSuffix), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// x is not listed in indices.
+	if err := ioutil.WriteFile(cacheFile("ubuntu/x.deb"+fileSuffix), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.CacheLayout = LayoutSharded
+	res, err := Migrate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (MigrateResult{Migrated: 3, Removed: 1, Unverified: 1}) {
+		t.Error(`unexpected result`, *res)
+	}
+
+	cm := NewStorage(config.CacheDirectory, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{paths[0], paths[2], "ubuntu/x.deb"} {
+		if !cm.Contains(p) {
+			t.Error(p + ` must be migrated`)
+		}
+		if _, err := os.Stat(cacheFile(shardFile(p))); err != nil {
+			t.Error(err)
+		}
+	}
+	if cm.Contains(paths[1]) {
+		t.Error(`corrupted item must be removed`)
+	}
+
+	// back to the tree layout.
+	config.CacheLayout = LayoutTree
+	res, err = Migrate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (MigrateResult{Migrated: 3, Unverified: 1}) {
+		t.Error(`unexpected result`, *res)
+	}
+	if _, err := os.Stat(cacheFile(paths[0] + fileSuffix)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,91 @@
+package cacher
+
+// This file implements notifications from go-apt-mirror.
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+)
+
+const (
+	// notifyPath is the URL path prefix of the notification API
+	// in the admin API.  The mapping prefix follows, as "/notify/ubuntu".
+	notifyPath = "/notify/"
+
+	// maxNotifyBody limits the size of notification requests.
+	maxNotifyBody = 1 << 20
+)
+
+// Notification is the body of a notification request.
+type Notification struct {
+	// Paths of indices changed in the upstream repository.
+	// They are relative to the mapped URL.
+	Paths []string `json:"paths"`
+}
+
+// Refresh re-downloads cached indices of prefix listed in paths
+// without waiting for check_interval.
+//
+// Paths that are not indices or not cached are ignored.
+// Nothing is refreshed in offline mode.
+// The number of indices being refreshed is returned.
+func (c *Cacher) Refresh(prefix string, paths []string) int {
+	if c.offline || !c.mapped(prefix) {
+		return 0
+	}
+
+	n := 0
+	for _, p := range paths {
+		p = path.Clean(p)
+		if !apt.IsMeta(p) || strings.HasPrefix(p, "../") || path.IsAbs(p) {
+			continue
+		}
+		p = path.Join(prefix, p)
+
+		c.fiLock.RLock()
+		_, ok := c.info.Get(p)
+		c.fiLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		c.Download(p, nil)
+		n++
+	}
+	return n
+}
+
+func (h adminHandler) serveNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := strings.TrimPrefix(r.URL.Path, notifyPath)
+	if !h.mapped(prefix) || strings.Contains(prefix, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var n Notification
+	err := json.NewDecoder(io.LimitReader(r.Body, maxNotifyBody)).Decode(&n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refreshed := h.Refresh(prefix, n.Paths)
+	log.Info("notified", map[string]interface{}{
+		"prefix":    prefix,
+		"paths":     len(n.Paths),
+		"refreshed": refreshed,
+		"client":    r.RemoteAddr,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
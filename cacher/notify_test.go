@@ -0,0 +1,103 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var version int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&version) == 1 {
+			w.Write([]byte("Version: 1\n"))
+			return
+		}
+		w.Write([]byte("Version: 2\n"))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+
+	read := func() string {
+		status, f, err := c.Get("ubuntu/dists/stable/Release")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(`status != http.StatusOK`, status)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if s := read(); s != "Version: 1\n" {
+		t.Fatal(`unexpected Release`, s)
+	}
+	atomic.StoreInt32(&version, 2)
+
+	handler := adminHandler{Cacher: c, token: "secret"}
+	body := `{"paths": ["dists/stable/Release", "dists/stable/InRelease", "pool/a.deb"]}`
+	post := func(method, p, body, token string) int {
+		r := httptest.NewRequest(method, p, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post("POST", "/notify/ubuntu", body, ""); code != http.StatusUnauthorized {
+		t.Error(`code != http.StatusUnauthorized`, code)
+	}
+	if code := post("POST", "/notify/ubuntu", body, "wrong"); code != http.StatusUnauthorized {
+		t.Error(`code != http.StatusUnauthorized`, code)
+	}
+	if code := post("GET", "/notify/ubuntu", "", "secret"); code != http.StatusMethodNotAllowed {
+		t.Error(`code != http.StatusMethodNotAllowed`, code)
+	}
+	if code := post("POST", "/notify/debian", body, "secret"); code != http.StatusNotFound {
+		t.Error(`code != http.StatusNotFound`, code)
+	}
+	if code := post("POST", "/notify/ubuntu", "{", "secret"); code != http.StatusBadRequest {
+		t.Error(`code != http.StatusBadRequest`, code)
+	}
+
+	// the client port does not accept notifications.
+	w := httptest.NewRecorder()
+	cacheHandler{c}.ServeHTTP(w, httptest.NewRequest("POST", "/_notify/ubuntu", strings.NewReader(body)))
+	if w.Code != http.StatusNotImplemented {
+		t.Error(`w.Code != http.StatusNotImplemented`, w.Code)
+	}
+
+	if code := post("POST", "/notify/ubuntu", body, "secret"); code != http.StatusAccepted {
+		t.Fatal(`code != http.StatusAccepted`, code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for read() != "Version: 2\n" {
+		if time.Now().After(deadline) {
+			t.Fatal(`Release was not refreshed`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// only cached indices are refreshed.
+	if n := c.Refresh("ubuntu", []string{"dists/stable/InRelease", "pool/a.deb", "../etc/Release"}); n != 0 {
+		t.Error(`n != 0`, n)
+	}
+}
@@ -0,0 +1,68 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestOffline(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	repo.Put("extra/b.deb", []byte("b"))
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		repo.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	paths := []string{
+		"dists/stable/Release",
+		"dists/stable/main/binary-amd64/Packages",
+		repotest.PoolPath(pkg),
+		"extra/b.deb",
+	}
+
+	// seed the cache.
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config = cfg
+	})
+	defer cleanup()
+	for _, p := range paths {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+
+	config.Offline = true
+	c, err := NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&requests, 0)
+
+	for _, p := range paths {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	status, _, err := c.Get("ubuntu/dists/stable/main/binary-i386/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNotFound {
+		t.Error(`status != http.StatusNotFound`, status)
+	}
+	if c.Refresh("ubuntu", []string{"dists/stable/Release"}) != 0 {
+		t.Error(`indices must not be refreshed`)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Error(`upstream must not be contacted`, n)
+	}
+}
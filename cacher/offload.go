@@ -0,0 +1,89 @@
+package cacher
+
+// This file implements offloading large items to the upstream or CDNs
+// by redirecting clients instead of proxying and caching them.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+const (
+	// defaultRedirectExpires is the lifetime of signed redirect URLs.
+	defaultRedirectExpires = time.Hour
+)
+
+// signRedirect returns the signature of a redirect URL path valid
+// until expires.
+func signRedirect(secret, p string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(p + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// redirectURL returns the URL to redirect clients to for p, or nil
+// if p is to be served by go-apt-cacher.
+//
+// Only non-meta items whose sizes are known by indices to exceed
+// RedirectSize are redirected.
+func (c *Cacher) redirectURL(p string, now time.Time) *url.URL {
+	if c.offline || apt.IsMeta(p) {
+		return nil
+	}
+	t := strings.SplitN(p, "/", 2)
+	uc, ok := c.upstreams[t[0]]
+	if !ok || uc.RedirectSize == 0 || len(t) == 1 {
+		return nil
+	}
+
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok || fi.Size() <= uint64(uc.RedirectSize)*mib {
+		return nil
+	}
+
+	if uc.RedirectURL == "" {
+		return c.upstreamURL(p)
+	}
+	base, err := url.Parse(uc.RedirectURL)
+	if err != nil {
+		return nil
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	u := base.ResolveReference(&url.URL{Path: t[1]})
+	if uc.RedirectSecret != "" {
+		lifetime := defaultRedirectExpires
+		if uc.RedirectExpires > 0 {
+			lifetime = time.Duration(uc.RedirectExpires) * time.Second
+		}
+		expires := now.Add(lifetime).Unix()
+		q := url.Values{}
+		q.Set("expires", strconv.FormatInt(expires, 10))
+		q.Set("signature", signRedirect(uc.RedirectSecret, u.Path, expires))
+		u.RawQuery = q.Encode()
+	}
+	return u
+}
+
+// serveRedirect redirects the client to another URL for p.
+// It returns false if p is to be served by go-apt-cacher.
+func (c cacheHandler) serveRedirect(w http.ResponseWriter, r *http.Request, p string) bool {
+	u := c.redirectURL(p, time.Now())
+	if u == nil {
+		return false
+	}
+	setCacheStatus(r, cacheRedirect)
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return true
+}
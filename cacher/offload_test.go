@@ -0,0 +1,100 @@
+package cacher
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestRedirectOffload(t *testing.T) {
+	t.Parallel()
+
+	small := repotest.Package{Name: "small", Version: "1.0", Arch: "amd64", Data: []byte("small")}
+	large := repotest.Package{Name: "large", Version: "1.0", Arch: "amd64", Data: bytes.Repeat([]byte("x"), mib+1)}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, small, large)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {upstream.URL},
+			"cdn":    {upstream.URL},
+		}
+		config.Upstreams = map[string]*UpstreamConfig{
+			"ubuntu": {RedirectSize: 1},
+			"cdn": {
+				RedirectSize:   1,
+				RedirectURL:    "https://cdn.example.com/ubuntu",
+				RedirectSecret: "secret",
+			},
+		}
+	})
+	defer cleanup()
+	for _, prefix := range []string{"ubuntu", "cdn"} {
+		for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+			testGetData(t, c, prefix+"/"+p, repo.Get(p))
+		}
+	}
+
+	noFollow := &http.Client{CheckRedirect: noRedirect}
+	s := httptest.NewServer(cacheHandler{c})
+	defer s.Close()
+	get := func(p string) *http.Response {
+		resp, err := noFollow.Get(s.URL + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("ubuntu/" + repotest.PoolPath(small))
+	if resp.StatusCode != http.StatusOK {
+		t.Error(`small items must be served`, resp.StatusCode)
+	}
+
+	resp = get("ubuntu/" + repotest.PoolPath(large))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal(`large items must be redirected`, resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != upstream.URL+"/"+repotest.PoolPath(large) {
+		t.Error(`large items must be redirected to the upstream`, loc)
+	}
+	if c.items.Contains("ubuntu/" + repotest.PoolPath(large)) {
+		t.Error(`redirected items must not be cached`)
+	}
+
+	resp = get("cdn/" + repotest.PoolPath(large))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal(`large items must be redirected`, resp.StatusCode)
+	}
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "cdn.example.com" || u.Path != "/ubuntu/"+repotest.PoolPath(large) {
+		t.Error(`unexpected redirect URL`, u)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(time.Unix(expires, 0)); d <= 0 || d > time.Hour {
+		t.Error(`unexpected expiration`, d)
+	}
+	if sig := u.Query().Get("signature"); sig != signRedirect("secret", u.Path, expires) {
+		t.Error(`invalid signature`, sig)
+	}
+
+	uc := &UpstreamConfig{RedirectURL: "/relative"}
+	if err := uc.check(); err == nil {
+		t.Error(`redirect_url must be absolute`)
+	}
+}
@@ -0,0 +1,195 @@
+package cacher
+
+// This file implements sharing cached items between go-apt-cacher
+// instances.  On a local miss, items are first requested to peers
+// with peerHeader so that peers serve them only if cached.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// peerHeader marks requests from peers.
+	peerHeader = "X-Apt-Cacher-Peer"
+
+	// peerTimeout limits the time to connect and to receive
+	// response headers from peers.
+	peerTimeout = 5 * time.Second
+)
+
+// parsePeers parses base URLs of peers.
+func parsePeers(l []string) ([]*url.URL, error) {
+	var peers []*url.URL
+	for _, s := range l {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("invalid peer: " + s)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		peers = append(peers, u)
+	}
+	return peers, nil
+}
+
+// newPeerClient returns a client for other go-apt-cacher instances.
+// Zero headerTimeout means no timeout for response headers.
+func newPeerClient(headerTimeout time.Duration) *http.Client {
+	return &http.Client{
+		CheckRedirect: noRedirect,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   peerTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: headerTimeout,
+		},
+	}
+}
+
+// fetchFromPeer downloads p from peer into the cache.
+// It returns false if the peer does not have p matching valid.
+func (c *Cacher) fetchFromPeer(ctx context.Context, peer *url.URL, p string, valid *apt.FileInfo) (bool, error) {
+	u := peer.ResolveReference(&url.URL{Path: p})
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(peerHeader, "1")
+	resp, err := c.peerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer closeRespBody(resp)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 500:
+		return false, errors.Errorf("status %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return false, nil
+	}
+
+	tempfile, err := c.items.TempFile()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+	}()
+
+	fi, err := apt.CopyWithFileInfo(tempfile, resp.Body, p)
+	if err != nil {
+		return false, err
+	}
+	if !valid.Same(fi) {
+		log.Warn("peer served invalid data", map[string]interface{}{
+			"url": u.String(),
+		})
+		return false, nil
+	}
+	if err := tempfile.Sync(); err != nil {
+		return false, err
+	}
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+	if c.snapshotSaved {
+		return false, nil
+	}
+	if err := c.items.Insert(tempfile.Name(), fi); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fetchFromPeers downloads p from one of peers.  Only items whose
+// checksums are known are fetched so that they can be verified.
+// It returns false if no peer has p.
+func (c *Cacher) fetchFromPeers(ctx context.Context, p string, valid *apt.FileInfo) bool {
+	if valid == nil || !valid.HasChecksum() || len(c.peers) == 0 {
+		return false
+	}
+
+	for _, peer := range c.peerHealth.order(c.peers) {
+		if !c.peerHealth.healthy(peer) {
+			break
+		}
+		ok, err := c.fetchFromPeer(ctx, peer, p, valid)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			log.Warn("failed to fetch from peer", map[string]interface{}{
+				"peer":  peer.String(),
+				"path":  p,
+				"error": err.Error(),
+			})
+			c.peerHealth.fail(peer)
+			continue
+		}
+		c.peerHealth.ok(peer)
+		if ok {
+			log.Info("fetched from peer", map[string]interface{}{
+				"peer": peer.String(),
+				"path": p,
+			})
+			return true
+		}
+	}
+	return false
+}
+
+// servePeer serves an item at p only if cached.
+func (c cacheHandler) servePeer(w http.ResponseWriter, r *http.Request, p string) {
+	storage := c.items
+	if apt.IsMeta(p) {
+		storage = c.meta
+	}
+
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := storage.Lookup(fi)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	setCacheStatus(r, cacheHit)
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, path.Base(p), stat.ModTime(), f)
+}
@@ -0,0 +1,73 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestPeers(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("package a")},
+		{Name: "b", Version: "1.0", Arch: "amd64", Data: []byte("package b")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		repo.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	newCacher := func(peers ...string) (*Cacher, func()) {
+		return newTestCacher(t, func(config *Config) {
+			config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+			config.Peers = peers
+		})
+	}
+	indices := []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"}
+
+	peer, cleanupPeer := newCacher()
+	defer cleanupPeer()
+	for _, p := range indices {
+		testGetData(t, peer, "ubuntu/"+p, repo.Get(p))
+	}
+	testGetData(t, peer, "ubuntu/"+repotest.PoolPath(pkgs[0]), pkgs[0].Data)
+	ps := httptest.NewServer(cacheHandler{peer})
+	defer ps.Close()
+
+	c, cleanup := newCacher(ps.URL)
+	defer cleanup()
+	for _, p := range indices {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	for _, pkg := range pkgs {
+		testGetData(t, c, "ubuntu/"+repotest.PoolPath(pkg), pkg.Data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/"+repotest.PoolPath(pkgs[0])]; n != 1 {
+		t.Error(`items cached by peers must be fetched from peers`, n)
+	}
+	if n := requests["/"+repotest.PoolPath(pkgs[1])]; n != 1 {
+		t.Error(`items not cached by peers must be downloaded from the upstream`, n)
+	}
+	if peer.items.Contains("ubuntu/" + repotest.PoolPath(pkgs[1])) {
+		t.Error(`peers must not download items for peer requests`)
+	}
+
+	if _, err := parsePeers([]string{"cacher2:3142"}); err == nil {
+		t.Error(`peers must be URLs`)
+	}
+}
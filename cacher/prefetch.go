@@ -0,0 +1,234 @@
+package cacher
+
+// This file implements prefetching of items listed in cached indices.
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/well"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPrefetchConcurrency = 4
+
+	// prefetchTimeFormat is the format of PrefetchConfig.At.
+	prefetchTimeFormat = "15:04"
+)
+
+var (
+	// ErrPrefetchRunning is returned by Prefetch if prefetching for
+	// the same prefix is running.
+	ErrPrefetchRunning = errors.New("prefetch is running")
+)
+
+// PrefetchConfig is a configuration to prefetch items of a mapping
+// prefix.
+type PrefetchConfig struct {
+	// Patterns select items to prefetch by path.Match.  Patterns
+	// containing "/" are matched with paths under the prefix such as
+	// "pool/main/a/apt/*", and others with base names of the items
+	// such as "linux-image-*".
+	//
+	// If empty, all items listed in cached indices are prefetched.
+	Patterns []string `toml:"patterns"`
+
+	// At specifies the local time of day to prefetch in "HH:MM".
+	//
+	// If empty, items are prefetched only by the admin API.
+	At string `toml:"at"`
+}
+
+// check validates the configuration.
+func (pc *PrefetchConfig) check() error {
+	if err := checkPatterns(pc.Patterns); err != nil {
+		return err
+	}
+	if len(pc.At) > 0 {
+		if _, err := time.Parse(prefetchTimeFormat, pc.At); err != nil {
+			return errors.Wrap(err, "at")
+		}
+	}
+	return nil
+}
+
+// checkPatterns validates patterns for path.Match.
+func checkPatterns(patterns []string) error {
+	for _, pat := range patterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return errors.Wrap(err, pat)
+		}
+	}
+	return nil
+}
+
+// matchPatterns returns true if p under a prefix matches one of patterns.
+func matchPatterns(patterns []string, p string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pat := range patterns {
+		target := p
+		if !strings.Contains(pat, "/") {
+			target = path.Base(p)
+		}
+		if ok, _ := path.Match(pat, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PrefetchResult is the result of Cacher.Prefetch.
+type PrefetchResult struct {
+	// Downloaded is the number of items downloaded.
+	Downloaded int `json:"downloaded"`
+
+	// Cached is the number of items already cached.
+	Cached int `json:"cached"`
+
+	// Failed is the number of items failed to download.
+	Failed int `json:"failed"`
+}
+
+// Prefetch downloads items under prefix listed in cached indices and
+// matching patterns.  At most prefetch_concurrency items are downloaded
+// at once.  If patterns is empty, all listed items are downloaded.
+//
+// Prefetch blocks until all items are downloaded or ctx is canceled.
+func (c *Cacher) Prefetch(ctx context.Context, prefix string, patterns []string) (*PrefetchResult, error) {
+	if c.offline {
+		return nil, errors.New("prefetch is not available in offline mode")
+	}
+	if !c.mapped(prefix) || strings.Contains(prefix, "/") {
+		return nil, errors.New("unknown prefix: " + prefix)
+	}
+	if err := checkPatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	c.prefetchLock.Lock()
+	if c.prefetching[prefix] {
+		c.prefetchLock.Unlock()
+		return nil, ErrPrefetchRunning
+	}
+	c.prefetching[prefix] = true
+	c.prefetchLock.Unlock()
+	defer func() {
+		c.prefetchLock.Lock()
+		delete(c.prefetching, prefix)
+		c.prefetchLock.Unlock()
+	}()
+
+	res := new(PrefetchResult)
+	var targets []*apt.FileInfo
+	seen := make(map[string]bool)
+	err := c.walkIndexed(prefix, func(fi *apt.FileInfo) {
+		p := fi.Path()
+		if apt.IsMeta(p) || seen[p] {
+			return
+		}
+		seen[p] = true
+		if !matchPatterns(patterns, strings.TrimPrefix(p, prefix+"/")) {
+			return
+		}
+		if c.items.Contains(p) {
+			res.Cached++
+			return
+		}
+		targets = append(targets, fi)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("prefetch started", map[string]interface{}{
+		"prefix": prefix,
+		"items":  len(targets),
+	})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.prefetchConcurrency)
+LOOP:
+	for _, fi := range targets {
+		select {
+		case <-ctx.Done():
+			break LOOP
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(fi *apt.FileInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ch := c.Download(fi.Path(), fi)
+			if ch == nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if c.items.Contains(fi.Path()) {
+				res.Downloaded++
+			} else {
+				res.Failed++
+			}
+		}(fi)
+	}
+	wg.Wait()
+
+	log.Info("prefetch finished", map[string]interface{}{
+		"prefix":     prefix,
+		"downloaded": res.Downloaded,
+		"cached":     res.Cached,
+		"failed":     res.Failed,
+	})
+	return res, ctx.Err()
+}
+
+// nextPrefetch returns the next time of day at after now.
+func nextPrefetch(now time.Time, at string) time.Time {
+	t, _ := time.Parse(prefetchTimeFormat, at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// schedulePrefetch prefetches items of prefix daily as configured.
+func (c *Cacher) schedulePrefetch(prefix string, pc *PrefetchConfig) {
+	well.Go(func(ctx context.Context) error {
+		for {
+			next := nextPrefetch(time.Now(), pc.At)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(next)):
+			}
+
+			_, err := c.Prefetch(ctx, prefix, pc.Patterns)
+			if err != nil && ctx.Err() == nil {
+				log.Error("prefetch failed", map[string]interface{}{
+					"prefix": prefix,
+					"error":  err.Error(),
+				})
+			}
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package cacher
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	t.Parallel()
+
+	p := "pool/main/l/linux/linux-image-5.4_1.0_amd64.deb"
+	if !matchPatterns(nil, p) {
+		t.Error(`empty patterns must match everything`)
+	}
+	if !matchPatterns([]string{"linux-image-*"}, p) {
+		t.Error(`base name must match`)
+	}
+	if !matchPatterns([]string{"pool/main/l/*/*"}, p) {
+		t.Error(`path must match`)
+	}
+	if matchPatterns([]string{"pool/*", "apt_*"}, p) {
+		t.Error(`must not match`)
+	}
+}
+
+func TestNextPrefetch(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if next := nextPrefetch(now, "03:30"); !next.Equal(time.Date(2020, 1, 2, 3, 30, 0, 0, time.UTC)) {
+		t.Error(`unexpected next`, next)
+	}
+	if next := nextPrefetch(now, "03:04"); !next.Equal(time.Date(2020, 1, 3, 3, 4, 0, 0, time.UTC)) {
+		t.Error(`unexpected next`, next)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")},
+		{Name: "b", Version: "1.0", Arch: "amd64", Data: []byte("b")},
+		{Name: "c", Version: "1.0", Arch: "amd64", Data: []byte("c")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+	repo.Corrupt(repotest.PoolPath(pkgs[2]))
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.Prefetch = map[string]*PrefetchConfig{
+			"ubuntu": {Patterns: []string{"a_*"}, At: "03:00"},
+		}
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+
+	res, err := c.Prefetch(context.Background(), "ubuntu", []string{"a_*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (PrefetchResult{Downloaded: 1}) {
+		t.Error(`unexpected result`, *res)
+	}
+	if !c.items.Contains("ubuntu/" + repotest.PoolPath(pkgs[0])) {
+		t.Error(`a must be prefetched`)
+	}
+
+	res, err = c.Prefetch(context.Background(), "ubuntu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (PrefetchResult{Downloaded: 1, Cached: 1, Failed: 1}) {
+		t.Error(`unexpected result`, *res)
+	}
+
+	if _, err := c.Prefetch(context.Background(), "debian", nil); err == nil {
+		t.Error(`unknown prefix must be rejected`)
+	}
+}
@@ -0,0 +1,310 @@
+package cacher
+
+// This file implements support for reverse proxies in front of
+// go-apt-cacher: trusted X-Forwarded-For header and PROXY protocol.
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	proxyHeaderTimeout = 10 * time.Second
+
+	// the longest PROXY protocol v1 header is 107 bytes.
+	proxyV1MaxLength = 107
+)
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// trustedNets is a list of networks of trusted proxies.
+type trustedNets []*net.IPNet
+
+// parseTrustedNets parses a list of IP addresses or CIDR networks.
+func parseTrustedNets(l []string) (trustedNets, error) {
+	var nets trustedNets
+	for _, s := range l {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP address: " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// contains returns true if ip is in one of the networks.
+func (nets trustedNets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedFor returns a Middleware that replaces RemoteAddr of
+// requests from trusted proxies with the client address in
+// X-Forwarded-For header.
+//
+// The header is scanned from the right, skipping trusted proxies,
+// so that clients cannot spoof their addresses.
+func forwardedFor(trusted trustedNets) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !trusted.contains(hostIP(r.RemoteAddr)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var addrs []string
+			for _, h := range r.Header["X-Forwarded-For"] {
+				for _, a := range strings.Split(h, ",") {
+					addrs = append(addrs, strings.TrimSpace(a))
+				}
+			}
+
+			var client net.IP
+			for i := len(addrs) - 1; i >= 0; i-- {
+				ip := net.ParseIP(addrs[i])
+				if ip == nil {
+					break
+				}
+				client = ip
+				if !trusted.contains(ip) {
+					break
+				}
+			}
+			if client != nil {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+				r = r2
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// proxyListener is a net.Listener that accepts PROXY protocol
+// version 1 and 2 headers.
+//
+// If trusted is not empty, headers are read only from connections
+// of trusted proxies.
+type proxyListener struct {
+	net.Listener
+	trusted trustedNets
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 && !l.trusted.contains(hostIP(c.RemoteAddr().String())) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads the PROXY protocol header lazily so that
+// Accept is not blocked by slow clients.
+type proxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header from r.
+//
+// It returns nil net.Addr for "UNKNOWN" or "LOCAL" connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("too long PROXY header")
+		}
+	}
+	s := strings.TrimSuffix(string(line), "\r\n")
+	if len(s) == len(line) {
+		return nil, errors.New("invalid PROXY header")
+	}
+
+	t := strings.Split(s, " ")
+	if len(t) < 2 || t[0] != "PROXY" {
+		return nil, errors.New("invalid PROXY header")
+	}
+	switch t[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.New("unsupported PROXY protocol: " + t[1])
+	}
+	if len(t) != 6 {
+		return nil, errors.New("invalid PROXY header")
+	}
+	ip := net.ParseIP(t[2])
+	if ip == nil {
+		return nil, errors.New("invalid source address: " + t[2])
+	}
+	port, err := strconv.ParseUint(t[4], 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid source port")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errors.New("short PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:4]),
+			Port: int(binary.BigEndian.Uint16(data[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errors.New("short PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:16]),
+			Port: int(binary.BigEndian.Uint16(data[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
+
+// Listen creates a listener for the HTTP server of go-apt-cacher.
+//
+// If a socket is passed by systemd socket activation, it is used
+// instead of config.Addr.  If config.MaxConnections is positive, the
+// listener accepts at most that many connections at once.
+// If config.ProxyProtocol is true, the listener
+// accepts PROXY protocol headers from trusted proxies.  If a certificate
+// is configured or ACME is enabled, the listener serves TLS.
+func Listen(c *Cacher, config *Config) (net.Listener, error) {
+	ln, err := systemdListener()
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		addr := config.Addr
+		if len(addr) == 0 {
+			addr = defaultAddress
+		}
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxConnections > 0 {
+		ln = newLimitListener(ln, config.MaxConnections)
+	}
+	if config.ProxyProtocol {
+		ln = proxyListener{ln, c.trusted}
+	}
+	if c.tls != nil {
+		ln = tls.NewListener(ln, c.tls)
+	}
+	return ln, nil
+}
@@ -0,0 +1,163 @@
+package cacher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrustedNets(t *testing.T) {
+	t.Parallel()
+
+	nets, err := parseTrustedNets([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"127.0.0.1", "10.1.2.3", "::1"} {
+		if !nets.contains(net.ParseIP(s)) {
+			t.Error(`!nets.contains ` + s)
+		}
+	}
+	for _, s := range []string{"127.0.0.2", "192.168.0.1", "::2"} {
+		if nets.contains(net.ParseIP(s)) {
+			t.Error(`nets.contains ` + s)
+		}
+	}
+
+	_, err = parseTrustedNets([]string{"example.com"})
+	if err == nil {
+		t.Error(`err == nil`)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	t.Parallel()
+
+	nets, err := parseTrustedNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	h := forwardedFor(nets)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = hostIP(r.RemoteAddr).String()
+	}))
+
+	cases := []struct {
+		remote string
+		xff    string
+		client string
+	}{
+		{"10.0.0.1:1234", "192.168.0.1", "192.168.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 192.168.0.1, 10.0.0.2", "192.168.0.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"192.168.0.2:1234", "1.2.3.4", "192.168.0.2"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if len(c.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != c.client {
+			t.Errorf("client for %s %q: %s, want %s", c.remote, c.xff, got, c.client)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.168.0.1:56324" {
+		t.Error(`addr.String() != "192.168.0.1:56324"`, addr)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Error(`wrong rest`, string(rest))
+	}
+
+	r = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	addr, err = readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != nil {
+		t.Error(`addr != nil`)
+	}
+
+	r = bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	_, err = readProxyHeader(r)
+	if err == nil {
+		t.Error(`err == nil`)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x11})
+	binary.Write(buf, binary.BigEndian, uint16(12))
+	buf.Write([]byte{10, 1, 2, 3, 10, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(40000))
+	binary.Write(buf, binary.BigEndian, uint16(3142))
+	buf.WriteString("GET")
+	r = bufio.NewReader(buf)
+	addr, err = readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "10.1.2.3:40000" {
+		t.Error(`addr.String() != "10.1.2.3:40000"`, addr)
+	}
+	rest, _ = ioutil.ReadAll(r)
+	if string(rest) != "GET" {
+		t.Error(`wrong rest`, string(rest))
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := proxyListener{ln, nil}
+	defer pl.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+		c.Close()
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Error(`wrong remote address`, c.RemoteAddr())
+	}
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error(`string(data) != "hello"`)
+	}
+}
@@ -0,0 +1,223 @@
+package cacher
+
+// This file implements per-client rate limiting and bandwidth shaping.
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// shapeChunkSize is the maximum size of a write to clients whose
+	// bandwidth is limited.
+	shapeChunkSize = 32 * 1024
+
+	// clientIdleTime is the time to forget idle clients.
+	clientIdleTime = 5 * time.Minute
+)
+
+// tokenBucket is a token bucket filled at rate tokens per second
+// up to burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// allow takes a token if available.  If not, it returns false and
+// the duration until a token becomes available.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.fill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserve takes n tokens and returns the duration to wait before
+// using them.  Tokens may become negative so that concurrent
+// reservations wait in turn.
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.fill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// clientState is the limits of a client.
+type clientState struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+	lastSeen time.Time
+}
+
+// clientLimiter limits requests and bandwidth per client IP address.
+type clientLimiter struct {
+	requestRate  float64
+	requestBurst float64
+	bandwidth    float64 // bytes per second
+	exempt       trustedNets
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+// newClientLimiter returns a clientLimiter, or nil if no limit is set.
+func newClientLimiter(requestRate float64, requestBurst int, bandwidth float64, exempt trustedNets) *clientLimiter {
+	if requestRate <= 0 && bandwidth <= 0 {
+		return nil
+	}
+	burst := float64(requestBurst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(requestRate))
+	}
+	return &clientLimiter{
+		requestRate:  requestRate,
+		requestBurst: burst,
+		bandwidth:    bandwidth,
+		exempt:       exempt,
+		clients:      make(map[string]*clientState),
+	}
+}
+
+// client returns the state of a client and forgets idle clients.
+// l.mu lock must be acquired beforehand.
+func (l *clientLimiter) client(ip string, now time.Time) *clientState {
+	if now.Sub(l.lastSweep) > clientIdleTime {
+		for k, cs := range l.clients {
+			if now.Sub(cs.lastSeen) > clientIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	cs, ok := l.clients[ip]
+	if !ok {
+		cs = new(clientState)
+		if l.requestRate > 0 {
+			cs.requests = newTokenBucket(l.requestRate, l.requestBurst, now)
+		}
+		if l.bandwidth > 0 {
+			// allow a second's worth of data to be sent at once.
+			cs.bytes = newTokenBucket(l.bandwidth, l.bandwidth, now)
+		}
+		l.clients[ip] = cs
+	}
+	cs.lastSeen = now
+	return cs
+}
+
+// allow returns false and the duration to retry if a request from ip
+// exceeds the request rate.
+func (l *clientLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cs := l.client(ip, now)
+	if cs.requests == nil {
+		return true, 0
+	}
+	return cs.requests.allow(now)
+}
+
+// reserve returns the duration to wait before sending n bytes to ip.
+func (l *clientLimiter) reserve(ip string, n int) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cs := l.client(ip, now)
+	if cs.bytes == nil {
+		return 0
+	}
+	return cs.bytes.reserve(now, n)
+}
+
+// shapedWriter limits the bandwidth of a response.
+type shapedWriter struct {
+	http.ResponseWriter
+	r  *http.Request
+	l  *clientLimiter
+	ip string
+}
+
+func (sw shapedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > shapeChunkSize {
+			chunk = chunk[:shapeChunkSize]
+		}
+		if d := sw.l.reserve(sw.ip, len(chunk)); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-sw.r.Context().Done():
+				t.Stop()
+				return written, sw.r.Context().Err()
+			case <-t.C:
+			}
+		}
+		n, err := sw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (sw shapedWriter) Flush() {
+	if fl, ok := sw.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// rateLimit returns a Middleware that limits requests and bandwidth
+// of each client IP address.  Requests exceeding the rate are
+// responded with 429 Too Many Requests.
+func rateLimit(l *clientLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := hostIP(r.RemoteAddr)
+			if ip == nil || l.exempt.contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := ip.String()
+
+			ok, retry := l.allow(key)
+			if !ok {
+				secs := int(math.Ceil(retry.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			if l.bandwidth > 0 {
+				w = shapedWriter{w, r, l, key}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
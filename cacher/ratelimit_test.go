@@ -0,0 +1,108 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.allow(now); !ok {
+			t.Fatal(`burst must be allowed`, i)
+		}
+	}
+	ok, d := b.allow(now)
+	if ok {
+		t.Error(`bucket must be empty`)
+	}
+	if d != 500*time.Millisecond {
+		t.Error(`unexpected retry duration`, d)
+	}
+	if ok, _ := b.allow(now.Add(500 * time.Millisecond)); !ok {
+		t.Error(`token must be refilled`)
+	}
+
+	b = newTokenBucket(100, 100, now)
+	if d := b.reserve(now, 100); d != 0 {
+		t.Error(`reserve must not wait within burst`, d)
+	}
+	if d := b.reserve(now, 50); d != 500*time.Millisecond {
+		t.Error(`unexpected wait`, d)
+	}
+	if d := b.reserve(now, 50); d != time.Second {
+		t.Error(`reservations must wait in turn`, d)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	exempt, err := parseTrustedNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newClientLimiter(1, 2, 0, exempt)
+	h := rateLimit(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	serve := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/ubuntu/pool/a.deb", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve("192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatal(`w.Code != http.StatusOK`, i, w.Code)
+		}
+	}
+	w := serve("192.0.2.1:1235")
+	if w.Code != http.StatusTooManyRequests {
+		t.Error(`w.Code != http.StatusTooManyRequests`, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Error(`unexpected Retry-After`, w.Header().Get("Retry-After"))
+	}
+
+	// other clients are not limited.
+	if w := serve("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Error(`w.Code != http.StatusOK`, w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if w := serve("10.1.2.3:1234"); w.Code != http.StatusOK {
+			t.Error(`exempt clients must not be limited`, w.Code)
+		}
+	}
+}
+
+func TestShapedWriter(t *testing.T) {
+	t.Parallel()
+
+	// 64 KiB/s with a burst of 64 KiB.
+	l := newClientLimiter(0, 0, 64*kib, nil)
+	data := make([]byte, 96*kib)
+	h := rateLimit(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+
+	r := httptest.NewRequest("GET", "/ubuntu/pool/a.deb", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(w, r)
+	elapsed := time.Since(start)
+
+	if w.Body.Len() != len(data) {
+		t.Error(`short body`, w.Body.Len())
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Error(`bandwidth must be limited`, elapsed)
+	}
+}
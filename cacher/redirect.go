@@ -0,0 +1,55 @@
+package cacher
+
+// This file implements handling of upstream redirects.
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// redirectError is returned when a redirect cannot be followed.
+// Such errors are not retried.
+type redirectError struct {
+	msg string
+}
+
+func (e *redirectError) Error() string {
+	return e.msg
+}
+
+// noRedirect makes http.Client return redirect responses as is
+// so that upstreamReader can follow them by itself.
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectTarget returns the URL to which resp redirects.
+func redirectTarget(resp *http.Response) (*url.URL, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, &redirectError{"redirect without Location"}
+	}
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return nil, &redirectError{"invalid Location: " + loc}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, &redirectError{"unsupported scheme: " + loc}
+	}
+	return u, nil
+}
+
+// sameOrigin returns true if a and b have the same scheme and host.
+// Credentials are sent only to the origin of the mapping.
+func sameOrigin(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host
+}
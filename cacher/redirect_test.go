@@ -0,0 +1,75 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	t.Parallel()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error(`credentials must not be sent to other hosts`)
+		}
+		if r.URL.Path != "/mirror/pool/a.deb" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer mirror.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pool/a.deb":
+			http.Redirect(w, r, mirror.URL+"/mirror/pool/a.deb", http.StatusFound)
+		case "/pool/loop.deb":
+			http.Redirect(w, r, "/pool/loop.deb", http.StatusFound)
+		case "/pool/ftp.deb":
+			http.Redirect(w, r, "ftp://example.com/pool/ftp.deb", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer redirector.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {redirector.URL}}
+		config.Upstreams = map[string]*UpstreamConfig{"ubuntu": {Token: "secret"}}
+		config.MaxRedirects = 3
+	})
+	defer cleanup()
+
+	// the item is cached at the original path.
+	testGetData(t, c, "ubuntu/pool/a.deb", []byte("data"))
+	if !c.items.Contains("ubuntu/pool/a.deb") {
+		t.Error(`item must be cached at the original path`)
+	}
+
+	// semaphores for both hosts have been used and released.
+	for _, s := range []string{redirector.URL, mirror.URL} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.hostLock.Lock()
+		sem := c.hostSem[u.Host]
+		c.hostLock.Unlock()
+		if sem == nil || len(sem) != defaultMaxConns {
+			t.Error(`semaphore must be released`, u.Host)
+		}
+	}
+
+	for _, p := range []string{"ubuntu/pool/loop.deb", "ubuntu/pool/ftp.deb"} {
+		status, _, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusBadGateway {
+			t.Error(p, `status != http.StatusBadGateway`, status)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cacher
+
+// This file implements protection of items referenced by current
+// indices against eviction.
+
+import (
+	"context"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+)
+
+// updateReferences tells c.items the set of items listed in cached
+// indices so that obsolete items are evicted first.
+func (c *Cacher) updateReferences() error {
+	refs := make(map[string]bool)
+	err := c.walkIndexed("", func(fi *apt.FileInfo) {
+		if !apt.IsMeta(fi.Path()) {
+			refs[fi.Path()] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.items.SetReferenced(refs)
+	log.Debug("updated referenced items", map[string]interface{}{
+		"items": len(refs),
+	})
+	return nil
+}
+
+// notifyReferences requests maintReferences to update references.
+// It does not block.
+func (c *Cacher) notifyReferences() {
+	if c.refsCh == nil {
+		return
+	}
+	select {
+	case c.refsCh <- struct{}{}:
+	default:
+	}
+}
+
+// maintReferences updates references whenever indices are updated.
+// Consecutive updates of indices are coalesced.
+func (c *Cacher) maintReferences(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.refsCh:
+		}
+
+		if err := c.updateReferences(); err != nil {
+			log.Error("failed to update referenced items", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}
+}
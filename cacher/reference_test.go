@@ -0,0 +1,40 @@
+package cacher
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestUpdateReferences(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.ProtectReferenced = true
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+
+	if err := c.updateReferences(); err != nil {
+		t.Fatal(err)
+	}
+	c.items.mu.Lock()
+	refs := c.items.referenced
+	c.items.mu.Unlock()
+	if !refs["ubuntu/"+repotest.PoolPath(pkg)] {
+		t.Error(`package must be referenced`)
+	}
+	if len(refs) != 1 {
+		t.Error(`meta data files must not be referenced`, refs)
+	}
+}
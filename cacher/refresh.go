@@ -0,0 +1,105 @@
+package cacher
+
+// This file implements refreshes of indices.
+
+import (
+	"context"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+// stagger returns a random delay up to d for the first check.
+func stagger(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// jitter returns d randomized by up to 10% so that checks of
+// many files do not fire in lockstep.
+func jitter(d time.Duration) time.Duration {
+	j := int64(d / 10)
+	if j <= 0 {
+		return d
+	}
+	return d - time.Duration(j) + time.Duration(rand.Int63n(2*j+1))
+}
+
+// refreshedOnDemand returns true if p is checked for updates when
+// requested in on-demand mode.
+func refreshedOnDemand(p string) bool {
+	return isRelease(p) || path.Base(p) == "Release.gpg"
+}
+
+// refreshDue returns true if a Release file p should be checked for
+// updates before being served in on-demand mode.  If mark is true,
+// the check is recorded so that other requests do not check it again
+// within check_interval.
+func (c *Cacher) refreshDue(p string, mark bool) bool {
+	if !c.onDemand || c.offline || !refreshedOnDemand(p) {
+		return false
+	}
+
+	now := time.Now()
+	c.dlLock.Lock()
+	defer c.dlLock.Unlock()
+
+	if t, ok := c.refreshed[p]; ok && now.Sub(t) < c.checkInterval {
+		return false
+	}
+	if mark {
+		c.refreshed[p] = now
+	}
+	return true
+}
+
+// refreshes returns true if an index p matches refresh_indices.
+func (c *Cacher) refreshes(p string) bool {
+	t := strings.SplitN(p, "/", 2)
+	if len(c.refreshIndices) == 0 || len(t) != 2 {
+		return false
+	}
+	return matchPatterns(c.refreshIndices, t[1])
+}
+
+// maintIndex downloads an index p again when updated Release files
+// list different contents so that clients need not wait for it.
+func (c *Cacher) maintIndex(ctx context.Context, p string) {
+	timer := time.NewTimer(stagger(c.checkInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(jitter(c.checkInterval))
+
+		storage := c.items
+		if apt.IsMeta(p) {
+			storage = c.meta
+		}
+		if !storage.Contains(p) {
+			// removed until requested again.
+			continue
+		}
+		c.fiLock.RLock()
+		fi, ok := c.info.Get(p)
+		c.fiLock.RUnlock()
+		if !ok {
+			continue
+		}
+		if _, _, err := storage.Stat(fi); err != ErrNotFound {
+			continue
+		}
+		if ch := c.Download(p, fi); ch != nil {
+			<-ch
+		}
+	}
+}
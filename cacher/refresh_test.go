@@ -0,0 +1,162 @@
+package cacher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func TestRefreshIndices(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	files := make(map[string]string)
+	requests := 0
+	put := func(translation string) {
+		mu.Lock()
+		defer mu.Unlock()
+		files["/dists/stable/main/i18n/Translation-en"] = translation
+		files["/dists/stable/Release"] = fmt.Sprintf("Origin: test\nSHA256:\n %x %d main/i18n/Translation-en\n",
+			sha256.Sum256([]byte(translation)), len(translation))
+	}
+	put("Package: a\n")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/dists/stable/main/i18n/Translation-en" {
+			requests++
+		}
+		w.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.CheckInterval = 1
+		config.RefreshIndices = []string{"Translation-*"}
+	})
+	defer cleanup()
+
+	p := "ubuntu/dists/stable/main/i18n/Translation-en"
+	if !c.refreshes(p) || c.refreshes("ubuntu/dists/stable/main/binary-amd64/Packages") {
+		t.Error(`refreshes must match base names`)
+	}
+	for _, p := range []string{"ubuntu/dists/stable/Release", p} {
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(`unexpected status`, p, status)
+		}
+		f.Close()
+	}
+
+	put("Package: b\n")
+	expected, err := apt.CopyWithFileInfo(ioutil.Discard, strings.NewReader("Package: b\n"), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, err := c.items.Stat(expected); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, _, err := c.items.Stat(expected); err != nil {
+		t.Fatal(`updated index must be downloaded`, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Error(`unexpected requests`, requests)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+		if d := stagger(time.Minute); d < 0 || d >= time.Minute {
+			t.Fatal(`stagger out of range`, d)
+		}
+		if d := jitter(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Fatal(`jitter out of range`, d)
+		}
+	}
+}
+
+func TestRefreshOnDemand(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	data := "Label: v1\n"
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.CheckInterval = 1
+		config.RefreshOnDemand = true
+	})
+	defer cleanup()
+
+	get := func(expected string, expectedRequests int) {
+		t.Helper()
+		status, f, err := c.Get("ubuntu/dists/stable/InRelease")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(`unexpected status`, status)
+		}
+		body, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Error(`unexpected data`, string(body))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if requests != expectedRequests {
+			t.Error(`unexpected requests`, requests, expectedRequests)
+		}
+	}
+
+	get("Label: v1\n", 1)
+	get("Label: v1\n", 1)
+
+	mu.Lock()
+	data = "Label: v2\n"
+	mu.Unlock()
+	// InRelease is not checked in background.
+	time.Sleep(2100 * time.Millisecond)
+	mu.Lock()
+	if requests != 1 {
+		t.Error(`InRelease must not be checked until requested`, requests)
+	}
+	mu.Unlock()
+	get("Label: v2\n", 2)
+	get("Label: v2\n", 2)
+}
@@ -0,0 +1,217 @@
+package cacher
+
+// This file implements caching of bad HTTP response statuses.
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	resultsSaveInterval = 1 * time.Minute
+)
+
+var (
+	cachePeriodKey = regexp.MustCompile(`^[45]([0-9]{2}|xx)$`)
+)
+
+// result is a cached response status of an upstream server.
+type result struct {
+	Status  int       `json:"status"`
+	Expires time.Time `json:"expires"`
+}
+
+// cachePeriods determines how long response statuses are cached.
+type cachePeriods struct {
+	def     time.Duration
+	periods map[string]time.Duration
+}
+
+// newCachePeriods creates cachePeriods from configurations in seconds.
+//
+// Keys of m are status codes such as "404", or status classes such
+// as "5xx".
+func newCachePeriods(def int, m map[string]int) (cachePeriods, error) {
+	cp := cachePeriods{
+		def:     time.Duration(def) * time.Second,
+		periods: make(map[string]time.Duration),
+	}
+	for k, v := range m {
+		if !cachePeriodKey.MatchString(k) {
+			return cp, errors.New("invalid status in cache_periods: " + k)
+		}
+		if v < 0 {
+			return cp, errors.New("cache_periods must be >= 0: " + k)
+		}
+		cp.periods[k] = time.Duration(v) * time.Second
+	}
+	return cp, nil
+}
+
+// of returns the period to cache status.
+func (cp cachePeriods) of(status int) time.Duration {
+	code := strconv.Itoa(status)
+	if d, ok := cp.periods[code]; ok {
+		return d
+	}
+	if d, ok := cp.periods[code[:1]+"xx"]; ok {
+		return d
+	}
+	return cp.def
+}
+
+// setResult caches status of p and returns the period to cache it.
+// c.dlLock must be locked.
+func (c *Cacher) setResult(p string, status int) time.Duration {
+	d := c.cachePeriods.of(status)
+	c.results[p] = result{
+		Status:  status,
+		Expires: time.Now().Add(d),
+	}
+	if status != 200 {
+		c.resultsDirty = true
+	}
+	return d
+}
+
+// getResult returns the cached status of p.
+//
+// If waited is true, the status is returned even if it has expired
+// because it was set by the download that the caller waited for.
+// c.dlLock must be locked.
+func (c *Cacher) getResult(p string, waited bool) (int, bool) {
+	r, ok := c.results[p]
+	if !ok || (!waited && !time.Now().Before(r.Expires)) {
+		return 0, false
+	}
+	return r.Status, true
+}
+
+// sweepResults removes expired statuses.
+func (c *Cacher) sweepResults() {
+	now := time.Now()
+	c.dlLock.Lock()
+	defer c.dlLock.Unlock()
+
+	for p, r := range c.results {
+		if !now.Before(r.Expires) {
+			delete(c.results, p)
+		}
+	}
+}
+
+// negativeCounts returns the number of cached bad statuses for each status.
+func (c *Cacher) negativeCounts() map[string]int {
+	c.dlLock.RLock()
+	defer c.dlLock.RUnlock()
+
+	now := time.Now()
+	counts := make(map[string]int)
+	for _, r := range c.results {
+		if r.Status == 200 || !now.Before(r.Expires) {
+			continue
+		}
+		counts[strconv.Itoa(r.Status)]++
+	}
+	return counts
+}
+
+// loadResults loads cached bad statuses saved by saveResults.
+func (c *Cacher) loadResults() error {
+	data, err := ioutil.ReadFile(c.resultsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var results map[string]result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	c.dlLock.Lock()
+	defer c.dlLock.Unlock()
+	for p, r := range results {
+		if now.Before(r.Expires) {
+			c.results[p] = r
+		}
+	}
+	return nil
+}
+
+// saveResults saves cached bad statuses to survive restarts.
+func (c *Cacher) saveResults() error {
+	now := time.Now()
+	results := make(map[string]result)
+
+	c.dlLock.Lock()
+	if !c.resultsDirty {
+		c.dlLock.Unlock()
+		return nil
+	}
+	c.resultsDirty = false
+	for p, r := range c.results {
+		if r.Status != 200 && now.Before(r.Expires) {
+			results[p] = r
+		}
+	}
+	c.dlLock.Unlock()
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.resultsPath), "_tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.resultsPath)
+}
+
+// persistResults saves cached bad statuses periodically
+// and when ctx is canceled.  Expired statuses are removed as well.
+func (c *Cacher) persistResults(ctx context.Context) error {
+	ticker := time.NewTicker(resultsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		done := false
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+			c.sweepResults()
+		}
+		if err := c.saveResults(); err != nil {
+			log.Error("failed to save cached statuses", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		if done {
+			return nil
+		}
+	}
+}
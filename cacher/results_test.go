@@ -0,0 +1,99 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachePeriods(t *testing.T) {
+	t.Parallel()
+
+	for _, k := range []string{"200", "3xx", "x04", "4x"} {
+		if _, err := newCachePeriods(3, map[string]int{k: 1}); err == nil {
+			t.Error(`invalid key must be rejected`, k)
+		}
+	}
+	if _, err := newCachePeriods(3, map[string]int{"404": -1}); err == nil {
+		t.Error(`negative period must be rejected`)
+	}
+
+	cp, err := newCachePeriods(3, map[string]int{"404": 3600, "5xx": 10, "503": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[int]time.Duration{
+		200: 3 * time.Second,
+		403: 3 * time.Second,
+		404: time.Hour,
+		500: 10 * time.Second,
+		503: time.Second,
+	}
+	for status, d := range testCases {
+		if p := cp.of(status); p != d {
+			t.Error(status, p)
+		}
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/pool/b.deb" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		cfg.CachePeriods = map[string]int{"404": 3600, "5xx": 0}
+		cfg.Retries = 0
+		config = cfg
+	})
+	defer cleanup()
+	get := func(p string, expected int) {
+		t.Helper()
+		status, _, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Error(p, status)
+		}
+	}
+
+	get("ubuntu/pool/a.deb", http.StatusNotFound)
+	get("ubuntu/pool/a.deb", http.StatusNotFound)
+	get("ubuntu/pool/b.deb", http.StatusServiceUnavailable)
+	get("ubuntu/pool/b.deb", http.StatusServiceUnavailable)
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Error(`only 404 must be cached`, n)
+	}
+
+	counts := c.Stats().NegativeCache
+	if len(counts) != 1 || counts["404"] != 1 {
+		t.Error(`unexpected counts`, counts)
+	}
+
+	// cached statuses survive restarts.
+	if err := c.saveResults(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get("ubuntu/pool/a.deb", http.StatusNotFound)
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Error(`cached 404 must be loaded`, n)
+	}
+}
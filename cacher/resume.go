@@ -0,0 +1,288 @@
+package cacher
+
+// This file implements retries, redirects, and resumption of upstream
+// downloads.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// upstreamReader reads an item from an upstream server.
+//
+// Network errors and 5xx responses are retried with backoff.
+// If the connection is dropped in the middle of the body, the
+// download is resumed by a Range request from where it was dropped.
+//
+// Redirects are followed up to max_redirects.  The semaphore for
+// the host that actually serves the item is held while reading.
+type upstreamReader struct {
+	c   *Cacher
+	ctx context.Context
+	p   string
+	u   *url.URL
+
+	target *url.URL // the URL that served the item
+	host   string   // the host whose semaphore is held
+	sem    string   // the key of the semaphore
+
+	// cond is used for the initial request to revalidate
+	// the cached item.
+	cond *Validators
+
+	// failFast disables retries of the initial request so that
+	// another upstream can be tried.
+	failFast bool
+
+	resp      *http.Response
+	validator string // strong validator for If-Range
+	off       int64
+	retries   uint
+}
+
+func newUpstreamReader(ctx context.Context, c *Cacher, p string, u *url.URL) *upstreamReader {
+	return &upstreamReader{
+		c:   c,
+		ctx: ctx,
+		p:   p,
+		u:   u,
+	}
+}
+
+func (r *upstreamReader) newRequest(u *url.URL) *http.Request {
+	// imitation apt-get command
+	header := http.Header{}
+	header.Add("Cache-Control", "max-age=0")
+	header.Add("User-Agent", "Debian APT-HTTP/1.3 (aptutil)")
+	if r.off == 0 && r.cond != nil {
+		r.cond.setConditional(header)
+	}
+	if r.off > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.off))
+		if r.validator != "" {
+			header.Set("If-Range", r.validator)
+		}
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if sameOrigin(u, r.u) {
+		r.c.setAuth(req, r.p)
+	}
+	return req.WithContext(r.ctx)
+}
+
+// acquire switches the semaphore held by r to that of host.
+func (r *upstreamReader) acquire(host string) {
+	if r.host == host {
+		return
+	}
+	if r.host != "" {
+		r.c.releaseSemaphore(r.sem)
+	}
+	r.sem = r.c.acquireSemaphore(r.p, host)
+	r.host = host
+}
+
+// do sends a request to u following redirects.
+func (r *upstreamReader) do(u *url.URL) (*http.Response, error) {
+	client := r.c.clientFor(r.p)
+	for hops := 0; ; hops++ {
+		r.acquire(u.Host)
+		resp, err := client.Do(r.newRequest(u))
+		if err != nil {
+			return nil, err
+		}
+		if !isRedirect(resp.StatusCode) {
+			r.target = u
+			return resp, nil
+		}
+
+		closeRespBody(resp)
+		if hops >= r.c.maxRedirects {
+			return nil, &redirectError{"too many redirects"}
+		}
+		next, err := redirectTarget(resp)
+		if err != nil {
+			return nil, err
+		}
+		if log.Enabled(log.LvDebug) {
+			log.Debug("redirected", map[string]interface{}{
+				"url":      u.String(),
+				"location": next.String(),
+			})
+		}
+		u = next
+	}
+}
+
+// get sends a request to the upstream server.
+//
+// Network errors and 5xx responses are retried until the number of
+// retries reaches the limit.  After that, the last response or error
+// is returned.
+func (r *upstreamReader) get() (*http.Response, error) {
+	for {
+		if r.retries > 0 {
+			delay := r.c.backoff.Delay(r.retries)
+			log.Warn("retrying download", map[string]interface{}{
+				"url":    r.u.String(),
+				"offset": r.off,
+				"delay":  delay.Seconds(),
+			})
+			select {
+			case <-r.ctx.Done():
+				return nil, r.ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		// The initial request starts from the original URL as
+		// redirectors may choose another server.  Resumption requests
+		// are sent to the server that served the item.
+		u := r.u
+		if r.off > 0 {
+			u = r.target
+		}
+		resp, err := r.do(u)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if _, ok := err.(*redirectError); ok {
+			return nil, err
+		}
+		if r.retries >= r.c.retries || (r.failFast && r.off == 0) || r.ctx.Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			log.Warn("GET failed", map[string]interface{}{
+				"url":   r.u.String(),
+				"error": err.Error(),
+			})
+		} else {
+			closeRespBody(resp)
+		}
+		r.retries++
+	}
+}
+
+// Open sends the initial request.  If the returned response has
+// status 200, its body should be read through r.
+func (r *upstreamReader) Open() (*http.Response, error) {
+	resp, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	r.resp = resp
+
+	// weak ETags cannot be used for If-Range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		r.validator = etag
+	} else {
+		r.validator = resp.Header.Get("Last-Modified")
+	}
+	return resp, nil
+}
+
+// Read reads the body of the response.
+func (r *upstreamReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.resp.Body.Read(p)
+		r.off += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			// the error will be returned again by the next Read.
+			return n, nil
+		}
+		if r.retries >= r.c.retries || r.ctx.Err() != nil {
+			return 0, err
+		}
+
+		log.Warn("resuming download", map[string]interface{}{
+			"url":    r.u.String(),
+			"offset": r.off,
+			"error":  err.Error(),
+		})
+		r.resp.Body.Close()
+		if err := r.resume(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// resume continues the download from r.off.
+func (r *upstreamReader) resume() error {
+	for r.retries < r.c.retries {
+		r.retries++
+		resp, err := r.get()
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if contentRangeStart(resp) == r.off {
+				r.resp = resp
+				return nil
+			}
+		case http.StatusOK:
+			// The server ignored Range, or the item has been
+			// updated since the initial request if If-Range was sent.
+			if r.validator != "" {
+				closeRespBody(resp)
+				return errors.New("cannot resume download: item may have been updated")
+			}
+			_, err := io.CopyN(ioutil.Discard, resp.Body, r.off)
+			if err == nil {
+				r.resp = resp
+				return nil
+			}
+			resp.Body.Close()
+			continue
+		}
+
+		closeRespBody(resp)
+		return errors.New("cannot resume download: " + resp.Status)
+	}
+	return errors.New("too many retries")
+}
+
+// Close closes the current response and releases the semaphore.
+func (r *upstreamReader) Close() {
+	if r.resp != nil {
+		closeRespBody(r.resp)
+		r.resp = nil
+	}
+	if r.host != "" {
+		r.c.releaseSemaphore(r.sem)
+		r.host = ""
+	}
+}
+
+// contentRangeStart returns the first byte position of
+// Content-Range header of resp, or -1.
+func contentRangeStart(resp *http.Response) int64 {
+	var start int64
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err != nil {
+		return -1
+	}
+	return start
+}
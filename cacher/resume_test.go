@@ -0,0 +1,174 @@
+package cacher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testResume(t *testing.T, h http.Handler) (*Cacher, func()) {
+	upstream := httptest.NewServer(h)
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.RetryBaseDelay = 0.001
+		config.RetryMaxDelay = 0.01
+	})
+	return c, func() {
+		cleanup()
+		upstream.Close()
+	}
+}
+
+// dropConnection sends the first half of data then drops the connection.
+func dropConnection(w http.ResponseWriter, data []byte, etag string) {
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n", len(data))
+	if etag != "" {
+		fmt.Fprintf(bufrw, "ETag: %s\r\n", etag)
+	}
+	bufrw.WriteString("\r\n")
+	bufrw.Write(data[:len(data)/2])
+	bufrw.Flush()
+}
+
+func testGetData(t *testing.T, c *Cacher, p string, data []byte) {
+	status, f, err := c.Get(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error(`!bytes.Equal(got, data)`, string(got))
+	}
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var mu sync.Mutex
+	var ranges []string
+	c, cleanup := testResume(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		n := len(ranges)
+		mu.Unlock()
+
+		if n == 1 {
+			dropConnection(w, data, `"v1"`)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer cleanup()
+
+	testGetData(t, c, "ubuntu/pool/a_1.0_amd64.deb", data)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 {
+		t.Fatal(`len(ranges) != 2`, ranges)
+	}
+	if ranges[1] != fmt.Sprintf("bytes=%d-", len(data)/2) {
+		t.Error(`unexpected Range`, ranges[1])
+	}
+}
+
+func TestResumeIgnored(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var mu sync.Mutex
+	var count int
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		n := count
+		mu.Unlock()
+
+		switch n {
+		case 1:
+			var etag string
+			if r.URL.Path == "/pool/b_1.0_amd64.deb" {
+				etag = `"v1"`
+			}
+			dropConnection(w, data, etag)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			// ignore Range
+			w.Write(data)
+		}
+	})
+
+	// without validators, the received part is skipped.
+	c, cleanup := testResume(t, h)
+	defer cleanup()
+	testGetData(t, c, "ubuntu/pool/a_1.0_amd64.deb", data)
+
+	// If-Range with the ETag tells that the item has been updated.
+	mu.Lock()
+	count = 0
+	mu.Unlock()
+	status, _, err := c.Get("ubuntu/pool/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == http.StatusOK {
+		t.Error(`download must fail`)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("data")
+	var mu sync.Mutex
+	var count int
+	c, cleanup := testResume(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		n := count
+		mu.Unlock()
+
+		if r.URL.Path == "/pool/b_1.0_amd64.deb" || n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	}))
+	defer cleanup()
+
+	testGetData(t, c, "ubuntu/pool/a_1.0_amd64.deb", data)
+
+	status, _, err := c.Get("ubuntu/pool/b_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Error(`status != http.StatusServiceUnavailable`, status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 3+4 {
+		t.Error(`count != 3+4`, count)
+	}
+}
@@ -0,0 +1,165 @@
+package cacher
+
+// This file implements background verification of cached items.
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+)
+
+const (
+	defaultScrubRate = 10 // MiB/s
+
+	// scrubChunkSize limits the size of a read so that
+	// throttled reads sleep for a short time each.
+	scrubChunkSize = 64 * 1024
+)
+
+// ScrubResult is the result of Cacher.Scrub.
+type ScrubResult struct {
+	// Verified is the number of items whose checksums match.
+	Verified int `json:"verified"`
+
+	// Corrupted is the number of items removed for checksum mismatch.
+	Corrupted int `json:"corrupted"`
+}
+
+// throttle limits the rate of reads across items.
+type throttle struct {
+	rate  float64 // bytes per second
+	start time.Time
+	n     int64
+}
+
+func newThrottle(rate float64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait sleeps until n more bytes can be read.
+func (t *throttle) wait(n int) {
+	t.n += int64(n)
+	expected := time.Duration(float64(t.n) / t.rate * float64(time.Second))
+	if d := expected - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	if len(p) > scrubChunkSize {
+		p = p[:scrubChunkSize]
+	}
+	n, err := r.r.Read(p)
+	r.t.wait(n)
+	return n, err
+}
+
+// verify returns false if the cached file of p does not match fi.
+func (c *Cacher) verify(p string, fi *apt.FileInfo, t *throttle) (bool, error) {
+	f, err := c.items.Open(p)
+	if err == ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hashed, err := apt.CopyWithFileInfoMask(ioutil.Discard, throttledReader{f, t}, p, fi.HashMask())
+	if err != nil {
+		return false, err
+	}
+	return fi.Same(hashed), nil
+}
+
+// Scrub reads all cached items listed in indices at scrub_rate, and
+// removes items whose checksums do not match the indices.  Removed
+// items are downloaded again unless in offline mode.
+//
+// Items not listed in indices are not verified.
+func (c *Cacher) Scrub(ctx context.Context) (*ScrubResult, error) {
+	res := new(ScrubResult)
+	t := newThrottle(c.scrubRate)
+	for _, cfi := range c.items.ListAll() {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		p := cfi.Path()
+		c.fiLock.RLock()
+		fi, ok := c.info.Get(p)
+		c.fiLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		ok, err := c.verify(p, fi, t)
+		if err != nil {
+			return res, err
+		}
+		if ok {
+			res.Verified++
+			continue
+		}
+
+		log.Warn("removed a corrupted item", map[string]interface{}{
+			"path": p,
+		})
+		res.Corrupted++
+		c.fiLock.Lock()
+		err = c.items.Delete(p)
+		c.fiLock.Unlock()
+		if err != nil {
+			return res, err
+		}
+		if c.offline {
+			continue
+		}
+		ch := c.Download(p, fi)
+		if ch == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-ch:
+		}
+	}
+	return res, nil
+}
+
+// scrubItems runs Scrub every interval.
+func (c *Cacher) scrubItems(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		res, err := c.Scrub(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error("scrub failed", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+			continue
+		}
+		log.Info("scrubbed items", map[string]interface{}{
+			"verified":  res.Verified,
+			"corrupted": res.Corrupted,
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package cacher
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestThrottle(t *testing.T) {
+	t.Parallel()
+
+	th := newThrottle(1000)
+	start := time.Now()
+	th.wait(100)
+	th.wait(100)
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Error(`throttle must wait`, d)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []repotest.Package{
+		{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")},
+		{Name: "b", Version: "1.0", Arch: "amd64", Data: []byte("b")},
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkgs...)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	for _, pkg := range pkgs {
+		testGetData(t, c, "ubuntu/"+repotest.PoolPath(pkg), pkg.Data)
+	}
+
+	// corrupt b on disk.
+	p := "ubuntu/" + repotest.PoolPath(pkgs[1])
+	filename := filepath.Join(c.items.dir, p+fileSuffix)
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (ScrubResult{Verified: 1, Corrupted: 1}) {
+		t.Error(`unexpected result`, *res)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "b" {
+		t.Error(`corrupted item must be downloaded again`, string(data))
+	}
+
+	res, err = c.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (ScrubResult{Verified: 2}) {
+		t.Error(`unexpected result`, *res)
+	}
+}
@@ -2,21 +2,61 @@ package cacher
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/cybozu-go/well"
 )
 
+// Middleware wraps an http.Handler to add features such as
+// authentication, logging, metrics, or rate limiting.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares to h.
+//
+// The first middleware becomes the outermost handler, i.e. it
+// receives requests first.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
 // NewServer returns HTTPServer implements go-apt-cacher handlers.
-func NewServer(c *Cacher, config *Config) *well.HTTPServer {
+//
+// middlewares are applied to the handler by Chain.
+// If config.TrustedProxies is not empty, RemoteAddr of requests
+// is replaced with the client address in X-Forwarded-For header
+// before middlewares are called.  If config.AccessLog is set,
+// access logs are written before middlewares are called too,
+// followed by limits of requests if configured.
+func NewServer(c *Cacher, config *Config, middlewares ...Middleware) *well.HTTPServer {
 	addr := config.Addr
 	if len(addr) == 0 {
 		addr = defaultAddress
 	}
 
+	if config.MaxRequests > 0 {
+		middlewares = append([]Middleware{maxRequests(config.MaxRequests)}, middlewares...)
+	}
+	if c.limiter != nil {
+		middlewares = append([]Middleware{rateLimit(c.limiter)}, middlewares...)
+	}
+	if c.accessLog != nil {
+		middlewares = append([]Middleware{accessLog(c.accessLog, c.accessLogFormat)}, middlewares...)
+	}
+	if len(c.trusted) > 0 {
+		middlewares = append([]Middleware{forwardedFor(c.trusted)}, middlewares...)
+	}
+
 	return &well.HTTPServer{
 		Server: &http.Server{
-			Addr:    addr,
-			Handler: cacheHandler{c},
+			Addr:         addr,
+			Handler:      Chain(cacheHandler{c}, middlewares...),
+			ReadTimeout:  time.Duration(config.ReadTimeout) * time.Second,
+			WriteTimeout: time.Duration(config.WriteTimeout) * time.Second,
+			IdleTimeout:  time.Duration(config.IdleTimeout) * time.Second,
 		},
+		ShutdownTimeout: time.Duration(config.ShutdownTimeout) * time.Second,
 	}
 }
@@ -0,0 +1,47 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("first"), mw("second"), deny)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/ubuntu/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Error(`w.Code != http.StatusUnauthorized`)
+	}
+
+	order = nil
+	r := httptest.NewRequest("GET", "/ubuntu/", nil)
+	r.Header.Set("Authorization", "Bearer x")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "handler" {
+		t.Error(`wrong order`, order)
+	}
+}
@@ -0,0 +1,156 @@
+package cacher
+
+// This file implements sharing of directories among processes.
+//
+// Processes sharing a directory, such as blue/green deployments,
+// serialize modifications of files by flock(2) on a lock file.
+// Files are replaced atomically by rename(2) so that readers never
+// miss them.  Each process keeps its own entries, and files added or
+// removed by others are noticed when they are looked up.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+)
+
+// SetShared makes the Storage share its directory with other
+// processes.  Snapshots are not used for shared directories as
+// they may be modified by others.
+// This must be called before Load.
+func (cm *Storage) SetShared() error {
+	f, err := os.OpenFile(filepath.Join(cm.dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.lock = f
+	return nil
+}
+
+// lockDir acquires the lock of the directory shared with other
+// processes, and returns a function to release it.
+// Nothing is locked unless the directory is shared.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) lockDir() func() {
+	if cm.lock == nil {
+		return func() {}
+	}
+
+	fd := int(cm.lock.Fd())
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_EX)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Error("failed to lock a directory", map[string]interface{}{
+				"dir":   cm.dir,
+				"error": err.Error(),
+			})
+		}
+		break
+	}
+	return func() {
+		syscall.Flock(fd, syscall.LOCK_UN)
+	}
+}
+
+// inode returns the inode number of a file.
+func inode(info os.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Ino)
+}
+
+// linkFile links filename to dest atomically.  An existing dest is
+// replaced.
+func (cm *Storage) linkFile(filename, dest string) error {
+	dir, err := cm.tempDirectory()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "_tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	os.Remove(tmp)
+
+	if err := os.Link(filename, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sync updates the entry of p if its file has been added, replaced,
+// or removed by other processes.  Nothing is done unless the
+// directory is shared.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) sync(p string) {
+	if cm.lock == nil {
+		return
+	}
+
+	file := cm.itemFile(p)
+	e, ok := cm.cache[p]
+	if ok {
+		file = e.file
+	}
+	path := filepath.Join(cm.dir, file)
+	info, err := os.Stat(path)
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return
+	case ok && err == nil && e.ino == inode(info):
+		return
+	case !ok && err != nil:
+		return
+	}
+
+	if ok {
+		cm.invalidateSnapshot()
+		cm.remove(e)
+		delete(cm.cache, p)
+		log.Info("removed an item changed by another process", map[string]interface{}{
+			"path": p,
+		})
+	}
+	if err != nil {
+		return
+	}
+
+	size := uint64(info.Size())
+	if mayBeCompressed(p) {
+		size, err = cm.loadedSize(path, p, size)
+		if err != nil {
+			log.Warn("failed to load an item of another process", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	e = &entry{
+		// delay calculation of checksums.
+		FileInfo:   apt.MakeFileInfoNoChecksum(p, size),
+		file:       file,
+		ino:        inode(info),
+		referenced: cm.referenced[p],
+	}
+	cm.push(e)
+	cm.cache[p] = e
+}
@@ -0,0 +1,94 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func TestStorageShared(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storages := make([]*Storage, 2)
+	for i := range storages {
+		cm := NewStorage(dir, 0)
+		if err := cm.SetShared(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cm.Load(); err != nil {
+			t.Fatal(err)
+		}
+		storages[i] = cm
+	}
+	cm1, cm2 := storages[0], storages[1]
+
+	p := "ubuntu/pool/a/a.deb"
+	fi, err := insert(cm1, []byte("abc"), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cm2.Lookup(fi)
+	if err != nil {
+		t.Fatal(`cm2.Lookup(fi) failed`, err)
+	}
+	f.Close()
+
+	// replaced by cm1.
+	fi2, err := insert(cm1, []byte("defg"), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm2.Lookup(fi); err != ErrNotFound {
+		t.Error(`cm2.Lookup(fi) != ErrNotFound`, err)
+	}
+	f, err = cm2.Lookup(fi2)
+	if err != nil {
+		t.Fatal(`cm2.Lookup(fi2) failed`, err)
+	}
+	f.Close()
+	if items, used, _ := cm2.Usage(); items != 1 || used != 4 {
+		t.Error(`items != 1 || used != 4`, items, used)
+	}
+
+	// replaced by cm2 while cm1 has the old one.
+	fi3, err := insert(cm2, []byte("hi"), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = cm1.Lookup(fi3)
+	if err != nil {
+		t.Fatal(`cm1.Lookup(fi3) failed`, err)
+	}
+	f.Close()
+
+	// removed by cm1.
+	if err := cm1.Delete(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm2.Lookup(fi3); err != ErrNotFound {
+		t.Error(`cm2.Lookup(fi3) != ErrNotFound`, err)
+	}
+	if _, _, err := cm2.Stat(apt.MakeFileInfoNoChecksum(p, 2)); err != ErrNotFound {
+		t.Error(`cm2.Stat() != ErrNotFound`, err)
+	}
+	if items, used, _ := cm2.Usage(); items != 0 || used != 0 {
+		t.Error(`items != 0 || used != 0`, items, used)
+	}
+
+	// snapshots are not saved.
+	if err := cm2.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, storageSnapshot)); !os.IsNotExist(err) {
+		t.Error(`snapshot is saved`, err)
+	}
+}
@@ -0,0 +1,311 @@
+package cacher
+
+// This file implements snapshots of indices to shorten startup.
+//
+// At shutdown, Storage saves its entries and Cacher saves FileInfo
+// of meta data files to snapshot files.  They are loaded at startup
+// instead of walking directories and parsing meta data files, and
+// removed so that a crash afterwards results in a full scan.
+// A Storage snapshot is also removed when the Storage is modified
+// after it is saved.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotVersion = 1
+)
+
+type storageSnapshotHeader struct {
+	Version int    `json:"version"`
+	Clock   uint64 `json:"clock"`
+	Items   int    `json:"items"`
+}
+
+type storageSnapshotEntry struct {
+	Info     *apt.FileInfo `json:"info"`
+	File     string        `json:"file"`
+	Hits     uint64        `json:"hits"`
+	Atime    uint64        `json:"atime"`
+	Accessed time.Time     `json:"accessed"`
+}
+
+// writeSnapshot writes a snapshot file atomically.
+// write is called to encode contents.
+func writeSnapshot(filename string, write func(enc *json.Encoder) error) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := write(json.NewEncoder(w)); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// SaveSnapshot saves entries of the Storage so that the next Load
+// does not need to walk the directory.
+//
+// Nothing is saved if the directory is shared with other processes.
+func (cm *Storage) SaveSnapshot() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.lock != nil {
+		return nil
+	}
+
+	err := writeSnapshot(filepath.Join(cm.dir, storageSnapshot), func(enc *json.Encoder) error {
+		err := enc.Encode(storageSnapshotHeader{
+			Version: snapshotVersion,
+			Clock:   cm.lclock,
+			Items:   len(cm.cache),
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range cm.cache {
+			err := enc.Encode(storageSnapshotEntry{
+				Info:     e.FileInfo,
+				File:     e.file,
+				Hits:     e.hits,
+				Atime:    e.atime,
+				Accessed: e.accessed,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cm.snapshotSaved = true
+	return nil
+}
+
+// invalidateSnapshot removes the saved snapshot as the Storage is
+// modified.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) invalidateSnapshot() {
+	if !cm.snapshotSaved {
+		return
+	}
+	cm.snapshotSaved = false
+	err := os.Remove(filepath.Join(cm.dir, storageSnapshot))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("failed to remove a snapshot", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// loadSnapshot loads entries from the snapshot file.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(cm.dir, storageSnapshot))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var hdr storageSnapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	if hdr.Version != snapshotVersion {
+		return errors.New("unsupported snapshot version")
+	}
+
+	for i := 0; i < hdr.Items; i++ {
+		var se storageSnapshotEntry
+		if err := dec.Decode(&se); err != nil {
+			return err
+		}
+		if se.Info == nil {
+			return errors.New("broken snapshot")
+		}
+		p := se.Info.Path()
+		pl := cm.poolOf(p)
+		e := &entry{
+			FileInfo:   se.Info,
+			file:       se.File,
+			atime:      se.Atime,
+			hits:       se.Hits,
+			accessed:   se.Accessed,
+			index:      len(pl.queue),
+			referenced: cm.referenced[p],
+			pool:       pl,
+		}
+		e.priority = cm.policy.Priority(ItemStats{
+			Size:  e.Size(),
+			Hits:  e.hits,
+			Clock: e.atime,
+		})
+		pl.used += e.Size()
+		pl.queue = append(pl.queue, e)
+		cm.cache[p] = e
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("broken snapshot")
+	}
+	cm.lclock = hdr.Clock
+	return nil
+}
+
+// reset discards all entries loaded.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) reset() {
+	cm.cache = make(map[string]*entry)
+	cm.usage = make(map[string]*PrefixUsage)
+	cm.shared = pool{capacity: cm.shared.capacity}
+	for prefix, pl := range cm.pools {
+		cm.pools[prefix] = &pool{capacity: pl.capacity}
+	}
+	cm.lclock = 0
+}
+
+type infoSnapshotHeader struct {
+	Version int `json:"version"`
+
+	// Metas is the number of meta data files in the meta storage.
+	Metas int `json:"metas"`
+
+	// Disk is true if FileInfo are kept in diskIndex.
+	Disk bool `json:"disk"`
+
+	// Maintained lists meta data files checked periodically.
+	Maintained []string `json:"maintained"`
+
+	// Items is the number of FileInfo in the snapshot.
+	Items int `json:"items"`
+}
+
+// infoSnapshotData is the contents of an info snapshot.
+type infoSnapshotData struct {
+	infoSnapshotHeader
+	items []*apt.FileInfo
+}
+
+// loadInfoSnapshot loads and removes the info snapshot in metaDir.
+// nil is returned if no valid snapshot is available.
+func loadInfoSnapshot(metaDir string) *infoSnapshotData {
+	filename := filepath.Join(metaDir, infoSnapshot)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Warn("failed to open a snapshot", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return nil
+	}
+	defer func() {
+		f.Close()
+		os.Remove(filename)
+	}()
+
+	snap := new(infoSnapshotData)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	err = dec.Decode(&snap.infoSnapshotHeader)
+	if err == nil && snap.Version != snapshotVersion {
+		err = errors.New("unsupported snapshot version")
+	}
+	for i := 0; err == nil && i < snap.Items; i++ {
+		fi := new(apt.FileInfo)
+		err = dec.Decode(fi)
+		snap.items = append(snap.items, fi)
+	}
+	if err != nil {
+		log.Warn("ignored a broken snapshot", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return nil
+	}
+	return snap
+}
+
+// saveSnapshots saves snapshots of storages and c.info for the next
+// startup.  Items are no longer cached after this.
+func (c *Cacher) saveSnapshots() error {
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+
+	c.snapshotSaved = true
+	if err := c.items.SaveSnapshot(); err != nil {
+		return errors.Wrap(err, "cache_dir")
+	}
+	if err := c.meta.SaveSnapshot(); err != nil {
+		return errors.Wrap(err, "meta_dir")
+	}
+
+	var items []*apt.FileInfo
+	hdr := infoSnapshotHeader{
+		Version: snapshotVersion,
+		Metas:   len(c.meta.ListAll()),
+	}
+	for p := range c.maintained {
+		hdr.Maintained = append(hdr.Maintained, p)
+	}
+	switch index := c.info.(type) {
+	case mapIndex:
+		for _, fi := range index {
+			items = append(items, fi)
+		}
+	case *diskIndex:
+		hdr.Disk = true
+		if err := index.db.Sync(); err != nil {
+			return errors.Wrap(err, "sync index")
+		}
+	}
+	hdr.Items = len(items)
+
+	return writeSnapshot(filepath.Join(c.meta.dir, infoSnapshot), func(enc *json.Encoder) error {
+		if err := enc.Encode(hdr); err != nil {
+			return err
+		}
+		for _, fi := range items {
+			if err := enc.Encode(fi); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// persistSnapshots saves snapshots at shutdown.
+func (c *Cacher) persistSnapshots(ctx context.Context) error {
+	<-ctx.Done()
+	if err := c.saveSnapshots(); err != nil {
+		log.Error("failed to save snapshots", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	return nil
+}
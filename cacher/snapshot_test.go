@@ -0,0 +1,126 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestStorageSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, storageSnapshot)
+
+	cm := NewStorage(dir, 0)
+	fi, err := insert(cm, []byte("a"), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove the cache file to make sure the snapshot is used.
+	if err := os.Rename(filepath.Join(dir, "a"+fileSuffix), filepath.Join(dir, "a.bak")); err != nil {
+		t.Fatal(err)
+	}
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Contains("a") {
+		t.Error(`a must be loaded from the snapshot`)
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Error(`snapshot must be removed by Load`, err)
+	}
+	if err := os.Rename(filepath.Join(dir, "a.bak"), filepath.Join(dir, "a"+fileSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cm.Lookup(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// modifications invalidate the snapshot.
+	if err := cm.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert(cm, []byte("b"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Error(`snapshot must be removed by Insert`, err)
+	}
+
+	// broken snapshots are ignored.
+	if err := ioutil.WriteFile(snapshot, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Contains("a") || !cm.Contains("b") {
+		t.Error(`items must be loaded by walking the directory`)
+	}
+}
+
+func TestInfoSnapshot(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	upstream := httptest.NewServer(repo)
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config = cfg
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	p := "ubuntu/" + repotest.PoolPath(pkg)
+	testGetData(t, c, p, pkg.Data)
+
+	if err := c.saveSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.maintained["ubuntu/dists/stable/Release"] {
+		t.Error(`Release must be maintained`)
+	}
+
+	// the index is loaded from the snapshot without meta data files.
+	packages := filepath.Join(config.MetaDirectory, "ubuntu/dists/stable/main/binary-amd64/Packages"+fileSuffix)
+	if err := ioutil.WriteFile(packages, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.info.Get(p); !ok {
+		t.Error(`index must be loaded from the snapshot`)
+	}
+	if !c.maintained["ubuntu/dists/stable/Release"] {
+		t.Error(`Release must be maintained`)
+	}
+	testGetData(t, c, p, pkg.Data)
+	if _, err := os.Stat(filepath.Join(config.MetaDirectory, infoSnapshot)); !os.IsNotExist(err) {
+		t.Error(`snapshot must be removed`, err)
+	}
+}
@@ -0,0 +1,329 @@
+package cacher
+
+// This file implements mappings learned from sources.list of APT.
+//
+// Both the one-line style (*.list) and the deb822 style (*.sources)
+// are read.  https://manpages.debian.org/sources.list.5
+//
+// Prefixes are the last path elements of repository URLs such as
+// "ubuntu".  When they conflict, host names are prepended such as
+// "security.ubuntu.com-ubuntu".
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// parseSourcesLine parses a line of a one-line style sources.list,
+// and returns the repository URI.  An empty string is returned for
+// comments, blank lines, and disabled entries.
+func parseSourcesLine(l string) (string, error) {
+	if i := strings.IndexByte(l, '#'); i >= 0 {
+		l = l[:i]
+	}
+	fields := strings.Fields(l)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	if fields[0] != "deb" && fields[0] != "deb-src" {
+		return "", errors.New("invalid line: " + l)
+	}
+
+	i := 1
+	if i < len(fields) && strings.HasPrefix(fields[i], "[") {
+		for i < len(fields) && !strings.HasSuffix(fields[i], "]") {
+			i++
+		}
+		i++
+	}
+	if i+1 >= len(fields) {
+		return "", errors.New("invalid line: " + l)
+	}
+	return fields[i], nil
+}
+
+// parseDeb822Sources parses a deb822 style sources file, and returns
+// repository URIs of enabled entries.
+func parseDeb822Sources(data []byte) ([]string, error) {
+	// apt.Parser stops at an empty paragraph, so comments and
+	// extra blank lines are removed beforehand.
+	var buf bytes.Buffer
+	blank := true
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(l, " \t\r")
+		switch {
+		case strings.HasPrefix(l, "#"):
+			continue
+		case len(l) == 0:
+			if blank {
+				continue
+			}
+			blank = true
+		default:
+			blank = false
+		}
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+
+	var uris []string
+	parser := apt.NewParser(&buf)
+	for {
+		d, err := parser.Read()
+		if err == io.EOF {
+			return uris, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if enabled, ok := d["Enabled"]; ok && strings.ToLower(enabled[0]) == "no" {
+			continue
+		}
+		if len(d["Types"]) == 0 || len(d["URIs"]) == 0 {
+			return nil, errors.New("Types or URIs is missing")
+		}
+		for _, v := range d["URIs"] {
+			uris = append(uris, strings.Fields(v)...)
+		}
+	}
+}
+
+// readSources reads a sources.list file, or *.list and *.sources
+// files in a directory such as /etc/apt/sources.list.d, and returns
+// HTTP and HTTPS repository URLs in order.  Other URIs such as
+// file:/ are ignored.
+func readSources(name string) ([]*url.URL, error) {
+	st, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{name}
+	if st.IsDir() {
+		infos, err := ioutil.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, info := range infos {
+			switch filepath.Ext(info.Name()) {
+			case ".list", ".sources":
+				files = append(files, filepath.Join(name, info.Name()))
+			}
+		}
+	}
+
+	var urls []*url.URL
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var uris []string
+		if filepath.Ext(file) == ".sources" {
+			uris, err = parseDeb822Sources(data)
+			if err != nil {
+				return nil, errors.Wrap(err, file)
+			}
+		} else {
+			for n, l := range strings.Split(string(data), "\n") {
+				uri, err := parseSourcesLine(l)
+				if err != nil {
+					return nil, errors.Wrap(err, file+":"+strconv.Itoa(n+1))
+				}
+				if len(uri) > 0 {
+					uris = append(uris, uri)
+				}
+			}
+		}
+
+		for _, uri := range uris {
+			u, err := url.Parse(uri)
+			if err != nil {
+				return nil, errors.Wrap(err, file)
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				continue
+			}
+			addSlash(u)
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
+// sanitizePrefix makes s a valid prefix by replacing invalid characters.
+func sanitizePrefix(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '.', c == '-':
+		case c == '_' && i > 0:
+		default:
+			b[i] = '-'
+		}
+	}
+	return string(b)
+}
+
+// sourcesMapping derives prefixes for urls.  URLs and prefixes in
+// mapping are not used.
+func sourcesMapping(urls []*url.URL, mapping map[string]UpstreamURLs) map[string]*url.URL {
+	used := make(map[string]bool)
+	for prefix, l := range mapping {
+		used[prefix] = true
+		for _, u := range l {
+			if pu, err := url.Parse(u); err == nil {
+				addSlash(pu)
+				used[pu.String()] = true
+			}
+		}
+	}
+
+	names := make(map[string][]*url.URL)
+	var order []string
+	for _, u := range urls {
+		if used[u.String()] {
+			continue
+		}
+		used[u.String()] = true
+		name := sanitizePrefix(path.Base(strings.TrimSuffix(u.Path, "/")))
+		if name == "." || name == "/" || name == "-" {
+			name = ""
+		}
+		if _, ok := names[name]; !ok {
+			order = append(order, name)
+		}
+		names[name] = append(names[name], u)
+	}
+
+	m := make(map[string]*url.URL)
+	for _, name := range order {
+		l := names[name]
+		for _, u := range l {
+			prefix := name
+			if len(l) > 1 || len(prefix) == 0 || used[prefix] {
+				prefix = strings.Trim(sanitizePrefix(proxyPrefix(u.Host))+"-"+name, "-")
+			}
+			base := prefix
+			for i := 2; used[prefix]; i++ {
+				prefix = base + "-" + strconv.Itoa(i)
+			}
+			used[prefix] = true
+			m[prefix] = u
+		}
+	}
+	return m
+}
+
+// sourcesList keeps mappings learned from sources.list.
+type sourcesList struct {
+	name    string
+	mapping map[string]UpstreamURLs
+
+	mu   sync.RWMutex
+	urls map[string][]*url.URL
+}
+
+// newSourcesList reads sources.list name and creates sourcesList.
+// Mappings in mapping take precedence.
+func newSourcesList(name string, mapping map[string]UpstreamURLs) (*sourcesList, error) {
+	s := &sourcesList{
+		name:    name,
+		mapping: mapping,
+	}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads sources.list again.  It returns true if mappings are
+// changed.
+func (s *sourcesList) load() (bool, error) {
+	l, err := readSources(s.name)
+	if err != nil {
+		return false, err
+	}
+	urls := make(map[string][]*url.URL)
+	for prefix, u := range sourcesMapping(l, s.mapping) {
+		urls[prefix] = []*url.URL{u}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(urls, s.urls) {
+		return false, nil
+	}
+	s.urls = urls
+	for prefix, l := range urls {
+		log.Info("mapped from sources.list", map[string]interface{}{
+			"prefix": prefix,
+			"url":    l[0].String(),
+		})
+	}
+	return true, nil
+}
+
+// get returns upstream URLs of prefix.  s can be nil.
+func (s *sourcesList) get(prefix string) []*url.URL {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.urls[prefix]
+}
+
+// all returns all mappings.  s can be nil.
+func (s *sourcesList) all() map[string][]*url.URL {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.urls
+}
+
+// watchSources reads sources.list every interval to follow changes.
+func (c *Cacher) watchSources(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		changed, err := c.sources.load()
+		if err != nil {
+			log.Warn("failed to read sources.list", map[string]interface{}{
+				"path":  c.sources.name,
+				"error": err.Error(),
+			})
+			continue
+		}
+		if changed {
+			log.Info("updated mappings from sources.list", map[string]interface{}{
+				"path": c.sources.name,
+			})
+		}
+	}
+}
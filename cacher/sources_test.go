@@ -0,0 +1,184 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSourcesLine(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		line string
+		uri  string
+		ok   bool
+	}{
+		{"deb http://archive.ubuntu.com/ubuntu focal main", "http://archive.ubuntu.com/ubuntu", true},
+		{"deb-src http://archive.ubuntu.com/ubuntu focal main # comment", "http://archive.ubuntu.com/ubuntu", true},
+		{"deb [arch=amd64 signed-by=/usr/share/keyrings/a.gpg] https://example.com/apt stable main", "https://example.com/apt", true},
+		{"# deb http://archive.ubuntu.com/ubuntu focal main", "", true},
+		{"   ", "", true},
+		{"deb http://archive.ubuntu.com/ubuntu", "", false},
+		{"rpm http://example.com/ focal", "", false},
+	}
+	for _, tc := range cases {
+		uri, err := parseSourcesLine(tc.line)
+		if (err == nil) != tc.ok {
+			t.Error(`unexpected result`, tc.line, err)
+			continue
+		}
+		if uri != tc.uri {
+			t.Error(`unexpected URI`, tc.line, uri)
+		}
+	}
+}
+
+func TestParseDeb822Sources(t *testing.T) {
+	t.Parallel()
+
+	data := `# comment
+
+Types: deb deb-src
+URIs: http://archive.ubuntu.com/ubuntu http://jp.archive.ubuntu.com/ubuntu
+Suites: focal focal-updates
+Components: main
+
+
+Types: deb
+URIs: http://disabled.example.com/
+Suites: stable
+Enabled: no
+
+Types: deb
+URIs: https://example.com/apt
+Suites: stable
+`
+	uris, err := parseDeb822Sources([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"http://archive.ubuntu.com/ubuntu",
+		"http://jp.archive.ubuntu.com/ubuntu",
+		"https://example.com/apt",
+	}
+	if !reflect.DeepEqual(uris, expected) {
+		t.Error(`unexpected URIs`, uris)
+	}
+
+	_, err = parseDeb822Sources([]byte("Types: deb\nSuites: stable\n"))
+	if err == nil {
+		t.Error(`missing URIs must be an error`)
+	}
+}
+
+func TestSourcesMapping(t *testing.T) {
+	t.Parallel()
+
+	var urls []*url.URL
+	for _, s := range []string{
+		"http://archive.ubuntu.com/ubuntu/",
+		"http://security.ubuntu.com/ubuntu/",
+		"http://ftp.debian.org/debian/",
+		"http://ftp.debian.org/debian/",
+		"https://example.com/",
+		"http://example.com:8080/Repo_1/",
+		"http://mirror.example.com/local/",
+	} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	m := sourcesMapping(urls, map[string]UpstreamURLs{
+		"local":  {"http://other.example.com/local"},
+		"debian": {"http://ftp.debian.org/debian"},
+	})
+	actual := make(map[string]string)
+	for prefix, u := range m {
+		actual[prefix] = u.String()
+	}
+	expected := map[string]string{
+		"archive.ubuntu.com-ubuntu":  "http://archive.ubuntu.com/ubuntu/",
+		"security.ubuntu.com-ubuntu": "http://security.ubuntu.com/ubuntu/",
+		"example.com":                "https://example.com/",
+		"repo_1":                     "http://example.com:8080/Repo_1/",
+		"mirror.example.com-local":   "http://mirror.example.com/local/",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(`unexpected mapping`, actual)
+	}
+}
+
+func TestSourcesList(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	var sources string
+	write := func(name, data string) {
+		err := ioutil.WriteFile(filepath.Join(sources, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		sources = filepath.Join(filepath.Dir(cfg.MetaDirectory), "sources.list.d")
+		if err := os.Mkdir(sources, 0755); err != nil {
+			t.Fatal(err)
+		}
+		write("a.list", "deb "+upstream.URL+"/ubuntu focal main\ndeb file:/srv/local ./\n")
+		write("ignored.txt", "invalid")
+
+		cfg.SourcesList = sources
+		config = cfg
+	})
+	defer cleanup()
+	testGetData(t, c, "ubuntu/pool/a.deb", []byte("/ubuntu/pool/a.deb"))
+	if c.mapped("local") {
+		t.Error(`file: URIs must be ignored`)
+	}
+
+	write("b.sources", "Types: deb\nURIs: "+upstream.URL+"/debian\nSuites: stable\n")
+	changed, err := c.sources.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error(`mappings must be changed`)
+	}
+	testGetData(t, c, "debian/pool/b.deb", []byte("/debian/pool/b.deb"))
+
+	changed, err = c.sources.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error(`mappings must not be changed`)
+	}
+
+	write("c.list", "invalid line\n")
+	if _, err := c.sources.load(); err == nil {
+		t.Error(`invalid sources.list must be an error`)
+	}
+	if !c.mapped("debian") {
+		t.Error(`mappings must be kept on errors`)
+	}
+
+	config.SourcesListInterval = -1
+	if _, err := NewCacher(config); err == nil {
+		t.Error(`negative sources_list_interval must be an error`)
+	}
+}
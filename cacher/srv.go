@@ -0,0 +1,168 @@
+package cacher
+
+// This file implements discovery of upstreams by DNS SRV records.
+// A mapping such as "dns+srv://_apt._tcp.mirrors.internal/ubuntu"
+// is resolved to upstreams "http://TARGET:PORT/ubuntu/" of the records.
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// srvScheme is the URL scheme of mappings discovered by SRV records.
+	srvScheme = "dns+srv"
+
+	defaultSRVRefreshInterval = 300
+
+	// srvLookupTimeout limits the time of a lookup.
+	srvLookupTimeout = 10 * time.Second
+)
+
+// lookupSRV is replaced in tests.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// srvUpstream is a set of upstreams discovered by SRV records.
+type srvUpstream struct {
+	name   string
+	scheme string
+	path   string
+
+	mu   sync.RWMutex
+	urls []*url.URL
+}
+
+// parseSRVUpstream parses a dns+srv URL.  The scheme of upstreams
+// is "http" unless "scheme=https" query is given.
+func parseSRVUpstream(u *url.URL) (*srvUpstream, error) {
+	if u.Host == "" {
+		return nil, errors.New("no SRV name in " + u.String())
+	}
+	scheme := u.Query().Get("scheme")
+	switch scheme {
+	case "":
+		scheme = "http"
+	case "http", "https":
+	default:
+		return nil, errors.New("unsupported scheme: " + scheme)
+	}
+	p := u.Path
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return &srvUpstream{
+		name:   u.Hostname(),
+		scheme: scheme,
+		path:   p,
+	}, nil
+}
+
+// lookup resolves SRV records into upstream URLs in the order of
+// priority and weight.
+func (s *srvUpstream) lookup(ctx context.Context) ([]*url.URL, error) {
+	ctx, cancel := context.WithTimeout(ctx, srvLookupTimeout)
+	defer cancel()
+
+	_, addrs, err := lookupSRV(ctx, "", "", s.name)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]*url.URL, 0, len(addrs))
+	for _, a := range addrs {
+		host := strings.TrimSuffix(a.Target, ".")
+		if host == "" {
+			continue
+		}
+		urls = append(urls, &url.URL{
+			Scheme: s.scheme,
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(a.Port))),
+			Path:   s.path,
+		})
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no SRV records for " + s.name)
+	}
+	return urls, nil
+}
+
+// refresh updates the upstreams.  The current upstreams are kept if
+// the lookup fails.
+func (s *srvUpstream) refresh(ctx context.Context) error {
+	urls, err := s.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.urls = urls
+	s.mu.Unlock()
+	return nil
+}
+
+// get returns the current upstreams.
+func (s *srvUpstream) get() []*url.URL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.urls
+}
+
+// unresolved returns true if p is under a prefix whose SRV records
+// have never been resolved.
+func (c *Cacher) unresolved(p string) bool {
+	s, ok := c.srv[strings.SplitN(p, "/", 2)[0]]
+	return ok && len(s.get()) == 0
+}
+
+// upstreamsOf returns the upstream base URLs of prefix.
+func (c *Cacher) upstreamsOf(prefix string) []*url.URL {
+	if s, ok := c.srv[prefix]; ok {
+		return s.get()
+	}
+	if urls, ok := c.upstreamURLs[prefix]; ok {
+		return urls
+	}
+	return c.sources.get(prefix)
+}
+
+// mapped returns true if prefix is in mapping or learned from
+// sources.list.
+func (c *Cacher) mapped(prefix string) bool {
+	if _, ok := c.upstreamURLs[prefix]; ok {
+		return true
+	}
+	return len(c.sources.get(prefix)) > 0
+}
+
+// refreshSRV periodically resolves SRV records of upstreams.
+func (c *Cacher) refreshSRV(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for prefix, s := range c.srv {
+			if err := s.refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Warn("failed to resolve SRV records", map[string]interface{}{
+					"prefix": prefix,
+					"name":   s.name,
+					"error":  err.Error(),
+				})
+			}
+		}
+	}
+}
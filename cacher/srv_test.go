@@ -0,0 +1,127 @@
+package cacher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSRVUpstream(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		url    string
+		name   string
+		scheme string
+		path   string
+		ok     bool
+	}{
+		{"dns+srv://_apt._tcp.mirrors.internal", "_apt._tcp.mirrors.internal", "http", "/", true},
+		{"dns+srv://_apt._tcp.mirrors.internal/ubuntu?scheme=https", "_apt._tcp.mirrors.internal", "https", "/ubuntu/", true},
+		{"dns+srv://_apt._tcp.mirrors.internal/?scheme=ftp", "", "", "", false},
+		{"dns+srv:///ubuntu", "", "", "", false},
+	}
+	for _, tc := range cases {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := parseSRVUpstream(u)
+		if (err == nil) != tc.ok {
+			t.Error(`unexpected result`, tc.url, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if s.name != tc.name || s.scheme != tc.scheme || s.path != tc.path {
+			t.Error(`unexpected SRV upstream`, tc.url, s.name, s.scheme, s.path)
+		}
+	}
+}
+
+// TestSRVUpstream replaces lookupSRV, so it must not run in parallel.
+func TestSRVUpstream(t *testing.T) {
+	newUpstream := func(data string) (*httptest.Server, *net.SRV) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(data))
+		}))
+		u, _ := url.Parse(s.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return s, &net.SRV{Target: u.Hostname() + ".", Port: uint16(port)}
+	}
+	s1, srv1 := newUpstream("Label: mirror1\n")
+	defer s1.Close()
+	s2, srv2 := newUpstream("Label: mirror2\n")
+	defer s2.Close()
+
+	var mu sync.Mutex
+	records := []*net.SRV{srv1}
+	orig := lookupSRV
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if name != "_apt._tcp.mirrors.internal" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return name, records, nil
+	}
+	defer func() {
+		lookupSRV = orig
+	}()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {"dns+srv://_apt._tcp.mirrors.internal"}}
+		config = cfg
+	})
+	defer cleanup()
+	testGetData(t, c, "ubuntu/pool/a.deb", []byte("Label: mirror1\n"))
+	testGetData(t, c, "ubuntu/dists/stable/Release", []byte("Label: mirror1\n"))
+
+	mu.Lock()
+	records = []*net.SRV{srv2}
+	mu.Unlock()
+	if err := c.srv["ubuntu"].refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testGetData(t, c, "ubuntu/pool/b.deb", []byte("Label: mirror2\n"))
+
+	mu.Lock()
+	records = nil
+	mu.Unlock()
+	if err := c.srv["ubuntu"].refresh(context.Background()); err == nil {
+		t.Error(`empty records must be an error`)
+	}
+	if urls := c.upstreamsOf("ubuntu"); len(urls) != 1 || urls[0].Host != s2.Listener.Addr().String() {
+		t.Error(`upstreams must be kept on failures`, urls)
+	}
+
+	// unresolvable SRV names do not prevent startup.
+	config.Mapping = map[string]UpstreamURLs{"ubuntu": {"dns+srv://_apt._tcp.unknown.internal"}}
+	c, err := NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetData(t, c, "ubuntu/dists/stable/Release", []byte("Label: mirror1\n"))
+	status, _, err := c.Get("ubuntu/pool/c.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Error(`status != http.StatusServiceUnavailable`, status)
+	}
+	if c.expireMeta(time.Hour) != 0 {
+		t.Error(`meta data of unresolved prefixes must be kept`)
+	}
+	config.Mapping = map[string]UpstreamURLs{"ubuntu": {"dns+srv://_apt._tcp.mirrors.internal", s1.URL}}
+	if _, err := NewCacher(config); err == nil {
+		t.Error(`dns+srv URL must be the only URL`)
+	}
+}
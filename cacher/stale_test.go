@@ -0,0 +1,61 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestServeStale(t *testing.T) {
+	t.Parallel()
+
+	repo := repotest.New()
+	repo.AddSuite("stable", false, repotest.Package{Name: "a", Version: "1.0", Arch: "amd64", Data: []byte("a")})
+	var failing int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 && strings.HasSuffix(r.URL.Path, "/Packages") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config.ServeStale = 60
+		config.RetryBaseDelay = 0.001
+		config.RetryMaxDelay = 0.01
+	})
+	defer cleanup()
+
+	const release = "dists/stable/Release"
+	const packages = "dists/stable/main/binary-amd64/Packages"
+	old := repo.Get(packages)
+	testGetData(t, c, "ubuntu/"+release, repo.Get(release))
+	testGetData(t, c, "ubuntu/"+packages, old)
+
+	// the upstream updates Release, then fails to serve Packages.
+	repo.AddSuite("stable", false, repotest.Package{Name: "a", Version: "2.0", Arch: "amd64", Data: []byte("a2")})
+	atomic.StoreInt32(&failing, 1)
+	<-c.Download("ubuntu/"+release, nil)
+
+	testGetData(t, c, "ubuntu/"+packages, old)
+
+	// after the grace period, the failure is returned.
+	c.dlLock.Lock()
+	c.staleSince["ubuntu/"+packages] = time.Now().Add(-2 * time.Minute)
+	c.dlLock.Unlock()
+	status, _, err := c.Get("ubuntu/" + packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Error(`status != http.StatusServiceUnavailable`, status)
+	}
+}
@@ -0,0 +1,124 @@
+package cacher
+
+// This file implements request statistics.
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// ArchStats is request statistics for an architecture.
+type ArchStats struct {
+	// Requests is the number of requests.
+	Requests uint64 `json:"requests"`
+
+	// Hits is the number of requests served from the cache
+	// without downloading from upstream.
+	Hits uint64 `json:"hits"`
+}
+
+// Stats is a snapshot of request statistics of Cacher.
+type Stats struct {
+	// Architectures is per-architecture statistics.
+	// Requests for source packages are counted as "source".
+	Architectures map[string]ArchStats `json:"architectures"`
+
+	// NegativeCache is the number of cached bad response statuses
+	// of upstream servers for each status code.
+	NegativeCache map[string]int `json:"negative_cache"`
+
+	// HotCache is statistics of the in-memory hot tier, if enabled.
+	HotCache *HotCacheStats `json:"hot_cache,omitempty"`
+
+	// Breakers is statistics of circuit breakers of upstream hosts
+	// that have failed, if enabled.
+	Breakers map[string]BreakerStats `json:"breakers,omitempty"`
+}
+
+type requestStats struct {
+	mu    sync.Mutex
+	archs map[string]*ArchStats
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		archs: make(map[string]*ArchStats),
+	}
+}
+
+// record counts a request for p.
+func (s *requestStats) record(p string, hit bool) {
+	arch := archOf(p)
+	if len(arch) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, ok := s.archs[arch]
+	if !ok {
+		as = new(ArchStats)
+		s.archs[arch] = as
+	}
+	as.Requests++
+	if hit {
+		as.Hits++
+	}
+}
+
+func (s *requestStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		Architectures: make(map[string]ArchStats, len(s.archs)),
+	}
+	for arch, as := range s.archs {
+		st.Architectures[arch] = *as
+	}
+	return st
+}
+
+// archOf returns the architecture derived from a requested path.
+//
+// Package files are named "name_version_arch.deb" and indices are
+// placed in "binary-arch" directories or named "Contents-arch".
+// If p does not belong to a specific architecture, an empty string
+// is returned.
+func archOf(p string) string {
+	base := path.Base(p)
+	switch path.Ext(base) {
+	case ".deb", ".udeb", ".ddeb":
+		t := strings.Split(strings.TrimSuffix(base, path.Ext(base)), "_")
+		if len(t) < 3 {
+			return ""
+		}
+		return t[len(t)-1]
+	case ".dsc":
+		return "source"
+	}
+	if strings.Contains(base, ".orig.tar.") || strings.Contains(base, ".debian.tar.") {
+		return "source"
+	}
+
+	if strings.HasPrefix(base, "Contents-") {
+		base = strings.TrimPrefix(base, "Contents-")
+		base = strings.TrimPrefix(base, "udeb-")
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		return base
+	}
+
+	for _, d := range strings.Split(path.Dir(p), "/") {
+		if strings.HasPrefix(d, "binary-") {
+			return d[len("binary-"):]
+		}
+		if d == "source" {
+			return "source"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package cacher
+
+import "testing"
+
+func TestArchOf(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"ubuntu/pool/main/a/apt/apt_1.0.1ubuntu2_amd64.deb":                     "amd64",
+		"ubuntu/pool/main/a/apt/apt-doc_1.0.1ubuntu2_all.deb":                   "all",
+		"ports/pool/main/l/linux/linux-udebs_4.4.0_arm64.udeb":                  "arm64",
+		"ubuntu/pool/main/a/apt/apt_1.0.1ubuntu2.dsc":                           "source",
+		"ubuntu/pool/main/a/apt/apt_1.0.1ubuntu2.tar.xz":                        "",
+		"ubuntu/pool/main/h/hello/hello_2.10.orig.tar.gz":                       "source",
+		"ubuntu/dists/trusty/main/binary-i386/Packages.gz":                      "i386",
+		"ubuntu/dists/trusty/main/source/Sources.gz":                            "source",
+		"ubuntu/dists/trusty/Contents-arm64.gz":                                 "arm64",
+		"ubuntu/dists/trusty/main/Contents-udeb-amd64.gz":                       "amd64",
+		"ubuntu/dists/trusty/Release":                                           "",
+		"ubuntu/dists/trusty/main/i18n/Translation-en.bz2":                      "",
+		"ubuntu/dists/trusty/main/binary-arm64/by-hash/SHA256/0123456789abcdef": "arm64",
+	}
+	for p, arch := range cases {
+		if a := archOf(p); a != arch {
+			t.Errorf("archOf(%q) = %q, want %q", p, a, arch)
+		}
+	}
+}
+
+func TestRequestStats(t *testing.T) {
+	t.Parallel()
+
+	s := newRequestStats()
+	s.record("ubuntu/pool/main/a/apt/apt_1.0_amd64.deb", true)
+	s.record("ubuntu/pool/main/a/apt/apt_1.0_amd64.deb", false)
+	s.record("ubuntu/pool/main/a/apt/apt_1.0_arm64.deb", false)
+	s.record("ubuntu/dists/trusty/Release", true)
+
+	st := s.snapshot()
+	if len(st.Architectures) != 2 {
+		t.Fatal(`len(st.Architectures) != 2`)
+	}
+	if st.Architectures["amd64"] != (ArchStats{Requests: 2, Hits: 1}) {
+		t.Error(`wrong amd64 stats`, st.Architectures["amd64"])
+	}
+	if st.Architectures["arm64"] != (ArchStats{Requests: 1, Hits: 0}) {
+		t.Error(`wrong arm64 stats`, st.Architectures["arm64"])
+	}
+}
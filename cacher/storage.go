@@ -2,10 +2,13 @@ package cacher
 
 import (
 	"container/heap"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cybozu-go/aptutil/apt"
 	"github.com/cybozu-go/log"
@@ -13,7 +16,8 @@ import (
 )
 
 const (
-	fileSuffix = ".cache"
+	fileSuffix       = ".cache"
+	validatorsSuffix = ".validators"
 )
 
 var (
@@ -28,30 +32,78 @@ var (
 type entry struct {
 	*apt.FileInfo
 
+	// file is the filename of the cache file relative to the directory.
+	file string
+
+	// ino is the inode number of the file to detect replacements
+	// by other processes sharing the directory.
+	ino uint64
+
 	// for container/heap.
-	// atime is used as priorities.
-	atime uint64
-	index int
+	// priority is given by EvictionPolicy.
+	atime    uint64
+	hits     uint64
+	priority float64
+	index    int
+	accessed time.Time
+
+	// referenced items are removed after unreferenced ones.
+	referenced bool
+
+	// expires is the time when the item becomes stale, or zero if
+	// it never does.  It is loaded from validators lazily.
+	expires       time.Time
+	expiresLoaded bool
+
+	pool *pool
 }
 
 // FilePath returns the filename of the entry.
 func (e *entry) FilePath() string {
-	return e.Path() + fileSuffix
+	return e.file
+}
+
+// pool is a group of items sharing a capacity.
+type pool struct {
+	capacity uint64
+	used     uint64
+	queue    evictionHeap
+
+	// inflation is the priority of the entry removed last.
+	inflation float64
 }
 
 // Storage stores cache items in local file system.
 //
-// Cached items will be removed in LRU fashion when the total size of
-// items exceeds the capacity.
+// Cached items will be removed in the order decided by EvictionPolicy,
+// LRU by default, when the total size of items exceeds the capacity.  Items of prefixes given dedicated
+// capacities by SetPrefixCapacity are counted and removed separately.
+// Items given by SetReferenced are removed only after others.
 type Storage struct {
-	dir      string // directory for cache items
-	capacity uint64
-
-	mu     sync.Mutex
-	used   uint64
-	cache  map[string]*entry
-	lru    []*entry // for container/heap
-	lclock uint64   // ditto
+	dir string // directory for cache items
+
+	mu         sync.Mutex
+	shared     pool
+	pools      map[string]*pool // for prefixes with dedicated capacities
+	cache      map[string]*entry
+	referenced map[string]bool
+	policy     EvictionPolicy
+	layout     string
+	compress   bool
+	lclock     uint64 // for container/heap
+
+	usage        map[string]*PrefixUsage
+	evictions    uint64
+	evictedBytes uint64
+
+	snapshotSaved bool
+
+	// lock is non-nil if the directory is shared with other processes.
+	lock *os.File
+
+	// copies of compressed files; see decompress.
+	copyLock sync.Mutex
+	copies   map[string]*decompressedCopy
 }
 
 // NewStorage creates a Storage.
@@ -73,65 +125,202 @@ func NewStorage(dir string, capacity uint64) *Storage {
 	}
 
 	return &Storage{
-		dir:      dir,
-		cache:    make(map[string]*entry),
-		capacity: capacity,
+		dir:    dir,
+		cache:  make(map[string]*entry),
+		shared: pool{capacity: capacity},
+		pools:  make(map[string]*pool),
+		usage:  make(map[string]*PrefixUsage),
+		policy: LRU,
+	}
+}
+
+// SetEvictionPolicy sets the policy to remove items.
+// This must be called before Load.
+func (cm *Storage) SetEvictionPolicy(policy EvictionPolicy) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.policy = policy
+}
+
+// SetPrefixCapacity gives items under prefix a dedicated capacity.
+//
+// Such items are removed only when their total size exceeds capacity,
+// and never removed to make room for items of other prefixes.
+// This must be called before Load.
+func (cm *Storage) SetPrefixCapacity(prefix string, capacity uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.pools[prefix] = &pool{capacity: capacity}
+}
+
+// SetReferenced sets items referenced by current indices.
+//
+// Referenced items are removed only when no unreferenced item is left
+// in the same pool.  Items inserted later are also checked against
+// paths.  paths must not be modified after the call.
+func (cm *Storage) SetReferenced(paths map[string]bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.referenced = paths
+	for p, e := range cm.cache {
+		e.referenced = paths[p]
+	}
+	cm.initQueues()
+}
+
+// SetLayout sets the layout of new cache files, LayoutTree or
+// LayoutSharded.  Cache files of both layouts are loaded regardless
+// of the layout.  This must be called before Load.
+func (cm *Storage) SetLayout(layout string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.layout = layout
+}
+
+// poolOf returns the pool for an item p.
+func (cm *Storage) poolOf(p string) *pool {
+	if pl, ok := cm.pools[strings.SplitN(p, "/", 2)[0]]; ok {
+		return pl
 	}
+	return &cm.shared
 }
 
 // Len implements heap.Interface.
 func (cm *Storage) Len() int {
-	return len(cm.lru)
+	return cm.shared.queue.Len()
 }
 
 // Less implements heap.Interface.
 func (cm *Storage) Less(i, j int) bool {
-	return cm.lru[i].atime < cm.lru[j].atime
+	return cm.shared.queue.Less(i, j)
 }
 
 // Swap implements heap.Interface.
 func (cm *Storage) Swap(i, j int) {
-	cm.lru[i], cm.lru[j] = cm.lru[j], cm.lru[i]
-	cm.lru[i].index = i
-	cm.lru[j].index = j
+	cm.shared.queue.Swap(i, j)
 }
 
 // Push implements heap.Interface.
 func (cm *Storage) Push(x interface{}) {
-	e, ok := x.(*entry)
-	if !ok {
-		panic("Storage.Push: wrong type")
-	}
-	n := len(cm.lru)
-	e.index = n
-	cm.lru = append(cm.lru, e)
+	cm.shared.queue.Push(x)
 }
 
 // Pop implements heap.Interface.
 func (cm *Storage) Pop() interface{} {
-	n := len(cm.lru)
-	e := cm.lru[n-1]
-	e.index = -1 // for safety
-	cm.lru = cm.lru[0 : n-1]
-	return e
+	return cm.shared.queue.Pop()
+}
+
+// touch records an access to e and updates its priority.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) touch(e *entry, pl *pool) {
+	e.atime = cm.lclock
+	cm.lclock++
+	e.hits++
+	e.accessed = time.Now()
+	e.priority = cm.policy.Priority(ItemStats{
+		Size:      e.Size(),
+		Hits:      e.hits,
+		Clock:     e.atime,
+		Inflation: pl.inflation,
+	})
+}
+
+// push adds e to its pool.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) push(e *entry) {
+	e.pool = cm.poolOf(e.Path())
+	e.pool.used += e.Size()
+	u := cm.prefixUsage(e.Path())
+	u.Items++
+	u.Used += e.Size()
+	cm.touch(e, e.pool)
+	heap.Push(&e.pool.queue, e)
 }
 
-// maint removes unused items from cache until used < capacity.
+// remove removes e from its pool.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) remove(e *entry) {
+	cm.dropCopy(e.Path())
+	e.pool.used -= e.Size()
+	u := cm.prefixUsage(e.Path())
+	u.Items--
+	u.Used -= e.Size()
+	heap.Remove(&e.pool.queue, e.index)
+}
+
+// evict removes e from the cache and the file system.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) evict(e *entry) {
+	cm.invalidateSnapshot()
+	cm.remove(e)
+	delete(cm.cache, e.Path())
+	if err := os.Remove(filepath.Join(cm.dir, e.FilePath())); err != nil {
+		log.Warn("Storage.maint", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	cm.releaseContent(e)
+	cm.removeSidecars(e)
+	log.Info("removed", map[string]interface{}{
+		"path": e.Path(),
+	})
+}
+
+// maint removes unused items from cache until used < capacity
+// for each pool.
 // cm.mu lock must be acquired beforehand.
 func (cm *Storage) maint() {
-	for cm.capacity > 0 && cm.used > cm.capacity {
-		e := heap.Pop(cm).(*entry)
-		delete(cm.cache, e.Path())
-		cm.used -= e.Size()
-		if err := os.Remove(filepath.Join(cm.dir, e.FilePath())); err != nil {
-			log.Warn("Storage.maint", map[string]interface{}{
-				"error": err.Error(),
-			})
+	cm.maintPool(&cm.shared)
+	for _, pl := range cm.pools {
+		cm.maintPool(pl)
+	}
+}
+
+func (cm *Storage) maintPool(pl *pool) {
+	for pl.capacity > 0 && pl.used > pl.capacity {
+		e := pl.queue[0]
+		pl.inflation = e.priority
+		cm.countEviction(e)
+		cm.evict(e)
+	}
+}
+
+// Touch records an access to the item p without opening it.
+func (cm *Storage) Touch(p string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	e, ok := cm.cache[p]
+	if !ok {
+		return
+	}
+	cm.touch(e, e.pool)
+	heap.Fix(&e.pool.queue, e.index)
+}
+
+// Expire removes items not accessed for ttl, and returns
+// the number of removed items.  Updating an item does not count
+// as an access.
+func (cm *Storage) Expire(ttl time.Duration) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.lockDir()()
+
+	deadline := time.Now().Add(-ttl)
+	var expired []*entry
+	for _, e := range cm.cache {
+		if e.accessed.Before(deadline) {
+			expired = append(expired, e)
 		}
-		log.Info("removed", map[string]interface{}{
-			"path": e.Path(),
-		})
 	}
+	for _, e := range expired {
+		cm.evict(e)
+	}
+	return len(expired)
 }
 
 func readData(path string) ([]byte, error) {
@@ -145,9 +334,32 @@ func readData(path string) ([]byte, error) {
 }
 
 // Load loads existing items in filesystem.
+//
+// If a snapshot saved by SaveSnapshot is available, items are loaded
+// from it instead of walking the directory.
 func (cm *Storage) Load() error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	defer cm.lockDir()()
+
+	err := os.ErrNotExist
+	if cm.lock == nil {
+		err = cm.loadSnapshot()
+		os.Remove(filepath.Join(cm.dir, storageSnapshot))
+	}
+	if err == nil {
+		cm.initQueues()
+		cm.recount()
+		cm.maint()
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		log.Warn("ignored a broken snapshot", map[string]interface{}{
+			"dir":   cm.dir,
+			"error": err.Error(),
+		})
+	}
+	cm.reset()
 
 	wf := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -160,24 +372,53 @@ func (cm *Storage) Load() error {
 		if err != nil {
 			return err
 		}
+		if isContentPath(subpath) {
+			// remove contents no longer linked from items.
+			if linkCount(info) == 1 {
+				return os.Remove(path)
+			}
+			return nil
+		}
 		if filepath.Ext(subpath) != fileSuffix {
 			return nil
 		}
-		subpath = subpath[:len(subpath)-len(fileSuffix)]
+		file := subpath
+		if isShardPath(file) {
+			subpath, err = cm.readShardPath(file)
+			if err != nil {
+				log.Warn("removed a broken cache file", map[string]interface{}{
+					"path":  file,
+					"error": err.Error(),
+				})
+				return os.Remove(path)
+			}
+		} else {
+			subpath = subpath[:len(subpath)-len(fileSuffix)]
+		}
 		if _, ok := cm.cache[subpath]; ok {
 			return nil
 		}
 
 		size := uint64(info.Size())
+		if mayBeCompressed(subpath) {
+			size, err = cm.loadedSize(path, subpath, size)
+			if err != nil {
+				return err
+			}
+		}
+		pl := cm.poolOf(subpath)
 		e := &entry{
 			// delay calculation of checksums.
-			FileInfo: apt.MakeFileInfoNoChecksum(subpath, size),
-			atime:    cm.lclock,
-			index:    len(cm.lru),
+			FileInfo:   apt.MakeFileInfoNoChecksum(subpath, size),
+			file:       file,
+			ino:        inode(info),
+			index:      len(pl.queue),
+			referenced: cm.referenced[subpath],
+			pool:       pl,
 		}
-		cm.used += size
-		cm.lclock++
-		cm.lru = append(cm.lru, e)
+		cm.touch(e, pl)
+		pl.used += size
+		pl.queue = append(pl.queue, e)
 		cm.cache[subpath] = e
 		log.Debug("Storage.Load", map[string]interface{}{
 			"path": subpath,
@@ -188,28 +429,59 @@ func (cm *Storage) Load() error {
 	if err := filepath.Walk(cm.dir, wf); err != nil {
 		return err
 	}
-	heap.Init(cm)
-
+	cm.initQueues()
+	cm.recount()
 	cm.maint()
 
 	return nil
 }
 
+// initQueues initializes heaps of pools.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) initQueues() {
+	heap.Init(&cm.shared.queue)
+	for _, pl := range cm.pools {
+		heap.Init(&pl.queue)
+	}
+}
+
 // TempFile creates a new temporary file
 // in the directory specified in Storage,
 // opens the file for reading and writing,
 // and returns the resulting *os.File.
 func (cm *Storage) TempFile() (*os.File, error) {
-	return ioutil.TempFile(cm.dir, "_tmp")
+	dir, err := cm.tempDirectory()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "_tmp")
+}
+
+// tempDirectory returns the directory for temporary files.
+func (cm *Storage) tempDirectory() (string, error) {
+	if cm.layout == LayoutSharded {
+		dir := filepath.Join(cm.dir, tempDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+	return cm.dir, nil
 }
 
 // Insert inserts or updates a cache item.
 //
 // fi.Path() must be as clean as filepath.Clean() and
 // must not be filepath.IsAbs().
+//
+// If fi has SHA256 checksum, items with the same contents share
+// disk space by hard links.  Note that the capacity is still
+// consumed by each item.
 func (cm *Storage) Insert(filename string, fi *apt.FileInfo) error {
 	p := fi.Path()
 	switch {
+	case isContentPath(p), isShardPath(p):
+		return ErrBadPath
 	case p != filepath.Clean(p):
 		return ErrBadPath
 	case filepath.IsAbs(p):
@@ -218,7 +490,13 @@ func (cm *Storage) Insert(filename string, fi *apt.FileInfo) error {
 		return ErrBadPath
 	}
 
-	destpath := filepath.Join(cm.dir, p+fileSuffix)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.lockDir()()
+
+	cm.invalidateSnapshot()
+	file := cm.itemFile(p)
+	destpath := filepath.Join(cm.dir, file)
 	dirpath := filepath.Dir(destpath)
 
 	_, err := os.Stat(dirpath)
@@ -232,41 +510,80 @@ func (cm *Storage) Insert(filename string, fi *apt.FileInfo) error {
 		return err
 	}
 
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	if existing, ok := cm.cache[p]; ok {
-		err = os.Remove(destpath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
+	var accessed time.Time
+	var linked bool
+	existing, ok := cm.cache[p]
+	if ok {
+		accessed = existing.accessed
+		cm.removeSidecars(existing)
+		cm.remove(existing)
+		delete(cm.cache, p)
+	}
+	// the existing file is replaced after the new one is ready.
+	defer func() {
+		if !ok {
+			return
+		}
+		if existing.file != file || !linked {
+			err := os.Remove(filepath.Join(cm.dir, existing.file))
+			if err != nil && !os.IsNotExist(err) {
+				log.Warn("failed to remove a cache file", map[string]interface{}{
+					"path":  p,
+					"error": err.Error(),
+				})
 			}
-			log.Warn("cache file was removed already", map[string]interface{}{
-				"path": p,
-			})
 		}
-		cm.used -= existing.Size()
-		heap.Remove(cm, existing.index)
-		delete(cm.cache, p)
+		cm.releaseContent(existing)
 		if log.Enabled(log.LvDebug) {
 			log.Debug("deleted existing item", map[string]interface{}{
 				"path": p,
 			})
 		}
-	}
+	}()
 
-	err = os.Link(filename, destpath)
+	if isShardPath(file) {
+		if err := cm.writeShardPath(file, p); err != nil {
+			return err
+		}
+	}
+	if cm.shouldCompress(p, fi.Size()) {
+		// compressed files are not shared with other items.
+		dir, err := cm.tempDirectory()
+		if err != nil {
+			return err
+		}
+		cf, err := compressFile(dir, filename)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(cf)
+		filename = cf
+	} else if cp := cm.storeContent(filename, fi); cp != "" {
+		filename = cp
+	}
+	// link atomically so that readers never miss the file.
+	err = cm.linkFile(filename, destpath)
 	if err != nil {
+		cm.releaseContent(&entry{FileInfo: fi})
 		return err
 	}
+	linked = true
 
 	e := &entry{
-		FileInfo: fi,
-		atime:    cm.lclock,
+		FileInfo:   fi,
+		file:       file,
+		referenced: cm.referenced[p],
+	}
+	if cm.lock != nil {
+		if st, err := os.Stat(destpath); err == nil {
+			e.ino = inode(st)
+		}
+	}
+	cm.push(e)
+	if !accessed.IsZero() {
+		// updates of items are not accesses.
+		e.accessed = accessed
 	}
-	cm.used += fi.Size()
-	cm.lclock++
-	heap.Push(cm, e)
 	cm.cache[p] = e
 
 	cm.maint()
@@ -279,7 +596,7 @@ func calcChecksum(dir string, e *entry) error {
 		return nil
 	}
 
-	data, err := readData(filepath.Join(dir, e.FilePath()))
+	data, err := readItem(filepath.Join(dir, e.FilePath()), e.Path())
 	if err != nil {
 		return err
 	}
@@ -292,9 +609,18 @@ func calcChecksum(dir string, e *entry) error {
 //
 // The caller is responsible to close the returned os.File.
 func (cm *Storage) Lookup(fi *apt.FileInfo) (*os.File, error) {
+	f, err := cm.lookup(fi)
+	if err != nil {
+		return nil, err
+	}
+	return cm.decompress(f, fi.Path())
+}
+
+func (cm *Storage) lookup(fi *apt.FileInfo) (*os.File, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	cm.sync(fi.Path())
 	e, ok := cm.cache[fi.Path()]
 	if !ok {
 		return nil, ErrNotFound
@@ -311,9 +637,68 @@ func (cm *Storage) Lookup(fi *apt.FileInfo) (*os.File, error) {
 		return nil, ErrNotFound
 	}
 
-	e.atime = cm.lclock
-	cm.lclock++
-	heap.Fix(cm, e.index)
+	cm.touch(e, e.pool)
+	heap.Fix(&e.pool.queue, e.index)
+	return os.Open(filepath.Join(cm.dir, e.FilePath()))
+}
+
+// Stat returns FileInfo and os.FileInfo of the cached item matching
+// fi without opening it.  If no item matching fi is found,
+// ErrNotFound is returned.
+//
+// Unlike Lookup, Stat does not count as an access to the item.
+func (cm *Storage) Stat(fi *apt.FileInfo) (*apt.FileInfo, os.FileInfo, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.sync(fi.Path())
+	e, ok := cm.cache[fi.Path()]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	// delayed checksum calculation
+	err := calcChecksum(cm.dir, e)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !fi.Same(e.FileInfo) {
+		return nil, nil, ErrNotFound
+	}
+
+	st, err := os.Stat(filepath.Join(cm.dir, e.FilePath()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if size := int64(e.Size()); st.Size() != size {
+		// the file is compressed.
+		st = sizedFileInfo{st, size}
+	}
+	return e.FileInfo, st, nil
+}
+
+// Open opens a cached item p without verifying checksums.
+// If p is not cached, ErrNotFound is returned.
+//
+// The caller is responsible to close the returned os.File.
+func (cm *Storage) Open(p string) (*os.File, error) {
+	f, err := cm.open(p)
+	if err != nil {
+		return nil, err
+	}
+	return cm.decompress(f, p)
+}
+
+func (cm *Storage) open(p string) (*os.File, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.sync(p)
+	e, ok := cm.cache[p]
+	if !ok {
+		return nil, ErrNotFound
+	}
 	return os.Open(filepath.Join(cm.dir, e.FilePath()))
 }
 
@@ -322,23 +707,49 @@ func (cm *Storage) ListAll() []*apt.FileInfo {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	l := make([]*apt.FileInfo, cm.Len())
-	for i, e := range cm.lru {
-		l[i] = e.FileInfo
+	l := make([]*apt.FileInfo, 0, len(cm.cache))
+	for _, e := range cm.cache {
+		l = append(l, e.FileInfo)
 	}
 	return l
 }
 
+// Contains returns true if an item for p is cached.
+func (cm *Storage) Contains(p string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	_, ok := cm.cache[p]
+	return ok
+}
+
+// Usage returns the number of items, the total size of items,
+// and the capacity of the cache.  Dedicated capacities of prefixes
+// are included.
+func (cm *Storage) Usage() (items int, used, capacity uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	used, capacity = cm.shared.used, cm.shared.capacity
+	for _, pl := range cm.pools {
+		used += pl.used
+		capacity += pl.capacity
+	}
+	return len(cm.cache), used, capacity
+}
+
 // Delete deletes an item from the cache.
 func (cm *Storage) Delete(p string) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	defer cm.lockDir()()
 
 	e, ok := cm.cache[p]
 	if !ok {
 		return nil
 	}
 
+	cm.invalidateSnapshot()
 	err := os.Remove(filepath.Join(cm.dir, e.FilePath()))
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -349,11 +760,108 @@ func (cm *Storage) Delete(p string) error {
 		})
 	}
 
-	cm.used -= e.Size()
-	heap.Remove(cm, e.index)
+	cm.releaseContent(e)
+	cm.removeSidecars(e)
+	cm.remove(e)
 	delete(cm.cache, p)
 	log.Info("deleted item", map[string]interface{}{
 		"path": p,
 	})
 	return nil
 }
+
+// SetValidators stores HTTP validators given by the upstream server
+// for a cached item p.  They persist across restarts.
+func (cm *Storage) SetValidators(p string, v *Validators) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	e, ok := cm.cache[p]
+	if !ok {
+		return ErrNotFound
+	}
+
+	f, err := cm.TempFile()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), filepath.Join(cm.dir, sidecar(e.file, validatorsSuffix)))
+	if err != nil {
+		return err
+	}
+	e.expires, e.expiresLoaded = v.expiresAt(), true
+	return nil
+}
+
+// Validators returns HTTP validators of a cached item p.
+// If p is not cached or has no validators, nil is returned.
+func (cm *Storage) Validators(p string) (*Validators, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	e, ok := cm.cache[p]
+	if !ok {
+		return nil, nil
+	}
+	return cm.readValidators(e)
+}
+
+// readValidators reads validators of e.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) readValidators(e *entry) (*Validators, error) {
+	data, err := readData(filepath.Join(cm.dir, sidecar(e.file, validatorsSuffix)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(Validators)
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Stale returns true if a cached item p has become stale by now.
+// Items without expiration times never become stale.
+func (cm *Storage) Stale(p string, now time.Time) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	e, ok := cm.cache[p]
+	if !ok {
+		return false
+	}
+	if !e.expiresLoaded {
+		v, err := cm.readValidators(e)
+		if err != nil {
+			log.Warn("failed to read validators", map[string]interface{}{
+				"path":  p,
+				"error": err.Error(),
+			})
+		}
+		if v != nil {
+			e.expires = v.expiresAt()
+		}
+		e.expiresLoaded = true
+	}
+	return !e.expires.IsZero() && now.After(e.expires)
+}
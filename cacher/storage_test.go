@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cybozu-go/aptutil/apt"
 )
@@ -193,11 +194,234 @@ func testStorageInsertPurgesFilesAllowingLRU(t *testing.T) {
 	}
 }
 
+func testStorageInsertPrefixCapacity(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 3)
+	cm.SetPrefixCapacity("internal", 2)
+
+	fiA, err := insert(cm, []byte("a"), "internal/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shared items do not purge internal/a.
+	for _, p := range []string{"ubuntu/bc", "ubuntu/de"} {
+		if _, err := insert(cm, []byte("xx"), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cm.Lookup(fiA); err != nil {
+		t.Error(err)
+	}
+	if cm.Contains("ubuntu/bc") {
+		t.Error(`ubuntu/bc must be purged`)
+	}
+
+	// internal/a will be purged
+	if _, err := insert(cm, []byte("fg"), "internal/fg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.Lookup(fiA); err != ErrNotFound {
+		t.Error(`err != ErrNotFound`)
+	}
+	if !cm.Contains("ubuntu/de") {
+		t.Error(`ubuntu/de must not be purged`)
+	}
+
+	items, used, capacity := cm.Usage()
+	if items != 2 || used != 4 || capacity != 5 {
+		t.Error(`unexpected usage`, items, used, capacity)
+	}
+}
+
+func testStorageInsertProtectsReferenced(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 3)
+	cm.SetReferenced(map[string]bool{"a": true})
+
+	for _, p := range []string{"a", "b", "c", "d"} {
+		if _, err := insert(cm, []byte(p), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cm.Contains("a") {
+		t.Error(`referenced a must not be purged`)
+	}
+	if cm.Contains("b") {
+		t.Error(`b must be purged`)
+	}
+
+	// a is no longer referenced, and is the least recently used.
+	cm.SetReferenced(map[string]bool{"c": true})
+	if _, err := insert(cm, []byte("e"), "e"); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Contains("a") {
+		t.Error(`a must be purged`)
+	}
+	if !cm.Contains("c") || !cm.Contains("d") {
+		t.Error(`c and d must not be purged`)
+	}
+}
+
+func testStorageInsertLFU(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 3)
+	cm.SetEvictionPolicy(LFU)
+
+	fis := make(map[string]*apt.FileInfo)
+	for _, p := range []string{"a", "b", "c"} {
+		fi, err := insert(cm, []byte(p), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fis[p] = fi
+	}
+	for _, p := range []string{"c", "a", "a", "b"} {
+		f, err := cm.Lookup(fis[p])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	// d is used less than others even though c is the least recently used.
+	if _, err := insert(cm, []byte("d"), "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		if !cm.Contains(p) {
+			t.Error(p + ` must not be purged`)
+		}
+	}
+	if cm.Contains("d") {
+		t.Error(`d must be purged`)
+	}
+
+	// e is as frequently used as b and c by aging, and c is older.
+	if _, err := insert(cm, []byte("e"), "e"); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Contains("c") {
+		t.Error(`c must be purged`)
+	}
+	if !cm.Contains("e") {
+		t.Error(`e must not be purged`)
+	}
+}
+
+func testStorageInsertSizeWeighted(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 10)
+	cm.SetEvictionPolicy(SizeWeighted)
+
+	fi, err := insert(cm, []byte("aaaaaa"), "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"b", "c"} {
+		if _, err := insert(cm, []byte(p), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := cm.Lookup(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, p := range []string{"d", "ee"} {
+		if _, err := insert(cm, []byte(p), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cm.Contains("large") {
+		t.Error(`large must be purged`)
+	}
+	for _, p := range []string{"b", "c", "d", "ee"} {
+		if !cm.Contains(p) {
+			t.Error(p + ` must not be purged`)
+		}
+	}
+}
+
+func TestStorageExpire(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 0)
+
+	if _, err := insert(cm, []byte("a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cm.Expire(time.Hour); n != 0 {
+		t.Error(`a must not expire`, n)
+	}
+	if n := cm.Expire(0); n != 1 {
+		t.Error(`a must expire`, n)
+	}
+	if cm.Contains("a") {
+		t.Error(`a must be removed`)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a"+fileSuffix)); !os.IsNotExist(err) {
+		t.Error(`cache file must be removed`, err)
+	}
+
+	age := func(p string) {
+		cm.mu.Lock()
+		cm.cache[p].accessed = time.Now().Add(-2 * time.Hour)
+		cm.mu.Unlock()
+	}
+	for _, p := range []string{"b", "c"} {
+		if _, err := insert(cm, []byte(p), p); err != nil {
+			t.Fatal(err)
+		}
+		age(p)
+	}
+	if _, err := insert(cm, []byte("bb"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	cm.Touch("c")
+	if n := cm.Expire(time.Hour); n != 1 {
+		t.Error(`updated items must expire`, n)
+	}
+	if cm.Contains("b") || !cm.Contains("c") {
+		t.Error(`touched items must not expire`)
+	}
+}
+
 func TestStorageInsert(t *testing.T) {
 	t.Run("Storage.Insert should insert file", testStorageInsertWorksCorrectly)
 	t.Run("Storage.Insert should overwrite", testStorageInsertOverwrite)
 	t.Run("Storage.Insert should return error if passed FileInfo path is bad path", testStorageInsertReturnsErrorAgainstBadPath)
 	t.Run("Storage.Insert should purge files allowing LRU", testStorageInsertPurgesFilesAllowingLRU)
+	t.Run("Storage.Insert should purge files per prefix capacity", testStorageInsertPrefixCapacity)
+	t.Run("Storage.Insert should purge unreferenced files first", testStorageInsertProtectsReferenced)
+	t.Run("Storage.Insert should purge files allowing LFU", testStorageInsertLFU)
+	t.Run("Storage.Insert should purge files allowing size-weighted", testStorageInsertSizeWeighted)
 }
 
 func makeFileInfo(path string, data []byte) (*apt.FileInfo, error) {
@@ -293,3 +517,138 @@ func TestStorageLoad(t *testing.T) {
 		t.Error(`bytes.Compare(files["ghij"], data) != 0`)
 	}
 }
+
+func TestStorageValidators(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cm := NewStorage(dir, 0)
+
+	v := &Validators{ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	if err := cm.SetValidators("a", v); err != ErrNotFound {
+		t.Error(`validators of non-cached items must not be stored`, err)
+	}
+
+	if _, err := insert(cm, []byte("a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.SetValidators("a", v); err != nil {
+		t.Fatal(err)
+	}
+
+	// validators persist across restarts.
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cm.Validators("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != *v {
+		t.Error(`unexpected validators`, got)
+	}
+
+	// validators are removed when the item is replaced.
+	if _, err := insert(cm, []byte("b"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = cm.Validators("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error(`validators must be removed`, got)
+	}
+
+	if err := cm.SetValidators("a", v); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "a"+validatorsSuffix))
+	if !os.IsNotExist(err) {
+		t.Error(`validators must be removed`, err)
+	}
+}
+
+func TestStorageSharded(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exists := func(file string) bool {
+		_, err := os.Stat(filepath.Join(dir, file))
+		return err == nil
+	}
+
+	cm := NewStorage(dir, 0)
+	if _, err := insert(cm, []byte("a"), "ubuntu/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// items in the tree layout are loaded.
+	cm = NewStorage(dir, 0)
+	cm.SetLayout(LayoutSharded)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Contains("ubuntu/a") {
+		t.Error(`ubuntu/a must be loaded`)
+	}
+
+	fiB, err := insert(cm, []byte("b"), "ubuntu/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(shardFile("ubuntu/b")) || exists("ubuntu/b"+fileSuffix) {
+		t.Error(`ubuntu/b must be stored in the sharded layout`)
+	}
+	v := &Validators{ETag: `"b"`}
+	if err := cm.SetValidators("ubuntu/b", v); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaced items move to the sharded layout.
+	if _, err := insert(cm, []byte("A"), "ubuntu/a"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(shardFile("ubuntu/a")) || exists("ubuntu/a"+fileSuffix) {
+		t.Error(`ubuntu/a must be moved to the sharded layout`)
+	}
+
+	// items in the sharded layout are loaded in the tree layout.
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cm.Lookup(fiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got, err := cm.Validators("ubuntu/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != *v {
+		t.Error(`unexpected validators`, got)
+	}
+
+	if err := cm.Delete("ubuntu/b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{fileSuffix, validatorsSuffix, pathSuffix} {
+		if exists(sidecar(shardFile("ubuntu/b"), suffix)) {
+			t.Error(`files of ubuntu/b must be removed`, suffix)
+		}
+	}
+}
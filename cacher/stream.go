@@ -0,0 +1,250 @@
+package cacher
+
+// This file implements streaming of items being downloaded.
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errStreamAborted = errors.New("download aborted")
+)
+
+// stream shares an item being downloaded with clients.
+//
+// The downloading goroutine writes the item into a temporary file,
+// and clients read it from the file as it grows.  If the download
+// fails or the item turns out to be invalid, clients get an error
+// and should abort their responses.
+//
+// The end of the item is held back until the stream is finished
+// successfully so that clients never receive a complete body of an
+// invalid item.
+type stream struct {
+	ready chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	f       *os.File
+	old     []*os.File // replaced by switchFile
+	size    int64      // Content-Length of the upstream response, or -1
+	modTime time.Time
+	written int64
+	last    int64 // size of the last write
+	started bool
+	done    bool
+	err     error
+	refs    int
+}
+
+func newStream() *stream {
+	s := &stream{
+		ready: make(chan struct{}),
+		size:  -1,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// start makes the stream readable from the file name.
+// It is called by the downloading goroutine.
+//
+// modTime is Last-Modified of the upstream response, or zero.
+func (s *stream) start(name string, size int64, modTime time.Time) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.f = f
+	s.size = size
+	s.modTime = modTime
+	s.started = true
+	s.refs = 1
+	close(s.ready)
+	return nil
+}
+
+// switchFile makes the stream read from the file name, which must
+// have the same contents as the current file.  It is called by the
+// downloading goroutine when it moves the item to another file.
+func (s *stream) switchFile(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started || s.f == nil {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	// readers may be reading the current file.
+	s.old = append(s.old, s.f)
+	s.f = f
+	return nil
+}
+
+// finish ends the stream.  err is nil if the item was downloaded
+// and validated successfully.  Only the first call takes effect.
+func (s *stream) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return
+	}
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+
+	if !s.started {
+		close(s.ready)
+		return
+	}
+	s.release()
+}
+
+// release drops a reference to s.f.  s.mu must be locked.
+func (s *stream) release() {
+	s.refs--
+	if s.refs == 0 {
+		s.f.Close()
+		s.f = nil
+		for _, f := range s.old {
+			f.Close()
+		}
+		s.old = nil
+	}
+}
+
+// wrote counts bytes written to the temporary file.
+// It must be called after the data is written to the file.
+func (s *stream) wrote(n int) {
+	s.mu.Lock()
+	s.written += int64(n)
+	s.last = int64(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// readable returns the number of bytes clients may read.
+// s.mu must be locked.
+//
+// Until the stream is finished, the last byte of the item is held
+// back if the size is known.  Otherwise, the last chunk written is
+// held back as it may be the end of the item.
+func (s *stream) readable() int64 {
+	switch {
+	case s.done:
+		return s.written
+	case s.size < 0:
+		return s.written - s.last
+	case s.written >= s.size:
+		return s.size - 1
+	}
+	return s.written
+}
+
+// reader returns a reader of the stream, or nil if the stream
+// is not available.
+func (s *stream) reader() *streamReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started || s.f == nil || s.err != nil {
+		return nil
+	}
+	s.refs++
+	return &streamReader{s: s}
+}
+
+// streamWriter writes to w and notifies the stream.
+type streamWriter struct {
+	w io.Writer
+	s *stream
+}
+
+func (sw streamWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if n > 0 {
+		sw.s.wrote(n)
+	}
+	return n, err
+}
+
+// streamReader reads a stream from the beginning.
+type streamReader struct {
+	s      *stream
+	off    int64
+	closed bool
+}
+
+// Size returns the size of the item, or -1 if unknown.
+func (r *streamReader) Size() int64 {
+	return r.s.size
+}
+
+// ModTime returns the modification time of the item, or zero if unknown.
+func (r *streamReader) ModTime() time.Time {
+	return r.s.modTime
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for r.off >= s.readable() && !s.done {
+		s.cond.Wait()
+	}
+	written, err, f := s.readable(), s.err, s.f
+	s.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if r.off >= written {
+		return 0, io.EOF
+	}
+
+	if remain := written - r.off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	n, err := f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the stream.
+func (r *streamReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	r.s.mu.Lock()
+	r.s.release()
+	r.s.mu.Unlock()
+	return nil
+}
+
+// openStream returns a reader for the item being downloaded by f.
+// If the item cannot be streamed, nil is returned.
+func (f *dlFuture) openStream() *streamReader {
+	select {
+	case <-f.stream.ready:
+	case <-f.done:
+		return nil
+	}
+	return f.stream.reader()
+}
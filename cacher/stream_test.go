@@ -0,0 +1,305 @@
+package cacher
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	s := newStream()
+	if s.reader() != nil {
+		t.Error(`stream must not be readable before start`)
+	}
+	if err := s.start(f.Name(), 6, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	w := streamWriter{f, s}
+
+	r1 := s.reader()
+	r2 := s.reader()
+	if r1 == nil || r2 == nil {
+		t.Fatal(`s.reader() == nil`)
+	}
+	if r1.Size() != 6 {
+		t.Error(`r1.Size() != 6`, r1.Size())
+	}
+
+	w.Write([]byte("abc"))
+	buf := make([]byte, 10)
+	n, err := r1.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "abc" {
+		t.Error(`string(buf[:n]) != "abc"`, string(buf[:n]))
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("def"))
+		s.finish(nil)
+	}()
+	data, err := ioutil.ReadAll(r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "def" {
+		t.Error(`string(data) != "def"`, string(data))
+	}
+	r1.Close()
+
+	data, err = ioutil.ReadAll(r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcdef" {
+		t.Error(`string(data) != "abcdef"`, string(data))
+	}
+	r2.Close()
+
+	if s.f != nil {
+		t.Error(`file must be closed`)
+	}
+}
+
+func TestStreamAbort(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	s := newStream()
+	if err := s.start(f.Name(), 3, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	r := s.reader()
+	defer r.Close()
+
+	// the last byte is held back until the item is validated.
+	streamWriter{f, s}.Write([]byte("abc"))
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ab" {
+		t.Error(`string(buf[:n]) != "ab"`, string(buf[:n]))
+	}
+	s.finish(errStreamAborted)
+
+	_, err = r.Read(buf)
+	if err != errStreamAborted {
+		t.Error(`err != errStreamAborted`, err)
+	}
+	if s.reader() != nil {
+		t.Error(`aborted stream must not be readable`)
+	}
+}
+
+func TestStreamServe(t *testing.T) {
+	t.Parallel()
+
+	first := []byte("first half;")
+	second := []byte("second half")
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(first)+len(second)))
+		w.Write(first)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(second)
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	server := httptest.NewServer(cacheHandler{c})
+	defer server.Close()
+
+	// two clients receive the first half before the download completes.
+	var bodies []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL + "/ubuntu/pool/a_1.0_amd64.deb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(`resp.StatusCode != http.StatusOK`, resp.StatusCode)
+		}
+		if resp.ContentLength != int64(len(first)+len(second)) {
+			t.Error(`unexpected Content-Length`, resp.ContentLength)
+		}
+
+		buf := make([]byte, len(first))
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(first) {
+			t.Error(`string(buf) != string(first)`, string(buf))
+		}
+		bodies = append(bodies, resp.Body)
+	}
+
+	close(release)
+	for _, body := range bodies {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(second) {
+			t.Error(`string(data) != string(second)`, string(data))
+		}
+	}
+
+	// the item is cached.
+	status, f, err := c.Get("ubuntu/pool/a_1.0_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`, status)
+	}
+	f.Close()
+}
+
+func TestStreamChecksumMismatch(t *testing.T) {
+	t.Parallel()
+
+	pkg := repotest.Package{
+		Name: "a", Version: "1.0", Arch: "amd64",
+		Data: []byte("first half;second half"),
+	}
+	repo := repotest.New()
+	repo.AddSuite("stable", false, pkg)
+	pool := repotest.PoolPath(pkg)
+	repo.Put(pool, []byte("first half;second HALF"))
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+pool {
+			repo.ServeHTTP(w, r)
+			return
+		}
+		data := repo.Get(pool)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:11])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(data[11:])
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+	for _, p := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages"} {
+		testGetData(t, c, "ubuntu/"+p, repo.Get(p))
+	}
+	server := httptest.NewServer(cacheHandler{c})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ubuntu/" + pool)
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		close(release)
+		t.Fatal(`resp.StatusCode != http.StatusOK`, resp.StatusCode)
+	}
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(resp.Body, buf)
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the end of the item is not sent as the checksum does not match.
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil || len(buf)+len(data) >= len(pkg.Data) {
+		t.Error(`invalid item must not be received completely`, string(data))
+	}
+	if c.items.Contains("ubuntu/" + pool) {
+		t.Error(`invalid item must not be cached`)
+	}
+}
+
+func TestStreamSwitchFile(t *testing.T) {
+	t.Parallel()
+
+	f1, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+	f2, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+
+	s := newStream()
+	if err := s.start(f1.Name(), -1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	r := s.reader()
+	if r == nil {
+		t.Fatal(`s.reader() == nil`)
+	}
+	// the last chunk is held back.
+	streamWriter{f1, s}.Write([]byte("ab"))
+	streamWriter{f1, s}.Write([]byte("c"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest is written to another file with the same contents.
+	f2.Write([]byte("abc"))
+	if err := s.switchFile(f2.Name()); err != nil {
+		t.Fatal(err)
+	}
+	streamWriter{f2, s}.Write([]byte("def"))
+	s.finish(nil)
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "cdef" {
+		t.Error(`string(data) != "cdef"`, string(data))
+	}
+	r.Close()
+
+	if s.f != nil || s.old != nil {
+		t.Error(`files must be closed`)
+	}
+}
@@ -0,0 +1,59 @@
+package cacher
+
+// This file implements systemd socket activation.
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sdListenFdsStart is the first file descriptor passed by systemd.
+	sdListenFdsStart = 3
+)
+
+// systemdListener returns the listener passed by systemd socket
+// activation, or nil if go-apt-cacher is not socket-activated.
+func systemdListener() (net.Listener, error) {
+	return listenerFromEnv(sdListenFdsStart)
+}
+
+// listenerFromEnv implements systemdListener.  start is the first
+// file descriptor passed.
+//
+// If multiple sockets are passed, the first one is used.
+func listenerFromEnv(start int) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("invalid LISTEN_FDS")
+	}
+
+	// not to pass them to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := start; fd < start+n; fd++ {
+		syscall.CloseOnExec(fd)
+	}
+
+	f := os.NewFile(uintptr(start), "LISTEN_FD_"+strconv.Itoa(start))
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "systemd socket")
+	}
+	log.Info("socket activated", map[string]interface{}{
+		"address": ln.Addr().String(),
+	})
+	return ln, nil
+}
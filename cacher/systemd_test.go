@@ -0,0 +1,48 @@
+package cacher
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenerFromEnv(t *testing.T) {
+	ln, err := listenerFromEnv(sdListenFdsStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln != nil {
+		t.Fatal(`ln must be nil without LISTEN_PID`)
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	f, err := tl.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	ln, err = listenerFromEnv(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != tl.Addr().String() {
+		t.Error(`unexpected address`, ln.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error(`LISTEN_FDS must be unset`)
+	}
+}
@@ -0,0 +1,67 @@
+package cacher
+
+// This file implements TLS configurations of the listener.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig creates TLS configuration for the listener.
+// If TLS is not enabled, nil is returned.
+func newTLSConfig(config *Config, am *autocert.Manager) (*tls.Config, error) {
+	hasCert := len(config.TLSCertFile) > 0 || len(config.TLSKeyFile) > 0
+
+	var tc *tls.Config
+	switch {
+	case hasCert && am != nil:
+		return nil, errors.New("tls_cert_file and acme_hosts are exclusive")
+	case hasCert:
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "tls_cert_file")
+		}
+		tc = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	case am != nil:
+		tc = am.TLSConfig()
+	}
+
+	if len(config.ClientCAFile) == 0 {
+		return tc, nil
+	}
+	if tc == nil {
+		return nil, errors.New("client_ca_file requires TLS")
+	}
+
+	data, err := ioutil.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "client_ca_file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in client_ca_file")
+	}
+
+	noClientAuth := tc.Clone()
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	if am != nil {
+		// ACME servers do not have client certificates.
+		tc.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					return noClientAuth, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+	return tc, nil
+}
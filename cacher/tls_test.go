@@ -0,0 +1,169 @@
+package cacher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyFile) == 0 {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	client := newTestCert(t, "client", ca)
+	other := newTestCert(t, "other", newTestCert(t, "other-ca", nil))
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca.write(t, caFile, "")
+	server.write(t, certFile, keyFile)
+
+	config := NewConfig()
+	tc, err := newTLSConfig(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc != nil {
+		t.Error(`TLS must be disabled by default`)
+	}
+
+	config.ClientCAFile = caFile
+	_, err = newTLSConfig(config, nil)
+	if err == nil {
+		t.Error(`client_ca_file without TLS must be an error`)
+	}
+
+	config.TLSCertFile = certFile
+	config.TLSKeyFile = keyFile
+	tc, err = newTLSConfig(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// TLS 1.3 reports client certificate errors on read.
+		// The server closes the connection after handshake.
+		_, err = conn.Read(make([]byte, 1))
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	if err := dial(client.tlsCertificate()); err != nil {
+		t.Error(`client certificate signed by CA must be accepted`, err)
+	}
+	if err := dial(); err == nil {
+		t.Error(`client without certificate must be rejected`)
+	}
+	if err := dial(other.tlsCertificate()); err == nil {
+		t.Error(`client certificate signed by other CA must be rejected`)
+	}
+}
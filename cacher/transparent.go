@@ -0,0 +1,178 @@
+package cacher
+
+// This file implements the transparent proxy mode.
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// checkProxyHosts validates patterns in proxy_hosts.
+func checkProxyHosts(patterns []string) error {
+	for _, pat := range patterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selfNames returns the names of this server listening on addr
+// and the port number.
+func selfNames(addr string) (map[string]bool, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, ""
+	}
+	names := map[string]bool{"localhost": true}
+	if host != "" {
+		names[strings.ToLower(host)] = true
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		names[strings.ToLower(hostname)] = true
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				names[ipnet.IP.String()] = true
+			}
+		}
+	}
+	return names, port
+}
+
+// proxyAllowed returns true if host at port may be proxied without
+// mapping.  This server itself is never proxied to avoid loops.
+func (c *Cacher) proxyAllowed(host, port string) bool {
+	if port == "" {
+		port = "80"
+	}
+	if port == c.selfPort && c.selfNames[host] {
+		return false
+	}
+	for _, pat := range c.proxyHosts {
+		if ok, _ := path.Match(pat, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyPrefix returns the prefix to cache items of an upstream
+// server at hostport.  It is the host name followed by "_" and the
+// port number if the port is not 80.
+func proxyPrefix(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	host = strings.ToLower(host)
+	if port == "" || port == "80" {
+		return host
+	}
+	return host + "_" + port
+}
+
+// proxyBase returns the upstream URL for a prefix made by proxyPrefix,
+// or nil if prefix is not allowed to be proxied.
+func (c *Cacher) proxyBase(prefix string) *url.URL {
+	if !c.proxy || !validPrefix.MatchString(prefix) {
+		return nil
+	}
+	if c.mapped(prefix) {
+		return nil
+	}
+
+	host, port := prefix, ""
+	if i := strings.LastIndexByte(prefix, '_'); i > 0 {
+		if _, err := strconv.ParseUint(prefix[i+1:], 10, 16); err == nil {
+			host, port = prefix[:i], prefix[i+1:]
+			prefix = host + ":" + port
+		}
+	}
+	if !c.proxyAllowed(host, port) {
+		return nil
+	}
+	return &url.URL{Scheme: "http", Host: prefix, Path: "/"}
+}
+
+// upstreamURL returns the upstream URL for p, or nil if the prefix of
+// p is neither mapped nor allowed to be proxied.
+func (c *Cacher) upstreamURL(p string) *url.URL {
+	t := strings.SplitN(p, "/", 2)
+	var base *url.URL
+	if urls := c.upstreamsOf(t[0]); len(urls) > 0 {
+		base = urls[0]
+	} else {
+		base = c.proxyBase(t[0])
+	}
+	if base == nil || len(t) == 1 {
+		return base
+	}
+	return base.ResolveReference(&url.URL{Path: t[1]})
+}
+
+// proxyPath returns the path of the item requested by r as a proxy
+// request.  ok is false if r is not a proxy request.
+//
+// Requests in absolute-form and requests whose Host header names an
+// upstream server in mapping are proxy requests.  Items of upstream
+// servers in mapping are cached under their prefixes, and those of
+// other hosts allowed by proxy_hosts are cached under prefixes made
+// of the hosts.  Other hosts are routed only by absolute-form as the
+// Host header of ordinary requests names this server.
+func (c *Cacher) proxyPath(r *http.Request) (p string, ok bool) {
+	host := r.Host
+	if r.URL.IsAbs() {
+		if r.URL.Scheme != "http" {
+			return "", false
+		}
+		host = r.URL.Host
+	}
+	if host == "" {
+		return "", false
+	}
+	if strings.HasSuffix(host, ":80") {
+		host = host[:len(host)-3]
+	}
+	host = strings.ToLower(host)
+	upath := path.Clean("/" + r.URL.Path)
+
+	// the longest match in mapping.
+	matched, matchedPrefix := "", ""
+	for _, mapping := range []map[string][]*url.URL{c.upstreamURLs, c.sources.all()} {
+		for prefix, urls := range mapping {
+			for _, u := range urls {
+				if u.Scheme != "http" || strings.ToLower(u.Host) != host {
+					continue
+				}
+				if !strings.HasPrefix(upath+"/", u.Path) {
+					continue
+				}
+				if len(u.Path) < len(matched) ||
+					(len(u.Path) == len(matched) && prefix > matchedPrefix) {
+					continue
+				}
+				matched, matchedPrefix = u.Path, prefix
+				p = path.Join(prefix, upath[len(u.Path)-1:])
+			}
+		}
+	}
+	if matched != "" {
+		return p, true
+	}
+	if !r.URL.IsAbs() {
+		return "", false
+	}
+
+	prefix := proxyPrefix(host)
+	if c.proxyBase(prefix) == nil {
+		return "", false
+	}
+	return path.Join(prefix, upath), true
+}
@@ -0,0 +1,149 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyPrefix(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"archive.ubuntu.com":    "archive.ubuntu.com",
+		"Archive.Ubuntu.com:80": "archive.ubuntu.com",
+		"apt.example.com:8080":  "apt.example.com_8080",
+	}
+	for hostport, expected := range cases {
+		if prefix := proxyPrefix(hostport); prefix != expected {
+			t.Error(`unexpected prefix`, hostport, prefix)
+		}
+	}
+}
+
+func TestTransparentProxy(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	uu, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL + "/ubuntu"}}
+		config.Proxy = true
+		config.ProxyHosts = []string{"127.0.0.*"}
+	})
+	defer cleanup()
+	handler := cacheHandler{c}
+	serve := func(target, host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if host != "" {
+			r.Host = host
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// items of mapped upstreams are cached under the prefix.
+	w := serve(upstream.URL+"/ubuntu/pool/a.deb", "")
+	if w.Code != http.StatusOK {
+		t.Fatal(`w.Code != http.StatusOK`, w.Code)
+	}
+	if !c.items.Contains("ubuntu/pool/a.deb") {
+		t.Error(`item must be cached under the prefix`)
+	}
+
+	// Host based routing.
+	w = serve("/ubuntu/pool/b.deb", uu.Host)
+	if w.Code != http.StatusOK {
+		t.Fatal(`w.Code != http.StatusOK`, w.Code)
+	}
+	if w.Body.String() != "/ubuntu/pool/b.deb" {
+		t.Error(`unexpected body`, w.Body.String())
+	}
+	if !c.items.Contains("ubuntu/pool/b.deb") {
+		t.Error(`item must be cached under the prefix`)
+	}
+
+	// other hosts allowed by proxy_hosts are cached under the host.
+	w = serve(upstream.URL+"/debian/pool/c.deb", "")
+	if w.Code != http.StatusOK {
+		t.Fatal(`w.Code != http.StatusOK`, w.Code)
+	}
+	if w.Body.String() != "/debian/pool/c.deb" {
+		t.Error(`unexpected body`, w.Body.String())
+	}
+	if !c.items.Contains(proxyPrefix(uu.Host) + "/debian/pool/c.deb") {
+		t.Error(`item must be cached under the host`)
+	}
+
+	// not an open proxy.
+	w = serve("http://localhost:"+uu.Port()+"/debian/pool/c.deb", "")
+	if w.Code != http.StatusForbidden {
+		t.Error(`w.Code != http.StatusForbidden`, w.Code)
+	}
+
+	// requests to go-apt-cacher itself.
+	w = serve("/ubuntu/pool/a.deb", "cacher.example.com")
+	if w.Code != http.StatusOK {
+		t.Error(`w.Code != http.StatusOK`, w.Code)
+	}
+}
+
+func TestTransparentProxySelf(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Addr = "cacher.example.com:3142"
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL + "/ubuntu"}}
+		config.Proxy = true
+		config.ProxyHosts = []string{"*"}
+	})
+	defer cleanup()
+	handler := cacheHandler{c}
+
+	// ordinary requests are not routed by the Host header even if
+	// proxy_hosts matches the name of go-apt-cacher.
+	for _, host := range []string{"cacher.example.com:3142", "localhost:3142", "cacher.example.com"} {
+		r := httptest.NewRequest("GET", "/ubuntu/pool/a.deb", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Error(`w.Code != http.StatusOK`, host, w.Code)
+		}
+		if w.Body.String() != "/ubuntu/pool/a.deb" {
+			t.Error(`unexpected body`, host, w.Body.String())
+		}
+	}
+	if !c.items.Contains("ubuntu/pool/a.deb") {
+		t.Error(`item must be cached under the prefix`)
+	}
+
+	// go-apt-cacher never proxies requests to itself.
+	for _, target := range []string{
+		"http://cacher.example.com:3142/ubuntu/pool/b.deb",
+		"http://localhost:3142/ubuntu/pool/b.deb",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusForbidden {
+			t.Error(`w.Code != http.StatusForbidden`, target, w.Code)
+		}
+	}
+	if c.upstreamURL("localhost_3142/ubuntu") != nil {
+		t.Error(`upstream URL for go-apt-cacher itself`)
+	}
+}
@@ -0,0 +1,266 @@
+package cacher
+
+// This file implements per-mapping configurations of upstream servers.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// UpstreamConfig is a configuration for the upstream repository of
+// a mapping prefix.
+type UpstreamConfig struct {
+	// Username and Password are credentials for Basic authentication.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// Token is sent in "Authorization: Bearer" header.
+	Token string `toml:"token"`
+
+	// CAFile specifies a PEM file of CA certificates to verify
+	// the upstream server instead of the system roots.
+	CAFile string `toml:"ca_file"`
+
+	// CertFile and KeyFile specify PEM files of the client certificate
+	// and its private key presented to the upstream server.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+
+	// Proxy is the URL of the proxy to reach the upstream such as
+	// "http://proxy.example.com:3128".  "direct" connects to the
+	// upstream without proxies.
+	//
+	// If empty, HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment
+	// variables are honored.
+	Proxy string `toml:"proxy"`
+
+	// Keyring is an OpenPGP keyring file, ASCII-armored or binary, to
+	// verify signatures of Release and InRelease files.  Release files
+	// are verified with Release.gpg.  Files failed to be verified are
+	// not cached, so checksums in them are never trusted.
+	//
+	// If empty, signatures are not verified.
+	Keyring string `toml:"keyring"`
+
+	// CacheCapacity gives items of the prefix a dedicated capacity in
+	// GiB instead of sharing Config.CacheCapacity with other prefixes.
+	// Items of the prefix are never evicted by items of others.
+	//
+	// Zero means sharing the global capacity.
+	CacheCapacity int `toml:"cache_capacity"`
+
+	// MaxConns overrides Config.MaxConns for the upstream.  Connections
+	// for the prefix are counted separately from other prefixes.
+	//
+	// Zero means using the global limit.
+	MaxConns int `toml:"max_conns"`
+
+	// HonorCacheControl makes cached non-meta items stale as told by
+	// Cache-Control and Expires headers of the upstream.  Stale items
+	// are revalidated or downloaded again when requested.
+	//
+	// Items without such headers never become stale unless
+	// MaxFreshness is set.
+	HonorCacheControl bool `toml:"honor_cache_control"`
+
+	// MinFreshness and MaxFreshness clamp the freshness lifetime in
+	// seconds given by the upstream when HonorCacheControl is true.
+	//
+	// Zero MaxFreshness means no upper limit.
+	MinFreshness int `toml:"min_freshness"`
+	MaxFreshness int `toml:"max_freshness"`
+
+	// RedirectSize makes clients redirected with 302 for non-meta
+	// items larger than this size in MiB instead of proxying and
+	// caching them.  Sizes are taken from cached indices, so items
+	// not listed in indices are always served.
+	//
+	// Zero disables redirection.
+	RedirectSize int `toml:"redirect_size"`
+
+	// RedirectURL is the base URL of redirection such as a CDN.
+	// If empty, clients are redirected to the upstream.
+	RedirectURL string `toml:"redirect_url"`
+
+	// RedirectSecret signs redirect URLs.  If not empty, "expires"
+	// and "signature" query parameters are added to redirect URLs.
+	// The signature is the hex-encoded HMAC-SHA256 of the URL path
+	// and the expiration time in UNIX seconds joined by a newline.
+	RedirectSecret string `toml:"redirect_secret"`
+
+	// RedirectExpires is the lifetime of signed redirect URLs in
+	// seconds.  Default is 3600.
+	RedirectExpires int `toml:"redirect_expires"`
+
+	// BlockedPackages specifies patterns of items refused with
+	// 403 Forbidden.  Blocked items are never downloaded nor cached.
+	// Patterns without "/" are matched with the base names by
+	// path.Match such as "openssl_1.1.1f-1ubuntu2_*.deb".
+	BlockedPackages []string `toml:"blocked_packages"`
+}
+
+// check validates the configuration.
+func (uc *UpstreamConfig) check() error {
+	if len(uc.Token) > 0 && len(uc.Username) > 0 {
+		return errors.New("username and token are exclusive")
+	}
+	if (len(uc.CertFile) > 0) != (len(uc.KeyFile) > 0) {
+		return errors.New("cert_file and key_file must be given together")
+	}
+	if _, err := uc.proxyFunc(); err != nil {
+		return err
+	}
+	if uc.CacheCapacity < 0 {
+		return errors.New("cache_capacity must be >= 0")
+	}
+	if uc.MaxConns < 0 {
+		return errors.New("max_conns must be >= 0")
+	}
+	if uc.MinFreshness < 0 || uc.MaxFreshness < 0 {
+		return errors.New("min_freshness and max_freshness must be >= 0")
+	}
+	if uc.MaxFreshness > 0 && uc.MinFreshness > uc.MaxFreshness {
+		return errors.New("min_freshness must be <= max_freshness")
+	}
+	if uc.RedirectSize < 0 || uc.RedirectExpires < 0 {
+		return errors.New("redirect_size and redirect_expires must be >= 0")
+	}
+	if len(uc.RedirectURL) > 0 {
+		u, err := url.Parse(uc.RedirectURL)
+		if err != nil {
+			return errors.Wrap(err, "redirect_url")
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return errors.New("redirect_url must be an absolute URL")
+		}
+	}
+	if err := checkPatterns(uc.BlockedPackages); err != nil {
+		return errors.Wrap(err, "blocked_packages")
+	}
+	return nil
+}
+
+func (uc *UpstreamConfig) hasTLS() bool {
+	return len(uc.CAFile) > 0 || len(uc.CertFile) > 0 || uc.InsecureSkipVerify
+}
+
+// directProxy is the value of UpstreamConfig.Proxy to use no proxies.
+const directProxy = "direct"
+
+// proxyFunc returns the function for http.Transport.Proxy, or nil
+// if Proxy is empty.
+func (uc *UpstreamConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	switch uc.Proxy {
+	case "":
+		return nil, nil
+	case directProxy:
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	u, err := url.Parse(uc.Proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host in proxy: " + uc.Proxy)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// tlsConfig creates TLS client configuration for the upstream.
+func (uc *UpstreamConfig) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: uc.InsecureSkipVerify,
+	}
+
+	if len(uc.CAFile) > 0 {
+		data, err := ioutil.ReadFile(uc.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "ca_file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates in ca_file")
+		}
+		tc.RootCAs = pool
+	}
+
+	if len(uc.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(uc.CertFile, uc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cert_file")
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// setAuth sets credentials for the upstream to req.
+// It returns false if no credentials are configured.
+func (uc *UpstreamConfig) setAuth(req *http.Request) bool {
+	switch {
+	case len(uc.Token) > 0:
+		req.Header.Set("Authorization", "Bearer "+uc.Token)
+	case len(uc.Username) > 0:
+		req.SetBasicAuth(uc.Username, uc.Password)
+	default:
+		return false
+	}
+	return true
+}
+
+// newUpstreamClients creates HTTP clients for upstreams with TLS
+// or proxy options.  Transports are cloned from base.
+func newUpstreamClients(upstreams map[string]*UpstreamConfig, base *http.Transport) (map[string]*http.Client, error) {
+	clients := make(map[string]*http.Client)
+	for prefix, uc := range upstreams {
+		proxy, err := uc.proxyFunc()
+		if err != nil {
+			return nil, errors.Wrap(err, "upstream."+prefix)
+		}
+		if !uc.hasTLS() && proxy == nil {
+			continue
+		}
+		transport := base.Clone()
+		if uc.hasTLS() {
+			tc, err := uc.tlsConfig()
+			if err != nil {
+				return nil, errors.Wrap(err, "upstream."+prefix)
+			}
+			transport.TLSClientConfig = tc
+		}
+		if proxy != nil {
+			transport.Proxy = proxy
+		}
+		clients[prefix] = &http.Client{
+			Transport:     transport,
+			CheckRedirect: noRedirect,
+		}
+	}
+	return clients, nil
+}
+
+// checkUpstreams validates per-mapping upstream configurations.
+func checkUpstreams(config *Config) error {
+	for prefix, uc := range config.Upstreams {
+		if _, ok := config.Mapping[prefix]; !ok {
+			return errors.New("upstream for unknown prefix: " + prefix)
+		}
+		if err := uc.check(); err != nil {
+			return errors.Wrap(err, "upstream."+prefix)
+		}
+	}
+	return nil
+}
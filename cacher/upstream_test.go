@@ -0,0 +1,227 @@
+package cacher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamAuth(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bearer/a.deb":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		case "/basic/a.deb":
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "user" || password != "pass" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		case "/public/a.deb":
+			if r.Header.Get("Authorization") != "" {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Write([]byte("deb"))
+	}))
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{
+			"bearer": {upstream.URL + "/bearer"},
+			"basic":  {upstream.URL + "/basic"},
+			"public": {upstream.URL + "/public"},
+		}
+		cfg.Upstreams = map[string]*UpstreamConfig{
+			"bearer": {Token: "secret"},
+			"basic":  {Username: "user", Password: "pass"},
+		}
+		config = cfg
+	})
+	defer cleanup()
+
+	for _, p := range []string{"bearer/a.deb", "basic/a.deb", "public/a.deb"} {
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != nil {
+			f.Close()
+		}
+		if status != http.StatusOK {
+			t.Error(p, `status != http.StatusOK`, status)
+		}
+	}
+
+	config.Upstreams = map[string]*UpstreamConfig{
+		"unknown": {Token: "secret"},
+	}
+	if err := checkUpstreams(config); err == nil {
+		t.Error(`upstream for unknown prefix must be an error`)
+	}
+
+	config.Upstreams = map[string]*UpstreamConfig{
+		"basic": {Username: "user", Token: "secret"},
+	}
+	if err := checkUpstreams(config); err == nil {
+		t.Error(`username and token must be exclusive`)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "client", ca)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca.write(t, caFile, "")
+	client.write(t, certFile, keyFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("deb"))
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "server", ca).tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{
+			"internal": {upstream.URL + "/internal"},
+			"nocert":   {upstream.URL + "/nocert"},
+			"insecure": {upstream.URL + "/insecure"},
+			"default":  {upstream.URL + "/default"},
+		}
+		cfg.Upstreams = map[string]*UpstreamConfig{
+			"internal": {CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+			"nocert":   {CAFile: caFile},
+			"insecure": {InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile},
+		}
+		// TLS errors are not worth retrying in this test.
+		cfg.Retries = 0
+		config = cfg
+	})
+	defer cleanup()
+
+	testCases := map[string]bool{
+		"internal/a.deb": true,
+		"insecure/a.deb": true,
+		"nocert/a.deb":   false,
+		"default/a.deb":  false,
+	}
+	for p, ok := range testCases {
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != nil {
+			f.Close()
+		}
+		if ok != (status == http.StatusOK) {
+			t.Error(p, `unexpected status`, status)
+		}
+	}
+
+	config.Upstreams = map[string]*UpstreamConfig{
+		"internal": {CertFile: certFile},
+	}
+	if err := checkUpstreams(config); err == nil {
+		t.Error(`cert_file without key_file must be an error`)
+	}
+}
+
+func TestUpstreamMaxConns(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.MaxConns = 0
+		config.Mapping = map[string]UpstreamURLs{
+			"ubuntu": {"http://apt.example.com/ubuntu"},
+			"vendor": {"http://apt.example.com/vendor"},
+		}
+		config.Upstreams = map[string]*UpstreamConfig{
+			"vendor": {MaxConns: 1},
+		}
+	})
+	defer cleanup()
+
+	if key := c.acquireSemaphore("ubuntu/a.deb", "apt.example.com"); key != "" {
+		t.Error(`connections for ubuntu must not be limited`, key)
+	}
+
+	key := c.acquireSemaphore("vendor/a.deb", "apt.example.com")
+	if key != "vendor@apt.example.com" {
+		t.Fatal(`unexpected key`, key)
+	}
+	if len(c.hostSem[key]) != 0 {
+		t.Error(`len(c.hostSem[key]) != 0`)
+	}
+	c.releaseSemaphore(key)
+	if len(c.hostSem[key]) != 1 {
+		t.Error(`len(c.hostSem[key]) != 1`)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{
+			"internet": {upstream.URL + "/internet"},
+			"internal": {upstream.URL + "/internal"},
+		}
+		config.Upstreams = map[string]*UpstreamConfig{
+			"internet": {Proxy: proxy.URL},
+			"internal": {Proxy: "direct"},
+		}
+	})
+	defer cleanup()
+	testGetData(t, c, "internet/a.deb", []byte("proxied"))
+	testGetData(t, c, "internal/a.deb", []byte("direct"))
+
+	for _, p := range []string{"ftp://proxy.example.com", "http://", "%"} {
+		uc := &UpstreamConfig{Proxy: p}
+		if err := uc.check(); err == nil {
+			t.Error(`invalid proxy must be an error`, p)
+		}
+	}
+}
@@ -8,6 +8,39 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Reserved names.  Files of the cacher in the cache and meta
+// directories and APIs are named with a leading "_", and Register
+// refuses them as prefixes so that they never collide with items.
+const (
+	storageSnapshot = "_snapshot.json" // snapshot of the Storage directory
+	lockFile        = "_lock"          // lock of the shared Storage directory
+	dedupDir        = "_sha256"        // contents of items by checksums
+	shardDir        = "_objects"       // cache files in the sharded layout
+	tempDir         = "_tmp"           // also the prefix of temporary files
+
+	indexDB      = "_index.db"     // fileIndex in meta_dir for low_memory
+	infoSnapshot = "_info.json"    // snapshot of fileIndex in meta_dir
+	resultsFile  = "_results.json" // cached statuses in meta_dir
+
+	healthName = "_health" // health check API
+)
+
+var reservedNames = map[string]bool{
+	storageSnapshot: true,
+	lockFile:        true,
+	dedupDir:        true,
+	shardDir:        true,
+	indexDB:         true,
+	infoSnapshot:    true,
+	resultsFile:     true,
+	healthName:      true,
+}
+
+// isReserved returns true if name is reserved by the cacher.
+func isReserved(name string) bool {
+	return reservedNames[name] || strings.HasPrefix(name, tempDir)
+}
+
 var (
 	validPrefix = regexp.MustCompile(`^[a-z0-9._-]+$`)
 
@@ -22,16 +55,11 @@ type URLMap map[string]*url.URL
 
 // Register registeres a prefix for a remote URL.
 func (um *URLMap) Register(prefix string, u *url.URL) error {
-	if !validPrefix.MatchString(prefix) {
+	if !validPrefix.MatchString(prefix) || isReserved(prefix) {
 		return ErrInvalidPrefix
 	}
 
-	// for URL.ResolveReference
-	if !strings.HasSuffix(u.Path, "/") {
-		u.Path += "/"
-		u.RawPath += "/"
-	}
-
+	addSlash(u)
 	(*um)[prefix] = u
 	return nil
 }
@@ -58,3 +86,11 @@ func (um URLMap) URL(p string) *url.URL {
 	}
 	return u.ResolveReference(&url.URL{Path: t[1]})
 }
+
+// addSlash appends "/" to the path of u for URL.ResolveReference.
+func addSlash(u *url.URL) {
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath += "/"
+	}
+}
@@ -21,6 +21,22 @@ func TestURLMap(t *testing.T) {
 		t.Error(`hoge/fuga must be an invalid prefix`)
 	}
 
+	err = um.Register("_health", u)
+	if err != ErrInvalidPrefix {
+		t.Error(`_health must be an invalid prefix`)
+	}
+
+	for _, p := range []string{storageSnapshot, infoSnapshot, resultsFile, indexDB, lockFile, shardDir, dedupDir, tempDir, "_tmp123", healthName} {
+		if um.Register(p, u) != ErrInvalidPrefix {
+			t.Error(p + ` must be an invalid prefix`)
+		}
+	}
+
+	err = um.Register("_ubuntu", u)
+	if err != nil {
+		t.Error(`_ubuntu must be a valid prefix`)
+	}
+
 	err = um.Register("ubuntu", u)
 	if err != nil {
 		t.Error(`ubuntu must be a valid prefix`)
@@ -0,0 +1,93 @@
+package cacher
+
+// This file implements accounting of storage usage per prefix.
+
+import (
+	"strings"
+)
+
+// PrefixUsage is the usage of items under a prefix in a storage.
+type PrefixUsage struct {
+	// Items is the number of cached items.
+	Items int `json:"items"`
+
+	// Used is the total size of cached items.
+	Used uint64 `json:"used_bytes"`
+
+	// Capacity is the dedicated capacity of the prefix, or zero if
+	// the prefix shares the capacity of the storage.
+	Capacity uint64 `json:"capacity_bytes,omitempty"`
+
+	// Evictions is the number of items removed to free up capacity.
+	Evictions uint64 `json:"evictions"`
+
+	// EvictedBytes is the total size of items removed to free up
+	// capacity.
+	EvictedBytes uint64 `json:"evicted_bytes"`
+}
+
+// prefixOf returns the prefix of p.
+func prefixOf(p string) string {
+	return strings.SplitN(p, "/", 2)[0]
+}
+
+// prefixUsage returns the usage of the prefix of p to be updated.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) prefixUsage(p string) *PrefixUsage {
+	prefix := prefixOf(p)
+	u, ok := cm.usage[prefix]
+	if !ok {
+		u = new(PrefixUsage)
+		cm.usage[prefix] = u
+	}
+	return u
+}
+
+// countEviction records e being removed to free up capacity.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) countEviction(e *entry) {
+	u := cm.prefixUsage(e.Path())
+	u.Evictions++
+	u.EvictedBytes += e.Size()
+	cm.evictions++
+	cm.evictedBytes += e.Size()
+}
+
+// recount recalculates the number and size of items per prefix.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) recount() {
+	for _, u := range cm.usage {
+		u.Items = 0
+		u.Used = 0
+	}
+	for p, e := range cm.cache {
+		u := cm.prefixUsage(p)
+		u.Items++
+		u.Used += e.Size()
+	}
+}
+
+// PrefixUsage returns the usage of each prefix.
+func (cm *Storage) PrefixUsage() map[string]PrefixUsage {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	m := make(map[string]PrefixUsage, len(cm.usage))
+	for prefix, u := range cm.usage {
+		pu := *u
+		if pl, ok := cm.pools[prefix]; ok {
+			pu.Capacity = pl.capacity
+		}
+		m[prefix] = pu
+	}
+	return m
+}
+
+// Evictions returns the number and the total size of items removed
+// to free up capacity.
+func (cm *Storage) Evictions() (items, bytes uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.evictions, cm.evictedBytes
+}
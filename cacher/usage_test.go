@@ -0,0 +1,69 @@
+package cacher
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStoragePrefixUsage(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 10)
+	cm.SetPrefixCapacity("debian", 5)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []struct {
+		p    string
+		data string
+	}{
+		{"ubuntu/a", "aaaa"},
+		{"ubuntu/b", "bbbb"},
+		{"debian/c", "ccc"},
+		{"ubuntu/d", "dddd"}, // evicts ubuntu/a
+		{"debian/e", "ee"},
+		{"debian/f", "f"}, // evicts debian/c
+	}
+	for _, item := range items {
+		if _, err := insert(cm, []byte(item.data), item.p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cm.Delete("ubuntu/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]PrefixUsage{
+		"ubuntu": {Items: 1, Used: 4, Evictions: 1, EvictedBytes: 4},
+		"debian": {Items: 2, Used: 3, Capacity: 5, Evictions: 1, EvictedBytes: 3},
+	}
+	if u := cm.PrefixUsage(); !reflect.DeepEqual(u, expected) {
+		t.Error(`unexpected usage`, u)
+	}
+	if n, bytes := cm.Evictions(); n != 2 || bytes != 7 {
+		t.Error(`unexpected evictions`, n, bytes)
+	}
+
+	// usage is counted when loaded.
+	cm2 := NewStorage(dir, 10)
+	cm2.SetPrefixCapacity("debian", 5)
+	if err := cm2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]PrefixUsage{
+		"ubuntu": {Items: 1, Used: 4},
+		"debian": {Items: 2, Used: 3, Capacity: 5},
+	}
+	if u := cm2.PrefixUsage(); !reflect.DeepEqual(u, expected) {
+		t.Error(`unexpected usage after load`, u)
+	}
+}
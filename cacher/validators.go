@@ -0,0 +1,80 @@
+package cacher
+
+// This file implements conditional requests to upstream servers.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// Validators are HTTP validators of a cached item given by the
+// upstream server.
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Expires is the Unix time when the item becomes stale.
+	// Zero means the item never becomes stale.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+func (v *Validators) expiresAt() time.Time {
+	if v.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v.Expires, 0)
+}
+
+// validatorsFromHeader returns validators in h, or nil if none.
+func validatorsFromHeader(h http.Header) *Validators {
+	v := &Validators{
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+	}
+	if v.ETag == "" && v.LastModified == "" {
+		return nil
+	}
+	return v
+}
+
+// setConditional adds headers to revalidate a cached item with v.
+func (v *Validators) setConditional(h http.Header) {
+	if v.ETag != "" {
+		h.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		h.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// revalidatable returns validators of p if p can be revalidated by
+// a conditional request.
+//
+// p must be cached and consistent with the file index so that Get
+// serves it from the cache after a "304 Not Modified" response.
+func (c *Cacher) revalidatable(p string, storage *Storage) *Validators {
+	c.fiLock.RLock()
+	fi, ok := c.info.Get(p)
+	c.fiLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	f, err := storage.Lookup(fi)
+	if err != nil {
+		return nil
+	}
+	f.Close()
+
+	v, err := storage.Validators(p)
+	if err != nil {
+		log.Warn("failed to read validators", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	return v
+}
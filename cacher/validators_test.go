@@ -0,0 +1,65 @@
+package cacher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRevalidate(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var conds []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conds = append(conds, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+		mu.Unlock()
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("Version: 1\n"))
+	}))
+	defer upstream.Close()
+
+	var config *Config
+	c, cleanup := newTestCacher(t, func(cfg *Config) {
+		cfg.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+		config = cfg
+	})
+	defer cleanup()
+
+	const p = "ubuntu/dists/stable/Release"
+	testGetData(t, c, p, []byte("Version: 1\n"))
+	<-c.Download(p, nil)
+	testGetData(t, c, p, []byte("Version: 1\n"))
+
+	// validators persist across restarts.
+	c, err := NewCacher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c.Download(p, nil)
+	testGetData(t, c, p, []byte("Version: 1\n"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"|",
+		`"v1"|Mon, 02 Jan 2006 15:04:05 GMT`,
+		`"v1"|Mon, 02 Jan 2006 15:04:05 GMT`,
+	}
+	if len(conds) != len(expected) {
+		t.Fatal(`unexpected requests`, conds)
+	}
+	for i, e := range expected {
+		if conds[i] != e {
+			t.Error(`unexpected conditional headers`, i, conds[i])
+		}
+	}
+}
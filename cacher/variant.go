@@ -0,0 +1,98 @@
+package cacher
+
+// This file implements conversion between compressed variants of
+// indices such as Packages and Packages.gz.
+//
+// Only decompression is implemented because compressed variants
+// cannot be reproduced byte for byte to match their checksums.
+
+import (
+	"io"
+	"os"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// variantExts lists extensions of compressed variants to convert from
+// in the order of preference.
+var variantExts = []string{".gz", ".zst", ".xz", ".bz2", ".lz4", ".lzma", ".lz"}
+
+// convertIndex makes an uncompressed index fi in storage from its
+// compressed variant cached there, and returns it opened.
+// Checksums of fi must be known from Release.
+// nil is returned if no variant can be converted.
+func (c *Cacher) convertIndex(storage *Storage, fi *apt.FileInfo) *os.File {
+	p := fi.Path()
+	if !isIndex(p) || apt.CompressionExt(p) != "" {
+		return nil
+	}
+	if fi.MD5SumPath() == "" && fi.SHA1Path() == "" && fi.SHA256Path() == "" && fi.SHA512Path() == "" {
+		return nil
+	}
+
+	for _, ext := range variantExts {
+		c.fiLock.RLock()
+		vfi, ok := c.info.Get(p + ext)
+		c.fiLock.RUnlock()
+		if !ok {
+			continue
+		}
+		f, err := storage.Lookup(vfi)
+		if err != nil {
+			continue
+		}
+		err = decompressIndex(storage, f, vfi.Path(), fi)
+		f.Close()
+		if err != nil {
+			log.Warn("failed to convert an index", map[string]interface{}{
+				"path":  p,
+				"from":  vfi.Path(),
+				"error": err.Error(),
+			})
+			continue
+		}
+		log.Info("converted an index", map[string]interface{}{
+			"path": p,
+			"from": vfi.Path(),
+		})
+
+		f, err = storage.Lookup(fi)
+		if err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// decompressIndex decompresses r read from a compressed variant from,
+// and inserts it as fi into storage if the checksums match.
+func decompressIndex(storage *Storage, r io.Reader, from string, fi *apt.FileInfo) error {
+	dr, err := apt.Decompress(from, r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tempfile, err := storage.TempFile()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+	}()
+
+	got, err := apt.CopyWithFileInfo(tempfile, dr, fi.Path())
+	if err != nil {
+		return err
+	}
+	if !fi.Same(got) {
+		return errors.New("checksum mismatch")
+	}
+	if err := tempfile.Sync(); err != nil {
+		return err
+	}
+	return storage.Insert(tempfile.Name(), got)
+}
@@ -0,0 +1,78 @@
+package cacher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConvertIndex(t *testing.T) {
+	t.Parallel()
+
+	packages := "Package: a\n"
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(packages))
+	gz.Close()
+	gzipped := buf.String()
+
+	files := map[string]string{
+		"/dists/stable/main/binary-amd64/Packages.gz": gzipped,
+		"/dists/stable/Release": fmt.Sprintf("Origin: test\nSHA256:\n %x %d main/binary-amd64/Packages\n %x %d main/binary-amd64/Packages.gz\n",
+			sha256.Sum256([]byte(packages)), len(packages),
+			sha256.Sum256([]byte(gzipped)), len(gzipped)),
+	}
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+
+	get := func(p, expected string) {
+		t.Helper()
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(`unexpected status`, p, status)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Error(`unexpected data`, p, string(data))
+		}
+	}
+	get("ubuntu/dists/stable/Release", files["/dists/stable/Release"])
+	get("ubuntu/dists/stable/main/binary-amd64/Packages.gz", gzipped)
+	get("ubuntu/dists/stable/main/binary-amd64/Packages", packages)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/dists/stable/main/binary-amd64/Packages"]; n != 0 {
+		t.Error(`Packages must be converted from Packages.gz`, n)
+	}
+}
@@ -0,0 +1,283 @@
+package cacher
+
+// This file implements warming the cache from a go-apt-mirror.
+//
+// Files of a mirror are inserted with checksums recorded by the mirror
+// instead of reading them.  If the mirror is on the same file system,
+// they are hard-linked so that co-hosted deployments do not store
+// everything twice.
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/aptutil/mirror"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// openMirror opens the storage of a go-apt-mirror and returns it with
+// the directory of mirrored files.
+//
+// dir is the directory of a mirror such as /var/spool/go-apt-mirror/ubuntu,
+// which is a symlink to the current snapshot, or info.db or info.json
+// in a snapshot directory.
+func openMirror(dir string) (*mirror.Storage, string, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var root string
+	if st.IsDir() {
+		root, err = filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		// a snapshot directory has only the directory of the mirror.
+		base := filepath.Dir(dir)
+		f, err := os.Open(base)
+		if err != nil {
+			return nil, "", err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			if len(root) > 0 {
+				return nil, "", errors.New("multiple mirrors in " + base)
+			}
+			root = filepath.Join(base, info.Name())
+		}
+		if len(root) == 0 {
+			return nil, "", errors.New("no mirror in " + base)
+		}
+	}
+
+	s, err := mirror.NewStorage(filepath.Dir(root), filepath.Base(root))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.Load(); err != nil {
+		return nil, "", err
+	}
+	return s, root, nil
+}
+
+// sameDevice returns true if files a and b are on the same file system.
+func sameDevice(a, b string) bool {
+	var sta, stb syscall.Stat_t
+	if syscall.Stat(a, &sta) != nil || syscall.Stat(b, &stb) != nil {
+		return false
+	}
+	return sta.Dev == stb.Dev
+}
+
+// copyInto inserts a copy of filename as fi into storage if its
+// checksums match.  It returns false if they do not match.
+func copyInto(storage *Storage, filename string, fi *apt.FileInfo) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	tempfile, err := storage.TempFile()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+	}()
+
+	hashed, err := apt.CopyWithFileInfo(tempfile, f, fi.Path())
+	if err != nil {
+		return false, err
+	}
+	if !fi.Same(hashed) {
+		return false, nil
+	}
+	if err := tempfile.Sync(); err != nil {
+		return false, err
+	}
+	return true, storage.Insert(tempfile.Name(), hashed)
+}
+
+// mirrorWarmer inserts files of a mirror under a prefix.
+type mirrorWarmer struct {
+	*Cacher
+	root   string
+	prefix string
+
+	// link is true for storages on the same file system as root.
+	link map[*Storage]bool
+}
+
+// insert inserts the mirrored file of fi into storage as pfi.
+// c.fiLock must be locked beforehand.
+func (w *mirrorWarmer) insert(storage *Storage, fi, pfi *apt.FileInfo) (bool, error) {
+	filename := filepath.Join(w.root, filepath.FromSlash(fi.Path()))
+	if w.link[storage] {
+		return true, storage.Insert(filename, pfi)
+	}
+	return copyInto(storage, filename, pfi)
+}
+
+// warmMeta inserts a meta data file fi and indexes files listed in it.
+func (w *mirrorWarmer) warmMeta(fi *apt.FileInfo) (bool, error) {
+	pfi := fi.AddPrefix(w.prefix)
+	p := pfi.Path()
+
+	f, err := os.Open(filepath.Join(w.root, filepath.FromSlash(fi.Path())))
+	if err != nil {
+		return false, err
+	}
+	fil, d, err := apt.ExtractFileInfo(fi.Path(), f)
+	f.Close()
+	if err != nil {
+		log.Warn("invalid meta data", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+		return false, nil
+	}
+	fil = addPrefix(w.prefix, fil)
+
+	w.fiLock.Lock()
+	defer w.fiLock.Unlock()
+
+	known, indexed := w.info.Get(p)
+	if indexed && !known.Same(pfi) {
+		// the cached Release lists other contents.
+		return false, nil
+	}
+	ok, err := w.insert(w.meta, fi, pfi)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if !indexed {
+		w.maintMeta(p)
+	}
+	if !w.maintained[p] && w.refreshes(p) {
+		w.maintMeta(p)
+	}
+	if err := w.info.Put(append(fil, pfi)...); err != nil {
+		return false, err
+	}
+	if isRelease(p) {
+		w.byHash.update(p, fil, d)
+	}
+	return true, nil
+}
+
+// warmItem inserts a file fi listed in cached indices.
+func (w *mirrorWarmer) warmItem(fi *apt.FileInfo) (bool, error) {
+	pfi := fi.AddPrefix(w.prefix)
+	p := pfi.Path()
+	if w.blocked(p) {
+		return false, nil
+	}
+
+	w.fiLock.Lock()
+	defer w.fiLock.Unlock()
+
+	known, ok := w.info.Get(p)
+	if !ok || !known.Same(pfi) {
+		return false, nil
+	}
+	return w.insert(w.items, fi, pfi)
+}
+
+// WarmFromMirror inserts files of a go-apt-mirror into the cache
+// under prefix so that a go-apt-cacher on the same host starts warm.
+//
+// dir is the directory of a mirror, or info.db or info.json in its
+// snapshot directory.  Checksums recorded by the mirror are trusted,
+// and files are hard-linked if dir is on the same file system.
+// Meta data files are not inserted if the cached Release lists other
+// contents, and other files are inserted only if listed in cached
+// indices.
+func (c *Cacher) WarmFromMirror(dir, prefix string) (*ImportResult, error) {
+	if !c.mapped(prefix) {
+		return nil, errors.New("prefix is not mapped: " + prefix)
+	}
+	ms, root, err := openMirror(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "warm")
+	}
+	defer ms.Close()
+
+	var metas, items []*apt.FileInfo
+	err = ms.Walk(func(p string, fi *apt.FileInfo) error {
+		switch {
+		case p != fi.Path():
+			// by-hash paths are served by their files.
+		case apt.IsMeta(p):
+			metas = append(metas, fi)
+		default:
+			items = append(items, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "warm")
+	}
+
+	w := &mirrorWarmer{
+		Cacher: c,
+		root:   root,
+		prefix: prefix,
+		link: map[*Storage]bool{
+			c.meta:  sameDevice(root, c.meta.dir),
+			c.items: sameDevice(root, c.items.dir),
+		},
+	}
+	res := new(ImportResult)
+	warm := func(storage *Storage, fil []*apt.FileInfo, fn func(*apt.FileInfo) (bool, error)) error {
+		for _, fi := range fil {
+			if storage.Contains(path.Join(prefix, fi.Path())) {
+				res.Cached++
+				continue
+			}
+			ok, err := fn(fi)
+			if err != nil {
+				return errors.Wrap(err, "warm "+fi.Path())
+			}
+			if ok {
+				res.Imported++
+			} else {
+				res.Unknown++
+			}
+		}
+		return nil
+	}
+	if err := warm(c.meta, metas, w.warmMeta); err != nil {
+		return res, err
+	}
+	if res.Imported > 0 {
+		c.notifyReferences()
+	}
+	if err := warm(c.items, items, w.warmItem); err != nil {
+		return res, err
+	}
+
+	log.Info("warmed from a mirror", map[string]interface{}{
+		"dir":      dir,
+		"prefix":   prefix,
+		"imported": res.Imported,
+		"cached":   res.Cached,
+		"unknown":  res.Unknown,
+	})
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package cacher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/aptutil/mirror"
+)
+
+func TestWarmFromMirror(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deb := "deb contents"
+	packages := fmt.Sprintf("Package: a\nFilename: pool/a.deb\nSize: %d\nSHA256: %x\n",
+		len(deb), sha256.Sum256([]byte(deb)))
+	release := fmt.Sprintf("Origin: test\nSHA256:\n %x %d main/binary-amd64/Packages\n",
+		sha256.Sum256([]byte(packages)), len(packages))
+	files := map[string]string{
+		"dists/stable/Release":                    release,
+		"dists/stable/main/binary-amd64/Packages": packages,
+		"pool/a.deb":                              deb,
+		"pool/unknown.deb":                        "unknown",
+	}
+
+	// make a mirror as go-apt-mirror does.
+	snapshot := filepath.Join(dir, "mirror", ".ubuntu.20200101_000000")
+	if err := os.MkdirAll(snapshot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := mirror.NewStorage(snapshot, "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, data := range files {
+		tempfile, err := ms.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := apt.CopyWithFileInfo(tempfile, strings.NewReader(data), p)
+		tempfile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ms.StoreLinkWithHash(fi, tempfile.Name())
+		os.Remove(tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.Save(); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "mirror", "ubuntu")
+	if err := os.Symlink(filepath.Join(snapshot, "ubuntu"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCacher(t, func(config *Config) {
+		config.Mapping = map[string]UpstreamURLs{"ubuntu": {upstream.URL}}
+	})
+	defer cleanup()
+
+	if _, err := c.WarmFromMirror(link, "debian"); err == nil {
+		t.Error(`unmapped prefix must be rejected`)
+	}
+	res, err := c.WarmFromMirror(link, "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 3 || res.Cached != 0 || res.Unknown != 1 {
+		t.Error(`unexpected result`, res)
+	}
+
+	for p, expected := range map[string]string{
+		"ubuntu/dists/stable/main/binary-amd64/Packages": packages,
+		"ubuntu/pool/a.deb": deb,
+	} {
+		status, f, err := c.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Fatal(`unexpected status`, p, status)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Error(`unexpected data`, p, string(data))
+		}
+	}
+	mu.Lock()
+	if requests != 0 {
+		t.Error(`warmed files must not be downloaded`, requests)
+	}
+	mu.Unlock()
+
+	// files are hard-linked.
+	st, err := os.Stat(filepath.Join(link, "pool", "a.deb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkCount(st) < 2 {
+		t.Error(`files must be hard-linked`, linkCount(st))
+	}
+
+	// the info file in a snapshot can be given too.
+	res, err = c.WarmFromMirror(filepath.Join(snapshot, "info.db"), "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 0 || res.Cached != 3 || res.Unknown != 1 {
+		t.Error(`unexpected result`, res)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"runtime/debug"
 
 	"github.com/BurntSushi/toml"
 	"github.com/cybozu-go/aptutil/cacher"
@@ -13,10 +15,14 @@ import (
 
 const (
 	defaultConfigPath = "/etc/go-apt-cacher.toml"
+
+	// GOGC value in low memory mode.
+	lowMemoryGCPercent = 50
 )
 
 var (
 	configPath = flag.String("f", defaultConfigPath, "configuration file name")
+	offline    = flag.Bool("offline", false, "serve only cached items without contacting upstreams")
 )
 
 func main() {
@@ -34,21 +40,67 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *offline {
+		config.Offline = true
+	}
+
+	if config.LowMemory {
+		if !md.IsDefined("max_conns") {
+			config.MaxConns = cacher.LowMemoryMaxConns
+		}
+		debug.SetGCPercent(lowMemoryGCPercent)
+	}
+
 	err = config.Log.Apply()
 	if err != nil {
 		log.ErrorExit(err)
 	}
+
+	args := flag.Args()
+	switch {
+	case len(args) == 1 && args[0] == "migrate":
+		_, err = cacher.Migrate(config)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		return
+	case len(args) > 0:
+		log.ErrorExit(errors.New("unknown command: " + args[0]))
+	}
+
 	cc, err := cacher.NewCacher(config)
 	if err != nil {
 		log.ErrorExit(err)
 	}
 
 	s := cacher.NewServer(cc, config)
-	err = s.ListenAndServe()
+	ln, err := cacher.Listen(cc, config)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	err = s.Serve(ln)
 	if err != nil {
 		log.ErrorExit(err)
 	}
 
+	as, err := cacher.NewAdminServer(cc, config)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	if as != nil {
+		err = as.ListenAndServe()
+		if err != nil {
+			log.ErrorExit(err)
+		}
+	}
+
+	if hs := cacher.NewChallengeServer(cc, config, s.Handler); hs != nil {
+		err = hs.ListenAndServe()
+		if err != nil {
+			log.ErrorExit(err)
+		}
+	}
+
 	err = well.Wait()
 	if err != nil && !well.IsSignaled(err) {
 		log.ErrorExit(err)
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"text/tabwriter"
 
 	"github.com/BurntSushi/toml"
 	"github.com/cybozu-go/aptutil/mirror"
@@ -24,22 +25,72 @@ func main() {
 	config := mirror.NewConfig()
 	md, err := toml.DecodeFile(*configPath, config)
 	if err != nil {
-		log.ErrorExit(err)
+		log.Error(err.Error(), nil)
+		os.Exit(mirror.ClassConfig.ExitCode())
 	}
 	if len(md.Undecoded()) > 0 {
 		log.Error("invalid config keys", map[string]interface{}{
 			"keys": fmt.Sprintf("%#v", md.Undecoded()),
 		})
-		os.Exit(1)
+		os.Exit(mirror.ClassConfig.ExitCode())
 	}
 
 	err = config.Log.Apply()
 	if err != nil {
-		log.ErrorExit(err)
+		log.Error(err.Error(), nil)
+		os.Exit(mirror.ClassConfig.ExitCode())
 	}
 
-	err = mirror.Run(config, flag.Args())
+	args := flag.Args()
+	switch {
+	case len(args) > 0 && args[0] == "du":
+		err = du(config, args[1:])
+	case len(args) == 1 && args[0] == "gc":
+		err = mirror.GC(config)
+	default:
+		err = mirror.Run(config, args)
+	}
+	if err != nil {
+		class := mirror.Classify(err)
+		log.Error(err.Error(), map[string]interface{}{
+			"class": class.String(),
+		})
+		os.Exit(class.ExitCode())
+	}
+}
+
+// du prints disk usage of mirrors.
+func du(config *mirror.Config, mirrors []string) error {
+	usage, err := mirror.DiskUsage(config, mirrors)
 	if err != nil {
-		log.ErrorExit(err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "MIRROR\tSNAPSHOT\tSIZE\tFREEABLE\t")
+	for _, mu := range usage {
+		for _, su := range mu.Snapshots {
+			name := su.Name
+			if su.Current {
+				name += " (current)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n",
+				mu.ID, name, humanize(su.Size), humanize(su.Freeable))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", mu.ID, "total", humanize(mu.Size))
+	}
+	return w.Flush()
+}
+
+func humanize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
 }
@@ -2,10 +2,15 @@ module github.com/cybozu-go/aptutil
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/ProtonMail/go-crypto v0.0.0-20230217124315-7d5c6f04bbb8
 	github.com/cybozu-go/log v1.5.0
 	github.com/cybozu-go/well v1.10.0
+	github.com/klauspost/compress v1.13.6
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/pkg/errors v0.8.0
 	github.com/ulikunitz/xz v0.5.10
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
 
 go 1.15
@@ -0,0 +1,67 @@
+// Package backoff implements exponential backoff for retries
+// shared by go-apt-mirror and go-apt-cacher.
+package backoff
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultBaseDelay is the default delay in seconds before the first retry.
+	DefaultBaseDelay = 1.0
+
+	// DefaultMaxDelay is the default maximum delay in seconds.
+	DefaultMaxDelay = 16.0
+)
+
+// Backoff calculates delays before retries.
+type Backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter float64
+}
+
+// New creates Backoff from configurations in seconds.
+//
+// jitter is the ratio of randomization; the delay is chosen from
+// [d*(1-jitter), d] uniformly where d is the exponential delay.
+//
+// If both base and max are zero, the default values are used.
+func New(base, max, jitter float64) (Backoff, error) {
+	if base == 0 && max == 0 {
+		base = DefaultBaseDelay
+		max = DefaultMaxDelay
+	}
+
+	switch {
+	case base < 0:
+		return Backoff{}, errors.New("retry_base_delay must be >= 0")
+	case max < base:
+		return Backoff{}, errors.New("retry_max_delay must be >= retry_base_delay")
+	case jitter < 0 || jitter > 1:
+		return Backoff{}, errors.New("retry_jitter must be between 0 and 1")
+	}
+	return Backoff{
+		base:   time.Duration(base * float64(time.Second)),
+		max:    time.Duration(max * float64(time.Second)),
+		jitter: jitter,
+	}, nil
+}
+
+// Delay returns the delay before the n-th retry.  n starts from 1.
+func (b Backoff) Delay(n uint) time.Duration {
+	if n == 0 {
+		n = 1
+	}
+	d := b.base << (n - 1)
+	if d>>(n-1) != b.base || d > b.max {
+		// overflowed or exceeded the limit
+		d = b.max
+	}
+	if b.jitter > 0 {
+		d -= time.Duration(b.jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
@@ -0,0 +1,55 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(-1, 1, 0); err == nil {
+		t.Error(`negative base delay must be rejected`)
+	}
+	if _, err := New(2, 1, 0); err == nil {
+		t.Error(`max < base must be rejected`)
+	}
+	if _, err := New(1, 2, 1.5); err == nil {
+		t.Error(`jitter > 1 must be rejected`)
+	}
+
+	b, err := New(DefaultBaseDelay, DefaultMaxDelay, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{1, 2, 4, 8, 16, 16, 16}
+	for i, e := range expected {
+		if d := b.Delay(uint(i + 1)); d != e*time.Second {
+			t.Errorf("Delay(%d) = %v", i+1, d)
+		}
+	}
+	if d := b.Delay(100); d != 16*time.Second {
+		t.Error(`Delay(100) != max`)
+	}
+
+	b, err = New(0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint{1, 2, 10, 100} {
+		if d := b.Delay(n); d != 0 {
+			t.Errorf("Delay(%d) = %v with zero base", n, d)
+		}
+	}
+
+	b, err = New(0.5, 3, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		d := b.Delay(3)
+		if d < 1*time.Second || d > 2*time.Second {
+			t.Fatal(`jittered delay out of range`, d)
+		}
+	}
+}
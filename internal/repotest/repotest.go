@@ -0,0 +1,192 @@
+// Package repotest provides a fake Debian repository served over HTTP
+// for integration tests of go-apt-mirror and go-apt-cacher.
+package repotest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Package is a binary package in the repository.
+type Package struct {
+	Name    string
+	Version string
+	Arch    string
+	Data    []byte
+}
+
+func (pkg Package) basename() string {
+	return fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version, pkg.Arch)
+}
+
+// Repository is an in-memory Debian repository.
+//
+// Repository implements http.Handler.
+type Repository struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// New creates an empty Repository.
+func New() *Repository {
+	return &Repository{
+		files: make(map[string][]byte),
+	}
+}
+
+// Get returns the contents of p, or nil if p does not exist.
+func (r *Repository) Get(p string) []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.files[p]
+}
+
+// Put adds or replaces a file without updating indices.
+func (r *Repository) Put(p string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[p] = data
+}
+
+// Corrupt modifies the contents of p without updating indices
+// so that checksums in indices no longer match.
+func (r *Repository) Corrupt(p string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append([]byte(nil), r.files[p]...)
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	data[0] ^= 0xff
+	r.files[p] = data
+}
+
+// PoolPath returns the path of pkg added by AddSuite.
+func PoolPath(pkg Package) string {
+	return path.Join("pool", "main", pkg.Name[0:1], pkg.Name, pkg.basename())
+}
+
+// AddSuite adds "dists/<suite>" with "main" section for pkgs.
+// All packages must share the same architecture.
+//
+// If byHash is true, indices are also available by their hash
+// and Release declares "Acquire-By-Hash: yes".
+func (r *Repository) AddSuite(suite string, byHash bool, pkgs ...Package) {
+	arch := "amd64"
+	if len(pkgs) > 0 {
+		arch = pkgs[0].Arch
+	}
+
+	dir := path.Join("dists", suite)
+	indexDir := path.Join("main", "binary-"+arch)
+	packages := new(bytes.Buffer)
+	for _, pkg := range pkgs {
+		p := PoolPath(pkg)
+		r.Put(p, pkg.Data)
+		writeParagraph(packages, pkg, p)
+	}
+
+	indices := r.addIndices(dir, indexDir, packages.Bytes(), byHash)
+
+	release := new(bytes.Buffer)
+	fmt.Fprintf(release, "Suite: %s\nArchitectures: %s\nComponents: main\n", suite, arch)
+	if byHash {
+		release.WriteString("Acquire-By-Hash: yes\n")
+	}
+	writeChecksums(release, indices)
+	r.Put(path.Join(dir, "Release"), release.Bytes())
+}
+
+// AddFlat adds a flat repository at dir for pkgs.
+// dir must not end with "/".
+//
+// As in real flat repositories, Filename fields are relative to dir.
+func (r *Repository) AddFlat(dir string, pkgs ...Package) {
+	packages := new(bytes.Buffer)
+	for _, pkg := range pkgs {
+		r.Put(path.Join(dir, pkg.basename()), pkg.Data)
+		writeParagraph(packages, pkg, pkg.basename())
+	}
+
+	indices := r.addIndices(dir, "", packages.Bytes(), false)
+
+	release := new(bytes.Buffer)
+	writeChecksums(release, indices)
+	r.Put(path.Join(dir, "Release"), release.Bytes())
+}
+
+// addIndices adds Packages and Packages.gz under path.Join(dir, indexDir),
+// and returns their contents keyed by paths relative to dir.
+func (r *Repository) addIndices(dir, indexDir string, packages []byte, byHash bool) map[string][]byte {
+	gz := new(bytes.Buffer)
+	w := gzip.NewWriter(gz)
+	w.Write(packages)
+	w.Close()
+
+	indices := map[string][]byte{
+		path.Join(indexDir, "Packages"):    packages,
+		path.Join(indexDir, "Packages.gz"): gz.Bytes(),
+	}
+	for p, data := range indices {
+		r.Put(path.Join(dir, p), data)
+		if byHash {
+			sum := sha256.Sum256(data)
+			r.Put(path.Join(dir, indexDir, "by-hash", "SHA256", hex.EncodeToString(sum[:])), data)
+		}
+	}
+	return indices
+}
+
+func writeParagraph(w *bytes.Buffer, pkg Package, filename string) {
+	md5sum := md5.Sum(pkg.Data)
+	sha256sum := sha256.Sum256(pkg.Data)
+	fmt.Fprintf(w, "Package: %s\nVersion: %s\nArchitecture: %s\n", pkg.Name, pkg.Version, pkg.Arch)
+	fmt.Fprintf(w, "Filename: %s\nSize: %d\n", filename, len(pkg.Data))
+	fmt.Fprintf(w, "MD5sum: %s\nSHA256: %s\n\n", hex.EncodeToString(md5sum[:]), hex.EncodeToString(sha256sum[:]))
+}
+
+func writeChecksums(w *bytes.Buffer, files map[string][]byte) {
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	w.WriteString("MD5Sum:\n")
+	for _, p := range paths {
+		sum := md5.Sum(files[p])
+		fmt.Fprintf(w, " %s %d %s\n", hex.EncodeToString(sum[:]), len(files[p]), p)
+	}
+	w.WriteString("SHA256:\n")
+	for _, p := range paths {
+		sum := sha256.Sum256(files[p])
+		fmt.Fprintf(w, " %s %d %s\n", hex.EncodeToString(sum[:]), len(files[p]), p)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Repository) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	data := r.Get(strings.TrimPrefix(req.URL.Path, "/"))
+	if data == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "GET" {
+		w.Write(data)
+	}
+}
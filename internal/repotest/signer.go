@@ -0,0 +1,82 @@
+package repotest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Signer signs Release files by an OpenPGP key generated for tests.
+//
+// NewSigner and methods of Signer panic on errors as they are
+// only for tests.
+type Signer struct {
+	Entity *openpgp.Entity
+}
+
+// NewSigner generates a key for name and returns a Signer for it.
+func NewSigner(name string) *Signer {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		panic(err)
+	}
+	return &Signer{e}
+}
+
+// Keyring returns a keyring containing the key of s.
+func (s *Signer) Keyring() openpgp.EntityList {
+	return openpgp.EntityList{s.Entity}
+}
+
+// PublicKey returns the ASCII armored public key of s.
+func (s *Signer) PublicKey() []byte {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		panic(err)
+	}
+	if err := s.Entity.Serialize(w); err != nil {
+		panic(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// WriteKeyring writes the ASCII armored public key of s to filename.
+func (s *Signer) WriteKeyring(filename string) error {
+	return ioutil.WriteFile(filename, s.PublicKey(), 0644)
+}
+
+// DetachSign returns an ASCII armored detached signature of data
+// as in Release.gpg.
+func (s *Signer) DetachSign(data []byte) []byte {
+	sig := new(bytes.Buffer)
+	if err := openpgp.ArmoredDetachSign(sig, s.Entity, bytes.NewReader(data), nil); err != nil {
+		panic(err)
+	}
+	return sig.Bytes()
+}
+
+// ClearSign returns data signed in the cleartext form as in InRelease.
+func (s *Signer) ClearSign(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := clearsign.Encode(buf, s.Entity.PrivateKey, nil)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// Sign adds Release.gpg and InRelease for Release in dir signed by s.
+func (r *Repository) Sign(dir string, s *Signer) {
+	release := r.Get(path.Join(dir, "Release"))
+	r.Put(path.Join(dir, "Release.gpg"), s.DetachSign(release))
+	r.Put(path.Join(dir, "InRelease"), s.ClearSign(release))
+}
@@ -0,0 +1,76 @@
+package mirror
+
+// This file implements a per-host circuit breaker.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrCircuitOpen is returned when downloads from a host are
+	// stopped because of too many consecutive failures.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// circuitBreaker stops requests to a host after threshold
+// consecutive failures.  Once tripped, the breaker stays open
+// until the end of the sync.
+type circuitBreaker struct {
+	threshold int
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// newCircuitBreaker creates circuitBreaker.
+// If threshold is zero or negative, the breaker never trips.
+func newCircuitBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		failures:  make(map[string]int),
+	}
+}
+
+// Allow returns non-nil error if requests to host should be stopped.
+func (b *circuitBreaker) Allow(host string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	n := b.failures[host]
+	b.mu.Unlock()
+
+	if n >= b.threshold {
+		return errors.Wrap(ErrCircuitOpen,
+			fmt.Sprintf("%d consecutive failures for %s", n, host))
+	}
+	return nil
+}
+
+// Success resets the failure count of host unless the breaker is open.
+func (b *circuitBreaker) Success(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	if b.failures[host] < b.threshold {
+		delete(b.failures, host)
+	}
+	b.mu.Unlock()
+}
+
+// Failure records a failure for host.
+func (b *circuitBreaker) Failure(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.failures[host]++
+	b.mu.Unlock()
+}
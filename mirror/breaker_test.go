@@ -0,0 +1,41 @@
+package mirror
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	b := newCircuitBreaker(3)
+	b.Failure("a")
+	b.Failure("a")
+	b.Success("a")
+	b.Failure("a")
+	b.Failure("a")
+	if err := b.Allow("a"); err != nil {
+		t.Error(err)
+	}
+	b.Failure("a")
+	err := b.Allow("a")
+	if errors.Cause(err) != ErrCircuitOpen {
+		t.Error(`errors.Cause(err) != ErrCircuitOpen`)
+	}
+	b.Success("a")
+	if err := b.Allow("a"); err == nil {
+		t.Error(`tripped breaker was reset`)
+	}
+	if err := b.Allow("b"); err != nil {
+		t.Error(err)
+	}
+
+	b = newCircuitBreaker(0)
+	for i := 0; i < 100; i++ {
+		b.Failure("a")
+	}
+	if err := b.Allow("a"); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,19 +2,26 @@ package mirror
 
 import (
 	"errors"
+	"net"
 	"net/url"
 	"path"
 	"strings"
 
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/aptutil/internal/backoff"
 	"github.com/cybozu-go/well"
 )
 
 const (
-	defaultMaxConns = 10
+	defaultMaxConns  = 10
+	defaultGCWorkers = 8
 )
 
 type tomlURL struct {
 	*url.URL
+
+	// ppa is non-empty if the URL is given as "ppa:user/name".
+	ppa string
 }
 
 func (u *tomlURL) UnmarshalText(text []byte) error {
@@ -25,6 +32,14 @@ func (u *tomlURL) UnmarshalText(text []byte) error {
 	switch tu.Scheme {
 	case "http":
 	case "https":
+	case "ppa":
+		user, name, err := parsePPA(string(text))
+		if err != nil {
+			return err
+		}
+		u.URL, err = ppaURL(user, name, defaultDistro)
+		u.ppa = string(text)
+		return err
 	default:
 		return errors.New("unsupported scheme: " + tu.Scheme)
 	}
@@ -46,6 +61,29 @@ type MirrConfig struct {
 	Sections      []string `toml:"sections"`
 	Source        bool     `toml:"mirror_source"`
 	Architectures []string `toml:"architectures"`
+	ByHashSymlink bool     `toml:"by_hash_symlink"`
+	AuthToken     string   `toml:"auth_token"`
+
+	PreferCompression       []string `toml:"prefer_compression"`
+	MaterializeUncompressed bool     `toml:"materialize_uncompressed"`
+
+	// Distro is the distribution name for PPA.  Default is "ubuntu".
+	Distro string `toml:"distro"`
+
+	// Notify is a list of go-apt-cacher notification URLs in the admin
+	// API such as "http://cacher:3143/notify/ubuntu".
+	Notify []string `toml:"notify"`
+
+	// NotifyToken is the admin token of go-apt-cacher sent with
+	// notifications.  This is required if Notify is not empty.
+	NotifyToken string `toml:"notify_token"`
+}
+
+func (mc *MirrConfig) distro() string {
+	if len(mc.Distro) == 0 {
+		return defaultDistro
+	}
+	return mc.Distro
 }
 
 // isFlat returns true if suite ends with "/" as described in
@@ -55,11 +93,30 @@ func isFlat(suite string) bool {
 }
 
 // Check vaildates the configuration.
+//
+// If URL is given as PPA shorthand, Check also expands it
+// for Distro.
 func (mc *MirrConfig) Check() error {
 	if len(mc.Suites) == 0 {
 		return errors.New("no suites")
 	}
 
+	if len(mc.URL.ppa) > 0 {
+		if !validPPAName.MatchString(mc.distro()) {
+			return errors.New("invalid distro: " + mc.Distro)
+		}
+		user, name, err := parsePPA(mc.URL.ppa)
+		if err != nil {
+			return err
+		}
+		mc.URL.URL, err = ppaURL(user, name, mc.distro())
+		if err != nil {
+			return err
+		}
+	} else if len(mc.Distro) > 0 {
+		return errors.New("distro is only for PPA")
+	}
+
 	flat := isFlat(mc.Suites[0])
 	if flat && len(mc.Sections) != 0 {
 		return errors.New("flat repository cannot have sections")
@@ -73,6 +130,27 @@ func (mc *MirrConfig) Check() error {
 		}
 	}
 
+	for _, c := range mc.PreferCompression {
+		switch c {
+		case "none", "gz", "bz2", "xz", "zst", "lzma", "lz4", "lz":
+		default:
+			return errors.New("unsupported compression: " + c)
+		}
+	}
+
+	if len(mc.Notify) > 0 && len(mc.NotifyToken) == 0 {
+		return errors.New("notify_token is required for notify")
+	}
+	for _, n := range mc.Notify {
+		u, err := url.Parse(n)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("unsupported scheme in notify: " + n)
+		}
+	}
+
 	return nil
 }
 
@@ -112,7 +190,23 @@ func rawName(p string) string {
 	return base[0 : len(base)-len(ext)]
 }
 
+// binaryArch returns the architecture of p if p is a path to
+// "<section>/binary-<arch>/Packages".
+func binaryArch(p, section string) (string, bool) {
+	dir, base := path.Split(p)
+	if base != "Packages" {
+		return "", false
+	}
+	dir, bin := path.Split(strings.TrimSuffix(dir, "/"))
+	if !strings.HasPrefix(bin, "binary-") || !strings.HasSuffix(strings.TrimSuffix(dir, "/"), section) {
+		return "", false
+	}
+	return strings.TrimPrefix(bin, "binary-"), true
+}
+
 // MatchingIndex returns true if mc is configured for the given index.
+//
+// Architectures may contain wildcards such as "any" or "linux-any".
 func (mc *MirrConfig) MatchingIndex(p string) bool {
 	rn := rawName(p)
 
@@ -132,15 +226,16 @@ func (mc *MirrConfig) MatchingIndex(p string) bool {
 	}
 
 	pNoExt := p[0 : len(p)-len(path.Ext(p))]
-	var archs []string
-	archs = append(archs, "all")
-	archs = append(archs, mc.Architectures...)
 	for _, section := range mc.Sections {
-		for _, arch := range archs {
-			t := path.Join(path.Clean(section), "binary-"+arch, "Packages")
-			if strings.HasSuffix(pNoExt, t) {
+		if arch, ok := binaryArch(pNoExt, path.Clean(section)); ok {
+			if arch == "all" {
 				return true
 			}
+			for _, spec := range mc.Architectures {
+				if apt.MatchArch(arch, spec) {
+					return true
+				}
+			}
 		}
 		if mc.Source {
 			t := path.Join(path.Clean(section), "source", "Sources")
@@ -163,15 +258,73 @@ func (mc *MirrConfig) MatchingIndex(p string) bool {
 //        ...
 //    }
 type Config struct {
-	Dir      string                 `toml:"dir"`
-	MaxConns int                    `toml:"max_conns"`
-	Log      well.LogConfig         `toml:"log"`
-	Mirrors  map[string]*MirrConfig `toml:"mirror"`
+	Dir                     string                 `toml:"dir"`
+	MaxConns                int                    `toml:"max_conns"`
+	AdaptiveConns           bool                   `toml:"adaptive_conns"`
+	CircuitBreakerThreshold int                    `toml:"circuit_breaker_threshold"`
+	RetryBaseDelay          float64                `toml:"retry_base_delay"`
+	RetryMaxDelay           float64                `toml:"retry_max_delay"`
+	RetryJitter             float64                `toml:"retry_jitter"`
+	DeterministicOrder      bool                   `toml:"deterministic_order"`
+	BindAddress             string                 `toml:"bind_address"`
+	DNSServers              []string               `toml:"dns_servers"`
+	DNSCacheTTL             int                    `toml:"dns_cache_ttl"`
+	AuthFile                string                 `toml:"auth_file"`
+	GCWorkers               int                    `toml:"gc_workers"`
+	DeferGC                 bool                   `toml:"defer_gc"`
+	SnapshotCommand         []string               `toml:"snapshot_command"`
+	StatusAddress           string                 `toml:"status_address"`
+	Log                     well.LogConfig         `toml:"log"`
+	Mirrors                 map[string]*MirrConfig `toml:"mirror"`
 }
 
 // NewConfig creates Config with default values.
 func NewConfig() *Config {
 	return &Config{
-		MaxConns: defaultMaxConns,
+		MaxConns:       defaultMaxConns,
+		GCWorkers:      defaultGCWorkers,
+		RetryBaseDelay: backoff.DefaultBaseDelay,
+		RetryMaxDelay:  backoff.DefaultMaxDelay,
+	}
+}
+
+// LocalAddr returns the local address to dial from as specified
+// by BindAddress.  BindAddress may be an IP address or the name of
+// a network interface.  If BindAddress is empty, nil is returned.
+func (c *Config) LocalAddr() (*net.TCPAddr, error) {
+	if len(c.BindAddress) == 0 {
+		return nil, nil
+	}
+
+	if ip := net.ParseIP(c.BindAddress); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(c.BindAddress)
+	if err != nil {
+		return nil, errors.New("invalid bind_address: " + c.BindAddress)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	// prefer IPv4 addresses
+	var ip6 net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipnet.IP}, nil
+		}
+		if ip6 == nil && !ipnet.IP.IsLinkLocalUnicast() {
+			ip6 = ipnet.IP
+		}
+	}
+	if ip6 != nil {
+		return &net.TCPAddr{IP: ip6}, nil
 	}
+	return nil, errors.New("no usable address on " + c.BindAddress)
 }
@@ -80,6 +80,9 @@ func TestConfig(t *testing.T) {
 			"main", "restricted", "universe"}) {
 			t.Error(`!reflect.DeepEqual(security.Sections)`)
 		}
+		if security.AuthToken != "secret" {
+			t.Error(`security.AuthToken != "secret"`)
+		}
 	}
 }
 
@@ -202,3 +205,120 @@ func TestMirrorConfig(t *testing.T) {
 		t.Error(`mc.MatchingIndex("14.04/Sources")`)
 	}
 }
+
+func TestLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	laddr, err := c.LocalAddr()
+	if err != nil {
+		t.Error(err)
+	}
+	if laddr != nil {
+		t.Error(`laddr != nil`)
+	}
+
+	c.BindAddress = "127.0.0.1"
+	laddr, err = c.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laddr.IP.String() != "127.0.0.1" {
+		t.Error(`laddr.IP.String() != "127.0.0.1"`)
+	}
+
+	c.BindAddress = "no-such-interface0"
+	_, err = c.LocalAddr()
+	if err == nil {
+		t.Error(`err == nil`)
+	}
+}
+
+func TestPPA(t *testing.T) {
+	t.Parallel()
+
+	var mc MirrConfig
+	_, err := toml.Decode(`
+url = "ppa:git-core/ppa"
+distro = "debian"
+suites = ["stretch"]
+sections = ["main"]
+architectures = ["amd64"]
+`, &mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.URL.String() != "https://ppa.launchpadcontent.net/git-core/ppa/ubuntu/" {
+		t.Error(`mc.URL.String() != "https://ppa.launchpadcontent.net/git-core/ppa/ubuntu/"`)
+	}
+	if err := mc.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if mc.URL.String() != "https://ppa.launchpadcontent.net/git-core/ppa/debian/" {
+		t.Error(`mc.URL.String() != "https://ppa.launchpadcontent.net/git-core/ppa/debian/"`)
+	}
+
+	user, name, err := parsePPA("ppa:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "foo" || name != "ppa" {
+		t.Error(`user != "foo" || name != "ppa"`)
+	}
+
+	for _, s := range []string{"ppa:", "ppa:a/b/c", "ppa:Foo/bar", "ppa:foo/../bar"} {
+		if _, _, err := parsePPA(s); err == nil {
+			t.Error(`err == nil for ` + s)
+		}
+	}
+
+	mc.URL = tomlURL{URL: mc.URL.URL}
+	mc.Distro = "debian"
+	if err := mc.Check(); err == nil {
+		t.Error(`distro without PPA should be an error`)
+	}
+}
+
+func TestMatchingIndexWildcard(t *testing.T) {
+	t.Parallel()
+
+	mc := &MirrConfig{
+		Suites:        []string{"buster"},
+		Sections:      []string{"main"},
+		Architectures: []string{"linux-any", "any-i386"},
+	}
+	for p, expected := range map[string]bool{
+		"dists/buster/main/binary-amd64/Packages.xz":               true,
+		"dists/buster/main/binary-arm64/Packages":                  true,
+		"dists/buster/main/binary-all/Packages.gz":                 true,
+		"dists/buster/main/binary-hurd-i386/Packages":              true,
+		"dists/buster/main/binary-kfreebsd-amd64/Packages":         false,
+		"dists/buster/contrib/binary-amd64/Packages":               false,
+		"dists/buster/main/binary-amd64/Contents-amd64":            false,
+		"dists/buster/main/debian-installer/binary-amd64/Packages": false,
+	} {
+		if mc.MatchingIndex(p) != expected {
+			t.Errorf("MatchingIndex(%q) != %v", p, expected)
+		}
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	t.Parallel()
+
+	mc := &MirrConfig{
+		Suites: []string{"stable"},
+		Notify: []string{"http://cacher:3143/notify/ubuntu"},
+	}
+	if err := mc.Check(); err == nil {
+		t.Error(`notify without notify_token should be an error`)
+	}
+	mc.NotifyToken = "secret"
+	if err := mc.Check(); err != nil {
+		t.Error(err)
+	}
+	mc.Notify = []string{"ftp://cacher/notify/ubuntu"}
+	if err := mc.Check(); err == nil {
+		t.Error(`ftp scheme should be an error`)
+	}
+}
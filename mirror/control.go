@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cybozu-go/log"
@@ -20,14 +23,24 @@ func updateMirrors(ctx context.Context, c *Config, mirrors []string) error {
 	t := time.Now()
 
 	var ml []*Mirror
+	keys := newPPAKeys()
 	for _, id := range mirrors {
 		m, err := NewMirror(t, id, c)
 		if err != nil {
 			return err
 		}
+		m.ppaKeys = keys
 		ml = append(ml, m)
 	}
 
+	if len(c.StatusAddress) > 0 {
+		stop, err := serveStatus(c.StatusAddress, ml)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
 	log.Info("update starts", nil)
 
 	// run goroutines in an environment.
@@ -92,7 +105,7 @@ func gc(ctx context.Context, c *Config) error {
 		log.Info("removing old mirror", map[string]interface{}{
 			"path": p,
 		})
-		err := os.RemoveAll(p)
+		err := removeTree(ctx, p, c.GCWorkers)
 		if err != nil {
 			return errors.Wrap(err, "gc")
 		}
@@ -101,43 +114,138 @@ func gc(ctx context.Context, c *Config) error {
 	return nil
 }
 
-// Run starts mirroring.
-//
-// The first thing to do is to acquire flock on the lock file.
+// removeTree removes p and its contents like os.RemoveAll.
 //
-// mirrors is a list of mirror IDs defined in the configuration file
-// (or keys in c.Mirrors).  If mirrors is an empty list, all mirrors
-// will be updated.
-func Run(c *Config, mirrors []string) error {
+// Files are removed by workers goroutines in parallel as snapshots
+// of large archives have millions of files.  Directories are removed
+// after all files are gone.
+func removeTree(ctx context.Context, p string, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var removed int64
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var rmErr error
+	ch := make(chan string, workers*16)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fp := range ch {
+				err := os.Remove(fp)
+				if err != nil && !os.IsNotExist(err) {
+					errOnce.Do(func() { rmErr = err })
+					continue
+				}
+				atomic.AddInt64(&removed, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Info("removing old mirror", map[string]interface{}{
+					"path":    p,
+					"removed": atomic.LoadInt64(&removed),
+				})
+			}
+		}
+	}()
+
+	walkErr := filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- fp:
+		}
+		return nil
+	})
+	close(ch)
+	wg.Wait()
+	close(done)
+
+	if walkErr != nil {
+		return walkErr
+	}
+	if rmErr != nil {
+		return rmErr
+	}
+	return os.RemoveAll(p)
+}
+
+// lock acquires flock on the lock file in c.Dir.
+// The returned function releases the lock.
+func lock(c *Config) (func(), error) {
 	lockFile := filepath.Join(c.Dir, lockFilename)
 	f, err := os.Open(lockFile)
 	switch {
 	case os.IsNotExist(err):
 		f2, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		f = f2
 	case err != nil:
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
 	fl := Flock{f}
 	err = fl.Lock()
+	if err != nil {
+		f.Close()
+		return nil, withClass(ClassLocked, err)
+	}
+	return func() {
+		fl.Unlock()
+		f.Close()
+	}, nil
+}
+
+// Run starts mirroring.
+//
+// The first thing to do is to acquire flock on the lock file.
+//
+// mirrors is a list of mirror IDs defined in the configuration file
+// (or keys in c.Mirrors).  If mirrors is an empty list, all mirrors
+// will be updated.
+//
+// Old mirrors are removed after update unless c.DeferGC is true.
+func Run(c *Config, mirrors []string) error {
+	unlock, err := lock(c)
 	if err != nil {
 		return err
 	}
-	defer fl.Unlock()
+	defer unlock()
 
 	if len(mirrors) == 0 {
 		for id := range c.Mirrors {
 			mirrors = append(mirrors, id)
 		}
+		if c.DeterministicOrder {
+			sort.Strings(mirrors)
+		}
 	}
 
 	well.Go(func(ctx context.Context) error {
 		err := updateMirrors(ctx, c, mirrors)
+		if c.DeferGC {
+			return err
+		}
 		if err != nil {
 			if gcErr := gc(ctx, c); gcErr != nil {
 				err = errors.Wrap(err, gcErr.Error())
@@ -149,3 +257,21 @@ func Run(c *Config, mirrors []string) error {
 	well.Stop()
 	return well.Wait()
 }
+
+// GC removes old mirrors.
+//
+// This is for c.DeferGC; GC can be run separately from Run
+// at a convenient time.
+func GC(c *Config) error {
+	unlock, err := lock(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	well.Go(func(ctx context.Context) error {
+		return gc(ctx, c)
+	})
+	well.Stop()
+	return well.Wait()
+}
@@ -0,0 +1,59 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveTree(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, ".ubuntu.20160101_000000")
+	for i := 0; i < 10; i++ {
+		d := filepath.Join(root, "ubuntu", "pool", fmt.Sprintf("d%d", i))
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			err := ioutil.WriteFile(filepath.Join(d, fmt.Sprintf("f%d", j)), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Symlink("pool", filepath.Join(root, "ubuntu", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = removeTree(context.Background(), root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(root); !os.IsNotExist(err) {
+		t.Error(`root was not removed`)
+	}
+
+	// canceled context
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = removeTree(ctx, root, 4)
+	if err == nil {
+		t.Error(`err == nil`)
+	}
+}
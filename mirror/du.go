@@ -0,0 +1,182 @@
+package mirror
+
+// This file implements disk usage accounting of mirror snapshots.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotUsage is the disk usage of a mirror snapshot.
+type SnapshotUsage struct {
+	// Name is the directory name of the snapshot.
+	Name string
+
+	// Current is true if the snapshot is the one being published.
+	Current bool
+
+	// Size is the number of bytes used by the snapshot.
+	// Hard-linked files are counted once.
+	Size uint64
+
+	// Freeable is the number of bytes that would be freed by
+	// removing the snapshot, i.e. the size of files not hard-linked
+	// from anywhere else.
+	Freeable uint64
+}
+
+// MirrorUsage is the disk usage of a mirror.
+type MirrorUsage struct {
+	// ID is the mirror ID.
+	ID string
+
+	// Size is the number of bytes used by all snapshots.
+	// Files shared between snapshots are counted once.
+	Size uint64
+
+	// Snapshots lists snapshots in chronological order.
+	Snapshots []SnapshotUsage
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+type inodeUsage struct {
+	size  uint64
+	nlink uint64
+	seen  uint64
+}
+
+// walkInodes calls fn for each inode under dir once, with the number
+// of links to the inode found under dir.
+func walkInodes(dir string, fn func(key inodeKey, u *inodeUsage)) error {
+	inodes := make(map[inodeKey]*inodeUsage)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.New("no stat for " + p)
+		}
+		key := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+		u, ok := inodes[key]
+		if !ok {
+			u = &inodeUsage{
+				// like du(1), count allocated blocks.
+				size:  uint64(st.Blocks) * 512,
+				nlink: uint64(st.Nlink),
+			}
+			if !info.Mode().IsRegular() {
+				// directories are not shared between snapshots.
+				u.nlink = 1
+			}
+			inodes[key] = u
+		}
+		u.seen++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, u := range inodes {
+		fn(key, u)
+	}
+	return nil
+}
+
+// snapshotDirs returns snapshot directory names of mirror id
+// in chronological order.
+func snapshotDirs(dir, id string) ([]string, error) {
+	dentries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "." + id + "."
+	var l []string
+	for _, dentry := range dentries {
+		name := dentry.Name()
+		if !dentry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if len(name) != len(prefix)+len(timestampFormat) {
+			continue
+		}
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l, nil
+}
+
+// DiskUsage calculates disk usage of mirrors.
+//
+// mirrors is a list of mirror IDs.  If mirrors is an empty list,
+// all mirrors in c are examined.
+func DiskUsage(c *Config, mirrors []string) ([]MirrorUsage, error) {
+	dir := filepath.Clean(c.Dir)
+
+	if len(mirrors) == 0 {
+		for id := range c.Mirrors {
+			mirrors = append(mirrors, id)
+		}
+	}
+	sort.Strings(mirrors)
+
+	var result []MirrorUsage
+	for _, id := range mirrors {
+		if _, ok := c.Mirrors[id]; !ok {
+			return nil, errors.New("no such mirror: " + id)
+		}
+
+		var current string
+		p, err := filepath.EvalSymlinks(filepath.Join(dir, id))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, errors.Wrap(err, id)
+		default:
+			current = filepath.Base(filepath.Dir(p))
+		}
+
+		names, err := snapshotDirs(dir, id)
+		if err != nil {
+			return nil, errors.Wrap(err, id)
+		}
+
+		mu := MirrorUsage{ID: id}
+		counted := make(map[inodeKey]bool)
+		for _, name := range names {
+			su := SnapshotUsage{
+				Name:    name,
+				Current: name == current,
+			}
+			err := walkInodes(filepath.Join(dir, name), func(key inodeKey, u *inodeUsage) {
+				su.Size += u.size
+				if u.seen >= u.nlink {
+					su.Freeable += u.size
+				}
+				if !counted[key] {
+					counted[key] = true
+					mu.Size += u.size
+				}
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, id)
+			}
+			mu.Snapshots = append(mu.Snapshots, su)
+		}
+		result = append(result, mu)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, ".ubuntu.20160101_000000", "ubuntu")
+	cur := filepath.Join(dir, ".ubuntu.20160102_000000", "ubuntu")
+	for _, d := range []string{old, cur} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := make([]byte, 8192)
+	shared := filepath.Join(old, "shared")
+	if err := ioutil.WriteFile(shared, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(shared, filepath.Join(cur, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(old, "removed"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cur, "added"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(".ubuntu.20160102_000000", "ubuntu"), filepath.Join(dir, "ubuntu")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConfig()
+	c.Dir = dir
+	c.Mirrors = map[string]*MirrConfig{"ubuntu": {}}
+
+	usage, err := DiskUsage(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 {
+		t.Fatal(`len(usage) != 1`)
+	}
+	mu := usage[0]
+	if len(mu.Snapshots) != 2 {
+		t.Fatal(`len(mu.Snapshots) != 2`)
+	}
+
+	so, sc := mu.Snapshots[0], mu.Snapshots[1]
+	if so.Current || !sc.Current {
+		t.Error(`wrong current snapshot`)
+	}
+
+	// fileSize is the allocated size of a data file.
+	fi, err := os.Stat(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSize := uint64(fi.Sys().(*syscall.Stat_t).Blocks) * 512
+	if fileSize == 0 {
+		t.Skip("filesystem does not allocate blocks")
+	}
+
+	if so.Size < 2*fileSize {
+		t.Error(`so.Size < 2*fileSize`)
+	}
+	// shared is not freeable.
+	if so.Freeable >= so.Size || so.Size-so.Freeable != fileSize {
+		t.Error(`wrong so.Freeable`, so.Size, so.Freeable)
+	}
+	if mu.Size != so.Size+sc.Size-fileSize {
+		t.Error(`shared file must be counted once`, mu.Size, so.Size, sc.Size)
+	}
+
+	_, err = DiskUsage(c, []string{"debian"})
+	if err == nil {
+		t.Error(`err == nil for unknown mirror`)
+	}
+}
@@ -0,0 +1,107 @@
+package mirror
+
+// This file implements classification of errors.
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrorClass is a class of errors returned by Run.
+type ErrorClass int
+
+// Error classes.
+const (
+	ClassUnknown  ErrorClass = iota // unclassified errors
+	ClassConfig                     // invalid configurations
+	ClassNetwork                    // network or upstream server failures
+	ClassChecksum                   // checksum mismatch
+	ClassDisk                       // disk full or read-only file system
+	ClassMissing                    // files missing in upstream
+	ClassLocked                     // another go-apt-mirror is running
+)
+
+var classNames = map[ErrorClass]string{
+	ClassUnknown:  "unknown",
+	ClassConfig:   "config",
+	ClassNetwork:  "network",
+	ClassChecksum: "checksum",
+	ClassDisk:     "disk",
+	ClassMissing:  "missing",
+	ClassLocked:   "locked",
+}
+
+func (c ErrorClass) String() string {
+	return classNames[c]
+}
+
+// ExitCode returns the exit code of go-apt-mirror for the class.
+//
+// ClassUnknown is mapped to 1, and other classes to 2 and above.
+func (c ErrorClass) ExitCode() int {
+	return int(c) + 1
+}
+
+// classError is an error with ErrorClass.
+type classError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error for github.com/pkg/errors.
+func (e *classError) Cause() error {
+	return e.err
+}
+
+// withClass annotates err with class.
+func withClass(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class, err}
+}
+
+// Classify returns the class of err.
+//
+// err may be wrapped by github.com/pkg/errors.
+func Classify(err error) ErrorClass {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if ce, ok := err.(*classError); ok {
+			return ce.class
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case net.Error:
+		return ClassNetwork
+	}
+
+	switch err {
+	case syscall.ENOSPC, syscall.EDQUOT, syscall.EROFS:
+		return ClassDisk
+	}
+	if err == ErrCircuitOpen {
+		return ClassNetwork
+	}
+	return ClassUnknown
+}
@@ -0,0 +1,41 @@
+package mirror
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{errors.New("foo"), ClassUnknown},
+		{withClass(ClassConfig, errors.New("bad")), ClassConfig},
+		{errors.Wrap(withClass(ClassChecksum, errors.New("bad")), "ubuntu"), ClassChecksum},
+		{errors.Wrap(&os.PathError{Op: "write", Path: "/x", Err: syscall.ENOSPC}, "store"), ClassDisk},
+		{&os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EROFS}, ClassDisk},
+		{errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("refused")}, "download"), ClassNetwork},
+		{errors.Wrap(ErrCircuitOpen, "5 failures"), ClassNetwork},
+		{statusError(&dlResult{status: 404, path: "a"}), ClassMissing},
+		{statusError(&dlResult{status: 503, path: "a"}), ClassNetwork},
+	}
+	for _, c := range cases {
+		if cl := Classify(c.err); cl != c.class {
+			t.Errorf("Classify(%v) = %s, want %s", c.err, cl, c.class)
+		}
+	}
+
+	if ClassUnknown.ExitCode() != 1 {
+		t.Error(`ClassUnknown.ExitCode() != 1`)
+	}
+	if ClassConfig.ExitCode() != 2 {
+		t.Error(`ClassConfig.ExitCode() != 2`)
+	}
+}
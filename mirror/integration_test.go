@@ -0,0 +1,182 @@
+//go:build integration
+// +build integration
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+var integrationPackages = []repotest.Package{
+	{Name: "hoge", Version: "1.0", Arch: "amd64", Data: []byte("hoge deb")},
+	{Name: "fuga", Version: "2.0-1", Arch: "amd64", Data: []byte("fuga deb")},
+}
+
+// integrationConfig creates Config that stores mirrors in dir.
+// mirror is a TOML fragment defining [mirror.test].
+func integrationConfig(t *testing.T, dir, mirror string) *Config {
+	c := NewConfig()
+	c.Dir = dir
+	c.RetryBaseDelay = 0.01
+	c.RetryMaxDelay = 0.01
+	_, err := toml.Decode(mirror, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func integrationUpdate(t *testing.T, ts time.Time, c *Config) error {
+	m, err := NewMirror(ts, "test", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Update(context.Background())
+}
+
+func checkMirrored(t *testing.T, dir, p string, data []byte) {
+	t.Helper()
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "test", p))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf(`%s: %q != %q`, p, got, data)
+	}
+}
+
+func TestIntegrationByHash(t *testing.T) {
+	t.Parallel()
+
+	repo := repotest.New()
+	repo.AddSuite("stable", true, integrationPackages...)
+	server := httptest.NewServer(repo)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := integrationConfig(t, dir, fmt.Sprintf(`
+[mirror.test]
+url = "%s"
+suites = ["stable"]
+sections = ["main"]
+architectures = ["amd64"]
+`, server.URL))
+
+	now := time.Now()
+	err = integrationUpdate(t, now, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMirrored(t, dir, "dists/stable/Release", repo.Get("dists/stable/Release"))
+	checkMirrored(t, dir, "dists/stable/main/binary-amd64/Packages",
+		repo.Get("dists/stable/main/binary-amd64/Packages"))
+	for _, pkg := range integrationPackages {
+		checkMirrored(t, dir, repotest.PoolPath(pkg), pkg.Data)
+	}
+
+	byhash, err := filepath.Glob(filepath.Join(dir, "test", "dists/stable/main/binary-amd64/by-hash/SHA256/*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byhash) != 2 {
+		t.Error(`len(byhash) != 2`, byhash)
+	}
+
+	// the second update reuses files in the first snapshot.
+	err = integrationUpdate(t, now.Add(time.Second), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range integrationPackages {
+		checkMirrored(t, dir, repotest.PoolPath(pkg), pkg.Data)
+	}
+}
+
+func TestIntegrationFlat(t *testing.T) {
+	t.Parallel()
+
+	repo := repotest.New()
+	repo.AddFlat("flat", integrationPackages...)
+	server := httptest.NewServer(repo)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := integrationConfig(t, dir, fmt.Sprintf(`
+[mirror.test]
+url = "%s/flat/"
+suites = ["/"]
+`, server.URL))
+
+	err = integrationUpdate(t, time.Now(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMirrored(t, dir, "Release", repo.Get("flat/Release"))
+	checkMirrored(t, dir, "Packages.gz", repo.Get("flat/Packages.gz"))
+	for _, pkg := range integrationPackages {
+		checkMirrored(t, dir, fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version, pkg.Arch), pkg.Data)
+	}
+}
+
+func TestIntegrationBroken(t *testing.T) {
+	t.Parallel()
+
+	repo := repotest.New()
+	repo.AddSuite("stable", false, integrationPackages...)
+	repo.Corrupt(repotest.PoolPath(integrationPackages[0]))
+	server := httptest.NewServer(repo)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := integrationConfig(t, dir, fmt.Sprintf(`
+[mirror.test]
+url = "%s"
+suites = ["stable"]
+sections = ["main"]
+architectures = ["amd64"]
+`, server.URL))
+
+	err = integrationUpdate(t, time.Now(), c)
+	if err == nil {
+		t.Fatal(`broken repository must not be mirrored`)
+	}
+	if class := Classify(err); class != ClassChecksum {
+		t.Error(`class != ClassChecksum`, class)
+	}
+
+	// the symlink must not be created.
+	_, err = os.Lstat(filepath.Join(dir, "test"))
+	if !os.IsNotExist(err) {
+		t.Error(`symlink was created`, err)
+	}
+}
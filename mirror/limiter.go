@@ -0,0 +1,166 @@
+package mirror
+
+// This file implements a limiter for concurrent connections.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveInitialConns = 2
+	adaptiveBackoffWait  = 5 * time.Second
+	adaptiveSlowFactor   = 3
+	ewmaWeight           = 0.2
+)
+
+// connLimiter limits the number of concurrent connections.
+//
+// In adaptive mode, the limit starts small and increases one by one
+// while upstream responses are fast and successful.  When an upstream
+// slows down or returns errors, the limit is halved.
+type connLimiter struct {
+	max      int
+	adaptive bool
+
+	mu        sync.Mutex
+	limit     int
+	inUse     int
+	successes int
+	avg       time.Duration // exponentially weighted moving average
+	base      time.Duration // the smallest average ever observed
+	backedOff time.Time
+	notify    chan struct{}
+}
+
+// newConnLimiter creates a connLimiter.
+//
+// max is the maximum number of concurrent connections.
+// If max is zero or negative, the number is not limited.
+func newConnLimiter(max int, adaptive bool) *connLimiter {
+	l := &connLimiter{
+		max:      max,
+		adaptive: adaptive && max > 0,
+		limit:    max,
+		notify:   make(chan struct{}),
+	}
+	if l.adaptive && max > adaptiveInitialConns {
+		l.limit = adaptiveInitialConns
+	}
+	return l
+}
+
+// Acquire waits until a connection is available.
+func (l *connLimiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.max <= 0 || l.inUse < l.limit {
+			l.inUse++
+			l.mu.Unlock()
+			return nil
+		}
+		ch := l.notify
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// Release releases a connection acquired by Acquire.
+func (l *connLimiter) Release() {
+	l.mu.Lock()
+	l.inUse--
+	l.wakeup()
+	l.mu.Unlock()
+}
+
+// wakeup wakes up goroutines waiting in Acquire.
+// l.mu must be locked.
+func (l *connLimiter) wakeup() {
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Report records the result of a request to adjust the limit.
+//
+// latency is the time until the response header was received.
+// ok should be false if the request has failed or the upstream
+// returned a server error.
+func (l *connLimiter) Report(latency time.Duration, ok bool) {
+	if !l.adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slow := false
+	if ok {
+		if l.avg == 0 {
+			l.avg = latency
+		} else {
+			l.avg = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(l.avg))
+		}
+		if l.base == 0 || l.avg < l.base {
+			l.base = l.avg
+		}
+		slow = l.avg > l.base*adaptiveSlowFactor
+	}
+
+	if !ok || slow {
+		l.successes = 0
+		now := time.Now()
+		if now.Sub(l.backedOff) < adaptiveBackoffWait {
+			return
+		}
+		l.backedOff = now
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		if slow {
+			// forget the average to measure the new state.
+			l.avg = 0
+		}
+		return
+	}
+
+	// increase the limit after a round of successful requests.
+	l.successes++
+	if l.successes < l.limit || l.limit >= l.max {
+		return
+	}
+	l.successes = 0
+	l.limit++
+	l.wakeup()
+}
+
+// Limit returns the current limit.
+func (l *connLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// counts returns the number of connections in use and the current limit.
+// If l is nil, zeros are returned.
+func (l *connLimiter) counts() (inUse, limit int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inUse, l.limit
+}
+
+// InUse returns the number of connections in use.
+func (l *connLimiter) InUse() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inUse
+}
@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testLimiterFixed(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(2, false)
+	ctx := context.Background()
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l.InUse() != 2 {
+		t.Error(`l.InUse() != 2`)
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx2); err == nil {
+		t.Error(`acquired more than limit`)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.Acquire(ctx)
+		close(done)
+	}()
+	l.Release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error(`Acquire was not woken up`)
+	}
+
+	l.Report(time.Hour, false)
+	if l.Limit() != 2 {
+		t.Error(`fixed limiter changed its limit`)
+	}
+}
+
+func testLimiterUnlimited(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(0, true)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testLimiterAdaptive(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(10, true)
+	if l.Limit() != adaptiveInitialConns {
+		t.Fatal(`l.Limit() != adaptiveInitialConns`)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Report(10*time.Millisecond, true)
+	}
+	if l.Limit() != 10 {
+		t.Error(`limit did not grow to max`, l.Limit())
+	}
+
+	l.Report(10*time.Millisecond, false)
+	if l.Limit() != 5 {
+		t.Error(`limit was not halved`, l.Limit())
+	}
+
+	// consecutive failures within adaptiveBackoffWait are ignored.
+	l.Report(10*time.Millisecond, false)
+	if l.Limit() != 5 {
+		t.Error(`limit was halved twice`, l.Limit())
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("Fixed", testLimiterFixed)
+	t.Run("Unlimited", testLimiterUnlimited)
+	t.Run("Adaptive", testLimiterAdaptive)
+}
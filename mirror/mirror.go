@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/aptutil/internal/backoff"
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/well"
 	"github.com/pkg/errors"
@@ -25,7 +29,9 @@ const (
 )
 
 var (
-	validID = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	validID          = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	validPPAName     = regexp.MustCompile(`^[a-z0-9][a-z0-9.+_-]*$`)
+	validFingerprint = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
 )
 
 // Mirror implements mirroring logics.
@@ -36,8 +42,23 @@ type Mirror struct {
 	storage *Storage
 	current *Storage
 
-	semaphore chan struct{}
-	client    *http.Client
+	limiter  *connLimiter
+	client   *http.Client
+	stats    *ioStats
+	progress *progress
+	breaker  *circuitBreaker
+	backoff  backoff.Backoff
+	creds    *apt.Credentials
+	ppaKeys  *ppaKeys
+
+	// keyring is the signing key of the PPA, or nil for other mirrors.
+	keyring openpgp.EntityList
+
+	deterministic   bool
+	snapshotCommand []string
+
+	// paths of changed indices to notify go-apt-cacher.
+	changed []string
 }
 
 // NewMirror constructs a Mirror for given mirror id.
@@ -45,15 +66,24 @@ func NewMirror(t time.Time, id string, c *Config) (*Mirror, error) {
 	dir := filepath.Clean(c.Dir)
 	mc, ok := c.Mirrors[id]
 	if !ok {
-		return nil, errors.New("no such mirror: " + id)
+		return nil, withClass(ClassConfig, errors.New("no such mirror: "+id))
 	}
 
 	// sanity checks
 	if !validID.MatchString(id) {
-		return nil, errors.New("invalid id: " + id)
+		return nil, withClass(ClassConfig, errors.New("invalid id: "+id))
 	}
 	if err := mc.Check(); err != nil {
-		return nil, errors.Wrap(err, id)
+		return nil, withClass(ClassConfig, errors.Wrap(err, id))
+	}
+
+	var creds *apt.Credentials
+	if len(c.AuthFile) > 0 {
+		cr, err := apt.LoadCredentials(c.AuthFile)
+		if err != nil {
+			return nil, withClass(ClassConfig, errors.Wrap(err, id))
+		}
+		creds = cr
 	}
 
 	var currentStorage *Storage
@@ -83,11 +113,6 @@ func NewMirror(t time.Time, id string, c *Config) (*Mirror, error) {
 		return nil, errors.Wrap(err, id)
 	}
 
-	sem := make(chan struct{}, c.MaxConns)
-	for i := 0; i < c.MaxConns; i++ {
-		sem <- struct{}{}
-	}
-
 	transport := clonedTransport(http.DefaultTransport)
 	if transport == nil {
 		transport = &http.Transport{
@@ -96,13 +121,48 @@ func NewMirror(t time.Time, id string, c *Config) (*Mirror, error) {
 	}
 	transport.MaxIdleConnsPerHost = c.MaxConns
 
+	laddr, err := c.LocalAddr()
+	if err != nil {
+		return nil, withClass(ClassConfig, errors.Wrap(err, id))
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+		transport.DialContext = dialer.DialContext
+	}
+	if len(c.DNSServers) > 0 || c.DNSCacheTTL > 0 {
+		resolver, err := newCachingResolver(c.DNSServers,
+			time.Duration(c.DNSCacheTTL)*time.Second)
+		if err != nil {
+			return nil, withClass(ClassConfig, errors.Wrap(err, id))
+		}
+		transport.DialContext = resolver.dialContext(dialer)
+	}
+
+	bo, err := backoff.New(c.RetryBaseDelay, c.RetryMaxDelay, c.RetryJitter)
+	if err != nil {
+		return nil, withClass(ClassConfig, errors.Wrap(err, id))
+	}
+
 	mr := &Mirror{
-		id:        id,
-		dir:       dir,
-		mc:        mc,
-		storage:   storage,
-		current:   currentStorage,
-		semaphore: sem,
+		id:       id,
+		dir:      dir,
+		mc:       mc,
+		storage:  storage,
+		current:  currentStorage,
+		limiter:  newConnLimiter(c.MaxConns, c.AdaptiveConns),
+		stats:    newIOStats(),
+		progress: newProgress(),
+		breaker:  newCircuitBreaker(c.CircuitBreakerThreshold),
+		backoff:  bo,
+		creds:    creds,
+		ppaKeys:  newPPAKeys(),
+
+		deterministic:   c.DeterministicOrder,
+		snapshotCommand: c.SnapshotCommand,
 		client: &http.Client{
 			Transport: transport,
 		},
@@ -118,8 +178,29 @@ func clonedTransport(rt http.RoundTripper) *http.Transport {
 	return t.Clone()
 }
 
+// sortFileInfo sorts fil by path, then by checksum.
+func sortFileInfo(fil []*apt.FileInfo) {
+	sort.Slice(fil, func(i, j int) bool {
+		pi, pj := fil[i].Path(), fil[j].Path()
+		if pi != pj {
+			return pi < pj
+		}
+		return fil[i].SHA256Path() < fil[j].SHA256Path()
+	})
+}
+
+// statsSnapshot returns the IO statistics with the connection counts.
+func (m *Mirror) statsSnapshot() ioSnapshot {
+	snap := m.stats.Snapshot()
+	snap.Conns, snap.ConnLimit = m.limiter.counts()
+	return snap
+}
+
 func (m *Mirror) storeLink(fi *apt.FileInfo, fp string, byhash bool) error {
 	if byhash {
+		if m.mc.ByHashSymlink {
+			return m.storage.StoreSymlinkWithHash(fi, fp)
+		}
 		return m.storage.StoreLinkWithHash(fi, fp)
 	}
 	return m.storage.StoreLink(fi, fp)
@@ -140,19 +221,18 @@ func (m *Mirror) extractItems(indices []*apt.FileInfo, indexMap map[string][]*ap
 			return err
 		}
 
-		fil, _, err := apt.ExtractFileInfo(p, f)
-		f.Close()
-		if err != nil {
-			return err
-		}
-
-		for _, fi := range fil {
+		_, err = apt.ExtractFileInfoFunc(p, f, func(fi *apt.FileInfo) error {
 			fipath := fi.Path()
 			if _, ok := indexMap[fipath]; ok {
 				// already included in Release/InRelease
-				continue
+				return nil
 			}
 			itemMap[fipath] = fi
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
 		}
 	}
 	return nil
@@ -181,7 +261,24 @@ func (m *Mirror) replaceLink() error {
 }
 
 // Update updates mirrored files.
-func (m *Mirror) Update(ctx context.Context) error {
+func (m *Mirror) Update(ctx context.Context) (err error) {
+	if m.current != nil {
+		defer m.current.Close()
+	}
+	defer func() {
+		if err != nil {
+			m.progress.setPhase(phaseFailed)
+			return
+		}
+		m.progress.setPhase(phaseSucceeded)
+	}()
+
+	m.progress.setPhase(phaseIndices)
+	err = m.loadPPAKey(ctx)
+	if err != nil {
+		return err
+	}
+
 	itemMap := make(map[string]*apt.FileInfo)
 
 	for _, suite := range m.mc.Suites {
@@ -196,7 +293,8 @@ func (m *Mirror) Update(ctx context.Context) error {
 		"repo":  m.id,
 		"items": len(itemMap),
 	})
-	_, err := m.downloadItems(ctx, itemMap)
+	m.progress.setPhase(phaseItems)
+	_, err = m.downloadItems(ctx, itemMap)
 	if err != nil {
 		return errors.Wrap(err, m.id)
 	}
@@ -205,11 +303,18 @@ func (m *Mirror) Update(ctx context.Context) error {
 	log.Info("saving meta data", map[string]interface{}{
 		"repo": m.id,
 	})
+	m.progress.setPhase(phaseSaving)
 	err = m.storage.Save()
 	if err != nil {
 		return errors.Wrap(err, m.id)
 	}
 
+	m.progress.setPhase(phaseSwitching)
+	err = m.snapshot(ctx)
+	if err != nil {
+		return errors.Wrap(err, m.id)
+	}
+
 	// replace the symlink atomically
 	err = m.replaceLink()
 	if err != nil {
@@ -219,6 +324,10 @@ func (m *Mirror) Update(ctx context.Context) error {
 	log.Info("update succeeded", map[string]interface{}{
 		"repo": m.id,
 	})
+	err = m.notify(ctx)
+	if err != nil {
+		return errors.Wrap(err, m.id)
+	}
 	return nil
 }
 
@@ -241,7 +350,7 @@ func (m *Mirror) updateSuite(ctx context.Context, suite string, itemMap map[stri
 	}
 
 	if len(indexMap) == 0 {
-		return errors.New(m.id + ": found no Release/InRelease")
+		return withClass(ClassMissing, errors.New(m.id+": found no Release/InRelease"))
 	}
 
 	// WORKAROUND: some (zabbix) repositories returns wrong contents
@@ -265,6 +374,23 @@ func (m *Mirror) updateSuite(ctx context.Context, suite string, itemMap map[stri
 	if err != nil {
 		return errors.Wrap(err, m.id)
 	}
+	for _, fi := range indices {
+		m.recordChanged(fi)
+	}
+
+	if len(m.mc.PreferCompression) > 0 {
+		err = m.rewriteRelease(suite, indexMap, indices)
+		if err != nil {
+			return errors.Wrap(err, m.id)
+		}
+	}
+
+	if m.mc.MaterializeUncompressed {
+		err = m.materialize(indices, byhash)
+		if err != nil {
+			return errors.Wrap(err, m.id)
+		}
+	}
 
 	// extract file information from indices
 	err = m.extractItems(indices, indexMap, itemMap, byhash)
@@ -304,13 +430,16 @@ func (m *Mirror) download(ctx context.Context,
 	defer func() {
 		r.tempfile = tempfile
 		ch <- r
-		m.semaphore <- struct{}{}
+		m.limiter.Release()
 	}()
 
 	var retries uint
 	targets := []string{p}
 	if byhash && fi != nil {
 		targets = append(targets, fi.SHA256Path())
+		if sha512p := fi.SHA512Path(); sha512p != "" {
+			targets = append(targets, sha512p)
+		}
 		targets = append(targets, fi.SHA1Path())
 		targets = append(targets, fi.MD5SumPath())
 	}
@@ -330,11 +459,18 @@ RETRY:
 	}
 
 	if retries > 0 {
+		delay := m.backoff.Delay(retries)
 		log.Warn("retrying download", map[string]interface{}{
-			"repo": m.id,
-			"path": p,
+			"repo":  m.id,
+			"path":  p,
+			"delay": delay.Seconds(),
 		})
-		time.Sleep(time.Duration(1<<(retries-1)) * time.Second)
+		select {
+		case <-ctx.Done():
+			r.err = ctx.Err()
+			return
+		case <-time.After(delay):
+		}
 	}
 
 	// imitation apt-get command
@@ -343,6 +479,9 @@ RETRY:
 	header := http.Header{}
 	header.Add("Cache-Control", "max-age=0")
 	header.Add("User-Agent", "Debian APT-HTTP/1.3 (aptutil)")
+	if len(m.mc.AuthToken) > 0 {
+		header.Add("Authorization", "Bearer "+m.mc.AuthToken)
+	}
 
 	req := &http.Request{
 		Method:     "GET",
@@ -352,8 +491,20 @@ RETRY:
 		ProtoMinor: 1,
 		Header:     header,
 	}
+	if len(m.mc.AuthToken) == 0 && m.creds != nil {
+		if login, password, ok := m.creds.Lookup(req.URL); ok {
+			req.SetBasicAuth(login, password)
+		}
+	}
+	if err := m.breaker.Allow(req.URL.Host); err != nil {
+		r.err = err
+		return
+	}
+	start := time.Now()
 	resp, err := m.client.Do(req.WithContext(ctx))
 	if err != nil {
+		m.limiter.Report(time.Since(start), false)
+		m.breaker.Failure(req.URL.Host)
 		if retries < httpRetries {
 			retries++
 			goto RETRY
@@ -372,6 +523,12 @@ RETRY:
 	}
 
 	r.status = resp.StatusCode
+	m.limiter.Report(time.Since(start), r.status < 500)
+	if r.status >= 500 {
+		m.breaker.Failure(req.URL.Host)
+	} else {
+		m.breaker.Success(req.URL.Host)
+	}
 	if r.status >= 500 && retries < httpRetries {
 		retries++
 		goto RETRY
@@ -386,7 +543,7 @@ RETRY:
 		r.err = err
 		return
 	}
-	fi2, err := apt.CopyWithFileInfo(tempfile, resp.Body, p)
+	fi2, err := apt.CopyWithFileInfo(m.stats.Writer(tempfile), m.stats.Reader(resp.Body), p)
 	if err != nil {
 		if retries < httpRetries {
 			retries++
@@ -416,7 +573,7 @@ RETRY:
 			})
 			goto RETRY
 		}
-		r.err = errors.New("invalid checksum for " + p)
+		r.err = withClass(ClassChecksum, errors.New("invalid checksum for "+p))
 		return
 	}
 
@@ -428,6 +585,18 @@ RETRY:
 	r.fi = fi2
 }
 
+// statusError returns a classified error for unexpected HTTP status.
+func statusError(r *dlResult) error {
+	err := fmt.Errorf("status %d for %s", r.status, r.path)
+	if r.status >= 500 {
+		return withClass(ClassNetwork, err)
+	}
+	if r.status >= 400 {
+		return withClass(ClassMissing, err)
+	}
+	return err
+}
+
 func addFileInfoToList(fi *apt.FileInfo, m map[string][]*apt.FileInfo, byhash bool) error {
 	p := fi.Path()
 	fil, ok := m[p]
@@ -444,7 +613,7 @@ func addFileInfoToList(fi *apt.FileInfo, m map[string][]*apt.FileInfo, byhash bo
 
 	// fi differs from all FileInfo in fil
 	if !byhash {
-		return errors.New("inconsistent checksum for " + p)
+		return withClass(ClassChecksum, errors.New("inconsistent checksum for "+p))
 	}
 	m[p] = append(fil, fi)
 	return nil
@@ -466,7 +635,7 @@ func (m *Mirror) handleReleaseResults(results <-chan *dlResult, byhash *bool) ([
 	}
 
 	if r.status != http.StatusOK {
-		return nil, fmt.Errorf("status %d for %s", r.status, r.path)
+		return nil, statusError(r)
 	}
 
 	// 200 OK
@@ -474,6 +643,7 @@ func (m *Mirror) handleReleaseResults(results <-chan *dlResult, byhash *bool) ([
 	if err != nil {
 		return nil, errors.Wrap(err, "storage.Store")
 	}
+	m.recordChanged(r.fi)
 	fil, d, err := apt.ExtractFileInfo(r.path, r.tempfile)
 	if err != nil {
 		return nil, errors.Wrap(err, "ExtractFileInfo: "+r.path)
@@ -491,10 +661,8 @@ func (m *Mirror) downloadRelease(ctx context.Context, suite string) (map[string]
 	results := make(chan *dlResult, len(releases))
 
 	for _, p := range releases {
-		select {
-		case <-ctx.Done():
-			return nil, false, ctx.Err()
-		case <-m.semaphore:
+		if err := m.limiter.Acquire(ctx); err != nil {
+			return nil, false, err
 		}
 
 		go m.download(ctx, p, nil, false, results)
@@ -515,6 +683,13 @@ func (m *Mirror) downloadRelease(ctx context.Context, suite string) (map[string]
 		}
 	}
 
+	if m.keyring != nil {
+		err := m.verifyRelease(suite)
+		if err != nil {
+			return nil, byhash, err
+		}
+	}
+
 	return filMap, byhash, nil
 }
 
@@ -525,12 +700,74 @@ func (m *Mirror) downloadIndices(ctx context.Context,
 		fil = append(fil, fil2...)
 	}
 
+	if m.deterministic {
+		sortFileInfo(fil)
+	}
+
 	log.Info("download other indices", map[string]interface{}{
 		"repo":    m.id,
 		"indices": len(fil),
 	})
 
-	return m.downloadFiles(ctx, fil, true, byhash)
+	if len(m.mc.PreferCompression) > 0 {
+		return m.downloadPreferred(ctx, fil, byhash)
+	}
+	return m.fetchIndices(ctx, fil, byhash)
+}
+
+// fetchIndices downloads (or reuses) indices in fil.
+func (m *Mirror) fetchIndices(ctx context.Context,
+	fil []*apt.FileInfo, byhash bool) ([]*apt.FileInfo, error) {
+
+	// Uncompressed indices are synthesized from their compressed
+	// variants when possible to save bandwidth.
+	others, uncompressed := splitVariants(fil)
+	stored, err := m.downloadFiles(ctx, others, true, byhash)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*apt.FileInfo
+	synthesized := 0
+	for _, fi := range uncompressed {
+		if m.current != nil {
+			if localfi, _ := m.current.Lookup(fi, byhash); localfi != nil {
+				// reuse is cheaper than synthesis.
+				pending = append(pending, fi)
+				continue
+			}
+		}
+
+		fi2, err := m.synthesize(fi, stored, byhash)
+		if err != nil {
+			return nil, err
+		}
+		if fi2 == nil {
+			pending = append(pending, fi)
+			continue
+		}
+		stored = append(stored, fi2)
+		synthesized++
+	}
+
+	if synthesized > 0 {
+		log.Info("synthesized uncompressed indices", map[string]interface{}{
+			"repo":        m.id,
+			"synthesized": synthesized,
+		})
+	}
+
+	if len(pending) > 0 {
+		fil2, err := m.downloadFiles(ctx, pending, true, byhash)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, fil2...)
+		if m.deterministic {
+			sortFileInfo(stored)
+		}
+	}
+	return stored, nil
 }
 
 func (m *Mirror) downloadItems(ctx context.Context,
@@ -539,6 +776,9 @@ func (m *Mirror) downloadItems(ctx context.Context,
 	for _, fi := range fiMap {
 		fil = append(fil, fi)
 	}
+	if m.deterministic {
+		sortFileInfo(fil)
+	}
 	return m.downloadFiles(ctx, fil, false, false)
 }
 
@@ -547,6 +787,7 @@ func (m *Mirror) downloadFiles(ctx context.Context,
 
 	results := make(chan *dlResult, len(fil))
 	var reused, downloaded []*apt.FileInfo
+	m.progress.addTotal(len(fil))
 
 	env := well.NewEnvironment(ctx)
 	env.Go(func(ctx context.Context) error {
@@ -565,15 +806,19 @@ func (m *Mirror) downloadFiles(ctx context.Context,
 		return nil, err
 	}
 
-	log.Info("stats", map[string]interface{}{
+	log.Info("stats", m.statsSnapshot().Fields(map[string]interface{}{
 		"repo":       m.id,
 		"total":      len(fil),
 		"reused":     len(reused),
 		"downloaded": len(downloaded),
-	})
+	}))
 
 	// reused has enough capacity.  See reuseOrDownload.
-	return append(reused, downloaded...), nil
+	fil = append(reused, downloaded...)
+	if m.deterministic {
+		sortFileInfo(fil)
+	}
+	return fil, nil
 }
 
 func (m *Mirror) reuseOrDownload(ctx context.Context, fil []*apt.FileInfo,
@@ -599,12 +844,12 @@ func (m *Mirror) reuseOrDownload(ctx context.Context, fil []*apt.FileInfo,
 		now := time.Now()
 		if now.Sub(loggedAt) > progressInterval {
 			loggedAt = now
-			log.Info("download progress", map[string]interface{}{
+			log.Info("download progress", m.statsSnapshot().Fields(map[string]interface{}{
 				"repo":      m.id,
 				"total":     len(fil),
 				"reused":    len(reused),
 				"downloads": i - len(reused),
-			})
+			}))
 		}
 
 		if m.current != nil {
@@ -615,6 +860,7 @@ func (m *Mirror) reuseOrDownload(ctx context.Context, fil []*apt.FileInfo,
 					return nil, errors.Wrap(err, "storeLink")
 				}
 				reused = append(reused, localfi)
+				m.progress.fileDone()
 				if log.Enabled(log.LvDebug) {
 					log.Debug("reuse item", map[string]interface{}{
 						"repo": m.id,
@@ -625,10 +871,8 @@ func (m *Mirror) reuseOrDownload(ctx context.Context, fil []*apt.FileInfo,
 			}
 		}
 
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-m.semaphore:
+		if err := m.limiter.Acquire(ctx); err != nil {
+			return nil, err
 		}
 
 		env.Go(func(ctx context.Context) error {
@@ -658,7 +902,7 @@ func (m *Mirror) handleResult(r *dlResult, allowMissing, byhash bool) (*apt.File
 	}
 
 	if r.status != http.StatusOK {
-		return nil, fmt.Errorf("status %d for %s", r.status, r.path)
+		return nil, statusError(r)
 	}
 
 	err := m.storeLink(r.fi, r.tempfile.Name(), byhash)
@@ -677,6 +921,7 @@ func (m *Mirror) recvResult(allowMissing, byhash bool, results <-chan *dlResult)
 		if err != nil {
 			return nil, err
 		}
+		m.progress.fileDone()
 		if fi != nil {
 			dlfil = append(dlfil, fi)
 		}
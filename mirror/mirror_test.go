@@ -1,11 +1,16 @@
 package mirror
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/cybozu-go/aptutil/apt"
 )
 
 func TestMirror(t *testing.T) {
@@ -34,3 +39,337 @@ func TestMirror(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSortFileInfo(t *testing.T) {
+	t.Parallel()
+
+	var fil []*apt.FileInfo
+	for _, d := range []struct{ path, data string }{
+		{"b", "1"}, {"a", "2"}, {"c", "3"}, {"a", "1"},
+	} {
+		fi, err := makeFileInfo(d.path, []byte(d.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fil = append(fil, fi)
+	}
+
+	sortFileInfo(fil)
+	for i, p := range []string{"a", "a", "b", "c"} {
+		if fil[i].Path() != p {
+			t.Errorf("fil[%d].Path() != %s", i, p)
+		}
+	}
+	if fil[0].SHA256Path() > fil[1].SHA256Path() {
+		t.Error(`items with the same path are not sorted by checksum`)
+	}
+}
+
+func TestSplitVariants(t *testing.T) {
+	t.Parallel()
+
+	var fil []*apt.FileInfo
+	for _, p := range []string{
+		"main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.gz",
+		"main/binary-amd64/Packages.xz",
+		"main/source/Sources",
+		"main/source/Sources.lz",
+		"main/i18n/Index",
+	} {
+		fi, err := makeFileInfo(p, []byte(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fil = append(fil, fi)
+	}
+
+	others, uncompressed := splitVariants(fil)
+	if len(uncompressed) != 2 {
+		t.Fatal(`len(uncompressed) != 2`)
+	}
+	if uncompressed[0].Path() != "main/binary-amd64/Packages" {
+		t.Error(`uncompressed[0].Path() != "main/binary-amd64/Packages"`)
+	}
+	if uncompressed[1].Path() != "main/source/Sources" {
+		t.Error(`uncompressed[1].Path() != "main/source/Sources"`)
+	}
+	if len(others) != 4 {
+		t.Error(`len(others) != 4`)
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mirror{id: "pre", storage: s, stats: newIOStats()}
+
+	body := []byte("Package: hoge\n")
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(body)
+	gz.Close()
+
+	tempfile, err := s.TempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzfi, err := apt.CopyWithFileInfo(tempfile, buf, "main/Packages.gz")
+	tempfile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.StoreLink(gzfi, tempfile.Name())
+	os.Remove(tempfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad, err := makeFileInfo("main/Packages", []byte("bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := m.synthesize(bad, []*apt.FileInfo{gzfi}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi != nil {
+		t.Error(`synthesized an index with wrong checksum`)
+	}
+
+	good, err := makeFileInfo("main/Packages", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err = m.synthesize(good, []*apt.FileInfo{gzfi}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi == nil {
+		t.Fatal(`fi == nil`)
+	}
+	if found, _ := s.Lookup(good, false); found == nil {
+		t.Error(`synthesized index was not stored`)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mirror{id: "pre", mc: &MirrConfig{}, storage: s, stats: newIOStats()}
+
+	body := []byte("Package: hoge\n")
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(body)
+	gz.Close()
+
+	var stored []*apt.FileInfo
+	for _, p := range []string{"main/binary-amd64/Packages.gz", "main/i18n/Translation-en.gz"} {
+		tempfile, err := s.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := apt.CopyWithFileInfo(tempfile, bytes.NewReader(buf.Bytes()), p)
+		tempfile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.StoreLink(fi, tempfile.Name())
+		os.Remove(tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, fi)
+	}
+
+	err = m.materialize(stored, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := makeFileInfo("main/binary-amd64/Packages", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := s.Lookup(want, false); found == nil {
+		t.Error(`uncompressed Packages was not materialized`)
+	}
+	if _, err := s.Open("main/i18n/Translation-en"); err == nil {
+		t.Error(`Translation-en should not be materialized`)
+	}
+}
+
+func TestRankVariants(t *testing.T) {
+	t.Parallel()
+
+	var fil []*apt.FileInfo
+	for _, p := range []string{
+		"main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.gz",
+		"main/binary-amd64/Packages.xz",
+		"main/source/Sources.bz2",
+		"main/source/Sources.gz",
+		"main/i18n/Index",
+	} {
+		fi, err := makeFileInfo(p, []byte(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fil = append(fil, fi)
+	}
+
+	fixed, groups := rankVariants(fil, []string{"xz", "gz"})
+	if len(fixed) != 1 || fixed[0].Path() != "main/i18n/Index" {
+		t.Error(`fixed must be only main/i18n/Index`)
+	}
+	if len(groups) != 2 {
+		t.Fatal(`len(groups) != 2`)
+	}
+	if len(groups[0]) != 2 {
+		t.Fatal(`len(groups[0]) != 2`)
+	}
+	if groups[0][0][0].Path() != "main/binary-amd64/Packages.xz" {
+		t.Error(`groups[0][0][0].Path() != "main/binary-amd64/Packages.xz"`)
+	}
+	if groups[0][1][0].Path() != "main/binary-amd64/Packages.gz" {
+		t.Error(`groups[0][1][0].Path() != "main/binary-amd64/Packages.gz"`)
+	}
+	if len(groups[1]) != 1 || groups[1][0][0].Path() != "main/source/Sources.gz" {
+		t.Error(`Sources.gz must be the only choice`)
+	}
+
+	fixed, groups = rankVariants(fil, []string{"lzma"})
+	if len(fixed) != len(fil) || len(groups) != 0 {
+		t.Error(`all indices must be fixed`)
+	}
+}
+
+func TestRewriteRelease(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mirror{
+		id:      "pre",
+		mc:      &MirrConfig{PreferCompression: []string{"xz", "gz"}},
+		storage: s,
+		stats:   newIOStats(),
+	}
+
+	store := func(p string, data []byte) *apt.FileInfo {
+		tempfile, err := s.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := apt.CopyWithFileInfo(tempfile, bytes.NewReader(data), p)
+		tempfile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.StoreLink(fi, tempfile.Name())
+		os.Remove(tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	release := `Origin: test
+SHA256:
+ aaaa 10 main/binary-amd64/Packages
+ bbbb 20 main/binary-amd64/Packages.gz
+ cccc 30 main/binary-amd64/Packages.xz
+ dddd 40 main/i18n/Translation-en.bz2
+`
+	store("dists/stable/Release", []byte(release))
+	store("dists/signed/Release", []byte(release))
+	store("dists/signed/InRelease", []byte(release))
+
+	xz, err := makeFileInfo("dists/stable/main/binary-amd64/Packages.xz", []byte("xz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexMap := func(suite string) map[string][]*apt.FileInfo {
+		im := make(map[string][]*apt.FileInfo)
+		for _, p := range []string{
+			"main/binary-amd64/Packages",
+			"main/binary-amd64/Packages.gz",
+			"main/binary-amd64/Packages.xz",
+			"main/i18n/Translation-en.bz2",
+		} {
+			im["dists/"+suite+"/"+p] = nil
+		}
+		return im
+	}
+	err = m.rewriteRelease("stable", indexMap("stable"), []*apt.FileInfo{xz})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := m.readStored("dists/stable/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Origin: test
+SHA256:
+ cccc 30 main/binary-amd64/Packages.xz
+ dddd 40 main/i18n/Translation-en.bz2
+`
+	if string(data) != expected {
+		t.Error(`string(data) != expected`)
+		t.Log(string(data))
+	}
+	fi, err := makeFileInfo("dists/stable/Release", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := s.Lookup(fi, false); found == nil {
+		t.Error(`rewritten Release is not recorded`)
+	}
+
+	// signed Release must be left as is.
+	xz, err = makeFileInfo("dists/signed/main/binary-amd64/Packages.xz", []byte("xz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.rewriteRelease("signed", indexMap("signed"), []*apt.FileInfo{xz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = m.readStored("dists/signed/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != release {
+		t.Error(`signed Release was rewritten`)
+	}
+}
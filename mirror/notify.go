@@ -0,0 +1,96 @@
+package mirror
+
+// This file implements notifications to go-apt-cacher.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	notifyTimeout = 30 * time.Second
+)
+
+// recordChanged records fi as a changed index if it differs from
+// the one in the current mirror.
+func (m *Mirror) recordChanged(fi *apt.FileInfo) {
+	if len(m.mc.Notify) == 0 {
+		return
+	}
+	if m.current != nil {
+		if localfi, _ := m.current.Lookup(fi, false); localfi != nil {
+			return
+		}
+	}
+	m.changed = append(m.changed, fi.Path())
+}
+
+// notify sends paths of changed indices to go-apt-cacher instances.
+//
+// Failures to send notifications are logged but not returned as
+// the mirror has already been updated.  go-apt-cacher will notice
+// the changes eventually.
+func (m *Mirror) notify(ctx context.Context) error {
+	if len(m.mc.Notify) == 0 || len(m.changed) == 0 {
+		return nil
+	}
+
+	sort.Strings(m.changed)
+	body, err := json.Marshal(map[string]interface{}{"paths": m.changed})
+	if err != nil {
+		return errors.Wrap(err, "notify")
+	}
+
+	for _, u := range m.mc.Notify {
+		err := m.postNotification(ctx, u, body)
+		if err != nil {
+			log.Warn("failed to notify go-apt-cacher", map[string]interface{}{
+				"repo":  m.id,
+				"url":   u,
+				"error": err.Error(),
+			})
+			continue
+		}
+		log.Info("notified go-apt-cacher", map[string]interface{}{
+			"repo":    m.id,
+			"url":     u,
+			"changed": len(m.changed),
+		})
+	}
+	return nil
+}
+
+func (m *Mirror) postNotification(ctx context.Context, u string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.mc.NotifyToken)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
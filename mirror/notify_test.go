@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/apt"
+)
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	var got []string
+	cacher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != "/notify/ubuntu" {
+			http.NotFound(w, r)
+			return
+		}
+		var n struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = n.Paths
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer cacher.Close()
+
+	m := &Mirror{
+		id: "ubuntu",
+		mc: &MirrConfig{
+			Notify:      []string{cacher.URL + "/notify/ubuntu"},
+			NotifyToken: "secret",
+		},
+		client: &http.Client{},
+	}
+
+	// nothing changed
+	if err := m.notify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error(`got != nil`, got)
+	}
+
+	m.recordChanged(apt.MakeFileInfoNoChecksum("dists/stable/Release", 10))
+	m.recordChanged(apt.MakeFileInfoNoChecksum("dists/stable/InRelease", 10))
+	if err := m.notify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"dists/stable/InRelease", "dists/stable/Release"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Error(`!reflect.DeepEqual(got, expected)`, got)
+	}
+
+	err := m.postNotification(context.Background(), cacher.URL+"/notify/debian", nil)
+	if err == nil {
+		t.Error(`404 must be an error`)
+	}
+}
@@ -0,0 +1,235 @@
+package mirror
+
+// This file implements PPA (Personal Package Archive) shorthand.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	ppaBaseURL      = "https://ppa.launchpadcontent.net"
+	launchpadAPIURL = "https://api.launchpad.net/1.0"
+	ppaKeyServerURL = "https://keyserver.ubuntu.com"
+	defaultDistro   = "ubuntu"
+)
+
+// parsePPA parses "ppa:user/name" or "ppa:user" and returns
+// the user and archive names.  The archive name defaults to "ppa".
+func parsePPA(s string) (user, name string, err error) {
+	if !strings.HasPrefix(s, "ppa:") {
+		return "", "", errors.New("not a PPA: " + s)
+	}
+	t := strings.Split(s[4:], "/")
+	switch {
+	case len(t) == 1 && validID.MatchString(t[0]):
+		return t[0], "ppa", nil
+	case len(t) == 2 && validID.MatchString(t[0]) && validPPAName.MatchString(t[1]):
+		return t[0], t[1], nil
+	}
+	return "", "", errors.New("invalid PPA: " + s)
+}
+
+// ppaURL returns the repository URL of a PPA.
+func ppaURL(user, name, distro string) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("%s/%s/%s/%s/", ppaBaseURL, user, name, distro))
+}
+
+// ppaKeys fetches signing keys of PPAs.
+//
+// A key is fetched at most once for each PPA so that Launchpad API
+// is called only once in a run even if mirrors share a PPA.
+type ppaKeys struct {
+	apiURL    string
+	keyServer string
+
+	mu   sync.Mutex
+	keys map[string]*ppaKey
+}
+
+type ppaKey struct {
+	once        sync.Once
+	fingerprint string
+	keyring     openpgp.EntityList
+	err         error
+}
+
+func newPPAKeys() *ppaKeys {
+	return &ppaKeys{
+		apiURL:    launchpadAPIURL,
+		keyServer: ppaKeyServerURL,
+		keys:      make(map[string]*ppaKey),
+	}
+}
+
+// get returns the fingerprint and the signing key of a PPA.
+func (pk *ppaKeys) get(ctx context.Context, client *http.Client, user, name, distro string) (string, openpgp.EntityList, error) {
+	id := path.Join(user, name, distro)
+	pk.mu.Lock()
+	k, ok := pk.keys[id]
+	if !ok {
+		k = new(ppaKey)
+		pk.keys[id] = k
+	}
+	pk.mu.Unlock()
+
+	k.once.Do(func() {
+		k.fingerprint, k.err = fetchPPAFingerprint(ctx, client, pk.apiURL, user, name, distro)
+		if k.err != nil {
+			return
+		}
+		k.keyring, k.err = fetchPPAKey(ctx, client, pk.keyServer, k.fingerprint)
+	})
+	return k.fingerprint, k.keyring, k.err
+}
+
+// fetchPPAFingerprint retrieves the fingerprint of the signing key
+// of a PPA through Launchpad API.
+func fetchPPAFingerprint(ctx context.Context, client *http.Client, apiURL, user, name, distro string) (string, error) {
+	u := fmt.Sprintf("%s/~%s/+archive/%s/%s", apiURL, user, distro, name)
+	resp, err := httpGet(ctx, client, u)
+	if err != nil {
+		return "", err
+	}
+	defer closeRespBody(resp)
+
+	var archive struct {
+		Fingerprint string `json:"signing_key_fingerprint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&archive)
+	if err != nil {
+		return "", errors.Wrap(err, u)
+	}
+	if !validFingerprint.MatchString(archive.Fingerprint) {
+		return "", errors.New("no signing key for " + u)
+	}
+	return strings.ToUpper(archive.Fingerprint), nil
+}
+
+// fetchPPAKey retrieves the public key of fingerprint from a key server.
+//
+// As key servers are not trusted, keys other than the one of
+// fingerprint are discarded.
+func fetchPPAKey(ctx context.Context, client *http.Client, keyServer, fingerprint string) (openpgp.EntityList, error) {
+	u := fmt.Sprintf("%s/pks/lookup?op=get&options=mr&search=0x%s", keyServer, fingerprint)
+	resp, err := httpGet(ctx, client, u)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRespBody(resp)
+
+	kr, err := apt.ReadKeyring(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, u)
+	}
+	for _, e := range kr {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint) == fingerprint {
+			return openpgp.EntityList{e}, nil
+		}
+	}
+	return nil, withClass(ClassChecksum, errors.New("no key matches "+fingerprint))
+}
+
+func httpGet(ctx context.Context, client *http.Client, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		closeRespBody(resp)
+		return nil, withClass(ClassNetwork, fmt.Errorf("status %d for %s", resp.StatusCode, u))
+	}
+	return resp, nil
+}
+
+// loadPPAKey fetches the signing key if the mirror is a PPA.
+func (m *Mirror) loadPPAKey(ctx context.Context) error {
+	if len(m.mc.URL.ppa) == 0 {
+		return nil
+	}
+
+	user, name, err := parsePPA(m.mc.URL.ppa)
+	if err != nil {
+		return withClass(ClassConfig, errors.Wrap(err, m.id))
+	}
+	fpr, kr, err := m.ppaKeys.get(ctx, m.client, user, name, m.mc.distro())
+	if err != nil {
+		return errors.Wrap(err, m.id+": PPA signing key")
+	}
+	log.Info("PPA signing key", map[string]interface{}{
+		"repo":        m.id,
+		"ppa":         m.mc.URL.ppa,
+		"fingerprint": fpr,
+	})
+	m.keyring = kr
+	return nil
+}
+
+// verifyRelease verifies InRelease and Release of suite by m.keyring.
+//
+// Both of them must be signed if they exist, and at least one of
+// them must exist.  Compressed variants are rejected as their
+// signatures cannot be verified.
+func (m *Mirror) verifyRelease(suite string) error {
+	verified := false
+	for _, p := range m.mc.ReleaseFiles(suite) {
+		data, err := m.readStored(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch path.Base(p) {
+		case "Release.gpg":
+			continue
+		case "InRelease":
+			_, err = apt.VerifyInRelease(bytes.NewReader(data), m.keyring)
+		case "Release":
+			var sig []byte
+			sig, err = m.readStored(p + ".gpg")
+			if err == nil {
+				_, err = apt.VerifyRelease(bytes.NewReader(data), sig, m.keyring)
+			}
+		default:
+			err = errors.New("signatures of compressed files are not supported")
+		}
+		if err != nil {
+			return withClass(ClassChecksum, errors.Wrap(err, "invalid signature for "+p))
+		}
+		verified = true
+	}
+
+	if !verified {
+		return withClass(ClassMissing, errors.New(m.id+": found no signed Release/InRelease"))
+	}
+	return nil
+}
+
+func (m *Mirror) readStored(p string) ([]byte, error) {
+	f, err := m.storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
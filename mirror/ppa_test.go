@@ -0,0 +1,140 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cybozu-go/aptutil/internal/repotest"
+)
+
+func TestPPAKeys(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+	other := repotest.NewSigner("other")
+	fpr := fmt.Sprintf("%X", signer.Entity.PrimaryKey.Fingerprint)
+
+	var apiCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/~user/+archive/ubuntu/ppa", "/~user/+archive/ubuntu/forged":
+			atomic.AddInt32(&apiCalls, 1)
+			fmt.Fprintf(w, `{"signing_key_fingerprint": "%x"}`, signer.Entity.PrimaryKey.Fingerprint)
+		case "/~user/+archive/ubuntu/unsigned":
+			w.Write([]byte(`{"signing_key_fingerprint": null}`))
+		case "/pks/lookup":
+			if r.URL.Query().Get("search") != "0x"+fpr {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(signer.PublicKey())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	pk := &ppaKeys{
+		apiURL:    server.URL,
+		keyServer: server.URL,
+		keys:      make(map[string]*ppaKey),
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		got, kr, err := pk.get(ctx, server.Client(), "user", "ppa", "ubuntu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != fpr {
+			t.Error(`got != fpr`, got)
+		}
+		if len(kr) != 1 || kr[0].PrimaryKey.KeyId != signer.Entity.PrimaryKey.KeyId {
+			t.Error(`unexpected keyring`, kr)
+		}
+	}
+	if n := atomic.LoadInt32(&apiCalls); n != 1 {
+		t.Error(`Launchpad API must be called once`, n)
+	}
+
+	if _, _, err := pk.get(ctx, server.Client(), "user", "unsigned", "ubuntu"); err == nil {
+		t.Error(`PPA without signing key must be an error`)
+	}
+
+	// key servers may return other keys.
+	forged := &ppaKeys{
+		apiURL: server.URL,
+		keys:   make(map[string]*ppaKey),
+	}
+	ks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(other.PublicKey())
+	}))
+	defer ks.Close()
+	forged.keyServer = ks.URL
+	_, _, err := forged.get(ctx, server.Client(), "user", "forged", "ubuntu")
+	if Classify(err) != ClassChecksum {
+		t.Error(`keys not matching the fingerprint must be rejected`, err)
+	}
+}
+
+func TestVerifyPPARelease(t *testing.T) {
+	t.Parallel()
+
+	signer := repotest.NewSigner("signer")
+	other := repotest.NewSigner("other")
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "ppa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(p string, data []byte) {
+		fp := filepath.Join(d, "ppa", p)
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(suite string, s *repotest.Signer) {
+		release := []byte("Origin: LP-PPA-user\nSuite: " + suite + "\n")
+		put("dists/"+suite+"/Release", release)
+		put("dists/"+suite+"/Release.gpg", s.DetachSign(release))
+		put("dists/"+suite+"/InRelease", s.ClearSign(release))
+	}
+	sign("good", signer)
+	sign("forged", other)
+	sign("unsigned", signer)
+	os.Remove(filepath.Join(d, "ppa", "dists/unsigned/Release.gpg"))
+
+	m := &Mirror{
+		id:      "ppa",
+		mc:      &MirrConfig{},
+		storage: s,
+		keyring: signer.Keyring(),
+	}
+	if err := m.verifyRelease("good"); err != nil {
+		t.Error(err)
+	}
+	if err := m.verifyRelease("forged"); Classify(err) != ClassChecksum {
+		t.Error(`Release signed by other keys must be rejected`, err)
+	}
+	if err := m.verifyRelease("unsigned"); Classify(err) != ClassChecksum {
+		t.Error(`Release without Release.gpg must be rejected`, err)
+	}
+	if err := m.verifyRelease("missing"); Classify(err) != ClassMissing {
+		t.Error(`suite without Release must be an error`, err)
+	}
+}
@@ -0,0 +1,150 @@
+package mirror
+
+// This file implements the live status of mirrors.
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// Phases of Mirror.Update.
+const (
+	phasePending   = "pending"
+	phaseIndices   = "indices"
+	phaseItems     = "items"
+	phaseSaving    = "saving"
+	phaseSwitching = "switching"
+	phaseSucceeded = "succeeded"
+	phaseFailed    = "failed"
+)
+
+// progress tracks the phase and the number of processed files.
+type progress struct {
+	// int64 fields must come first for atomic operations on 32bit systems.
+	done  int64
+	total int64
+
+	mu          sync.Mutex
+	phase       string
+	phaseAt     time.Time
+	lastAt      time.Time
+	lastWritten int64
+}
+
+func newProgress() *progress {
+	now := time.Now()
+	return &progress{
+		phase:   phasePending,
+		phaseAt: now,
+		lastAt:  now,
+	}
+}
+
+// setPhase changes the phase and resets file counters.
+func (p *progress) setPhase(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.phaseAt = time.Now()
+	atomic.StoreInt64(&p.done, 0)
+	atomic.StoreInt64(&p.total, 0)
+	p.mu.Unlock()
+}
+
+// addTotal adds n files to be processed in the current phase.
+func (p *progress) addTotal(n int) {
+	atomic.AddInt64(&p.total, int64(n))
+}
+
+// fileDone counts a processed (downloaded or reused) file.
+func (p *progress) fileDone() {
+	atomic.AddInt64(&p.done, 1)
+}
+
+// MirrorStatus is the live status of a mirror being updated.
+type MirrorStatus struct {
+	ID         string    `json:"id"`
+	Phase      string    `json:"phase"`
+	PhaseSince time.Time `json:"phase_since"`
+	FilesDone  int64     `json:"files_done"`
+	FilesTotal int64     `json:"files_total"`
+	ioSnapshot
+}
+
+// Status returns the live status of m.
+//
+// Rate is calculated from bytes written since the last call.
+func (m *Mirror) Status() MirrorStatus {
+	snap := m.stats.peek()
+	snap.Conns, snap.ConnLimit = m.limiter.counts()
+
+	p := m.progress
+	p.mu.Lock()
+	snap.Rate = rate(&p.lastAt, &p.lastWritten, snap.BytesWritten)
+	st := MirrorStatus{
+		ID:         m.id,
+		Phase:      p.phase,
+		PhaseSince: p.phaseAt,
+		FilesDone:  atomic.LoadInt64(&p.done),
+		FilesTotal: atomic.LoadInt64(&p.total),
+		ioSnapshot: snap,
+	}
+	p.mu.Unlock()
+	return st
+}
+
+// statusHandler serves the status of mirrors in JSON.
+type statusHandler []*Mirror
+
+func (h statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := make([]MirrorStatus, 0, len(h))
+	for _, m := range h {
+		st = append(st, m.Status())
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].ID < st[j].ID })
+
+	data, err := json.Marshal(map[string]interface{}{"mirrors": st})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveStatus starts an HTTP server to report the status of ml.
+// The returned function stops the server.
+func serveStatus(addr string, ml []*Mirror) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, withClass(ClassConfig, errors.Wrap(err, "status_address"))
+	}
+
+	srv := &http.Server{
+		Handler:     statusHandler(ml),
+		ReadTimeout: 30 * time.Second,
+	}
+	go srv.Serve(ln)
+
+	log.Info("serving status", map[string]interface{}{
+		"address": ln.Addr().String(),
+	})
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusHandler(t *testing.T) {
+	t.Parallel()
+
+	m1 := &Mirror{
+		id:       "ubuntu",
+		limiter:  newConnLimiter(4, false),
+		stats:    newIOStats(),
+		progress: newProgress(),
+	}
+	m2 := &Mirror{id: "debian", stats: newIOStats(), progress: newProgress()}
+
+	m1.progress.setPhase(phaseItems)
+	m1.progress.addTotal(3)
+	m1.progress.fileDone()
+	m1.progress.fileDone()
+	if err := m1.limiter.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	statusHandler{m1, m2}.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(`w.Code != http.StatusOK`, w.Code)
+	}
+
+	var st struct {
+		Mirrors []MirrorStatus `json:"mirrors"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Mirrors) != 2 {
+		t.Fatal(`len(st.Mirrors) != 2`, len(st.Mirrors))
+	}
+
+	if st.Mirrors[0].ID != "debian" {
+		t.Error(`st.Mirrors[0].ID != "debian"`, st.Mirrors[0].ID)
+	}
+	if st.Mirrors[0].Phase != phasePending {
+		t.Error(`st.Mirrors[0].Phase != phasePending`, st.Mirrors[0].Phase)
+	}
+
+	s := st.Mirrors[1]
+	if s.Phase != phaseItems {
+		t.Error(`s.Phase != phaseItems`, s.Phase)
+	}
+	if s.FilesDone != 2 {
+		t.Error(`s.FilesDone != 2`, s.FilesDone)
+	}
+	if s.FilesTotal != 3 {
+		t.Error(`s.FilesTotal != 3`, s.FilesTotal)
+	}
+	if s.Conns != 1 {
+		t.Error(`s.Conns != 1`, s.Conns)
+	}
+	if s.ConnLimit != 4 {
+		t.Error(`s.ConnLimit != 4`, s.ConnLimit)
+	}
+	if st.Mirrors[0].Conns != 0 {
+		t.Error(`st.Mirrors[0].Conns != 0`, st.Mirrors[0].Conns)
+	}
+
+	fields := m1.statsSnapshot().Fields(map[string]interface{}{})
+	if fields["conns"] != 1 || fields["conn_limit"] != 4 {
+		t.Error(`connection counts are not in log fields`, fields)
+	}
+
+	m1.progress.setPhase(phaseSaving)
+	if s := m1.Status(); s.FilesDone != 0 || s.FilesTotal != 0 {
+		t.Error(`counters must be reset`, s.FilesDone, s.FilesTotal)
+	}
+}
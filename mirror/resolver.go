@@ -0,0 +1,144 @@
+package mirror
+
+// This file implements a caching DNS resolver for downloads.
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+type resolverEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// cachingResolver resolves host names with optional custom DNS servers
+// and caches the results for a given period.
+//
+// If a lookup fails after the cached entry has expired, the stale
+// entry is used so that long running syncs are not interrupted by
+// transient DNS failures.
+type cachingResolver struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*resolverEntry
+}
+
+// newCachingResolver creates cachingResolver.
+//
+// servers is a list of DNS server addresses.  If a server address
+// lacks a port number, 53 is used.  If servers is empty, the system
+// resolver is used.
+func newCachingResolver(servers []string, ttl time.Duration) (*cachingResolver, error) {
+	r := &cachingResolver{
+		resolver: net.DefaultResolver,
+		ttl:      ttl,
+		cache:    make(map[string]*resolverEntry),
+	}
+	if len(servers) == 0 {
+		return r, nil
+	}
+
+	addrs := make([]string, len(servers))
+	for i, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, _ := net.SplitHostPort(s)
+		if net.ParseIP(host) == nil {
+			return nil, errors.New("invalid DNS server address: " + servers[i])
+		}
+		addrs[i] = s
+	}
+
+	var next uint32
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			var err error
+			n := atomic.AddUint32(&next, 1)
+			for i := range addrs {
+				var conn net.Conn
+				conn, err = d.DialContext(ctx, network, addrs[(int(n)+i)%len(addrs)])
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+	return r, nil
+}
+
+// LookupIPAddr looks up host and returns its IP addresses.
+func (r *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ok {
+			log.Warn("DNS lookup failed; use stale addresses", map[string]interface{}{
+				"host":  host,
+				"error": err.Error(),
+			})
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[host] = &resolverEntry{
+			addrs:   addrs,
+			expires: now.Add(r.ttl),
+		}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// dialContext returns a function for http.Transport.DialContext that
+// resolves host names using r and dials with d.
+func (r *cachingResolver) dialContext(d *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range addrs {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if err == nil {
+			err = errors.New("no address for " + host)
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,43 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	_, err := newCachingResolver([]string{"dns.example.com"}, 0)
+	if err == nil {
+		t.Error(`host names must be rejected`)
+	}
+
+	r, err := newCachingResolver([]string{"127.0.0.1", "[::1]:5353"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	addrs, err := r.LookupIPAddr(ctx, "192.168.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "192.168.0.1" {
+		t.Error(`IP address was not returned as is`)
+	}
+
+	r.cache["example.com"] = &resolverEntry{
+		addrs:   []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}},
+		expires: time.Now().Add(time.Minute),
+	}
+	addrs, err = r.LookupIPAddr(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "10.1.2.3" {
+		t.Error(`cached entry was not used`)
+	}
+}
@@ -0,0 +1,59 @@
+package mirror
+
+// This file implements the hook to take file system snapshots.
+
+import (
+	"context"
+	"os"
+	"os/exec"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// Environment variables passed to snapshot_command.
+const (
+	snapshotEnvID      = "APT_MIRROR_ID"
+	snapshotEnvDir     = "APT_MIRROR_DIR"
+	snapshotEnvCurrent = "APT_MIRROR_CURRENT"
+	snapshotEnvNew     = "APT_MIRROR_NEW"
+)
+
+// snapshot runs snapshot_command, if configured, just before the
+// symlink is switched to the new mirror.
+//
+// If the command fails, the update is aborted so that the symlink
+// keeps pointing to the previous mirror.
+func (m *Mirror) snapshot(ctx context.Context) error {
+	if len(m.snapshotCommand) == 0 {
+		return nil
+	}
+
+	var current string
+	if m.current != nil {
+		current = m.current.Dir()
+	}
+
+	cmd := exec.CommandContext(ctx, m.snapshotCommand[0], m.snapshotCommand[1:]...)
+	cmd.Env = append(os.Environ(),
+		snapshotEnvID+"="+m.id,
+		snapshotEnvDir+"="+m.dir,
+		snapshotEnvCurrent+"="+current,
+		snapshotEnvNew+"="+m.storage.Dir(),
+	)
+
+	log.Info("taking snapshot", map[string]interface{}{
+		"repo":    m.id,
+		"command": m.snapshotCommand[0],
+	})
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Error("snapshot command failed", map[string]interface{}{
+			"repo":   m.id,
+			"error":  err.Error(),
+			"output": string(out),
+		})
+		return errors.Wrap(err, "snapshot_command")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mirror{id: "pre", dir: d, storage: s}
+
+	// no command
+	if err := m.snapshot(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	m.snapshotCommand = []string{"sh", "-c",
+		`echo "$APT_MIRROR_ID:$APT_MIRROR_CURRENT" > "$APT_MIRROR_DIR/hook"`}
+	if err := m.snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d, "hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pre:\n" {
+		t.Error(`string(data) != "pre:\n"`, string(data))
+	}
+
+	m.snapshotCommand = []string{"false"}
+	if err := m.snapshot(context.Background()); err == nil {
+		t.Error(`failed command must be an error`)
+	}
+}
@@ -0,0 +1,125 @@
+package mirror
+
+// This file implements IO statistics of downloads.
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ioStats accumulates IO statistics of downloads.
+//
+// Time spent in reading from upstream and writing to local disk are
+// measured separately so that operators can tell whether a slow sync
+// is network-bound or disk-bound.
+type ioStats struct {
+	// int64 fields must come first for atomic operations on 32bit systems.
+	bytesRead    int64
+	bytesWritten int64
+	readNanos    int64
+	writeNanos   int64
+
+	mu          sync.Mutex
+	lastAt      time.Time
+	lastWritten int64
+}
+
+func newIOStats() *ioStats {
+	return &ioStats{
+		lastAt: time.Now(),
+	}
+}
+
+// Reader returns an io.Reader that counts bytes and time of r.
+func (s *ioStats) Reader(r io.Reader) io.Reader {
+	return statsReader{r, s}
+}
+
+// Writer returns an io.Writer that counts bytes and time of w.
+func (s *ioStats) Writer(w io.Writer) io.Writer {
+	return statsWriter{w, s}
+}
+
+// ioSnapshot is a snapshot of ioStats.
+type ioSnapshot struct {
+	BytesRead    int64   `json:"bytes_read"`
+	BytesWritten int64   `json:"bytes_written"`
+	NetWait      float64 `json:"net_wait_seconds"`
+	DiskWait     float64 `json:"disk_wait_seconds"`
+	Rate         float64 `json:"mb_per_second"`
+	Conns        int     `json:"conns"`
+	ConnLimit    int     `json:"conn_limit"`
+}
+
+// Snapshot returns the current statistics.
+//
+// Rate is calculated from bytes written since the last call.
+func (s *ioStats) Snapshot() ioSnapshot {
+	snap := s.peek()
+	s.mu.Lock()
+	snap.Rate = rate(&s.lastAt, &s.lastWritten, snap.BytesWritten)
+	s.mu.Unlock()
+	return snap
+}
+
+// peek returns the current statistics without Rate.
+func (s *ioStats) peek() ioSnapshot {
+	return ioSnapshot{
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+		NetWait:      time.Duration(atomic.LoadInt64(&s.readNanos)).Seconds(),
+		DiskWait:     time.Duration(atomic.LoadInt64(&s.writeNanos)).Seconds(),
+	}
+}
+
+// rate calculates MiB/s from *lastAt and *lastWritten, then updates them.
+func rate(lastAt *time.Time, lastWritten *int64, written int64) float64 {
+	var r float64
+	now := time.Now()
+	if elapsed := now.Sub(*lastAt).Seconds(); elapsed > 0 {
+		r = float64(written-*lastWritten) / elapsed / (1 << 20)
+	}
+	*lastAt = now
+	*lastWritten = written
+	return r
+}
+
+// Fields returns the snapshot as log fields.
+func (snap ioSnapshot) Fields(fields map[string]interface{}) map[string]interface{} {
+	fields["bytes_read"] = snap.BytesRead
+	fields["bytes_written"] = snap.BytesWritten
+	fields["net_wait_seconds"] = snap.NetWait
+	fields["disk_wait_seconds"] = snap.DiskWait
+	fields["mb_per_second"] = snap.Rate
+	fields["conns"] = snap.Conns
+	fields["conn_limit"] = snap.ConnLimit
+	return fields
+}
+
+type statsReader struct {
+	r io.Reader
+	s *ioStats
+}
+
+func (sr statsReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := sr.r.Read(p)
+	atomic.AddInt64(&sr.s.readNanos, int64(time.Since(start)))
+	atomic.AddInt64(&sr.s.bytesRead, int64(n))
+	return n, err
+}
+
+type statsWriter struct {
+	w io.Writer
+	s *ioStats
+}
+
+func (sw statsWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := sw.w.Write(p)
+	atomic.AddInt64(&sw.s.writeNanos, int64(time.Since(start)))
+	atomic.AddInt64(&sw.s.bytesWritten, int64(n))
+	return n, err
+}
@@ -0,0 +1,43 @@
+package mirror
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestIOStats(t *testing.T) {
+	t.Parallel()
+
+	s := newIOStats()
+	w := new(bytes.Buffer)
+	_, err := io.Copy(s.Writer(w), s.Reader(strings.NewReader("hello world")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "hello world" {
+		t.Error(`w.String() != "hello world"`)
+	}
+
+	snap := s.Snapshot()
+	if snap.BytesRead != 11 {
+		t.Error(`snap.BytesRead != 11`)
+	}
+	if snap.BytesWritten != 11 {
+		t.Error(`snap.BytesWritten != 11`)
+	}
+	if snap.Rate <= 0 {
+		t.Error(`snap.Rate <= 0`)
+	}
+
+	snap = s.Snapshot()
+	if snap.Rate != 0 {
+		t.Error(`snap.Rate != 0`)
+	}
+
+	fields := snap.Fields(map[string]interface{}{"repo": "test"})
+	if fields["bytes_written"] != int64(11) {
+		t.Error(`fields["bytes_written"] != 11`)
+	}
+}
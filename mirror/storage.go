@@ -6,24 +6,44 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
 	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
-	infoJSON = "info.json"
+	infoDB   = "info.db"
+	infoJSON = "info.json" // legacy format
+
+	flushThreshold = 1000
+)
+
+var (
+	infoBucket = []byte("info")
 )
 
+type infoRecord struct {
+	path string
+	fi   *apt.FileInfo
+}
+
 // Storage manages a directory tree that mirrors a Debian repository.
 //
-// Storage also keeps checksum information for stored files.
+// Storage also keeps checksum information for stored files in an
+// embedded database.  Stored information is written to the database
+// incrementally, and Storage loaded by Load looks up the database
+// on demand instead of reading everything up front.
 type Storage struct {
 	dir    string
 	prefix string
 
-	mu   sync.RWMutex
-	info map[string]*apt.FileInfo
+	mu      sync.RWMutex
+	info    map[string]*apt.FileInfo
+	pending []infoRecord
+	db      *bolt.DB
 }
 
 // NewStorage constructs Storage.
@@ -57,7 +77,29 @@ func (s *Storage) Dir() string {
 }
 
 // Load loads existing directory contents.
+//
+// If the directory has the database, it is opened read-only.
+// Otherwise, info.json written by older versions is read if exists.
 func (s *Storage) Load() error {
+	dbPath := filepath.Join(s.dir, infoDB)
+	_, err := os.Stat(dbPath)
+	switch {
+	case err == nil:
+		db, err := bolt.Open(dbPath, 0644, &bolt.Options{
+			ReadOnly: true,
+			Timeout:  time.Second,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Storage.Load: "+dbPath)
+		}
+		s.mu.Lock()
+		s.db = db
+		s.mu.Unlock()
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
 	infoPath := filepath.Join(s.dir, infoJSON)
 
 	f, err := os.Open(infoPath)
@@ -85,25 +127,67 @@ func (s *Storage) TempFile() (*os.File, error) {
 	return ioutil.TempFile(s.dir, "_tmp")
 }
 
+// record records fi for p.  s.mu must be locked.
+func (s *Storage) record(p string, fi *apt.FileInfo) error {
+	s.info[p] = fi
+	s.pending = append(s.pending, infoRecord{p, fi})
+	if len(s.pending) < flushThreshold {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush writes pending records into the database.  s.mu must be locked.
+func (s *Storage) flush() error {
+	if s.db == nil {
+		db, err := bolt.Open(filepath.Join(s.dir, infoDB), 0644, &bolt.Options{
+			Timeout: time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		s.db = db
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(infoBucket)
+		if err != nil {
+			return err
+		}
+		for _, r := range s.pending {
+			data, err := json.Marshal(r.fi)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(r.path), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Storage.flush")
+	}
+	s.pending = nil
+	return nil
+}
+
 // Save saves storage contents persistently.
 func (s *Storage) Save() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	infoPath := filepath.Join(s.dir, infoJSON)
-	f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	err := s.flush()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	enc := json.NewEncoder(f)
-	err = enc.Encode(s.info)
+	err = s.db.Close()
+	s.db = nil
 	if err != nil {
 		return err
 	}
 
-	f.Sync()
 	err = DirSyncTree(s.dir)
 	if err != nil {
 		return errors.Wrap(err, "DirSyncTree(s.dir)")
@@ -112,6 +196,85 @@ func (s *Storage) Save() error {
 	return nil
 }
 
+// Close closes the database opened by Load.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// get returns FileInfo for p.  s.mu must be read-locked.
+func (s *Storage) get(p string) *apt.FileInfo {
+	if fi, ok := s.info[p]; ok {
+		return fi
+	}
+	if s.db == nil || !s.db.IsReadOnly() {
+		return nil
+	}
+
+	var fi *apt.FileInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(infoBucket)
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(p))
+		if data == nil {
+			return nil
+		}
+		fi = new(apt.FileInfo)
+		return json.Unmarshal(data, fi)
+	})
+	if err != nil {
+		log.Warn("Storage.get", map[string]interface{}{
+			"path":  p,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	return fi
+}
+
+// Walk calls fn for each stored file with its path and info.
+// Walk stops and returns the error if fn returns an error.
+func (s *Storage) Walk(fn func(p string, fi *apt.FileInfo) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for p, fi := range s.info {
+		if err := fn(p, fi); err != nil {
+			return err
+		}
+	}
+	if s.db == nil || !s.db.IsReadOnly() {
+		return nil
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(infoBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			p := string(k)
+			if _, ok := s.info[p]; ok {
+				return nil
+			}
+			fi := new(apt.FileInfo)
+			if err := json.Unmarshal(v, fi); err != nil {
+				return errors.Wrap(err, "Storage.Walk: "+p)
+			}
+			return fn(p, fi)
+		})
+	})
+}
+
 // StoreLink stores a hard link to a file into this storage.
 func (s *Storage) StoreLink(fi *apt.FileInfo, fullpath string) error {
 	p := fi.Path()
@@ -122,13 +285,16 @@ func (s *Storage) StoreLink(fi *apt.FileInfo, fullpath string) error {
 		s.mu.Unlock()
 		return errors.New("already stored: " + p)
 	}
-	s.info[p] = fi
+	err := s.record(p, fi)
 	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	fp := filepath.Join(s.dir, s.prefix, filepath.Clean(p))
 	d := filepath.Dir(fp)
 
-	err := os.MkdirAll(d, 0755)
+	err = os.MkdirAll(d, 0755)
 	if err != nil {
 		return err
 	}
@@ -136,6 +302,30 @@ func (s *Storage) StoreLink(fi *apt.FileInfo, fullpath string) error {
 	return os.Link(fullpath, fp)
 }
 
+// Replace replaces a file already stored with a hard link to fullpath.
+func (s *Storage) Replace(fi *apt.FileInfo, fullpath string) error {
+	p := fi.Path()
+
+	s.mu.Lock()
+	_, ok := s.info[p]
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("not stored: " + p)
+	}
+	err := s.record(p, fi)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fp := filepath.Join(s.dir, s.prefix, filepath.Clean(p))
+	err = os.Remove(fp)
+	if err != nil {
+		return err
+	}
+	return os.Link(fullpath, fp)
+}
+
 // StoreLinkWithHash stores a hard link to a file into this storage
 // with additional hard links for by-hash retrieval.
 func (s *Storage) StoreLinkWithHash(fi *apt.FileInfo, fullpath string) error {
@@ -143,20 +333,23 @@ func (s *Storage) StoreLinkWithHash(fi *apt.FileInfo, fullpath string) error {
 	md5p := fi.MD5SumPath()
 	sha1p := fi.SHA1Path()
 	sha256p := fi.SHA256Path()
-	fpl := []string{
-		filepath.Join(s.dir, s.prefix, filepath.Clean(p)),
-		filepath.Join(s.dir, s.prefix, filepath.Clean(md5p)),
-		filepath.Join(s.dir, s.prefix, filepath.Clean(sha1p)),
-		filepath.Join(s.dir, s.prefix, filepath.Clean(sha256p)),
+	hashPaths := []string{md5p, sha1p, sha256p}
+	if sha512p := fi.SHA512Path(); sha512p != "" {
+		hashPaths = append(hashPaths, sha512p)
+	}
+	fpl := []string{filepath.Join(s.dir, s.prefix, filepath.Clean(p))}
+	for _, hp := range hashPaths {
+		fpl = append(fpl, filepath.Join(s.dir, s.prefix, filepath.Clean(hp)))
 	}
 
 	s.mu.Lock()
+	var err error
 	_, ok := s.info[p]
 	if ok {
 		// ignore the canonical path because another file was already stored.
 		fpl = fpl[1:]
 	} else {
-		s.info[p] = fi
+		err = s.record(p, fi)
 	}
 
 	// This may overwrite existing entries in s.info if another item
@@ -166,10 +359,15 @@ func (s *Storage) StoreLinkWithHash(fi *apt.FileInfo, fullpath string) error {
 	//
 	// Although we may fix the problem in Storage.Lookup, at this point
 	// we leave it as it is not too bad.
-	s.info[md5p] = fi
-	s.info[sha1p] = fi
-	s.info[sha256p] = fi
+	for _, hp := range hashPaths {
+		if err == nil {
+			err = s.record(hp, fi)
+		}
+	}
 	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "StoreLinkWithHash")
+	}
 
 	for _, fp := range fpl {
 		d := filepath.Dir(fp)
@@ -185,6 +383,78 @@ func (s *Storage) StoreLinkWithHash(fi *apt.FileInfo, fullpath string) error {
 	return nil
 }
 
+// StoreSymlinkWithHash stores a hard link to a file into this storage
+// with additional relative symbolic links for by-hash retrieval.
+//
+// If the canonical path is already occupied by another file, the body
+// is stored at the SHA256 by-hash path and other by-hash entries are
+// made to point to it.
+func (s *Storage) StoreSymlinkWithHash(fi *apt.FileInfo, fullpath string) error {
+	p := fi.Path()
+	md5p := fi.MD5SumPath()
+	sha1p := fi.SHA1Path()
+	sha256p := fi.SHA256Path()
+	sha512p := fi.SHA512Path()
+
+	s.mu.Lock()
+	var err error
+	target := p
+	links := []string{md5p, sha1p, sha256p}
+	if _, ok := s.info[p]; ok {
+		target = sha256p
+		links = []string{md5p, sha1p}
+	} else {
+		err = s.record(p, fi)
+	}
+	hashPaths := []string{md5p, sha1p, sha256p}
+	if sha512p != "" {
+		links = append(links, sha512p)
+		hashPaths = append(hashPaths, sha512p)
+	}
+	for _, hp := range hashPaths {
+		if err == nil {
+			err = s.record(hp, fi)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "StoreSymlinkWithHash")
+	}
+
+	fullpath, err = filepath.EvalSymlinks(fullpath)
+	if err != nil {
+		return errors.Wrap(err, "StoreSymlinkWithHash: "+fullpath)
+	}
+
+	tp := filepath.Join(s.dir, s.prefix, filepath.Clean(target))
+	err = os.MkdirAll(filepath.Dir(tp), 0755)
+	if err != nil {
+		return errors.Wrap(err, "StoreSymlinkWithHash: "+tp)
+	}
+	err = os.Link(fullpath, tp)
+	if err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "StoreSymlinkWithHash: "+tp)
+	}
+
+	for _, l := range links {
+		fp := filepath.Join(s.dir, s.prefix, filepath.Clean(l))
+		d := filepath.Dir(fp)
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return errors.Wrap(err, "StoreSymlinkWithHash: "+fp)
+		}
+		rel, err := filepath.Rel(d, tp)
+		if err != nil {
+			return errors.Wrap(err, "StoreSymlinkWithHash: "+fp)
+		}
+		err = os.Symlink(rel, fp)
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "StoreSymlinkWithHash: "+fp)
+		}
+	}
+	return nil
+}
+
 // Lookup looks up a file in this storage.
 //
 // If a file matching fi exists, its info and full path is returned.
@@ -194,8 +464,8 @@ func (s *Storage) Lookup(fi *apt.FileInfo, byhash bool) (*apt.FileInfo, string)
 		s.mu.RLock()
 		defer s.mu.RUnlock()
 
-		fi2, ok := s.info[p]
-		if !ok || !fi.Same(fi2) {
+		fi2 := s.get(p)
+		if fi2 == nil || !fi.Same(fi2) {
 			return nil, ""
 		}
 		return fi2, filepath.Join(s.dir, s.prefix, filepath.Clean(p))
@@ -204,7 +474,10 @@ func (s *Storage) Lookup(fi *apt.FileInfo, byhash bool) (*apt.FileInfo, string)
 	if byhash {
 		fi2, fullpath := f(fi.SHA256Path())
 		if fi2 != nil {
-			return fi2, fullpath
+			// by-hash entries may be symbolic links.
+			if realpath, err := filepath.EvalSymlinks(fullpath); err == nil {
+				return fi2, realpath
+			}
 		}
 	}
 
@@ -2,8 +2,10 @@ package mirror
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -224,8 +226,180 @@ func testStorageStore(t *testing.T) {
 	}
 }
 
+func testStorageStoreSymlink(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(data string) *apt.FileInfo {
+		tempfile, err := s.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tempfile.Name())
+		fi, err := apt.CopyWithFileInfo(tempfile, strings.NewReader(data), "a/b/Packages")
+		tempfile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.StoreSymlinkWithHash(fi, tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	fi1 := store("abc")
+	fi2 := store("def")
+
+	for _, tc := range []struct {
+		fi   *apt.FileInfo
+		data string
+	}{{fi1, "abc"}, {fi2, "def"}} {
+		for _, p := range []string{tc.fi.MD5SumPath(), tc.fi.SHA1Path(), tc.fi.SHA256Path()} {
+			f, err := s.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.data {
+				t.Error(`string(data) != tc.data`, p)
+			}
+		}
+	}
+
+	st, err := os.Lstat(filepath.Join(d, "pre", fi1.SHA256Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Error(`by-hash entry is not a symlink`)
+	}
+
+	found, fullpath := s.Lookup(fi2, true)
+	if found == nil {
+		t.Fatal(`found == nil`)
+	}
+	st, err = os.Lstat(fullpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Mode().IsRegular() {
+		t.Error(`Lookup returned non-regular file`, fullpath)
+	}
+}
+
+func testStorageLegacyJSON(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	fi, err := makeFileInfo("a/b/c", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]*apt.FileInfo{"a/b/c": fi})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(d, infoJSON), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	found, _ := s.Lookup(fi, false)
+	if found == nil {
+		t.Error(`found == nil`)
+	}
+}
+
+func testStorageWalk(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/b/c", "a/d"} {
+		tempfile, err := s.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := apt.CopyWithFileInfo(tempfile, strings.NewReader(p), p)
+		tempfile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.StoreLink(fi, tempfile.Name())
+		os.Remove(tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := NewStorage(d, "pre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	walked := make(map[string]uint64)
+	err = s2.Walk(func(p string, fi *apt.FileInfo) error {
+		walked[p] = fi.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 2 || walked["a/b/c"] != 5 || walked["a/d"] != 3 {
+		t.Error(`unexpected walked files`, walked)
+	}
+}
+
 func TestStorage(t *testing.T) {
 	t.Run("BadConstruction", testStorageBadConstruction)
 	t.Run("Lookup", testStorageLookup)
 	t.Run("Store", testStorageStore)
+	t.Run("StoreSymlink", testStorageStoreSymlink)
+	t.Run("LegacyJSON", testStorageLegacyJSON)
+	t.Run("Walk", testStorageWalk)
 }
@@ -0,0 +1,383 @@
+package mirror
+
+// This file implements handling of compressed variants of indices.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cybozu-go/aptutil/apt"
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// splitVariants separates uncompressed indices whose compressed
+// variants are also listed in fil from other indices.
+func splitVariants(fil []*apt.FileInfo) (others, uncompressed []*apt.FileInfo) {
+	compressed := make(map[string]bool)
+	for _, fi := range fil {
+		p := fi.Path()
+		if apt.CompressionExt(p) != "" && apt.IsSupported(p) {
+			compressed[apt.TrimCompressionExt(p)] = true
+		}
+	}
+
+	for _, fi := range fil {
+		if compressed[fi.Path()] {
+			uncompressed = append(uncompressed, fi)
+			continue
+		}
+		others = append(others, fi)
+	}
+	return
+}
+
+// synthesize creates the uncompressed index fi by decompressing one of
+// its compressed variants in stored.  The result is validated against
+// the checksums in fi.
+//
+// If no variant can produce fi, nil is returned.
+func (m *Mirror) synthesize(fi *apt.FileInfo, stored []*apt.FileInfo, byhash bool) (*apt.FileInfo, error) {
+	for _, v := range stored {
+		vp := v.Path()
+		if apt.CompressionExt(vp) == "" || apt.TrimCompressionExt(vp) != fi.Path() {
+			continue
+		}
+
+		fi2, tempfile, err := m.decompressVariant(v, byhash)
+		if err != nil {
+			log.Warn("failed to decompress index", map[string]interface{}{
+				"repo":  m.id,
+				"path":  vp,
+				"error": err.Error(),
+			})
+			continue
+		}
+		if !fi.Same(fi2) {
+			closeAndRemoveFile(tempfile)
+			continue
+		}
+
+		err = m.storeLink(fi2, tempfile.Name(), byhash)
+		closeAndRemoveFile(tempfile)
+		if err != nil {
+			return nil, errors.Wrap(err, "store")
+		}
+		if log.Enabled(log.LvDebug) {
+			log.Debug("synthesized index", map[string]interface{}{
+				"repo": m.id,
+				"path": fi.Path(),
+				"from": vp,
+			})
+		}
+		return fi2, nil
+	}
+	return nil, nil
+}
+
+// decompressVariant decompresses a stored index into a tempfile.
+func (m *Mirror) decompressVariant(v *apt.FileInfo, byhash bool) (*apt.FileInfo, *os.File, error) {
+	vp := v.Path()
+	hashPath := vp
+	if byhash {
+		hashPath = v.SHA256Path()
+	}
+	f, err := m.storage.Open(hashPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r, err := apt.Decompress(vp, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	tempfile, err := m.storage.TempFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := apt.CopyWithFileInfo(m.stats.Writer(tempfile), r, apt.TrimCompressionExt(vp))
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	if err == nil {
+		err = os.Chmod(tempfile.Name(), 0644)
+	}
+	if err != nil {
+		closeAndRemoveFile(tempfile)
+		return nil, nil, err
+	}
+	return fi, tempfile, nil
+}
+
+// materialize decompresses Packages and Sources indices whose
+// uncompressed variants are not in stored, and adds the results
+// to the snapshot.
+//
+// Release files are not modified as go-apt-mirror does not re-sign
+// them.  The materialized indices are for clients and tools that
+// request uncompressed indices without verifying them against Release.
+func (m *Mirror) materialize(stored []*apt.FileInfo, byhash bool) error {
+	have := make(map[string]bool)
+	for _, fi := range stored {
+		have[fi.Path()] = true
+	}
+
+	for _, fi := range stored {
+		p := fi.Path()
+		base := apt.TrimCompressionExt(p)
+		if base == p || have[base] || !apt.IsSupported(p) {
+			continue
+		}
+		switch path.Base(base) {
+		case "Packages", "Sources":
+		default:
+			continue
+		}
+
+		fi2, tempfile, err := m.decompressVariant(fi, byhash)
+		if err != nil {
+			log.Warn("failed to decompress index", map[string]interface{}{
+				"repo":  m.id,
+				"path":  p,
+				"error": err.Error(),
+			})
+			continue
+		}
+		err = m.storeLink(fi2, tempfile.Name(), false)
+		closeAndRemoveFile(tempfile)
+		if err != nil {
+			return errors.Wrap(err, "store")
+		}
+		have[base] = true
+
+		if log.Enabled(log.LvDebug) {
+			log.Debug("materialized index", map[string]interface{}{
+				"repo": m.id,
+				"path": base,
+				"from": p,
+			})
+		}
+	}
+	return nil
+}
+
+// compressionName returns the name used in prefer_compression
+// for the compression of p.
+func compressionName(p string) string {
+	ext := apt.CompressionExt(p)
+	if ext == "" {
+		return "none"
+	}
+	return ext[1:]
+}
+
+// rankVariants groups indices that have compressed variants and
+// orders variants in each group by prefs.
+//
+// Indices without variants and groups having no preferred variant
+// are returned as fixed.  Variants not listed in prefs are dropped.
+func rankVariants(fil []*apt.FileInfo, prefs []string) (fixed []*apt.FileInfo, groups [][][]*apt.FileInfo) {
+	rank := make(map[string]int)
+	for i, p := range prefs {
+		rank[p] = i
+	}
+
+	byBase := make(map[string][]*apt.FileInfo)
+	var bases []string
+	for _, fi := range fil {
+		base := apt.TrimCompressionExt(fi.Path())
+		if _, ok := byBase[base]; !ok {
+			bases = append(bases, base)
+		}
+		byBase[base] = append(byBase[base], fi)
+	}
+
+	for _, base := range bases {
+		variants := byBase[base]
+		kinds := make(map[string]bool)
+		for _, fi := range variants {
+			kinds[compressionName(fi.Path())] = true
+		}
+		if len(kinds) < 2 {
+			fixed = append(fixed, variants...)
+			continue
+		}
+
+		ranked := make([][]*apt.FileInfo, len(prefs))
+		found := false
+		for _, fi := range variants {
+			r, ok := rank[compressionName(fi.Path())]
+			if !ok {
+				continue
+			}
+			ranked[r] = append(ranked[r], fi)
+			found = true
+		}
+		if !found {
+			fixed = append(fixed, variants...)
+			continue
+		}
+
+		var group [][]*apt.FileInfo
+		for _, l := range ranked {
+			if len(l) > 0 {
+				group = append(group, l)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return
+}
+
+// downloadPreferred downloads only the most preferred available
+// compression variant of each index.
+//
+// If the preferred variant is missing in the upstream, the next
+// preferred one is tried.
+func (m *Mirror) downloadPreferred(ctx context.Context,
+	fil []*apt.FileInfo, byhash bool) ([]*apt.FileInfo, error) {
+
+	fixed, groups := rankVariants(fil, m.mc.PreferCompression)
+
+	targets := fixed
+	for _, g := range groups {
+		targets = append(targets, g[0]...)
+	}
+
+	var stored []*apt.FileInfo
+	got := make(map[string]bool)
+	for round := 1; len(targets) > 0; round++ {
+		fil2, err := m.fetchIndices(ctx, targets, byhash)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, fil2...)
+
+		for _, fi := range fil2 {
+			got[apt.TrimCompressionExt(fi.Path())] = true
+		}
+
+		targets = nil
+		for _, g := range groups {
+			if round >= len(g) || got[apt.TrimCompressionExt(g[0][0].Path())] {
+				continue
+			}
+			targets = append(targets, g[round]...)
+		}
+	}
+
+	if m.deterministic {
+		sortFileInfo(stored)
+	}
+	return stored, nil
+}
+
+// rewritable returns true if Release of suite can be rewritten.
+//
+// go-apt-mirror does not re-sign Release files, so Release of suites
+// having signatures or compressed Release files is left as is.
+// apt skips variants listed in such Release but missing in the mirror.
+func (m *Mirror) rewritable(suite string) (bool, error) {
+	for _, p := range m.mc.ReleaseFiles(suite) {
+		if path.Base(p) == "Release" {
+			continue
+		}
+		f, err := m.storage.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		f.Close()
+		return false, nil
+	}
+	return true, nil
+}
+
+// rewriteRelease removes variants dropped by prefer_compression
+// from the checksum lists in Release of suite if rewritable.
+//
+// A variant is dropped when it is listed in indexMap but another
+// variant of the same index is in published.
+func (m *Mirror) rewriteRelease(suite string, indexMap map[string][]*apt.FileInfo, published []*apt.FileInfo) error {
+	ok, err := m.rewritable(suite)
+	if err != nil || !ok {
+		return err
+	}
+
+	have := make(map[string]bool)
+	bases := make(map[string]bool)
+	for _, fi := range published {
+		have[fi.Path()] = true
+		bases[apt.TrimCompressionExt(fi.Path())] = true
+	}
+	dropped := make(map[string]bool)
+	for p := range indexMap {
+		if !have[p] && bases[apt.TrimCompressionExt(p)] {
+			dropped[p] = true
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	p := m.mc.ReleaseFiles(suite)[0]
+	data, err := m.readStored(p)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(p)
+	buf := new(bytes.Buffer)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(l, " ") {
+			fields := strings.Fields(l)
+			if len(fields) == 3 && dropped[path.Join(dir, path.Clean(fields[2]))] {
+				continue
+			}
+		}
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	tempfile, err := m.storage.TempFile()
+	if err != nil {
+		return err
+	}
+	defer closeAndRemoveFile(tempfile)
+
+	fi, err := apt.CopyWithFileInfo(tempfile, buf, p)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	if err == nil {
+		err = os.Chmod(tempfile.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	err = m.storage.Replace(fi, tempfile.Name())
+	if err != nil {
+		return errors.Wrap(err, "storage.Replace")
+	}
+
+	log.Info("rewrote Release", map[string]interface{}{
+		"repo":    m.id,
+		"path":    p,
+		"dropped": len(dropped),
+	})
+	return nil
+}